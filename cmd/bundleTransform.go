@@ -0,0 +1,132 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// bundleTransform rewrites a bundle in place before it is uploaded.
+type bundleTransform func(bundleId bundleIdentifier, bundle *fm.Bundle) error
+
+// resourceTransform rewrites a single resource. Returning nil drops the resource.
+type resourceTransform func(resource json.RawMessage) (json.RawMessage, error)
+
+// transformBundle applies all transforms in order to the given bundle data and returns the
+// resulting bundle data.
+func transformBundle(data []byte, bundleId bundleIdentifier, transforms []bundleTransform) ([]byte, error) {
+	bundle, err := fm.UnmarshalBundle(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the bundle: %v", err)
+	}
+
+	for _, transform := range transforms {
+		if err := transform(bundleId, &bundle); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(bundle)
+}
+
+// decodeResource decodes a resource into a generic JSON object. Numbers are kept as json.Number
+// so that decimals retain their precision when the resource is encoded again.
+func decodeResource(resource json.RawMessage) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(resource))
+	decoder.UseNumber()
+
+	var object map[string]interface{}
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("could not parse resource: %v", err)
+	}
+	return object, nil
+}
+
+// encodeResource encodes a generic JSON object created by decodeResource.
+func encodeResource(object map[string]interface{}) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(object); err != nil {
+		return nil, fmt.Errorf("could not encode resource: %v", err)
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// rewriteReferences calls rewrite for the value of every reference element in the given JSON value
+// and replaces the value with the returned one if rewrite returns true.
+//
+// Returns true if at least one reference was replaced.
+func rewriteReferences(value interface{}, rewrite func(reference string) (string, bool)) bool {
+	var rewritten bool
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if reference, ok := child.(string); ok && key == "reference" {
+				if newReference, ok := rewrite(reference); ok {
+					v[key] = newReference
+					rewritten = true
+				}
+				continue
+			}
+			if rewriteReferences(child, rewrite) {
+				rewritten = true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if rewriteReferences(child, rewrite) {
+				rewritten = true
+			}
+		}
+	}
+	return rewritten
+}
+
+// rewriteBundleReferences rewrites the references in all entry resources of the bundle according to
+// the given mapping of old to new references.
+func rewriteBundleReferences(bundle *fm.Bundle, mapping map[string]string) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	for i, entry := range bundle.Entry {
+		if len(entry.Resource) == 0 {
+			continue
+		}
+
+		resource, err := decodeResource(entry.Resource)
+		if err != nil {
+			return fmt.Errorf("entry with index %d: %v", i, err)
+		}
+
+		rewritten := rewriteReferences(resource, func(reference string) (string, bool) {
+			newReference, ok := mapping[reference]
+			return newReference, ok
+		})
+		if !rewritten {
+			continue
+		}
+
+		if bundle.Entry[i].Resource, err = encodeResource(resource); err != nil {
+			return fmt.Errorf("entry with index %d: %v", i, err)
+		}
+	}
+	return nil
+}
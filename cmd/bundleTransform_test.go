@@ -0,0 +1,78 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"testing"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransformBundle(t *testing.T) {
+	data := []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}}]}`)
+
+	t.Run("AppliesTransformsInOrder", func(t *testing.T) {
+		var calls []string
+		transformed, err := transformBundle(data, bundleIdentifier{}, []bundleTransform{
+			func(_ bundleIdentifier, bundle *fm.Bundle) error {
+				calls = append(calls, "first")
+				bundle.Type = fm.BundleTypeBatch
+				return nil
+			},
+			func(_ bundleIdentifier, _ *fm.Bundle) error {
+				calls = append(calls, "second")
+				return nil
+			},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"first", "second"}, calls)
+		assert.Equal(t, fm.BundleTypeBatch, unmarshalBundle(t, transformed).Type)
+	})
+
+	t.Run("TransformFails", func(t *testing.T) {
+		_, err := transformBundle(data, bundleIdentifier{}, []bundleTransform{
+			func(_ bundleIdentifier, _ *fm.Bundle) error {
+				return errors.New("error-154912")
+			},
+		})
+
+		assert.EqualError(t, err, "error-154912")
+	})
+
+	t.Run("InvalidBundle", func(t *testing.T) {
+		_, err := transformBundle([]byte("{"), bundleIdentifier{}, nil)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRewriteBundleReferences(t *testing.T) {
+	bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"resource": {"resourceType": "Observation", "valueQuantity": {"value": 1.50},
+			"subject": {"reference": "urn:uuid:1"},
+			"performer": [{"reference": "urn:uuid:2"}, {"reference": "Practitioner/3"}]}}]}`))
+
+	err := rewriteBundleReferences(&bundle, map[string]string{"urn:uuid:1": "Patient/A", "urn:uuid:2": "Practitioner/B"})
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"resourceType": "Observation", "valueQuantity": {"value": 1.50},
+		"subject": {"reference": "Patient/A"},
+		"performer": [{"reference": "Practitioner/B"}, {"reference": "Practitioner/3"}]}`, string(bundle.Entry[0].Resource))
+	assert.Contains(t, string(bundle.Entry[0].Resource), "1.50")
+}
@@ -0,0 +1,525 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samply/blazectl/data"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// birthDateYear generalizes birth dates to the year.
+	birthDateYear = "year"
+	// birthDateMonth generalizes birth dates to the year and month.
+	birthDateMonth = "month"
+)
+
+// deidentifyConfigFile is the YAML de-identification config used by upload and download.
+var deidentifyConfigFile string
+
+// nonDateKeys are keys whose string values are never shifted even if they look like dates.
+var nonDateKeys = map[string]bool{
+	"id":        true,
+	"reference": true,
+	"system":    true,
+	"code":      true,
+	"version":   true,
+	"url":       true,
+}
+
+// datePattern matches FHIR date, dateTime and instant values with at least year and month.
+var datePattern = regexp.MustCompile(`^(\d{4})-(\d{2})(-(\d{2})(T\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:\d{2})?)?)?$`)
+
+var resourceTypePattern = regexp.MustCompile(`^[A-Z][A-Za-z]+$`)
+
+// deidentifier removes and pseudonymizes identifying data of resources. All hashes and date offsets
+// are derived from a secret salt, so that the same resources are de-identified the same way in
+// every run using the same salt.
+type deidentifier struct {
+	salt []byte
+	// paths of elements to drop by resource type, * stands for all resource types
+	drops           map[string][][]string
+	hashIdentifiers bool
+	maxShiftDays    int
+	birthDate       string
+	rewriteIds      bool
+}
+
+// readDeidentifier reads the YAML de-identification config from the given file.
+func readDeidentifier(filename string) (*deidentifier, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := data.Deidentification{}
+	if err := yaml.Unmarshal(file, &config); err != nil {
+		return nil, fmt.Errorf("could not parse the de-identification config: %v", err)
+	}
+	return newDeidentifier(config)
+}
+
+func newDeidentifier(config data.Deidentification) (*deidentifier, error) {
+	salt := config.Salt
+	if salt == "" && config.SaltEnv != "" {
+		salt = os.Getenv(config.SaltEnv)
+	}
+
+	d := &deidentifier{
+		salt:            []byte(salt),
+		drops:           make(map[string][][]string),
+		hashIdentifiers: config.HashIdentifiers,
+		birthDate:       config.BirthDate,
+		rewriteIds:      config.RewriteIds,
+	}
+
+	for _, path := range config.Drop {
+		segments := strings.Split(path, ".")
+		if len(segments) < 2 {
+			return nil, fmt.Errorf("invalid drop path `%s`, expect a resource type or * followed by element names", path)
+		}
+		d.drops[segments[0]] = append(d.drops[segments[0]], segments[1:])
+	}
+
+	if config.DateShift != nil {
+		if config.DateShift.MaxDays <= 0 {
+			return nil, errors.New("the maximum number of days to shift dates has to be positive")
+		}
+		d.maxShiftDays = config.DateShift.MaxDays
+	}
+
+	if d.birthDate != "" && d.birthDate != birthDateYear && d.birthDate != birthDateMonth {
+		return nil, fmt.Errorf("invalid birthDate generalization `%s`, expect `%s` or `%s`", d.birthDate,
+			birthDateYear, birthDateMonth)
+	}
+
+	if salt == "" && (d.hashIdentifiers || d.maxShiftDays > 0 || d.rewriteIds) {
+		return nil, errors.New("a salt is required to hash identifiers, shift dates or rewrite ids")
+	}
+	return d, nil
+}
+
+// hash returns the hex encoded HMAC of the given value keyed with the salt.
+func (d *deidentifier) hash(value string) string {
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// pseudonymId returns the id replacing the id of the resource with the given type and id.
+func (d *deidentifier) pseudonymId(resourceType string, id string) string {
+	return d.hash(resourceType + "/" + id)[:32]
+}
+
+// shiftDays returns the number of days all dates of the patient with the given key are shifted.
+func (d *deidentifier) shiftDays(patientKey string) int {
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte("date-shift:" + patientKey))
+	return d.daysOf(mac.Sum(nil))
+}
+
+// contentShiftDays returns the number of days the dates of a resource whose patient is unknown are
+// shifted. It is derived from the given content of the resource, so that the resource doesn't
+// share its offset with other resources but gets the same offset in every run.
+func (d *deidentifier) contentShiftDays(content []byte) int {
+	mac := hmac.New(sha256.New, d.salt)
+	mac.Write([]byte("date-shift-content:"))
+	mac.Write(content)
+	return d.daysOf(mac.Sum(nil))
+}
+
+// daysOf maps the first 8 bytes of the given value to a number of days within the maximum shift.
+func (d *deidentifier) daysOf(b []byte) int {
+	n := binary.BigEndian.Uint64(b[:8])
+	return int(n%uint64(2*d.maxShiftDays+1)) - d.maxShiftDays
+}
+
+// resource de-identifies a single resource.
+func (d *deidentifier) resource(raw json.RawMessage) (json.RawMessage, error) {
+	return d.bundleResource(raw, "", nil)
+}
+
+// bundleResource de-identifies a single resource of a bundle with the given full URL. References
+// to the full URLs of the patients of the bundle are resolved using the given patient keys.
+func (d *deidentifier) bundleResource(raw json.RawMessage, fullUrl string, patients map[string]string) (json.RawMessage, error) {
+	resource, err := decodeResource(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceType, _ := resource["resourceType"].(string)
+	id, _ := resource["id"].(string)
+	// the patient has to be determined before any reference is dropped or rewritten
+	patient, knownPatient := patientKey(resourceType, id, fullUrl, resource, patients)
+	// resources without patient are shifted by the hash of their original content
+	var content json.RawMessage
+	if !knownPatient && d.maxShiftDays > 0 {
+		if content, err = encodeResource(resource); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range append(append([][]string{}, d.drops["*"]...), d.drops[resourceType]...) {
+		dropPath(resource, path)
+	}
+
+	if birthDate, ok := resource["birthDate"].(string); ok && d.birthDate != "" {
+		resource["birthDate"] = generalizeDate(birthDate, d.birthDate)
+	}
+
+	if d.maxShiftDays > 0 {
+		var days int
+		if knownPatient {
+			days = d.shiftDays(patient)
+		} else {
+			days = d.contentShiftDays(content)
+		}
+		shiftDates(resource, days, d.birthDate != "")
+	}
+
+	if d.hashIdentifiers {
+		d.hashIdentifierValues(resource)
+	}
+
+	if d.rewriteIds && id != "" {
+		resource["id"] = d.pseudonymId(resourceType, id)
+	}
+	rewriteReferences(resource, d.rewriteReference)
+
+	return encodeResource(resource)
+}
+
+// bundleTransform returns a transform de-identifying the resources of a bundle. Full URLs, request
+// URLs and conditional creates are rewritten consistently with the resources. References to the
+// full URLs of patients, like urn:uuid references in transactions, shift dates by the offset of
+// the patient they point to.
+func (d *deidentifier) bundleTransform() bundleTransform {
+	return func(_ bundleIdentifier, bundle *fm.Bundle) error {
+		patients := bundlePatients(bundle)
+		for i, entry := range bundle.Entry {
+			if len(entry.Resource) > 0 {
+				var fullUrl string
+				if entry.FullUrl != nil {
+					fullUrl = *entry.FullUrl
+				}
+				resource, err := d.bundleResource(entry.Resource, fullUrl, patients)
+				if err != nil {
+					return fmt.Errorf("could not de-identify the resource of entry with index %d: %v", i, err)
+				}
+				bundle.Entry[i].Resource = resource
+			}
+			if entry.FullUrl != nil {
+				if fullUrl, ok := d.rewriteReference(*entry.FullUrl); ok {
+					bundle.Entry[i].FullUrl = &fullUrl
+				}
+			}
+			if entry.Request != nil {
+				if requestUrl, ok := d.rewriteReference(entry.Request.Url); ok {
+					bundle.Entry[i].Request.Url = requestUrl
+				}
+				if entry.Request.IfNoneExist != nil {
+					ifNoneExist := d.searchQuery(*entry.Request.IfNoneExist)
+					bundle.Entry[i].Request.IfNoneExist = &ifNoneExist
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// rewriteReference rewrites literal references like Patient/123, Patient/123/_history/1 or
+// absolute URLs ending in them if ids are rewritten, and identifier values of conditional
+// references like Patient?identifier=system|value if identifiers are hashed.
+func (d *deidentifier) rewriteReference(reference string) (string, bool) {
+	if idx := strings.Index(reference, "?"); idx >= 0 {
+		if !d.hashIdentifiers {
+			return "", false
+		}
+		return reference[:idx+1] + d.searchQuery(reference[idx+1:]), true
+	}
+	if !d.rewriteIds || strings.HasPrefix(reference, "#") || strings.HasPrefix(reference, "urn:") {
+		return "", false
+	}
+
+	segments := strings.Split(reference, "/")
+	typeIdx := len(segments) - 2
+	if len(segments) >= 4 && segments[len(segments)-2] == "_history" {
+		typeIdx = len(segments) - 4
+	}
+	if typeIdx < 0 || !resourceTypePattern.MatchString(segments[typeIdx]) || segments[typeIdx+1] == "" {
+		return "", false
+	}
+
+	segments[typeIdx+1] = d.pseudonymId(segments[typeIdx], segments[typeIdx+1])
+	return strings.Join(segments, "/"), true
+}
+
+// searchQuery hashes the values of identifier search parameters in the given query if identifiers
+// are hashed.
+func (d *deidentifier) searchQuery(query string) string {
+	if !d.hashIdentifiers {
+		return query
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, value, found := strings.Cut(param, "=")
+		if !found || name != "identifier" {
+			continue
+		}
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		system, identifierValue, hasSystem := strings.Cut(unescaped, "|")
+		if !hasSystem {
+			system, identifierValue = "", unescaped
+		}
+		hashed := d.hash(system + "|" + identifierValue)
+		if hasSystem {
+			hashed = system + "|" + hashed
+		}
+		params[i] = name + "=" + url.QueryEscape(hashed)
+	}
+	return strings.Join(params, "&")
+}
+
+// hashIdentifierValues replaces the values of all identifiers within the given JSON value by their
+// hash. The systems of the identifiers are retained.
+func (d *deidentifier) hashIdentifierValues(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if key == "identifier" {
+				for _, ident := range identifierObjects(child) {
+					if identifierValue, ok := ident["value"].(string); ok {
+						system, _ := ident["system"].(string)
+						ident["value"] = d.hash(system + "|" + identifierValue)
+					}
+				}
+			}
+			d.hashIdentifierValues(child)
+		}
+	case []interface{}:
+		for _, child := range v {
+			d.hashIdentifierValues(child)
+		}
+	}
+}
+
+// identifierObjects returns the identifiers of an identifier element which is either a list or a
+// single identifier.
+func identifierObjects(value interface{}) []map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		var identifiers []map[string]interface{}
+		for _, child := range v {
+			if ident, ok := child.(map[string]interface{}); ok {
+				identifiers = append(identifiers, ident)
+			}
+		}
+		return identifiers
+	}
+	return nil
+}
+
+// bundlePatients returns the keys of the patients of the given bundle by their full URL.
+func bundlePatients(bundle *fm.Bundle) map[string]string {
+	patients := make(map[string]string)
+	for _, entry := range bundle.Entry {
+		if entry.FullUrl == nil || len(entry.Resource) == 0 {
+			continue
+		}
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+			Id           string `json:"id"`
+		}
+		if err := json.Unmarshal(entry.Resource, &resource); err != nil || resource.ResourceType != "Patient" {
+			continue
+		}
+		if key, ok := patientKey(resource.ResourceType, resource.Id, *entry.FullUrl, nil, nil); ok {
+			patients[*entry.FullUrl] = key
+		}
+	}
+	return patients
+}
+
+// patientKey returns the key of the patient a resource belongs to. That is the patient itself, the
+// patient referenced by the subject or patient element or the first patient referenced anywhere
+// else. Resources not belonging to a patient use their own type and id as key. Resources without
+// id, like the entries of transactions, use their full URL instead. Returns false if there is no
+// key, because keys are never derived from empty ids.
+func patientKey(resourceType string, id string, fullUrl string, resource map[string]interface{},
+	patients map[string]string) (string, bool) {
+	ownKey := func() (string, bool) {
+		if id != "" {
+			return resourceType + "/" + id, true
+		}
+		return fullUrl, fullUrl != ""
+	}
+
+	if resourceType == "Patient" {
+		return ownKey()
+	}
+
+	for _, key := range []string{"subject", "patient"} {
+		if reference, ok := resource[key].(map[string]interface{}); ok {
+			if patient, ok := patientOfReference(reference["reference"], patients); ok {
+				return patient, true
+			}
+		}
+	}
+
+	var referenced []string
+	rewriteReferences(resource, func(reference string) (string, bool) {
+		if patient, ok := patientOfReference(reference, patients); ok {
+			referenced = append(referenced, patient)
+		}
+		return "", false
+	})
+	if len(referenced) > 0 {
+		sort.Strings(referenced)
+		return referenced[0], true
+	}
+
+	return ownKey()
+}
+
+// patientOfReference returns the key of the patient the given reference points to. That is the key
+// of the patient with the reference as full URL in the given patients, or Patient/<id> if the
+// reference is a relative or absolute literal reference to a patient.
+func patientOfReference(reference interface{}, patients map[string]string) (string, bool) {
+	str, ok := reference.(string)
+	if !ok || str == "" {
+		return "", false
+	}
+	if patient, ok := patients[str]; ok {
+		return patient, true
+	}
+	if strings.HasPrefix(str, "#") || strings.HasPrefix(str, "urn:") || strings.Contains(str, "?") {
+		return "", false
+	}
+
+	segments := strings.Split(str, "/")
+	typeIdx := len(segments) - 2
+	if len(segments) >= 4 && segments[len(segments)-2] == "_history" {
+		typeIdx = len(segments) - 4
+	}
+	if typeIdx < 0 || segments[typeIdx] != "Patient" || segments[typeIdx+1] == "" {
+		return "", false
+	}
+	return "Patient/" + segments[typeIdx+1], true
+}
+
+// dropPath removes the element at the given path from the given JSON object. Lists along the path
+// are traversed, so that the element is removed from every list item.
+func dropPath(value interface{}, path []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		if child, ok := v[path[0]]; ok {
+			dropPath(child, path[1:])
+		}
+	case []interface{}:
+		for _, child := range v {
+			dropPath(child, path)
+		}
+	}
+}
+
+// generalizeDate truncates the given date to the year or the year and month.
+func generalizeDate(date string, precision string) string {
+	length := 4
+	if precision == birthDateMonth {
+		length = 7
+	}
+	if len(date) <= length {
+		return date
+	}
+	return date[:length]
+}
+
+// shiftDates shifts all date, dateTime and instant values within the given JSON value by the given
+// number of days. Values with year and month only are shifted by month. Times and time zones are
+// retained.
+func shiftDates(value interface{}, days int, skipBirthDate bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if str, ok := child.(string); ok {
+				if nonDateKeys[key] || (skipBirthDate && key == "birthDate") {
+					continue
+				}
+				if shifted, ok := shiftDate(str, days); ok {
+					v[key] = shifted
+				}
+				continue
+			}
+			shiftDates(child, days, skipBirthDate)
+		}
+	case []interface{}:
+		for i, child := range v {
+			if str, ok := child.(string); ok {
+				if shifted, ok := shiftDate(str, days); ok {
+					v[i] = shifted
+				}
+				continue
+			}
+			shiftDates(child, days, skipBirthDate)
+		}
+	}
+}
+
+// shiftDate shifts a single date, dateTime or instant value by the given number of days. Returns
+// false if the value isn't a date with at least year and month.
+func shiftDate(value string, days int) (string, bool) {
+	match := datePattern.FindStringSubmatch(value)
+	if match == nil {
+		return "", false
+	}
+
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	if match[4] == "" {
+		// use the middle of the month, so that shifts smaller than half a month keep the month
+		shifted := time.Date(year, time.Month(month), 15, 0, 0, 0, 0, time.UTC).AddDate(0, 0, days)
+		return shifted.Format("2006-01"), true
+	}
+
+	day, _ := strconv.Atoi(match[4])
+	shifted := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC).AddDate(0, 0, days)
+	return shifted.Format("2006-01-02") + value[10:], true
+}
@@ -0,0 +1,301 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samply/blazectl/data"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeTestResource(t *testing.T, resource json.RawMessage) map[string]interface{} {
+	var object map[string]interface{}
+	if err := json.Unmarshal(resource, &object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+func TestReadDeidentifier(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "deidentify.yaml")
+		_ = os.WriteFile(filename, []byte(`
+saltEnv: BLAZECTL_TEST_SALT
+drop:
+  - Patient.name
+  - "*.text"
+hashIdentifiers: true
+dateShift:
+  maxDays: 30
+birthDate: year
+rewriteIds: true
+`), 0644)
+		t.Setenv("BLAZECTL_TEST_SALT", "salt-143012")
+
+		d, err := readDeidentifier(filename)
+
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("salt-143012"), d.salt)
+		assert.Equal(t, map[string][][]string{"Patient": {{"name"}}, "*": {{"text"}}}, d.drops)
+		assert.True(t, d.hashIdentifiers)
+		assert.Equal(t, 30, d.maxShiftDays)
+		assert.Equal(t, birthDateYear, d.birthDate)
+		assert.True(t, d.rewriteIds)
+	})
+
+	t.Run("MissingSalt", func(t *testing.T) {
+		_, err := newDeidentifier(data.Deidentification{HashIdentifiers: true})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("InvalidBirthDate", func(t *testing.T) {
+		_, err := newDeidentifier(data.Deidentification{BirthDate: "decade"})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("InvalidDropPath", func(t *testing.T) {
+		_, err := newDeidentifier(data.Deidentification{Drop: []string{"Patient"}})
+		assert.NotNil(t, err)
+	})
+}
+
+func TestDeidentifierResource(t *testing.T) {
+	d, err := newDeidentifier(data.Deidentification{
+		Salt:            "salt-143012",
+		Drop:            []string{"Patient.name", "*.text", "Observation.performer.display"},
+		HashIdentifiers: true,
+		DateShift:       &data.DateShift{MaxDays: 30},
+		BirthDate:       birthDateYear,
+		RewriteIds:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	days := d.shiftDays("Patient/0")
+	expectedDate, _ := shiftDate("2020-03-15", days)
+
+	patient, err := d.resource([]byte(`{"resourceType": "Patient", "id": "0",
+		"text": {"div": "<div>Max</div>"},
+		"identifier": [{"system": "http://mrn", "value": "4711"}],
+		"name": [{"family": "Mustermann"}],
+		"birthDate": "1970-05-23",
+		"deceasedDateTime": "2020-03-15"}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"resourceType":     "Patient",
+		"id":               d.pseudonymId("Patient", "0"),
+		"identifier":       []interface{}{map[string]interface{}{"system": "http://mrn", "value": d.hash("http://mrn|4711")}},
+		"birthDate":        "1970",
+		"deceasedDateTime": expectedDate,
+	}, decodeTestResource(t, patient))
+
+	observation, err := d.resource([]byte(`{"resourceType": "Observation", "id": "1",
+		"subject": {"reference": "Patient/0"},
+		"performer": [{"reference": "Practitioner/2", "display": "Dr. Who"}],
+		"effectiveDateTime": "2020-03-15T10:00:00+01:00",
+		"valueQuantity": {"value": 1.50, "code": "2020-03"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"resourceType":      "Observation",
+		"id":                d.pseudonymId("Observation", "1"),
+		"subject":           map[string]interface{}{"reference": "Patient/" + d.pseudonymId("Patient", "0")},
+		"performer":         []interface{}{map[string]interface{}{"reference": "Practitioner/" + d.pseudonymId("Practitioner", "2")}},
+		"effectiveDateTime": expectedDate + "T10:00:00+01:00",
+		"valueQuantity":     map[string]interface{}{"value": 1.5, "code": "2020-03"},
+	}, decodeTestResource(t, observation))
+	assert.Contains(t, string(observation), `"value":1.50`, "decimals keep their precision")
+}
+
+func TestShiftDate(t *testing.T) {
+	tests := []struct {
+		name, value string
+		days        int
+		expected    string
+		ok          bool
+	}{
+		{"Date", "2020-02-28", 2, "2020-03-01", true},
+		{"DateTime", "2020-01-01T00:30:00Z", -1, "2019-12-31T00:30:00Z", true},
+		{"Instant", "2020-01-01T00:30:00.123+02:00", 1, "2020-01-02T00:30:00.123+02:00", true},
+		{"YearMonth", "2020-01", -20, "2019-12", true},
+		{"YearMonthSmallShift", "2020-01", 10, "2020-01", true},
+		{"Year", "2020", 100, "", false},
+		{"NoDate", "2020-01-01 is the date", 1, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shifted, ok := shiftDate(test.value, test.days)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, shifted)
+		})
+	}
+}
+
+func TestShiftDaysIsConsistent(t *testing.T) {
+	d, _ := newDeidentifier(data.Deidentification{Salt: "salt-143012", DateShift: &data.DateShift{MaxDays: 10}})
+
+	assert.Equal(t, d.shiftDays("Patient/0"), d.shiftDays("Patient/0"))
+	for _, key := range []string{"Patient/0", "Patient/1", "Patient/2", "Patient/3"} {
+		assert.LessOrEqual(t, d.shiftDays(key), 10)
+		assert.GreaterOrEqual(t, d.shiftDays(key), -10)
+	}
+}
+
+func TestUnknownPatientShiftIsConsistent(t *testing.T) {
+	salt := "salt-143012"
+	d, _ := newDeidentifier(data.Deidentification{Salt: salt, DateShift: &data.DateShift{MaxDays: 1000}})
+	other, _ := newDeidentifier(data.Deidentification{Salt: salt, DateShift: &data.DateShift{MaxDays: 1000}})
+	resource := json.RawMessage(`{"resourceType": "Observation", "effectiveDateTime": "2020-01-10"}`)
+
+	first, err := d.resource(resource)
+	assert.NoError(t, err)
+	second, err := other.resource(resource)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(first), string(second))
+
+	shifted, err := d.resource(json.RawMessage(`{"resourceType": "Observation", "effectiveDateTime": "2020-01-10", "status": "final"}`))
+	assert.NoError(t, err)
+	assert.NotEqual(t, effectiveDateTime(t, first), effectiveDateTime(t, shifted))
+}
+
+func effectiveDateTime(t *testing.T, raw json.RawMessage) string {
+	resource, err := decodeResource(raw)
+	assert.NoError(t, err)
+	value, _ := resource["effectiveDateTime"].(string)
+	return value
+}
+
+func TestPatientKey(t *testing.T) {
+	key := func(resourceType, id, fullUrl string, resource map[string]interface{}, patients map[string]string) string {
+		key, ok := patientKey(resourceType, id, fullUrl, resource, patients)
+		if !ok {
+			return ""
+		}
+		return key
+	}
+
+	assert.Equal(t, "Patient/0", key("Patient", "0", "", map[string]interface{}{}, nil))
+	assert.Equal(t, "Patient/1", key("Observation", "2", "", map[string]interface{}{
+		"subject": map[string]interface{}{"reference": "Patient/1/_history/3"},
+	}, nil))
+	assert.Equal(t, "Patient/1", key("Encounter", "2", "", map[string]interface{}{
+		"participant": []interface{}{map[string]interface{}{"individual": map[string]interface{}{"reference": "Patient/5"}},
+			map[string]interface{}{"individual": map[string]interface{}{"reference": "Patient/1"}}},
+	}, nil))
+	assert.Equal(t, "Organization/2", key("Organization", "2", "", map[string]interface{}{}, nil))
+
+	t.Run("AbsoluteReference", func(t *testing.T) {
+		assert.Equal(t, "Patient/1", key("Observation", "", "", map[string]interface{}{
+			"subject": map[string]interface{}{"reference": "http://localhost/fhir/Patient/1"},
+		}, nil))
+	})
+
+	t.Run("FullUrlReference", func(t *testing.T) {
+		patients := map[string]string{"urn:uuid:p1": "urn:uuid:p1", "http://localhost/fhir/Patient/2": "Patient/2"}
+		assert.Equal(t, "urn:uuid:p1", key("Patient", "", "urn:uuid:p1", map[string]interface{}{}, nil))
+		assert.Equal(t, "urn:uuid:p1", key("Observation", "", "urn:uuid:o1", map[string]interface{}{
+			"subject": map[string]interface{}{"reference": "urn:uuid:p1"},
+		}, patients))
+		assert.Equal(t, "Patient/2", key("Observation", "", "urn:uuid:o2", map[string]interface{}{
+			"subject": map[string]interface{}{"reference": "http://localhost/fhir/Patient/2"},
+		}, patients))
+	})
+
+	t.Run("NoKeyFromEmptyId", func(t *testing.T) {
+		_, ok := patientKey("Patient", "", "", map[string]interface{}{}, nil)
+		assert.False(t, ok)
+		_, ok = patientKey("Observation", "", "", map[string]interface{}{
+			"subject": map[string]interface{}{"reference": "urn:uuid:unknown"},
+		}, nil)
+		assert.False(t, ok)
+		assert.Equal(t, "urn:uuid:o1", key("Observation", "", "urn:uuid:o1", map[string]interface{}{}, nil))
+	})
+}
+
+func TestDeidentifierRewriteReference(t *testing.T) {
+	d, _ := newDeidentifier(data.Deidentification{Salt: "salt-143012", HashIdentifiers: true, RewriteIds: true})
+	pseudonym := d.pseudonymId("Patient", "0")
+
+	tests := []struct {
+		name, reference, expected string
+		ok                        bool
+	}{
+		{"Relative", "Patient/0", "Patient/" + pseudonym, true},
+		{"Versioned", "Patient/0/_history/2", "Patient/" + pseudonym + "/_history/2", true},
+		{"Absolute", "http://localhost:8080/fhir/Patient/0", "http://localhost:8080/fhir/Patient/" + pseudonym, true},
+		{"Conditional", "Patient?identifier=http://mrn|4711", "Patient?identifier=" +
+			"http%3A%2F%2Fmrn%7C" + d.hash("http://mrn|4711"), true},
+		{"Urn", "urn:uuid:0", "", false},
+		{"Contained", "#0", "", false},
+		{"TypeOnly", "Patient", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewritten, ok := d.rewriteReference(test.reference)
+			assert.Equal(t, test.ok, ok)
+			assert.Equal(t, test.expected, rewritten)
+		})
+	}
+}
+
+func TestDeidentifierBundleTransform(t *testing.T) {
+	d, _ := newDeidentifier(data.Deidentification{Salt: "salt-143012", HashIdentifiers: true, RewriteIds: true})
+
+	bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient", "identifier": [{"value": "4711"}]},
+		 "request": {"method": "POST", "url": "Patient", "ifNoneExist": "identifier=4711"}},
+		{"fullUrl": "http://localhost/Patient/0", "resource": {"resourceType": "Patient", "id": "0"},
+		 "request": {"method": "PUT", "url": "Patient/0"}}]}`))
+
+	assert.Nil(t, d.bundleTransform()(bundleIdentifier{}, &bundle))
+
+	assert.Equal(t, "urn:uuid:1", *bundle.Entry[0].FullUrl)
+	assert.Equal(t, "Patient", bundle.Entry[0].Request.Url)
+	assert.Equal(t, "identifier="+d.hash("|4711"), *bundle.Entry[0].Request.IfNoneExist)
+	assert.Equal(t, "http://localhost/Patient/"+d.pseudonymId("Patient", "0"), *bundle.Entry[1].FullUrl)
+	assert.Equal(t, "Patient/"+d.pseudonymId("Patient", "0"), bundle.Entry[1].Request.Url)
+	assert.Equal(t, fm.HTTPVerbPUT, bundle.Entry[1].Request.Method)
+}
+
+func TestDeidentifierBundleTransformShiftsDatesPerPatient(t *testing.T) {
+	d, _ := newDeidentifier(data.Deidentification{Salt: "salt-143012", DateShift: &data.DateShift{MaxDays: 180}})
+
+	bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:p1", "resource": {"resourceType": "Patient", "deceasedDateTime": "2020-01-10"},
+		 "request": {"method": "POST", "url": "Patient"}},
+		{"fullUrl": "urn:uuid:p2", "resource": {"resourceType": "Patient", "deceasedDateTime": "2020-01-10"},
+		 "request": {"method": "POST", "url": "Patient"}},
+		{"fullUrl": "urn:uuid:o1", "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:p1"},
+		 "effectiveDateTime": "2020-01-10"}, "request": {"method": "POST", "url": "Observation"}},
+		{"fullUrl": "urn:uuid:o2", "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:p2"},
+		 "effectiveDateTime": "2020-01-10"}, "request": {"method": "POST", "url": "Observation"}}]}`))
+
+	assert.Nil(t, d.bundleTransform()(bundleIdentifier{}, &bundle))
+
+	date := func(i int, key string) string {
+		return decodeTestResource(t, bundle.Entry[i].Resource)[key].(string)
+	}
+	first, _ := shiftDate("2020-01-10", d.shiftDays("urn:uuid:p1"))
+	second, _ := shiftDate("2020-01-10", d.shiftDays("urn:uuid:p2"))
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, first, date(0, "deceasedDateTime"))
+	assert.Equal(t, second, date(1, "deceasedDateTime"))
+	assert.Equal(t, first, date(2, "effectiveDateTime"))
+	assert.Equal(t, second, date(3, "effectiveDateTime"))
+}
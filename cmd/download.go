@@ -15,8 +15,8 @@
 package cmd
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +27,7 @@ import (
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,16 +40,20 @@ import (
 var outputFile string
 var fhirSearchQuery string
 var usePost bool
+var downloadConcurrency int
 
 type commandStats struct {
 	totalPages                            int
 	resourcesPerPage                      []int
+	includesPerPage                       []int
 	requestDurations, processingDurations []float64
 	totalBytesIn                          int64
 	totalDuration                         time.Duration
 	inlineOperationOutcomes               []*fm.OperationOutcome
 	error                                 *util.ErrorResponse
 	bundles                               []downloadBundle
+	// nil unless the download is verified
+	verification *downloadVerification
 }
 
 func (cs *commandStats) String() string {
@@ -62,6 +67,14 @@ func (cs *commandStats) String() string {
 	}
 	builder.WriteString(fmt.Sprintf("Resources 	[total]			%d\n", resourcesTotal))
 
+	var includesTotal int
+	for _, n := range cs.includesPerPage {
+		includesTotal += n
+	}
+	if includesTotal > 0 {
+		builder.WriteString(fmt.Sprintf("Included 	[total]			%d\n", includesTotal))
+	}
+
 	if len(cs.resourcesPerPage) > 0 {
 		sort.Ints(cs.resourcesPerPage)
 		var totalResources int
@@ -72,6 +85,17 @@ func (cs *commandStats) String() string {
 		builder.WriteString(fmt.Sprintf("Resources/Page	[min, mean, max]	%d, %d, %d\n", cs.resourcesPerPage[0], totalResources/len(cs.resourcesPerPage), cs.resourcesPerPage[len(cs.resourcesPerPage)-1]))
 	}
 
+	if cs.verification != nil {
+		if expected, ok := cs.verification.expected(); ok {
+			builder.WriteString(fmt.Sprintf("Expected 	[total]			%d\n", expected))
+		}
+		builder.WriteString(fmt.Sprintf("Duplicates 	[total]			%d\n", len(cs.verification.duplicates)))
+	}
+
+	if minSize, maxSize := cs.pageSizes(); minSize != maxSize {
+		builder.WriteString(fmt.Sprintf("Page Size	[min, max]		%d, %d\n", minSize, maxSize))
+	}
+
 	builder.WriteString(fmt.Sprintf("Duration	[total]			%s\n", util.FmtDurationHumanReadable(cs.totalDuration)))
 
 	if len(cs.requestDurations) > 0 {
@@ -100,6 +124,46 @@ func (cs *commandStats) String() string {
 	return builder.String()
 }
 
+// pageSizes returns the smallest and largest page size requested, both zero if no page requested a
+// page size.
+func (cs *commandStats) pageSizes() (int, int) {
+	var minSize, maxSize int
+	for _, bundle := range cs.bundles {
+		if bundle.pageSize <= 0 {
+			continue
+		}
+		if minSize == 0 || bundle.pageSize < minSize {
+			minSize = bundle.pageSize
+		}
+		if bundle.pageSize > maxSize {
+			maxSize = bundle.pageSize
+		}
+	}
+	return minSize, maxSize
+}
+
+// merge adds the pages of the other statistics to these statistics. The total duration is left
+// unchanged and the first error is kept.
+func (cs *commandStats) merge(other *commandStats) {
+	cs.totalPages += other.totalPages
+	cs.resourcesPerPage = append(cs.resourcesPerPage, other.resourcesPerPage...)
+	cs.includesPerPage = append(cs.includesPerPage, other.includesPerPage...)
+	cs.requestDurations = append(cs.requestDurations, other.requestDurations...)
+	cs.processingDurations = append(cs.processingDurations, other.processingDurations...)
+	cs.totalBytesIn += other.totalBytesIn
+	cs.inlineOperationOutcomes = append(cs.inlineOperationOutcomes, other.inlineOperationOutcomes...)
+	if cs.error == nil {
+		cs.error = other.error
+	}
+	cs.bundles = append(cs.bundles, other.bundles...)
+	if other.verification != nil {
+		if cs.verification == nil {
+			cs.verification = newDownloadVerification()
+		}
+		cs.verification.merge(other.verification)
+	}
+}
+
 // networkStats describes network statistics that arise when downloading resources from
 // a FHIR server.
 type networkStats struct {
@@ -110,16 +174,30 @@ type networkStats struct {
 // downloadBundle describes the result of downloading a single page of resources from a FHIR server.
 type downloadBundle struct {
 	associatedRequestURL url.URL
-	rawEntries           []byte
 	err                  error
 	stats                *networkStats
 	errResponse          *util.ErrorResponse
+	// URL of the next page, nil on the last page
+	nextPageURL *url.URL
+	// time of the server at which the page was generated, zero if unknown
+	serverTime time.Time
+	// number of matching resources reported by the server, nil if unknown
+	total *int
+	// page size requested by _count, zero if the server default was used
+	pageSize int
+	// number of matching and included resources written while decoding the page
+	resources, included int
+	inlineOutcomes      []*fm.OperationOutcome
 }
 
+// pageHandler handles a page after all of its entries were handled or after its download failed.
+// The download stops if it returns false.
+type pageHandler func(page *downloadBundle) bool
+
 // downloadBundleError creates a downloadResource instance with an error attached to it.
 // The error is formatted using the given format with all potential substitutions.
-func downloadBundleError(format string, a ...interface{}) downloadBundle {
-	return downloadBundle{
+func downloadBundleError(format string, a ...interface{}) *downloadBundle {
+	return &downloadBundle{
 		err: fmt.Errorf(format, a...),
 	}
 }
@@ -273,7 +351,7 @@ var resourceTypes = []string{
 }
 
 var downloadCmd = &cobra.Command{
-	Use:   "download [resource-type]",
+	Use:   "download [resource-type]...",
 	Short: "Download FHIR resources into an NDJSON file",
 	Long: `Downloads FHIR resources and puts them into an NDJSON file.
 	
@@ -281,16 +359,98 @@ Potential FHIR resources that will be downloaded can be limited by a mandatory -
 and an optional -q/--query flag. The query flag has to be a valid FHIR search query.
 
 Downloaded resources will be stored within a file denoted by the -o/--output-file flag.
+With -o -, the resources are written to stdout, so that they can be piped into other tools.
+Existing output files are never overwritten, unless --append is given, which appends to
+them, or --force, which writes into a temporary file replacing the output file only after a
+successful download. All statistics are written to stderr.
+
+With --compress gzip or zstd, the output files are compressed while downloading and get the
+extension .gz or .zst, like patient.ndjson.gz. With --max-lines-per-file or
+--max-bytes-per-file, the output is rolled into numbered shards like patient-0001.ndjson.
+A new shard is started once the current shard reaches the number of resources or the
+uncompressed size, only between resources, so every shard is a valid NDJSON file.
+
+Resources included by _include or _revinclude in the query are written into one file per
+type next to the file of the matching resources, like patient-Observation.ndjson. Every
+included resource is written only once, even if it is included in several pages. The
+statistics show the number of matching and included resources separately.
+
+With several resource types or --all instead of a single resource type, the resources of
+every type are written to their own Type.ndjson file within the directory denoted by the
+-d/--output-dir flag. With --all, all resource types the server supports searching for are
+downloaded, skipping types without resources. Up to -c/--concurrency types are downloaded
+at the same time and the statistics are shown per type.
+
+With --queries, the searches listed in the given file are downloaded, one search like
+Patient?gender=female per line, optionally followed by the name of its output file. Empty
+lines and lines starting with # are ignored. With -d/--output-dir, every search is written into
+its own file in that directory, named like in the query file or Type-N.ndjson, where N is the
+number of the search. With -o/--output-file, all searches are written into that file and no
+manifest is written. Up to -c/--concurrency searches are downloaded at the same time and the
+statistics are shown per search followed by a summary.
+
+With --partitions N, the download of a single resource type is split into up to N disjoint
+_lastUpdated ranges holding about the same number of resources, which are downloaded in
+parallel. The resources of all partitions are written into the output file, or with --shards,
+into one numbered shard file per partition, like patient-0001.ndjson.
+
+While downloading a single resource type without partitions, the next link and the size of
+the output file after every page are saved in a state file next to the output file, like
+patient.ndjson.state. If the download fails, it can be continued with --resume, which
+removes a partially written page from the output file and downloads the remaining pages.
+With --resumable, or if the query has _sort=_lastUpdated, the search is sorted by _lastUpdated.
+If the server then responds to the saved next link with 404 or 410, the link has expired and
+only resources updated at or after the last written resource are searched again. Other
+downloads can't be continued once their next link expired. The state file is removed after a
+successful download.
+
+With --since, only resources updated after the given FHIR date time are downloaded. Instead
+of a date time, the name of a sync file can be given. After every successful download, the
+time of the server at which the download started is recorded in the sync file and used as
+bound of the next download. If the sync file doesn't exist, all resources are downloaded.
+With --dated, the output file name gets the time of the download, like
+patient-20221018T020000Z.ndjson, so that every run writes its own file. With --deletions,
+resources deleted after the bound are taken from the history of the resource type and written
+as tombstones with resourceType, id and deletion time into a file like
+patient-deleted.ndjson.
+
+After a successful download, a manifest.json in the format of a Bulk Data export manifest
+is written next to the output files, or to the file given by --manifest. It lists every
+output file with its type, number of resources, path and SHA-256 checksum together with the
+request URL and the transaction time of the server. No manifest is written with --append or
+stdout output and an existing manifest is only replaced with --force.
+
+With --page-size, the number of resources per page is requested by _count. With
+--adaptive-page-size, _count is adapted in the next link of every page, so that pages are
+processed by the server in about 2 seconds and have about 10 MiB, starting with --page-size
+or 50. The requested page size of every page is written to the statistics file of --output.
+Pages are decoded while they are received and at most 100 resources are decoded ahead of the
+written ones, so that the memory used doesn't depend on the page size.
+
+With --verify, the first page is requested with _total=accurate, or the matching resources are
+counted with _summary=count if the server doesn't report a total, and the download fails if
+this number differs from the number of downloaded resources or if a resource was downloaded
+more than once, which can happen if paging skips or repeats resources on busy servers. The
+output files are kept, but no manifest is written.
+
+With --deidentify, all resources are de-identified according to the given YAML config
+before they are written.
 
 Example:
 	
 	blazectl download --server http://localhost:8080/fhir Patient
-	blazectl download --server http://localhost:8080/fhir Patient -q "gender=female" -o ~/Downloads/patient.ndjson`,
+	blazectl download --server http://localhost:8080/fhir Patient -q "gender=female" -o ~/Downloads/patient.ndjson
+	blazectl download --server http://localhost:8080/fhir Patient -o - | jq .id
+	blazectl download --server http://localhost:8080/fhir Observation --compress zstd --max-bytes-per-file 10G -o observation.ndjson
+	blazectl download --server http://localhost:8080/fhir Patient --since patient.sync --dated --deletions -o ~/mirror/patient.ndjson
+	blazectl download --server http://localhost:8080/fhir Patient Observation Condition -d ~/Downloads/export
+	blazectl download --server http://localhost:8080/fhir --all -d ~/Downloads/export
+	blazectl download --server http://localhost:8080/fhir --queries cohort.txt -d ~/Downloads/cohort`,
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return resourceTypes, cobra.ShellCompDirectiveNoFileComp
 	},
 	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 1 {
+		if len(args) < 1 && !downloadAll && queriesFile == "" {
 			return errors.New("requires a resource type argument like Patient")
 		}
 		return nil
@@ -300,117 +460,335 @@ Example:
 		if err != nil {
 			return err
 		}
-		var stats commandStats
-		startTime := time.Now()
+		var transform resourceTransform
+		if deidentifyConfigFile != "" {
+			d, err := readDeidentifier(deidentifyConfigFile)
+			if err != nil {
+				return err
+			}
+			transform = d.resource
+		}
+
+		if appendOutput && forceOutput {
+			return errors.New("--append can't be combined with --force")
+		}
+		if forceOutput {
+			removeTempOutputFilesOnSignal()
+		}
+		if pageSize < 0 {
+			return fmt.Errorf("invalid --page-size %d", pageSize)
+		}
+		if query, err := url.ParseQuery(fhirSearchQuery); err == nil && query.Has("_count") && pageSize > 0 {
+			return errors.New("--page-size can't be combined with _count in the query")
+		}
+		sharded := maxLinesPerFile > 0 || maxBytesPerFile != ""
+		if sharded && (appendOutput || shardPartitions || outputFile == stdoutFilename) {
+			return errors.New("--max-lines-per-file and --max-bytes-per-file can't be combined with --append, --shards or stdout output")
+		}
+		if sortForResume && (queriesFile != "" || downloadAll || outputDir != "" || len(args) > 1 || partitions > 1) {
+			return errors.New("--resumable can only be used when downloading a single resource type without partitions")
+		}
+		if queriesFile != "" {
+			if downloadAll || len(args) > 0 || fhirSearchQuery != "" {
+				return errors.New("--queries can't be combined with resource type arguments, --all or -q/--query")
+			}
+			if partitions > 1 || resumeDownload || since != "" || datedOutput || downloadDeletions || shardPartitions {
+				return errors.New("--queries can't be combined with --partitions, --resume, --since, --dated, --deletions or --shards")
+			}
+			return downloadQueries(transform)
+		}
+		if downloadAll || outputDir != "" || len(args) > 1 {
+			if partitions > 1 {
+				return errors.New("--partitions can only be used when downloading a single resource type")
+			}
+			if resumeDownload || since != "" || datedOutput || downloadDeletions {
+				return errors.New("--resume, --since, --dated and --deletions can only be used when downloading a single resource type")
+			}
+			return downloadMultipleResourceTypes(args, transform)
+		}
+		if outputFile == "" {
+			return errors.New("requires the -o/--output-file flag")
+		}
+		if outputFile == stdoutFilename {
+			if resumeDownload || sortForResume || datedOutput || downloadDeletions || shardPartitions {
+				return errors.New("--resume, --resumable, --dated, --deletions and --shards can't be used when writing to stdout")
+			}
+			if hasIncludes(fhirSearchQuery) {
+				return errors.New("_include and _revinclude can't be used when writing to stdout")
+			}
+		}
+		if resumeDownload && verifyDownload {
+			return errors.New("--resume can't be combined with --verify")
+		}
+		if resumeDownload && (appendOutput || forceOutput) {
+			return errors.New("--resume can't be combined with --append or --force")
+		}
+		if partitions > 1 {
+			if resumeDownload || since != "" || datedOutput || downloadDeletions {
+				return errors.New("--resume, --since, --dated and --deletions can't be combined with --partitions")
+			}
+			downloadPartitioned(args[0], transform)
+			return nil
+		}
 
-		file := createOutputFileOrDie(outputFile)
-		sink := bufio.NewWriter(file)
-		defer file.Close()
-		defer file.Sync()
-		defer sink.Flush()
+		if datedOutput && resumeDownload {
+			return errors.New("--resume can't be combined with --dated")
+		}
+		return downloadSinceOrDie(args[0], transform)
+	},
+}
 
-		bundleChannel := make(chan downloadBundle, 2)
+// resourceWriteError is returned by downloadResourceType if downloaded resources can't be written.
+type resourceWriteError struct {
+	requestURL url.URL
+	err        error
+}
 
-		go downloadResources(client, args[0], fhirSearchQuery, usePost, bundleChannel)
+func (e *resourceWriteError) Error() string {
+	if e.requestURL == (url.URL{}) {
+		return fmt.Sprintf("Failed to write downloaded resources: %v", e.err)
+	}
+	return fmt.Sprintf("Failed to write downloaded resources received from request to URL %s: %v", e.requestURL.String(), e.err)
+}
 
-		for bundle := range bundleChannel {
-			stats.totalPages++
-			stats.bundles = append(stats.bundles, bundle)
+// downloadResourceType downloads all resources of the given type, optionally limited by the given
+// FHIR search query, and writes them to the sink. Resources included by _include or _revinclude
+// are written to includes unless it is nil. If pageDone isn't nil, it is called with every
+// written page and its number of matching resources.
+//
+// Returns the statistics of the download. A failed download is returned as error together with the
+// statistics, which contain the error response of the server if there is one. A failed write is
+// returned as resourceWriteError.
+func downloadResourceType(client *fhir.Client, resourceType string, fhirSearchQuery string, usePost bool,
+	sink io.Writer, includes *includeRouter, transform resourceTransform,
+	pageDone func(page *downloadBundle, resources int)) (commandStats, error) {
+	return downloadResourceTypeFrom(client, resourceType, fhirSearchQuery, usePost, nil, sink, includes, transform,
+		pageDone)
+}
 
-			if bundle.err != nil || bundle.errResponse != nil {
-				fmt.Printf("Failed to download resources: %v\n", bundle.err)
+// downloadResourceTypeFrom is like downloadResourceType but starts at the given page URL instead
+// of the first page if it isn't nil.
+func downloadResourceTypeFrom(client *fhir.Client, resourceType string, fhirSearchQuery string, usePost bool,
+	startPageURL *url.URL, sink io.Writer, includes *includeRouter, transform resourceTransform,
+	pageDone func(page *downloadBundle, resources int)) (commandStats, error) {
+	var stats commandStats
+	writer := &resourceWriter{sink: sink, includes: includes, transform: transform}
+	if verifyDownload {
+		stats.verification = newDownloadVerification()
+		writer.verification = stats.verification
+	}
+	startTime := time.Now()
 
-				stats.error = bundle.errResponse
-				stats.totalDuration = time.Since(startTime)
+	var err error
+	downloadResourcesFrom(client, resourceType, fhirSearchQuery, usePost, startPageURL, writer.writeEntry,
+		func(page *downloadBundle) bool {
+			stats.totalPages++
+			stats.bundles = append(stats.bundles, *page)
 
+			var writeErr *resourceWriteError
+			if page.errResponse != nil || (page.err != nil && !errors.As(page.err, &writeErr)) {
+				stats.error = page.errResponse
 				stats.requestDurations = append(stats.requestDurations, math.NaN())
 				stats.processingDurations = append(stats.processingDurations, math.NaN())
 				stats.resourcesPerPage = append(stats.resourcesPerPage, -1)
+				stats.includesPerPage = append(stats.includesPerPage, 0)
+				err = page.err
+				return false
+			}
 
-				fmt.Println(stats.String())
-				os.Exit(1)
-			} else {
-				stats.requestDurations = append(stats.requestDurations, bundle.stats.requestDuration)
-				stats.processingDurations = append(stats.processingDurations, bundle.stats.processingDuration)
-				stats.totalBytesIn += bundle.stats.totalBytesIn
-
-				resources, inlineOutcomes, err := writeResources(&bundle.rawEntries, sink)
-				stats.resourcesPerPage = append(stats.resourcesPerPage, resources)
-				stats.inlineOperationOutcomes = append(stats.inlineOperationOutcomes, inlineOutcomes...)
+			stats.requestDurations = append(stats.requestDurations, page.stats.requestDuration)
+			stats.processingDurations = append(stats.processingDurations, page.stats.processingDuration)
+			stats.totalBytesIn += page.stats.totalBytesIn
+			stats.resourcesPerPage = append(stats.resourcesPerPage, page.resources)
+			stats.includesPerPage = append(stats.includesPerPage, page.included)
+			stats.inlineOperationOutcomes = append(stats.inlineOperationOutcomes, page.inlineOutcomes...)
 
-				if err != nil {
-					fmt.Printf("Failed to write downloaded resources received from request to URL %s: %v\n", bundle.associatedRequestURL.String(), err)
-					os.Exit(2)
-				}
+			if page.err != nil {
+				err = page.err
+				return false
 			}
-		}
+			if stats.verification != nil && stats.totalPages == 1 {
+				stats.verification.addSearch(client, resourceType, fhirSearchQuery, page)
+			}
+			if pageDone != nil {
+				pageDone(page, page.resources)
+			}
+			return true
+		})
 
-		stats.totalDuration = time.Since(startTime)
-		fmt.Println(stats.String())
+	stats.totalDuration = time.Since(startTime)
+	return stats, err
+}
 
-		if outputStatisticsFileName != "" {
-			f, err := os.Create(outputStatisticsFileName)
+// exitOnDownloadError exits with a non-success error code if err isn't nil. Failed downloads are
+// reported together with the statistics. Temporary output files written with --force are removed
+// before.
+func exitOnDownloadError(stats commandStats, err error) {
+	if err != nil {
+		removeTempOutputFiles()
+	}
+	var writeErr *resourceWriteError
+	if errors.As(err, &writeErr) {
+		fmt.Fprintln(os.Stderr, writeErr)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to download resources: %v\n", err)
+		fmt.Fprintln(os.Stderr, stats.String())
+		os.Exit(1)
+	}
+}
 
-			if err != nil {
-				fmt.Printf("Failed to open output file: %v\n", err)
-				os.Exit(1)
-			}
+// writeDownloadStatisticsOrDie writes the statistics of every page of the given downloads as CSV
+// into the file with the given name.
+func writeDownloadStatisticsOrDie(filename string, downloads []*commandStats) {
+	f, err := os.Create(filename)
 
-			defer f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open output file: %v\n", err)
+		os.Exit(1)
+	}
 
-			l := len(stats.bundles)
+	defer f.Close()
 
-			f.WriteString("associatedRequestUrl,request,processing,resourcesPerPage\n")
+	f.WriteString("associatedRequestUrl,request,processing,resourcesPerPage,pageSize,includesPerPage\n")
 
-			for i := 0; i < l; i++ {
-				f.WriteString(fmt.Sprintf("%v,%v,%v,%v\n",
-					stats.bundles[i].associatedRequestURL.String(),
-					stats.requestDurations[i],
-					stats.processingDurations[i],
-					stats.resourcesPerPage[i]))
+	for _, stats := range downloads {
+		for i := 0; i < len(stats.bundles); i++ {
+			var pageSize string
+			if stats.bundles[i].pageSize > 0 {
+				pageSize = strconv.Itoa(stats.bundles[i].pageSize)
 			}
-
-			fmt.Println("Wrote output file")
+			f.WriteString(fmt.Sprintf("%v,%v,%v,%v,%v,%v\n",
+				stats.bundles[i].associatedRequestURL.String(),
+				stats.requestDurations[i],
+				stats.processingDurations[i],
+				stats.resourcesPerPage[i],
+				pageSize,
+				stats.includesPerPage[i]))
 		}
+	}
 
-		return nil
-	},
+	fmt.Fprintln(os.Stderr, "Wrote output file")
 }
 
 // downloadResources tries to download all resources of a given resource type from a FHIR server using
 // the given client. Resources that are downloaded can optionally be limited by a given FHIR search query.
 // The download respects pagination, i.e. it follows pagination links until there is no other next link.
 //
-// Downloaded resources as well as errors are sent to a given result channel.
-// As soon as an error occurs it is written to the channel and the channel is closed thereafter.
+// Every page is decoded while it is received and each of its entries is passed to handleEntry as
+// soon as it is decoded, so that the memory used doesn't depend on the size of the pages. Afterwards,
+// the page is passed to handlePage. Pages are fetched in the background up to readAheadEntries
+// entries ahead, so that the next page is already requested while the current one is written. As
+// soon as an error occurs, the failed page is passed to handlePage and the download stops.
 func downloadResources(client *fhir.Client, resourceType string, fhirSearchQuery string, usePost bool,
-	resChannel chan<- downloadBundle) {
-	defer close(resChannel)
+	handleEntry entryHandler, handlePage pageHandler) {
+	downloadResourcesFrom(client, resourceType, fhirSearchQuery, usePost, nil, handleEntry, handlePage)
+}
 
+// readAheadEntries is the number of decoded entries which are held while the entries before them
+// are handled.
+const readAheadEntries = 100
+
+// pageItem is an entry of a page or the end of the page if entry is nil.
+type pageItem struct {
+	entry *fm.BundleEntry
+	page  *downloadBundle
+}
+
+// downloadResourcesFrom is like downloadResources but starts at the given page URL instead of the
+// first page if it isn't nil.
+func downloadResourcesFrom(client *fhir.Client, resourceType string, fhirSearchQuery string, usePost bool,
+	startPageURL *url.URL, handleEntry entryHandler, handlePage pageHandler) {
 	query, err := url.ParseQuery(fhirSearchQuery)
 	if err != nil {
-		resChannel <- downloadBundleError("could not parse the FHIR search query: %v\n", err)
+		handlePage(downloadBundleError("could not parse the FHIR search query: %v\n", err))
 		return
 	}
+	if verifyDownload {
+		query = verificationQuery(query)
+	}
+	if pageSize > 0 {
+		query.Set("_count", strconv.Itoa(pageSize))
+	}
+	var sizer *pageSizer
+	if adaptivePageSize {
+		sizer = newPageSizer(query)
+		query.Set("_count", strconv.Itoa(sizer.size))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	items := make(chan pageItem, readAheadEntries)
+	go fetchPages(ctx, client, resourceType, query, usePost, startPageURL, sizer, handleEntry != nil, items)
+
+	// stop cancels the fetching of pages and waits until it has ended
+	stop := func() {
+		cancel()
+		for range items {
+		}
+	}
+	defer stop()
+
+	for item := range items {
+		if item.entry == nil {
+			if !handlePage(item.page) {
+				return
+			}
+			continue
+		}
+		if err := handleEntry(item.entry, item.page); err != nil {
+			stop()
+			item.page.err = &resourceWriteError{requestURL: item.page.associatedRequestURL, err: err}
+			handlePage(item.page)
+			return
+		}
+	}
+}
+
+// fetchPages requests the pages of a search one after another and sends their entries, followed by
+// the page itself, to items. Entries are only decoded if withEntries is true. Failed pages are sent
+// as last item. Stops as soon as ctx is cancelled and closes items at the end.
+//
+// The request duration of a page only covers the time it took to receive the page, not the time
+// spent waiting for its entries to be handled.
+func fetchPages(ctx context.Context, client *fhir.Client, resourceType string, query url.Values, usePost bool,
+	startPageURL *url.URL, sizer *pageSizer, withEntries bool, items chan<- pageItem) {
+	defer close(items)
+
+	send := func(item pageItem) bool {
+		select {
+		case items <- item:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	var requestStart time.Time
 	var processingStart time.Time
 	var request *http.Request
-	var nextPageURL *url.URL
+	var err error
+	nextPageURL := startPageURL
+	if sizer != nil && nextPageURL != nil {
+		nextPageURL = withPageSize(nextPageURL, sizer.size)
+	}
 	for ok := true; ok; ok = nextPageURL != nil {
 		var stats networkStats
 
-		if request == nil {
+		var requestedPageSize int
+		if request == nil && nextPageURL == nil {
+			requestedPageSize = pageSizeOf(query)
 			if usePost {
 				request, err = client.NewPostSearchTypeRequest(resourceType, query)
 			} else {
 				request, err = client.NewSearchTypeRequest(resourceType, query)
 			}
 		} else {
+			requestedPageSize = pageSizeOf(nextPageURL.Query())
 			request, err = client.NewPaginatedResourceRequest(nextPageURL)
 		}
 		if err != nil {
-			resChannel <- downloadBundleError("could not create FHIR server request: %v\n", err)
+			send(pageItem{page: downloadBundleError("could not create FHIR server request: %v\n", err)})
 			return
 		}
 
@@ -425,19 +803,21 @@ func downloadResources(client *fhir.Client, resourceType string, fhirSearchQuery
 				stats.processingDuration = time.Since(processingStart).Seconds()
 			},
 		}
-		request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+		request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
 
 		response, err := client.Do(request)
 		if err != nil {
-			resChannel <- downloadBundleError("could not request the FHIR server with URL %s: %v\n", request.URL, err)
+			if ctx.Err() == nil {
+				send(pageItem{page: downloadBundleError("could not request the FHIR server with URL %s: %v\n", request.URL, err)})
+			}
 			return
 		}
 
 		if response.StatusCode != http.StatusOK {
 			responseBody, err := io.ReadAll(response.Body)
 			if err != nil {
-				resChannel <- downloadBundleError("request to FHIR server with URL %s had a non-ok response status (%d) but its body could not be read: %v",
-					request.URL, response.StatusCode, err)
+				send(pageItem{page: downloadBundleError("request to FHIR server with URL %s had a non-ok response status (%d) but its body could not be read: %v",
+					request.URL, response.StatusCode, err)})
 				return
 			}
 			response.Body.Close()
@@ -448,7 +828,7 @@ func downloadResources(client *fhir.Client, resourceType string, fhirSearchQuery
 			if err != nil {
 				bundle := downloadBundleError("request to FHIR server with URL %s had a non-ok response status (%d) but the expected operation outcome could not be parsed: %v", request.URL, response.StatusCode, err)
 				bundle.stats = &stats
-				resChannel <- bundle
+				send(pageItem{page: bundle})
 				return
 			}
 
@@ -458,114 +838,171 @@ func downloadResources(client *fhir.Client, resourceType string, fhirSearchQuery
 				OperationOutcome: &outcome,
 			}
 			bundle.stats = &stats
-			resChannel <- bundle
+			send(pageItem{page: bundle})
 			return
 		}
 
-		responseBody, err := io.ReadAll(response.Body)
-		if err != nil {
-			resChannel <- downloadBundleError("could not read FHIR server response after request to URL %s: %v\n", request.URL, err)
-			return
+		page := &downloadBundle{
+			associatedRequestURL: *request.URL,
+			pageSize:             requestedPageSize,
+			stats:                &stats,
+		}
+		var handleEntry entryHandler
+		var waitDuration time.Duration
+		if withEntries {
+			handleEntry = func(entry *fm.BundleEntry, page *downloadBundle) error {
+				waitStart := time.Now()
+				if !send(pageItem{entry: entry, page: page}) {
+					return ctx.Err()
+				}
+				waitDuration += time.Since(waitStart)
+				return nil
+			}
 		}
+		body := &countingReader{r: response.Body}
+		head, err := decodePage(body, page, handleEntry)
 		response.Body.Close()
-		stats.requestDuration = time.Since(requestStart).Seconds()
-		stats.totalBytesIn += int64(len(responseBody))
-
-		essentialResource := struct {
-			Entries json.RawMessage `bson:"entry,omitempty" json:"entry,omitempty"`
-			Links   []fm.BundleLink `bson:"link,omitempty" json:"link,omitempty"`
-		}{}
-		err = json.Unmarshal(responseBody, &essentialResource)
-		if err != nil {
-			resChannel <- downloadBundleError("could not parse FHIR server response after request to URL %s: %v\n", request.URL, err)
+		stats.requestDuration = (time.Since(requestStart) - waitDuration).Seconds()
+		stats.totalBytesIn += body.n
+		if ctx.Err() != nil {
 			return
 		}
-		resChannel <- downloadBundle{
-			associatedRequestURL: *request.URL,
-			rawEntries:           essentialResource.Entries,
-			stats:                &stats,
+		if err != nil {
+			page.err = fmt.Errorf("could not parse FHIR server response after request to URL %s: %v\n", request.URL, err)
+			send(pageItem{page: page})
+			return
 		}
 
-		nextPageURL, err = getNextPageURL(essentialResource.Links)
+		nextPageURL, err = getNextPageURL(head.links)
+		if sizer != nil && nextPageURL != nil {
+			nextPageURL = withPageSize(nextPageURL, sizer.adapt(&stats))
+		}
+		page.nextPageURL = nextPageURL
+		page.serverTime = serverTime(head.meta, response.Header)
+		page.total = head.total
+		if !send(pageItem{page: page}) {
+			return
+		}
 		if err != nil {
-			resChannel <- downloadBundleError("could not parse the next page link within the FHIR server response after request to URL %s: %v\n", request.URL, err)
+			send(pageItem{page: downloadBundleError("could not parse the next page link within the FHIR server response after request to URL %s: %v\n", request.URL, err)})
 			return
 		}
 	}
 }
 
+// serverTime returns the time at which the server generated a search result page. It prefers
+// meta.lastUpdated of the page bundle. Otherwise, the Date header is used, minus one second,
+// because it is truncated to seconds. Returns the zero time if both are missing.
+func serverTime(meta *fm.Meta, header http.Header) time.Time {
+	if meta != nil && meta.LastUpdated != nil {
+		if t, err := time.Parse(time.RFC3339Nano, *meta.LastUpdated); err == nil {
+			return t
+		}
+	}
+	if t, err := http.ParseTime(header.Get("Date")); err == nil {
+		return t.Add(-time.Second)
+	}
+	return time.Time{}
+}
+
 // createOutputFileOrDie creates the output file at the given filepath if it does not already exist
 // and returns the file handle.
 // This is a non-destructive operation. Hence, if a file already exists at the given filepath then
 // the command exits with a non-success error code. If any other error case the command exits with
 // a non-success error code as well.
 //
-// Note: The callee has to make sure that the file handle is closed properly.
+// With --append, an existing file is appended to. With --force, a temporary file is returned
+// which replaces an existing file on commitOutputFile. The filepath - denotes stdout.
+//
+// Note: The callee has to make sure that the file handle is committed by commitOutputFile.
 func createOutputFileOrDie(filepath string) *os.File {
-	outputFile, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	outputFile, err := openOutputFile(filepath)
 	if err != nil {
 		if os.IsExist(err) {
-			fmt.Printf("The output file %s does already exist.\n", filepath)
+			fmt.Fprintf(os.Stderr, "The output file %s does already exist.\n", filepath)
 			os.Exit(3)
 		} else {
-			fmt.Printf("could not open/create the output file %s: %v\n", filepath, err)
+			fmt.Fprintf(os.Stderr, "could not open/create the output file %s: %v\n", filepath, err)
 			os.Exit(4)
 		}
 	}
 	return outputFile
 }
 
-// writeOutResources takes a raw set of FHIR bundle entries and writes the resource part of each of them to the given
-// sink. The data is written to the sink so that all information resemble a valid NDJSON stream.
+// resourceWriter writes the resources of search result entries to the sink. The data is written to
+// the sink so that all information resemble a valid NDJSON stream.
+//
+// Entries with search mode include are written to includes, which writes every included resource
+// only once. If includes is nil, they are written to the sink like matching resources.
 //
-// Always returns the number of written resources alongside all inline encountered operation outcomes.
-// This is also true for when there is an error. An error is returned alongside the other information
-// and can only occur if there is an actual issue writing to the file or the given resource bundle is
-// invalid in regard to the FHIR specification.
-func writeResources(data *[]byte, sink io.Writer) (int, []*fm.OperationOutcome, error) {
-	var resources int
-	var inlineOutcomes []*fm.OperationOutcome
+// Resources for which the optional transform returns nil are skipped. Inline operation outcomes
+// aren't written but collected in the page. If verification isn't nil, every matching resource is
+// recorded in it.
+type resourceWriter struct {
+	sink         io.Writer
+	includes     *includeRouter
+	transform    resourceTransform
+	verification *downloadVerification
+	buf          bytes.Buffer
+}
 
-	if len(*data) == 0 {
-		return resources, inlineOutcomes, nil
+// writeEntry writes the resource of the given entry and counts it in the page. An error can only
+// occur if there is an actual issue writing to the file or the entry is invalid in regard to the
+// FHIR specification.
+func (w *resourceWriter) writeEntry(e *fm.BundleEntry, page *downloadBundle) error {
+	var mode fm.SearchEntryMode
+	if e.Search != nil && e.Search.Mode != nil {
+		mode = *e.Search.Mode
 	}
 
-	var entries []fm.BundleEntry
-	if err := json.Unmarshal(*data, &entries); err != nil {
-		return resources, inlineOutcomes, fmt.Errorf("could not parse the bundle entries from JSON: %v\n", err)
+	if mode == fm.SearchEntryModeOutcome {
+		outcome, err := fm.UnmarshalOperationOutcome(e.Resource)
+		if err != nil {
+			return fmt.Errorf("could not parse an encountered inline outcome from JSON: %v\n", err)
+		}
+		page.inlineOutcomes = append(page.inlineOutcomes, &outcome)
+		return nil
 	}
 
-	var buf bytes.Buffer
-	for _, e := range entries {
-		if *e.Search.Mode == fm.SearchEntryModeOutcome {
-			outcome, err := fm.UnmarshalOperationOutcome(e.Resource)
-			if err != nil {
-				return resources, inlineOutcomes, fmt.Errorf("could not parse an encountered inline outcome from JSON: %v\n", err)
-			}
-
-			inlineOutcomes = append(inlineOutcomes, &outcome)
-			continue
-		}
+	if mode != fm.SearchEntryModeInclude && w.verification != nil {
+		w.verification.addEntry(e)
+	}
 
-		buf.Reset()
-		err := json.Compact(&buf, e.Resource)
+	if mode == fm.SearchEntryModeInclude && w.includes != nil {
+		written, err := w.includes.write(e.Resource, w.transform)
 		if err != nil {
-			return resources, inlineOutcomes, fmt.Errorf("could not compact JSON representation for write operation: %v\n", err)
+			return err
 		}
-
-		_, err = sink.Write(buf.Bytes())
-		if err != nil {
-			return resources, inlineOutcomes, fmt.Errorf("could not write resource to output file: %v\n", err)
+		if written {
+			page.included++
 		}
+		return nil
+	}
 
-		_, err = sink.Write([]byte{'\n'})
-		if err != nil {
-			return resources, inlineOutcomes, fmt.Errorf("could not write resource separator to output file: %v\n", err)
+	resource := e.Resource
+	if w.transform != nil {
+		var err error
+		if resource, err = w.transform(resource); err != nil {
+			return fmt.Errorf("could not transform a resource: %v\n", err)
+		}
+		if resource == nil {
+			return nil
 		}
-		resources++
 	}
 
-	return resources, inlineOutcomes, nil
+	w.buf.Reset()
+	err := json.Compact(&w.buf, resource)
+	if err != nil {
+		return fmt.Errorf("could not compact JSON representation for write operation: %v\n", err)
+	}
+	w.buf.WriteByte('\n')
+
+	_, err = w.sink.Write(w.buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not write resource to output file: %v\n", err)
+	}
+	page.resources++
+	return nil
 }
 
 // getNextPageURL extracts the URL to the next resource bundle page from a given
@@ -593,12 +1030,35 @@ func init() {
 	rootCmd.AddCommand(downloadCmd)
 
 	downloadCmd.Flags().StringVar(&server, "server", "", "the base URL of the server to use")
-	downloadCmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "path to the NDJSON file downloaded resources get written to")
+	downloadCmd.Flags().StringVarP(&outputFile, "output-file", "o", "", "path to the NDJSON file downloaded resources get written to, - for stdout")
+	downloadCmd.Flags().BoolVar(&appendOutput, "append", false, "append to existing output files")
+	downloadCmd.Flags().BoolVar(&forceOutput, "force", false, "replace existing output files after a successful download")
+	downloadCmd.Flags().StringVar(&manifestFile, "manifest", "", "path of the manifest written after the download (default manifest.json next to the output files)")
+	downloadCmd.Flags().StringVar(&compressOutput, "compress", "", "compress the output files with gzip or zstd")
+	downloadCmd.Flags().IntVar(&maxLinesPerFile, "max-lines-per-file", 0, "roll the output into numbered shards of at most this number of resources")
+	downloadCmd.Flags().StringVar(&maxBytesPerFile, "max-bytes-per-file", "", "roll the output into numbered shards once they reach this uncompressed size like 512M or 2G")
+	downloadCmd.Flags().StringVarP(&outputDir, "output-dir", "d", "", "path to the directory the NDJSON files of multiple resource types get written to")
+	downloadCmd.Flags().BoolVar(&downloadAll, "all", false, "download all resource types the server supports searching for")
+	downloadCmd.Flags().StringVar(&queriesFile, "queries", "", "file with one search like Patient?gender=female per line, optionally followed by an output file name")
+	downloadCmd.Flags().IntVarP(&downloadConcurrency, "concurrency", "c", 4, "number of resource types, queries or partitions downloaded in parallel")
+	downloadCmd.Flags().IntVar(&partitions, "partitions", 0, "split the download of a single resource type into this number of _lastUpdated ranges downloaded in parallel")
+	downloadCmd.Flags().StringVar(&since, "since", "", "only download resources updated after this FHIR date time or the server time recorded in this sync file")
+	downloadCmd.Flags().BoolVar(&datedOutput, "dated", false, "add the time of the download to the output file name")
+	downloadCmd.Flags().BoolVar(&downloadDeletions, "deletions", false, "write resources deleted since --since as tombstones into a separate file")
+	downloadCmd.Flags().IntVar(&pageSize, "page-size", 0, "number of resources requested per page by _count (default of the server)")
+	downloadCmd.Flags().BoolVar(&adaptivePageSize, "adaptive-page-size", false, "grow or shrink the page size depending on the processing duration and size of pages")
+	downloadCmd.Flags().BoolVar(&verifyDownload, "verify", false, "verify that every matching resource was downloaded exactly once")
+	downloadCmd.Flags().BoolVar(&resumeDownload, "resume", false, "resume an interrupted download using its state file")
+	downloadCmd.Flags().BoolVar(&sortForResume, "resumable", false, "sort the search by _lastUpdated, so that the download can be resumed after its next link expired")
+	downloadCmd.Flags().BoolVar(&shardPartitions, "shards", false, "write every partition into its own numbered shard file next to the output file")
 	downloadCmd.Flags().StringVarP(&fhirSearchQuery, "query", "q", "", "FHIR search query")
 	downloadCmd.Flags().BoolVarP(&usePost, "use-post", "p", false, "use POST to execute the search")
 	downloadCmd.Flags().StringVar(&outputStatisticsFileName, "output", "", "file to write detailed statistics to")
+	downloadCmd.Flags().StringVar(&deidentifyConfigFile, "deidentify", "", "YAML file configuring the de-identification of all downloaded resources")
 
 	_ = downloadCmd.MarkFlagRequired("server")
-	_ = downloadCmd.MarkFlagRequired("output-file")
 	_ = downloadCmd.MarkFlagFilename("output-file", "ndjson")
+	_ = downloadCmd.MarkFlagDirname("output-dir")
+	_ = downloadCmd.MarkFlagFilename("queries")
+	_ = downloadCmd.MarkFlagFilename("deidentify", "yaml", "yml")
 }
@@ -0,0 +1,185 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// includeRouter writes the resources included by _include or _revinclude into one file per type
+// next to the file of the matching resources, like patient-Observation.ndjson. Every included
+// resource is written only once, even if it is included in several pages. It is safe for
+// concurrent use.
+type includeRouter struct {
+	matchFilename string
+	mutex         sync.Mutex
+	// type and id of every included resource already seen
+	seen   map[string]bool
+	files  map[string]*os.File
+	sinks  map[string]*bufio.Writer
+	counts map[string]int
+	// types in the order of their first appearance
+	types []string
+}
+
+func newIncludeRouter(matchFilename string) *includeRouter {
+	return &includeRouter{
+		matchFilename: matchFilename,
+		seen:          make(map[string]bool),
+		files:         make(map[string]*os.File),
+		sinks:         make(map[string]*bufio.Writer),
+		counts:        make(map[string]int),
+	}
+}
+
+// filename returns the name of the file the included resources of the given type are written to.
+func (r *includeRouter) filename(resourceType string) string {
+	return siblingFilename(r.matchFilename, resourceType)
+}
+
+// sink returns the sink of the given type, creating its file on first use. Existing files are
+// only appended to with --append and replaced with --force.
+func (r *includeRouter) sink(resourceType string) (*bufio.Writer, error) {
+	if sink, ok := r.sinks[resourceType]; ok {
+		return sink, nil
+	}
+	filename := r.filename(resourceType)
+	file, err := openOutputFile(filename)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("the output file %s for included resources does already exist", filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.files[resourceType] = file
+	r.sinks[resourceType] = bufio.NewWriter(file)
+	r.types = append(r.types, resourceType)
+	return r.sinks[resourceType], nil
+}
+
+// write writes the given included resource unless a resource with the same type and id was
+// already written. Resources for which the optional transform returns nil are skipped.
+//
+// Returns true if the resource was written.
+func (r *includeRouter) write(resource json.RawMessage, transform resourceTransform) (bool, error) {
+	reference := struct {
+		ResourceType string `json:"resourceType"`
+		Id           string `json:"id"`
+	}{}
+	if err := json.Unmarshal(resource, &reference); err != nil {
+		return false, fmt.Errorf("could not parse an included resource from JSON: %v", err)
+	}
+	if reference.ResourceType == "" {
+		return false, fmt.Errorf("missing resourceType in an included resource")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := reference.ResourceType + "/" + reference.Id
+	if reference.Id != "" && r.seen[key] {
+		return false, nil
+	}
+	r.seen[key] = true
+
+	if transform != nil {
+		var err error
+		if resource, err = transform(resource); err != nil {
+			return false, fmt.Errorf("could not transform an included resource: %v", err)
+		}
+		if resource == nil {
+			return false, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, resource); err != nil {
+		return false, fmt.Errorf("could not compact JSON representation for write operation: %v", err)
+	}
+	buf.WriteByte('\n')
+
+	sink, err := r.sink(reference.ResourceType)
+	if err != nil {
+		return false, err
+	}
+	if _, err := sink.Write(buf.Bytes()); err != nil {
+		return false, fmt.Errorf("could not write an included resource to output file: %v", err)
+	}
+	r.counts[reference.ResourceType]++
+	return true, nil
+}
+
+// flush writes the buffered included resources into their files. Returns the first error.
+func (r *includeRouter) flush() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var err error
+	for _, resourceType := range r.types {
+		if flushErr := r.sinks[resourceType].Flush(); flushErr != nil && err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// close flushes and commits all files of included resources. Returns the first error.
+func (r *includeRouter) close() error {
+	err := r.flush()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, resourceType := range r.types {
+		if commitErr := commitOutputFile(r.files[resourceType]); commitErr != nil && err == nil {
+			err = commitErr
+		}
+	}
+	return err
+}
+
+// String lists the file and the number of included resources of every type.
+func (r *includeRouter) String() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	builder := strings.Builder{}
+	for _, resourceType := range r.types {
+		builder.WriteString(fmt.Sprintf("Included %s -> %s (%d resources)\n", resourceType,
+			r.filename(resourceType), r.counts[resourceType]))
+	}
+	return builder.String()
+}
+
+// hasIncludes returns true if the given FHIR search query contains _include or _revinclude
+// parameters.
+func hasIncludes(fhirSearchQuery string) bool {
+	query, err := url.ParseQuery(fhirSearchQuery)
+	if err != nil {
+		return false
+	}
+	for key := range query {
+		if strings.HasPrefix(key, "_include") || strings.HasPrefix(key, "_revinclude") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func searchEntry(mode fm.SearchEntryMode, resource string) fm.BundleEntry {
+	return fm.BundleEntry{
+		Resource: []byte(resource),
+		Search:   &fm.BundleEntrySearch{Mode: &mode},
+	}
+}
+
+func TestIncludeRouter(t *testing.T) {
+	t.Run("DeduplicatesByTypeAndId", func(t *testing.T) {
+		matchFilename := filepath.Join(t.TempDir(), "patient.ndjson")
+		router := newIncludeRouter(matchFilename)
+
+		for _, resource := range []string{
+			`{"resourceType": "Observation", "id": "0"}`,
+			`{"resourceType": "Observation", "id": "1"}`,
+			`{"resourceType": "Observation", "id": "0"}`,
+			`{"resourceType": "Encounter", "id": "0"}`,
+		} {
+			_, err := router.write([]byte(resource), nil)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, router.close())
+
+		assert.Equal(t, []string{`{"resourceType":"Observation","id":"0"}`, `{"resourceType":"Observation","id":"1"}`},
+			readLines(t, filepath.Join(filepath.Dir(matchFilename), "patient-Observation.ndjson")))
+		assert.Equal(t, []string{`{"resourceType":"Encounter","id":"0"}`},
+			readLines(t, filepath.Join(filepath.Dir(matchFilename), "patient-Encounter.ndjson")))
+		assert.Contains(t, router.String(), "Included Observation -> ")
+		assert.Contains(t, router.String(), "patient-Observation.ndjson (2 resources)\n")
+	})
+
+	t.Run("SkipsDroppedResources", func(t *testing.T) {
+		router := newIncludeRouter(filepath.Join(t.TempDir(), "patient.ndjson"))
+		drop := func(json.RawMessage) (json.RawMessage, error) { return nil, nil }
+
+		written, err := router.write([]byte(`{"resourceType": "Observation", "id": "0"}`), drop)
+		assert.NoError(t, err)
+		assert.False(t, written)
+		assert.NoError(t, router.close())
+		assert.Empty(t, router.String())
+	})
+
+	t.Run("ExistingFile", func(t *testing.T) {
+		matchFilename := filepath.Join(t.TempDir(), "patient.ndjson")
+		if err := os.WriteFile(siblingFilename(matchFilename, "Observation"), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		router := newIncludeRouter(matchFilename)
+
+		_, err := router.write([]byte(`{"resourceType": "Observation", "id": "0"}`), nil)
+		assert.ErrorContains(t, err, "does already exist")
+		assert.NoError(t, router.close())
+	})
+}
+
+func TestWriteResourcesWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	router := newIncludeRouter(filepath.Join(dir, "patient.ndjson"))
+
+	pages := [][]fm.BundleEntry{
+		{
+			searchEntry(fm.SearchEntryModeMatch, `{"resourceType": "Patient", "id": "0"}`),
+			searchEntry(fm.SearchEntryModeInclude, `{"resourceType": "Organization", "id": "0"}`),
+		},
+		{
+			searchEntry(fm.SearchEntryModeMatch, `{"resourceType": "Patient", "id": "1"}`),
+			searchEntry(fm.SearchEntryModeInclude, `{"resourceType": "Organization", "id": "0"}`),
+			searchEntry(fm.SearchEntryModeInclude, `{"resourceType": "Organization", "id": "1"}`),
+		},
+	}
+
+	var sink bytes.Buffer
+	writer := &resourceWriter{sink: &sink, includes: router}
+	var matches, includes []int
+	for _, page := range pages {
+		data, _ := json.Marshal(fm.Bundle{Entry: page})
+		written, err := writePage(data, writer)
+		assert.NoError(t, err)
+		matches = append(matches, written.resources)
+		includes = append(includes, written.included)
+	}
+	assert.NoError(t, router.close())
+
+	assert.Equal(t, []int{1, 1}, matches)
+	assert.Equal(t, []int{1, 1}, includes)
+	assert.Equal(t, "{\"resourceType\":\"Patient\",\"id\":\"0\"}\n{\"resourceType\":\"Patient\",\"id\":\"1\"}\n", sink.String())
+	assert.Equal(t, []string{`{"resourceType":"Organization","id":"0"}`, `{"resourceType":"Organization","id":"1"}`},
+		readLines(t, filepath.Join(dir, "patient-Organization.ndjson")))
+
+	stats := commandStats{totalPages: 2, resourcesPerPage: matches, includesPerPage: includes}
+	assert.Contains(t, stats.String(), "Resources 	[total]			2\n")
+	assert.Contains(t, stats.String(), "Included 	[total]			2\n")
+}
+
+func TestWriteResourcesWithoutIncludeRouter(t *testing.T) {
+	data, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{
+		searchEntry(fm.SearchEntryModeMatch, `{"resourceType": "Patient", "id": "0"}`),
+		searchEntry(fm.SearchEntryModeInclude, `{"resourceType": "Organization", "id": "0"}`),
+	}})
+
+	var sink bytes.Buffer
+	page, err := writePage(data, &resourceWriter{sink: &sink})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, page.resources)
+	assert.Equal(t, 0, page.included)
+}
+
+func TestHasIncludes(t *testing.T) {
+	assert.True(t, hasIncludes("_include=Observation:patient"))
+	assert.True(t, hasIncludes("_revinclude:iterate=Observation:patient"))
+	assert.False(t, hasIncludes("gender=female"))
+	assert.False(t, hasIncludes(""))
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const manifestBasename = "manifest.json"
+
+var manifestFile string
+
+// downloadManifest collects the output files of a download and writes them into a manifest in the
+// format of a Bulk Data export manifest, so that downloads can be consumed like Bulk Data exports.
+type downloadManifest struct {
+	filename string
+	manifest exportManifest
+}
+
+// newDownloadManifest returns a manifest written into the given directory, or to the file given
+// by --manifest.
+func newDownloadManifest(dir string) *downloadManifest {
+	filename := manifestFile
+	if filename == "" {
+		filename = filepath.Join(dir, manifestBasename)
+	}
+	return &downloadManifest{
+		filename: filename,
+		manifest: exportManifest{Output: []exportFile{}, Error: []exportFile{}},
+	}
+}
+
+// url returns the path of the given file relative to the directory of the manifest, or the
+// absolute path if there is no relative path.
+func (m *downloadManifest) url(filename string) string {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return filename
+	}
+	absDir, err := filepath.Abs(filepath.Dir(m.filename))
+	if err != nil {
+		return absFilename
+	}
+	if rel, err := filepath.Rel(absDir, absFilename); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return absFilename
+}
+
+// setRequest records the search request of the download of the given resource type.
+func (m *downloadManifest) setRequest(resourceType string, fhirSearchQuery string) {
+	request := strings.TrimSuffix(server, "/") + "/" + resourceType
+	if fhirSearchQuery != "" {
+		request += "?" + fhirSearchQuery
+	}
+	m.manifest.Request = request
+}
+
+// setTransactionTime records the given server time, keeping the earliest one. Zero times are
+// ignored.
+func (m *downloadManifest) setTransactionTime(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	if m.manifest.TransactionTime != "" {
+		if current, err := time.Parse(time.RFC3339Nano, m.manifest.TransactionTime); err == nil && !t.Before(current) {
+			return
+		}
+	}
+	m.manifest.TransactionTime = t.UTC().Format(time.RFC3339Nano)
+}
+
+// addStats records the server time of the first page of the given statistics.
+func (m *downloadManifest) addStats(stats *commandStats) {
+	for _, bundle := range stats.bundles {
+		m.setTransactionTime(bundle.serverTime)
+	}
+}
+
+// addFile adds an output file of the given type with the given number of resources and checksum.
+func (m *downloadManifest) addFile(resourceType string, filename string, count int, checksum string) {
+	m.manifest.Output = append(m.manifest.Output, exportFile{
+		Type:   resourceType,
+		Url:    m.url(filename),
+		Count:  &count,
+		Sha256: checksum,
+	})
+}
+
+// addOutput adds all files written by the given output writer.
+func (m *downloadManifest) addOutput(resourceType string, output *outputWriter) {
+	for i, filename := range output.filenames {
+		if i < len(output.counts) {
+			m.addFile(resourceType, filename, output.counts[i], output.checksums[i])
+		}
+	}
+}
+
+// addIncludes adds the files of included resources. Their checksums are calculated by reading the
+// files.
+func (m *downloadManifest) addIncludes(includes *includeRouter) error {
+	for _, resourceType := range includes.types {
+		filename := includes.filename(resourceType)
+		checksum, err := fileChecksum(filename)
+		if err != nil {
+			return err
+		}
+		m.addFile(resourceType, filename, includes.counts[resourceType], checksum)
+	}
+	return nil
+}
+
+// write writes the manifest. An existing manifest is only replaced with --force.
+func (m *downloadManifest) write() error {
+	if m.manifest.TransactionTime == "" {
+		m.manifest.TransactionTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	data, err := json.MarshalIndent(m.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if !forceOutput {
+		if _, err := os.Stat(m.filename); err == nil {
+			return fmt.Errorf("the manifest file %s does already exist", m.filename)
+		}
+	}
+	if err := os.WriteFile(m.filename+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(m.filename+".tmp", m.filename)
+}
+
+// writeOrWarn writes the manifest and reports a failure as warning, because the download itself
+// succeeded.
+func (m *downloadManifest) writeOrWarn() {
+	if err := m.write(); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the manifest: %v\n", err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Wrote manifest %s\n", m.filename)
+}
+
+// writesManifest returns true if a manifest is written after downloading into the given output
+// file. The counts of files written to stdout or appended to can't be known.
+func writesManifest(outputFile string) bool {
+	return outputFile != stdoutFilename && !appendOutput
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of the given file.
+func fileChecksum(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
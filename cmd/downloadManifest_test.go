@@ -0,0 +1,94 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadManifest(t *testing.T) {
+	dir := t.TempDir()
+	server = "http://localhost:8080/fhir/"
+	defer func() { server = "" }()
+
+	output := createOutputWriterOrDie(filepath.Join(dir, "patient.ndjson"), outputOptions{maxLines: 2})
+	_, err := output.Write([]byte("a\nb\nc\n"))
+	assert.NoError(t, err)
+	assert.NoError(t, output.commit())
+
+	manifest := newDownloadManifest(dir)
+	manifest.setRequest("Patient", "gender=female")
+	manifest.setTransactionTime(time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC))
+	manifest.setTransactionTime(time.Date(2022, 10, 1, 11, 0, 0, 0, time.UTC))
+	manifest.setTransactionTime(time.Date(2022, 10, 1, 13, 0, 0, 0, time.UTC))
+	manifest.addOutput("Patient", output)
+	assert.NoError(t, manifest.write())
+
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written exportManifest
+	assert.NoError(t, json.Unmarshal(data, &written))
+
+	assert.Equal(t, "2022-10-01T11:00:00Z", written.TransactionTime)
+	assert.Equal(t, "http://localhost:8080/fhir/Patient?gender=female", written.Request)
+	assert.Empty(t, written.Error)
+	if assert.Len(t, written.Output, 2) {
+		for i, expectedCount := range []int{2, 1} {
+			file := written.Output[i]
+			assert.Equal(t, "Patient", file.Type)
+			assert.Equal(t, filepath.Base(shardFilename("patient.ndjson", i)), file.Url)
+			assert.Equal(t, expectedCount, *file.Count)
+
+			checksum, err := fileChecksum(filepath.Join(dir, file.Url))
+			assert.NoError(t, err)
+			assert.Equal(t, checksum, file.Sha256)
+		}
+	}
+
+	t.Run("ExistingManifest", func(t *testing.T) {
+		assert.ErrorContains(t, manifest.write(), "does already exist")
+
+		forceOutput = true
+		defer func() { forceOutput = false }()
+		assert.NoError(t, manifest.write())
+	})
+}
+
+func TestDownloadManifestUrl(t *testing.T) {
+	manifest := &downloadManifest{filename: filepath.Join("export", "manifest.json")}
+
+	assert.Equal(t, "patient.ndjson", manifest.url(filepath.Join("export", "patient.ndjson")))
+	assert.Equal(t, "types/patient.ndjson", manifest.url(filepath.Join("export", "types", "patient.ndjson")))
+
+	abs, _ := filepath.Abs("patient.ndjson")
+	assert.Equal(t, abs, manifest.url("patient.ndjson"))
+}
+
+func TestWritesManifest(t *testing.T) {
+	assert.True(t, writesManifest("patient.ndjson"))
+	assert.False(t, writesManifest(stdoutFilename))
+
+	appendOutput = true
+	defer func() { appendOutput = false }()
+	assert.False(t, writesManifest("patient.ndjson"))
+}
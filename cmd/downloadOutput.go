@@ -0,0 +1,142 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// stdoutFilename is the name of the output file which denotes stdout.
+const stdoutFilename = "-"
+
+var appendOutput bool
+var forceOutput bool
+
+// tempOutputFiles maps the temporary files written with --force to the names of the output files
+// they replace on commit.
+var tempOutputFiles = struct {
+	sync.Mutex
+	names map[*os.File]string
+}{names: make(map[*os.File]string)}
+
+// openOutputFile opens the output file at the given filepath. Existing files are only appended to
+// with --append and replaced with --force. The filepath - denotes stdout.
+func openOutputFile(filename string) (*os.File, error) {
+	switch {
+	case filename == stdoutFilename:
+		return os.Stdout, nil
+	case forceOutput:
+		return createTempOutputFile(filename)
+	case appendOutput:
+		return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	default:
+		return os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+}
+
+// createTempOutputFile creates a temporary file in the directory of the given output file, which
+// replaces the output file on commitOutputFile. The file gets the mode of regular output files
+// instead of the private mode of temporary files, because the mode is kept on rename.
+func createTempOutputFile(filename string) (*os.File, error) {
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	tempOutputFiles.Lock()
+	defer tempOutputFiles.Unlock()
+	tempOutputFiles.names[file] = filename
+	return file, nil
+}
+
+// outputFilename returns the name of the output file the given file is written to, which differs
+// from the name of the file itself with --force.
+func outputFilename(file *os.File) string {
+	tempOutputFiles.Lock()
+	defer tempOutputFiles.Unlock()
+	if filename, ok := tempOutputFiles.names[file]; ok {
+		return filename
+	}
+	return file.Name()
+}
+
+// commitOutputFile syncs and closes the given output file. A temporary file written with --force
+// is renamed to its output file, so that the output file is replaced atomically. Stdout is left
+// open.
+func commitOutputFile(file *os.File) error {
+	if err := closeOutputFile(file); err != nil {
+		return err
+	}
+	return replaceOutputFile(file)
+}
+
+// closeOutputFile syncs and closes the given output file without replacing the output file by it.
+// Stdout is left open.
+func closeOutputFile(file *os.File) error {
+	if file == os.Stdout {
+		return nil
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replaceOutputFile renames the given closed temporary file written with --force to its output
+// file. Other files are left as they are.
+func replaceOutputFile(file *os.File) error {
+	tempOutputFiles.Lock()
+	defer tempOutputFiles.Unlock()
+	if filename, ok := tempOutputFiles.names[file]; ok {
+		if err := os.Rename(file.Name(), filename); err != nil {
+			return err
+		}
+		delete(tempOutputFiles.names, file)
+	}
+	return nil
+}
+
+// removeTempOutputFilesOnSignal removes all temporary files written with --force which weren't
+// committed if the process is interrupted or terminated, so that no temporary files are left
+// behind.
+func removeTempOutputFilesOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		removeTempOutputFiles()
+		os.Exit(1)
+	}()
+}
+
+// removeTempOutputFiles removes all temporary files written with --force which weren't committed,
+// so that a failed download leaves the existing output files untouched.
+func removeTempOutputFiles() {
+	tempOutputFiles.Lock()
+	defer tempOutputFiles.Unlock()
+	for file := range tempOutputFiles.names {
+		file.Close()
+		os.Remove(file.Name())
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readFile(t *testing.T, filename string) string {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestCreateOutputFileOrDie(t *testing.T) {
+	t.Run("Stdout", func(t *testing.T) {
+		file := createOutputFileOrDie(stdoutFilename)
+
+		assert.Equal(t, os.Stdout, file)
+		assert.NoError(t, commitOutputFile(file))
+	})
+
+	t.Run("Append", func(t *testing.T) {
+		appendOutput = true
+		defer func() { appendOutput = false }()
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		if err := os.WriteFile(filename, []byte("a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file := createOutputFileOrDie(filename)
+		_, err := file.WriteString("b\n")
+		assert.NoError(t, err)
+		assert.NoError(t, commitOutputFile(file))
+
+		assert.Equal(t, "a\nb\n", readFile(t, filename))
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		forceOutput = true
+		defer func() { forceOutput = false }()
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "patient.ndjson")
+		if err := os.WriteFile(filename, []byte("a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file := createOutputFileOrDie(filename)
+		_, err := file.WriteString("b\n")
+		assert.NoError(t, err)
+		assert.Equal(t, filename, outputFilename(file))
+
+		// the output file stays untouched until the commit
+		assert.Equal(t, "a\n", readFile(t, filename))
+		assert.NoError(t, commitOutputFile(file))
+		assert.Equal(t, "b\n", readFile(t, filename))
+		info, err := os.Stat(filename)
+		if assert.NoError(t, err) {
+			assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), "replaced files get the mode of regular output files")
+		}
+
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+
+	t.Run("ForceFails", func(t *testing.T) {
+		forceOutput = true
+		defer func() { forceOutput = false }()
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "patient.ndjson")
+		if err := os.WriteFile(filename, []byte("a\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		file := createOutputFileOrDie(filename)
+		_, err := file.WriteString("b\n")
+		assert.NoError(t, err)
+		removeTempOutputFiles()
+
+		assert.Equal(t, "a\n", readFile(t, filename))
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+	})
+}
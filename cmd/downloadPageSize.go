@@ -0,0 +1,96 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// page size used by --adaptive-page-size if neither --page-size nor _count is given
+	defaultAdaptivePageSize = 50
+	minAdaptivePageSize     = 10
+	maxAdaptivePageSize     = 10000
+	// pages are adapted to be processed by the server in about this number of seconds
+	targetPageProcessingDuration = 2.0
+	// pages are adapted to have about this number of bytes
+	targetPageBytes = 10 << 20
+)
+
+var pageSize int
+var adaptivePageSize bool
+
+// pageSizeOf returns the page size requested by the given query, zero if it requests none.
+func pageSizeOf(query url.Values) int {
+	size, err := strconv.Atoi(query.Get("_count"))
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// withPageSize returns a copy of the given page URL requesting the given page size.
+func withPageSize(pageURL *url.URL, size int) *url.URL {
+	result := *pageURL
+	query := result.Query()
+	query.Set("_count", strconv.Itoa(size))
+	result.RawQuery = query.Encode()
+	return &result
+}
+
+// pageSizer adapts the page size of a download, so that the server processes a page in about
+// targetPageProcessingDuration and responds with about targetPageBytes, whatever is reached first.
+type pageSizer struct {
+	size int
+}
+
+// newPageSizer returns a page sizer starting with the page size of the given query or
+// defaultAdaptivePageSize if the query requests none.
+func newPageSizer(query url.Values) *pageSizer {
+	size := pageSizeOf(query)
+	if size <= 0 {
+		size = defaultAdaptivePageSize
+	}
+	return &pageSizer{size: size}
+}
+
+// adapt calculates the size of the next page from the statistics of the last page. The size is
+// changed by at most factor two per page and is kept if it is within 25 % of the ideal size, so
+// that small variations don't change the page size all the time.
+func (s *pageSizer) adapt(stats *networkStats) int {
+	factor := math.Inf(1)
+	if stats.processingDuration > 0 {
+		factor = targetPageProcessingDuration / stats.processingDuration
+	}
+	if stats.totalBytesIn > 0 {
+		factor = math.Min(factor, float64(targetPageBytes)/float64(stats.totalBytesIn))
+	}
+	if math.IsInf(factor, 1) || (factor > 0.8 && factor < 1.25) {
+		return s.size
+	}
+
+	factor = math.Max(0.5, math.Min(2, factor))
+	size := int(math.Round(float64(s.size) * factor))
+	if size < minAdaptivePageSize {
+		size = minAdaptivePageSize
+	}
+	if size > maxAdaptivePageSize {
+		size = maxAdaptivePageSize
+	}
+	s.size = size
+	return size
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageSizeOf(t *testing.T) {
+	assert.Equal(t, 100, pageSizeOf(url.Values{"_count": {"100"}}))
+	assert.Equal(t, 0, pageSizeOf(url.Values{}))
+	assert.Equal(t, 0, pageSizeOf(url.Values{"_count": {"foo"}}))
+}
+
+func TestWithPageSize(t *testing.T) {
+	pageURL, _ := url.Parse("http://localhost:8080/fhir/Patient/__page?__t=1&_count=50")
+
+	resized := withPageSize(pageURL, 100)
+
+	assert.Equal(t, "100", resized.Query().Get("_count"))
+	assert.Equal(t, "1", resized.Query().Get("__t"))
+	assert.Equal(t, "50", pageURL.Query().Get("_count"))
+}
+
+func TestPageSizer(t *testing.T) {
+	t.Run("DefaultSize", func(t *testing.T) {
+		assert.Equal(t, defaultAdaptivePageSize, newPageSizer(url.Values{}).size)
+		assert.Equal(t, 200, newPageSizer(url.Values{"_count": {"200"}}).size)
+	})
+
+	t.Run("GrowsFastSmallPages", func(t *testing.T) {
+		s := &pageSizer{size: 100}
+		assert.Equal(t, 200, s.adapt(&networkStats{processingDuration: 0.1, totalBytesIn: 1 << 10}))
+		assert.Equal(t, 400, s.adapt(&networkStats{processingDuration: 0.1, totalBytesIn: 1 << 10}))
+	})
+
+	t.Run("ShrinksSlowPages", func(t *testing.T) {
+		s := &pageSizer{size: 1000}
+		assert.Equal(t, 500, s.adapt(&networkStats{processingDuration: 10, totalBytesIn: 1 << 10}))
+		assert.Equal(t, 400, s.adapt(&networkStats{processingDuration: 2.5, totalBytesIn: 1 << 10}))
+	})
+
+	t.Run("ShrinksLargePages", func(t *testing.T) {
+		s := &pageSizer{size: 1000}
+		assert.Equal(t, 500, s.adapt(&networkStats{processingDuration: 0.1, totalBytesIn: 4 * targetPageBytes}))
+	})
+
+	t.Run("KeepsSizeNearTarget", func(t *testing.T) {
+		s := &pageSizer{size: 1000}
+		assert.Equal(t, 1000, s.adapt(&networkStats{processingDuration: 1.8, totalBytesIn: 1 << 10}))
+	})
+
+	t.Run("StaysWithinBounds", func(t *testing.T) {
+		s := &pageSizer{size: 8000}
+		assert.Equal(t, maxAdaptivePageSize, s.adapt(&networkStats{processingDuration: 0.1, totalBytesIn: 1 << 10}))
+		s = &pageSizer{size: 15}
+		assert.Equal(t, minAdaptivePageSize, s.adapt(&networkStats{processingDuration: 10, totalBytesIn: 1 << 10}))
+	})
+}
+
+// newPageSizeServer returns a server with the given number of pages of one patient each. The next
+// links keep the _count of the request. The _count of every request is recorded.
+func newPageSizeServer(t *testing.T, pages int) (*httptest.Server, *[]string) {
+	var counts []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts = append(counts, r.URL.Query().Get("_count"))
+
+		var page int
+		_, _ = fmt.Sscan(r.URL.Query().Get("page"), &page)
+		bundle := fm.Bundle{Type: fm.BundleTypeSearchset, Entry: []fm.BundleEntry{
+			{Resource: json.RawMessage(fmt.Sprintf(`{"resourceType":"Patient","id":"%d"}`, page))},
+		}}
+		if page+1 < pages {
+			next := url.Values{"page": {fmt.Sprint(page + 1)}, "_count": {r.URL.Query().Get("_count")}}
+			bundle.Link = append(bundle.Link, fm.BundleLink{
+				Relation: "next",
+				Url:      server.URL + "/Patient?" + next.Encode(),
+			})
+		}
+		w.Header().Set("Content-Type", "application/fhir+json")
+		if err := json.NewEncoder(w).Encode(bundle); err != nil {
+			t.Error(err)
+		}
+	}))
+	return server, &counts
+}
+
+func TestDownloadPageSize(t *testing.T) {
+	download := func(t *testing.T) (commandStats, []string) {
+		server, counts := newPageSizeServer(t, 3)
+		defer server.Close()
+
+		baseURL, _ := url.ParseRequestURI(server.URL)
+		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+		stats, err := downloadResourceType(client, "Patient", "", false, &strings.Builder{}, nil, nil, nil)
+		assert.NoError(t, err)
+		return stats, *counts
+	}
+
+	t.Run("ServerDefault", func(t *testing.T) {
+		stats, counts := download(t)
+
+		assert.Equal(t, []string{"", "", ""}, counts)
+		assert.Equal(t, 0, stats.bundles[0].pageSize)
+	})
+
+	t.Run("FixedPageSize", func(t *testing.T) {
+		pageSize = 20
+		defer func() { pageSize = 0 }()
+
+		stats, counts := download(t)
+
+		assert.Equal(t, []string{"20", "20", "20"}, counts)
+		assert.Equal(t, 20, stats.bundles[2].pageSize)
+		assert.NotContains(t, stats.String(), "Page Size")
+	})
+
+	t.Run("Adaptive", func(t *testing.T) {
+		adaptivePageSize = true
+		defer func() { adaptivePageSize = false }()
+
+		stats, counts := download(t)
+
+		// the small pages are processed fast, so the page size grows
+		assert.Equal(t, []string{"50", "100", "200"}, counts)
+		assert.Equal(t, []int{50, 100, 200}, []int{stats.bundles[0].pageSize, stats.bundles[1].pageSize,
+			stats.bundles[2].pageSize})
+		assert.Contains(t, stats.String(), "Page Size	[min, max]		50, 200\n")
+
+		filename := filepath.Join(t.TempDir(), "stats.csv")
+		writeDownloadStatisticsOrDie(filename, []*commandStats{&stats})
+		lines := readLines(t, filename)
+		assert.Equal(t, "associatedRequestUrl,request,processing,resourcesPerPage,pageSize,includesPerPage", lines[0])
+		assert.True(t, strings.HasSuffix(lines[3], ",1,200,0"), lines[3])
+	})
+}
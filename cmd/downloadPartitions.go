@@ -0,0 +1,388 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// partitionSlices is the number of time slices per partition which are counted in order to
+// balance the number of resources between partitions.
+const partitionSlices = 8
+
+// lastUpdatedFormat is the format of the _lastUpdated boundaries of partitions.
+const lastUpdatedFormat = "2006-01-02T15:04:05.000Z"
+
+var partitions int
+var shardPartitions bool
+
+// planPartitions splits the search of the given type and query into at most n disjoint
+// _lastUpdated ranges holding about the same number of resources. The first range is open to the
+// past and the last range is open to the future, so that the ranges cover all resources.
+//
+// Returns the queries of the partitions which are the given query with the range parameters
+// added.
+func planPartitions(client *fhir.Client, resourceType string, query url.Values, n int) ([]url.Values, error) {
+	first, err := fetchLastUpdated(client, resourceType, query, "_lastUpdated")
+	if err != nil {
+		return nil, err
+	}
+	last, err := fetchLastUpdated(client, resourceType, query, "-_lastUpdated")
+	if err != nil {
+		return nil, err
+	}
+	if first == nil || last == nil || n < 2 || !last.After(*first) {
+		return []url.Values{query}, nil
+	}
+
+	boundaries := sliceBoundaries(*first, *last, n*partitionSlices)
+	sliceQueries := make([]url.Values, 0, len(boundaries)-1)
+	for j := 0; j < len(boundaries)-1; j++ {
+		lower, upper := boundaries[j], boundaries[j+1]
+		sliceQueries = append(sliceQueries, rangeQuery(query, &lower, &upper))
+	}
+	counts, err := fetchSearchTotals(client, resourceType, sliceQueries)
+	if err != nil {
+		return nil, fmt.Errorf("could not count the resources of the partitions: %v", err)
+	}
+
+	cuts := groupSlices(boundaries, counts, n)
+	queries := make([]url.Values, 0, len(cuts)+1)
+	for k := 0; k <= len(cuts); k++ {
+		var lower, upper *time.Time
+		if k > 0 {
+			lower = &cuts[k-1]
+		}
+		if k < len(cuts) {
+			upper = &cuts[k]
+		}
+		queries = append(queries, rangeQuery(query, lower, upper))
+	}
+	return queries, nil
+}
+
+// sliceBoundaries returns the boundaries of up to m equally long time slices with millisecond
+// precision covering first up to and including last.
+func sliceBoundaries(first, last time.Time, m int) []time.Time {
+	first = first.Truncate(time.Millisecond)
+	end := last.Truncate(time.Millisecond).Add(time.Millisecond)
+	step := (end.Sub(first) / time.Duration(m)).Truncate(time.Millisecond)
+	if step < time.Millisecond {
+		step = time.Millisecond
+	}
+
+	boundaries := []time.Time{first}
+	for j := 1; j < m; j++ {
+		boundary := first.Add(step * time.Duration(j))
+		if !boundary.Before(end) {
+			break
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	return append(boundaries, end)
+}
+
+// groupSlices groups consecutive time slices, delimited by the given boundaries and holding the
+// given counts of resources, into at most n partitions of about the same number of resources.
+//
+// Returns the boundaries between the partitions.
+func groupSlices(boundaries []time.Time, counts []int, n int) []time.Time {
+	var total int
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return nil
+	}
+
+	var cuts []time.Time
+	var sum int
+	for j := 0; j < len(counts)-1 && len(cuts) < n-1; j++ {
+		sum += counts[j]
+		if sum*n >= total*(len(cuts)+1) {
+			cuts = append(cuts, boundaries[j+1])
+		}
+	}
+	return cuts
+}
+
+// rangeQuery returns a copy of the given query limited to resources last updated at or after
+// lower and before upper. Nil bounds are left open.
+func rangeQuery(query url.Values, lower, upper *time.Time) url.Values {
+	result := make(url.Values, len(query)+1)
+	for key, values := range query {
+		result[key] = append([]string(nil), values...)
+	}
+	if lower != nil {
+		result.Add("_lastUpdated", "ge"+lower.UTC().Format(lastUpdatedFormat))
+	}
+	if upper != nil {
+		result.Add("_lastUpdated", "lt"+upper.UTC().Format(lastUpdatedFormat))
+	}
+	return result
+}
+
+// fetchLastUpdated returns meta.lastUpdated of the first resource of the search of the given type
+// and query sorted by the given sort parameter or nil if the search doesn't match any resource.
+func fetchLastUpdated(client *fhir.Client, resourceType string, query url.Values, sort string) (*time.Time, error) {
+	sortedQuery := rangeQuery(query, nil, nil)
+	sortedQuery.Set("_sort", sort)
+	sortedQuery.Set("_count", "1")
+
+	req, err := client.NewSearchTypeRequest(resourceType, sortedQuery)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-OK status while searching for the range of _lastUpdated: %s", resp.Status)
+	}
+	bundle, err := fhir.ReadBundle(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range bundle.Entry {
+		if entry.Search != nil && entry.Search.Mode != nil && *entry.Search.Mode != fm.SearchEntryModeMatch {
+			continue
+		}
+		resource := struct {
+			Meta struct {
+				LastUpdated string `json:"lastUpdated"`
+			} `json:"meta"`
+		}{}
+		if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+			return nil, err
+		}
+		lastUpdated, err := time.Parse(time.RFC3339Nano, resource.Meta.LastUpdated)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse meta.lastUpdated `%s`: %v", resource.Meta.LastUpdated, err)
+		}
+		return &lastUpdated, nil
+	}
+	return nil, nil
+}
+
+// fetchSearchTotals returns the total number of resources matching every given query using a
+// batch of _summary=count searches.
+func fetchSearchTotals(client *fhir.Client, resourceType string, queries []url.Values) ([]int, error) {
+	entries := make([]fm.BundleEntry, 0, len(queries))
+	for _, query := range queries {
+		countQuery := rangeQuery(query, nil, nil)
+		countQuery.Set("_summary", "count")
+		entries = append(entries, fm.BundleEntry{
+			Request: &fm.BundleEntryRequest{
+				Method: fm.HTTPVerbGET,
+				Url:    resourceType + "?" + countQuery.Encode(),
+			},
+		})
+	}
+	payload, err := json.Marshal(fm.Bundle{Type: fm.BundleTypeBatch, Entry: entries})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := client.NewTransactionRequest(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("non-OK status while performing a batch interaction: %s", resp.Status)
+	}
+	batchResponse, err := fhir.ReadBundle(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(batchResponse.Entry) != len(queries) {
+		return nil, fmt.Errorf("expect %d bundle entries but got %d", len(queries), len(batchResponse.Entry))
+	}
+
+	totals := make([]int, 0, len(queries))
+	for i, entry := range batchResponse.Entry {
+		if entry.Response == nil || !strings.HasPrefix(entry.Response.Status, "200") {
+			return nil, fmt.Errorf("unexpected response in entry with index %d", i)
+		}
+		searchsetBundle, err := fm.UnmarshalBundle(entry.Resource)
+		if err != nil {
+			return nil, err
+		}
+		if searchsetBundle.Total == nil {
+			return nil, fmt.Errorf("missing total in entry with index %d", i)
+		}
+		totals = append(totals, *searchsetBundle.Total)
+	}
+	return totals, nil
+}
+
+// downloadPartitions downloads the resources of the given type matching the given partition
+// queries. At most concurrency partitions are downloaded at the same time. If there is only one
+// sink, all partitions write their resources one by one to it, otherwise partition i is written to
+// sinks[i]. Included resources of all partitions are written to includes unless it is nil.
+//
+// Returns the statistics of all partitions merged together and the first error that occurred.
+func downloadPartitions(client *fhir.Client, resourceType string, queries []url.Values, usePost bool,
+	sinks []*bufio.Writer, includes *includeRouter, transform resourceTransform, concurrency int) (commandStats, error) {
+	startTime := time.Now()
+	allStats := make([]commandStats, len(queries))
+	errs := make([]error, len(queries))
+
+	shared := &sharedSink{sink: sinks[0]}
+	limiter := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		i, query := i, query
+		wg.Add(1)
+		limiter <- true
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			if len(sinks) > 1 {
+				allStats[i], errs[i] = downloadResourceType(client, resourceType, query.Encode(), usePost, sinks[i],
+					includes, transform, nil)
+				return
+			}
+
+			allStats[i], errs[i] = downloadResourceType(client, resourceType, query.Encode(), usePost, shared,
+				includes, transform, nil)
+		}()
+	}
+	wg.Wait()
+
+	var stats commandStats
+	var err error
+	for i := range queries {
+		stats.merge(&allStats[i])
+		if err == nil {
+			err = errs[i]
+		}
+	}
+	stats.totalDuration = time.Since(startTime)
+	return stats, err
+}
+
+// shardFilename returns the name of the shard with the given zero-based index of the file with the
+// given name.
+func shardFilename(filename string, index int) string {
+	return siblingFilename(filename, fmt.Sprintf("%04d", index+1))
+}
+
+// downloadPartitioned downloads the resources of the given type in partitions into the output file
+// or into one shard file per partition.
+func downloadPartitioned(resourceType string, transform resourceTransform) {
+	options, err := downloadOutputOptions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	query, err := url.ParseQuery(fhirSearchQuery)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not parse the FHIR search query: %v\n", err)
+		os.Exit(1)
+	}
+	queries, err := planPartitions(client, resourceType, query, partitions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not partition the download: %v\n", err)
+		os.Exit(1)
+	}
+
+	filenames := []string{outputFile}
+	if shardPartitions {
+		filenames = make([]string, 0, len(queries))
+		for i := range queries {
+			filenames = append(filenames, shardFilename(outputFile, i))
+		}
+	}
+	checkOutputWriterFilesOrDie(filenames, options)
+	outputs := make([]*outputWriter, 0, len(filenames))
+	sinks := make([]*bufio.Writer, 0, len(filenames))
+	for _, filename := range filenames {
+		output := createOutputWriterOrDie(filename, options)
+		outputs = append(outputs, output)
+		sinks = append(sinks, bufio.NewWriter(output))
+	}
+
+	includes := newIncludeRouter(outputFile)
+	stats, err := downloadPartitions(client, resourceType, queries, usePost, sinks, includes, transform, downloadConcurrency)
+	if flushErr := includes.flush(); flushErr != nil && err == nil {
+		err = &resourceWriteError{err: flushErr}
+	}
+	for i := range outputs {
+		if flushErr := sinks[i].Flush(); flushErr != nil && err == nil {
+			err = &resourceWriteError{err: flushErr}
+		}
+	}
+	exitOnDownloadError(stats, err)
+
+	for _, output := range outputs {
+		if err := output.commit(); err != nil {
+			exitOnDownloadError(stats, &resourceWriteError{err: err})
+		}
+	}
+	if err := includes.close(); err != nil {
+		exitOnDownloadError(stats, &resourceWriteError{err: err})
+	}
+	verifyDownloadOrDie(&stats)
+
+	written := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		written = append(written, output.String())
+	}
+	fmt.Fprintf(os.Stderr, "Downloaded %d partitions into %s\n", len(queries), strings.Join(written, ", "))
+	fmt.Fprintln(os.Stderr, includes.String())
+	fmt.Fprintln(os.Stderr, stats.String())
+
+	if writesManifest(outputFile) {
+		manifest := newDownloadManifest(filepath.Dir(outputFile))
+		manifest.setRequest(resourceType, fhirSearchQuery)
+		manifest.addStats(&stats)
+		for _, output := range outputs {
+			manifest.addOutput(resourceType, output)
+		}
+		if err := manifest.addIncludes(includes); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not write the manifest: %v\n", err)
+		} else {
+			manifest.writeOrWarn()
+		}
+	}
+
+	if outputStatisticsFileName != "" {
+		writeDownloadStatisticsOrDie(outputStatisticsFileName, []*commandStats{&stats})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+// inRange returns true if t satisfies all _lastUpdated ge/lt parameters of the given query.
+func inRange(t time.Time, query url.Values) bool {
+	for _, value := range query["_lastUpdated"] {
+		bound, _ := time.Parse(lastUpdatedFormat, value[2:])
+		if strings.HasPrefix(value, "ge") && t.Before(bound) {
+			return false
+		}
+		if strings.HasPrefix(value, "lt") && !t.Before(bound) {
+			return false
+		}
+	}
+	return true
+}
+
+// newLastUpdatedServer returns a server holding Observations last updated at the given times. It
+// supports sorting by _lastUpdated, _lastUpdated ranges and batches of _summary=count searches.
+func newLastUpdatedServer(t *testing.T, lastUpdated []time.Time) *httptest.Server {
+	search := func(query url.Values) fm.Bundle {
+		var matches []time.Time
+		for _, lu := range lastUpdated {
+			if inRange(lu, query) {
+				matches = append(matches, lu)
+			}
+		}
+		total := len(matches)
+		bundle := fm.Bundle{Type: fm.BundleTypeSearchset, Total: &total}
+		if query.Get("_summary") == "count" {
+			return bundle
+		}
+		if query.Get("_sort") == "-_lastUpdated" {
+			for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+				matches[i], matches[j] = matches[j], matches[i]
+			}
+		}
+		searchMode := fm.SearchEntryModeMatch
+		for i, lu := range matches {
+			bundle.Entry = append(bundle.Entry, fm.BundleEntry{
+				Resource: []byte(fmt.Sprintf(`{"resourceType": "Observation", "id": "%d", "meta": {"lastUpdated": "%s"}}`,
+					i, lu.Format(time.RFC3339Nano))),
+				Search: &fm.BundleEntrySearch{Mode: &searchMode},
+			})
+			if query.Get("_count") == "1" {
+				break
+			}
+		}
+		return bundle
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			if err := json.NewEncoder(w).Encode(search(r.URL.Query())); err != nil {
+				t.Error(err)
+			}
+			return
+		}
+
+		batch, err := fhir.ReadBundle(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response := fm.Bundle{Type: fm.BundleTypeBatchResponse}
+		for _, entry := range batch.Entry {
+			_, rawQuery, _ := strings.Cut(entry.Request.Url, "?")
+			query, _ := url.ParseQuery(rawQuery)
+			resource, _ := json.Marshal(search(query))
+			response.Entry = append(response.Entry, fm.BundleEntry{
+				Resource: resource,
+				Response: &fm.BundleEntryResponse{Status: "200"},
+			})
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestPlanPartitions(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	var lastUpdated []time.Time
+	// 8 resources on the first day and 8 resources spread over the following 100 days
+	for i := 0; i < 8; i++ {
+		lastUpdated = append(lastUpdated, start.Add(time.Duration(i)*time.Minute))
+	}
+	for i := 1; i <= 8; i++ {
+		lastUpdated = append(lastUpdated, start.Add(time.Duration(i*12)*24*time.Hour))
+	}
+	server := newLastUpdatedServer(t, lastUpdated)
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	t.Run("CoversAllResourcesDisjointly", func(t *testing.T) {
+		queries, err := planPartitions(client, "Observation", url.Values{"code": {"foo"}}, 4)
+
+		assert.NoError(t, err)
+		assert.Len(t, queries, 4)
+		assert.True(t, strings.HasPrefix(queries[0].Get("_lastUpdated"), "lt"))
+		assert.Len(t, queries[0]["_lastUpdated"], 1)
+		assert.True(t, strings.HasPrefix(queries[3].Get("_lastUpdated"), "ge"))
+		assert.Len(t, queries[3]["_lastUpdated"], 1)
+		for _, lu := range lastUpdated {
+			var matches int
+			for _, query := range queries {
+				if inRange(lu, query) {
+					matches++
+				}
+			}
+			assert.Equal(t, 1, matches, lu.String())
+		}
+		for _, query := range queries {
+			assert.Equal(t, "foo", query.Get("code"))
+		}
+	})
+
+	t.Run("BalancesPartitions", func(t *testing.T) {
+		queries, err := planPartitions(client, "Observation", url.Values{}, 2)
+
+		assert.NoError(t, err)
+		assert.Len(t, queries, 2)
+		totals, err := fetchSearchTotals(client, "Observation", queries)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{8, 8}, totals)
+	})
+
+	t.Run("NoResources", func(t *testing.T) {
+		emptyServer := newLastUpdatedServer(t, nil)
+		defer emptyServer.Close()
+		baseURL, _ := url.ParseRequestURI(emptyServer.URL)
+
+		queries, err := planPartitions(fhir.NewClient(*baseURL, fhir.ClientAuth{}), "Observation", url.Values{}, 4)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []url.Values{{}}, queries)
+	})
+}
+
+func TestSliceBoundaries(t *testing.T) {
+	first := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("EquallyLong", func(t *testing.T) {
+		boundaries := sliceBoundaries(first, first.Add(4*time.Second-time.Millisecond), 4)
+
+		assert.Equal(t, []time.Time{first, first.Add(time.Second), first.Add(2 * time.Second),
+			first.Add(3 * time.Second), first.Add(4 * time.Second)}, boundaries)
+	})
+
+	t.Run("ShorterThanSlices", func(t *testing.T) {
+		boundaries := sliceBoundaries(first, first.Add(time.Millisecond), 8)
+
+		assert.Equal(t, []time.Time{first, first.Add(time.Millisecond), first.Add(2 * time.Millisecond)}, boundaries)
+	})
+}
+
+func TestGroupSlices(t *testing.T) {
+	boundaries := []time.Time{
+		time.Unix(0, 0), time.Unix(1, 0), time.Unix(2, 0), time.Unix(3, 0), time.Unix(4, 0),
+	}
+
+	t.Run("Balanced", func(t *testing.T) {
+		assert.Equal(t, []time.Time{time.Unix(2, 0)}, groupSlices(boundaries, []int{1, 1, 1, 1}, 2))
+	})
+
+	t.Run("Skewed", func(t *testing.T) {
+		assert.Equal(t, []time.Time{time.Unix(1, 0), time.Unix(3, 0)}, groupSlices(boundaries, []int{6, 0, 3, 3}, 3))
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Empty(t, groupSlices(boundaries, []int{0, 0, 0, 0}, 2))
+	})
+}
+
+func TestRangeQuery(t *testing.T) {
+	lower := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	upper := time.Date(2022, 2, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+	query := url.Values{"code": {"foo"}}
+
+	result := rangeQuery(query, &lower, &upper)
+
+	assert.Equal(t, []string{"ge2022-01-01T00:00:00.000Z", "lt2022-01-31T23:00:00.000Z"}, result["_lastUpdated"])
+	assert.Equal(t, url.Values{"code": {"foo"}}, query)
+}
+
+func TestDownloadPartitions(t *testing.T) {
+	server := newSearchServer(t, map[string]int{"Patient": 2})
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	queries := []url.Values{{"_lastUpdated": {"lt2022"}}, {"_lastUpdated": {"ge2022"}}}
+
+	t.Run("SingleSink", func(t *testing.T) {
+		var sink bytes.Buffer
+		writer := bufio.NewWriter(&sink)
+
+		stats, err := downloadPartitions(client, "Patient", queries, false, []*bufio.Writer{writer}, nil, nil, 2)
+
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Flush())
+		assert.Equal(t, 2, stats.totalPages)
+		assert.Equal(t, []int{2, 2}, stats.resourcesPerPage)
+		assert.Len(t, stats.requestDurations, 2)
+		assert.Len(t, stats.bundles, 2)
+		assert.Equal(t, 4, bytes.Count(sink.Bytes(), []byte{'\n'}))
+	})
+
+	t.Run("Shards", func(t *testing.T) {
+		var shard1, shard2 bytes.Buffer
+		writer1, writer2 := bufio.NewWriter(&shard1), bufio.NewWriter(&shard2)
+
+		_, err := downloadPartitions(client, "Patient", queries, false, []*bufio.Writer{writer1, writer2}, nil, nil, 2)
+
+		assert.NoError(t, err)
+		assert.NoError(t, writer1.Flush())
+		assert.NoError(t, writer2.Flush())
+		assert.Equal(t, 2, bytes.Count(shard1.Bytes(), []byte{'\n'}))
+		assert.Equal(t, 2, bytes.Count(shard2.Bytes(), []byte{'\n'}))
+	})
+
+	t.Run("PartitionFails", func(t *testing.T) {
+		stats, err := downloadPartitions(client, "Condition", queries, false, []*bufio.Writer{bufio.NewWriter(io.Discard)}, nil, nil, 2)
+
+		assert.Error(t, err)
+		assert.NotNil(t, stats.error)
+	})
+}
+
+func TestShardFilename(t *testing.T) {
+	assert.Equal(t, "patients-0001.ndjson", shardFilename("patients.ndjson", 0))
+	assert.Equal(t, "dir/patients-0012", shardFilename("dir/patients", 11))
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var queriesFile string
+
+// downloadQuery is a search of a query file.
+type downloadQuery struct {
+	resourceType string
+	query        string
+	// name of the output file relative to the output directory, empty if none is given
+	filename string
+}
+
+// readDownloadQueries reads a query file. Every line is a search like Patient?gender=female,
+// optionally followed by the name of its output file. Empty lines and lines starting with # are
+// ignored.
+func readDownloadQueries(r io.Reader) ([]downloadQuery, error) {
+	var queries []downloadQuery
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expect a search like Patient?gender=female optionally followed by an output file name", line)
+		}
+		search, query, _ := strings.Cut(fields[0], "?")
+		resourceType, err := parseResourceType(search)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, err := url.ParseQuery(query); err != nil {
+			return nil, fmt.Errorf("line %d: could not parse the FHIR search query: %v", line, err)
+		}
+
+		q := downloadQuery{resourceType: resourceType.Code(), query: query}
+		if len(fields) == 2 {
+			q.filename = fields[1]
+		}
+		queries = append(queries, q)
+	}
+	return queries, scanner.Err()
+}
+
+// readDownloadQueriesFile reads the query file with the given name.
+func readDownloadQueriesFile(filename string) ([]downloadQuery, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	queries, err := readDownloadQueries(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the query file %s: %v", filename, err)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("the query file %s contains no queries", filename)
+	}
+	return queries, nil
+}
+
+// queryOutputFilenames returns the names of the output files of the given queries in the given
+// directory. Queries without an output file name are written to Type-N.ndjson, where N is the
+// number of the query.
+func queryOutputFilenames(queries []downloadQuery, dir string) ([]string, error) {
+	filenames := make([]string, 0, len(queries))
+	seen := make(map[string]bool)
+	for i, q := range queries {
+		filename := q.filename
+		if filename == "" {
+			filename = fmt.Sprintf("%s-%d.ndjson", q.resourceType, i+1)
+		}
+		filename = filepath.Join(dir, filename)
+		if seen[filename] {
+			return nil, fmt.Errorf("the output file %s is used by several queries", filename)
+		}
+		seen[filename] = true
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
+// sharedSink writes the resources of several concurrent downloads into one output. Resources are
+// written with a single Write each, so that the lines of the downloads don't interleave without
+// holding whole pages in memory.
+type sharedSink struct {
+	mutex sync.Mutex
+	sink  *bufio.Writer
+}
+
+func (s *sharedSink) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sink.Write(p)
+}
+
+// downloadQueries downloads the resources of all queries of the query file given by --queries.
+// Every query is written into its own file in the output directory, or all queries are written
+// into the output file. At most --concurrency queries are downloaded at the same time.
+func downloadQueries(transform resourceTransform) error {
+	if (outputFile == "") == (outputDir == "") {
+		return errors.New("--queries requires either -o/--output-file to write all queries into one file or -d/--output-dir to write every query into its own file")
+	}
+	options, err := downloadOutputOptions()
+	if err != nil {
+		return err
+	}
+	queries, err := readDownloadQueriesFile(queriesFile)
+	if err != nil {
+		return err
+	}
+	for _, q := range queries {
+		if values, _ := url.ParseQuery(q.query); values.Has("_count") && pageSize > 0 {
+			return fmt.Errorf("--page-size can't be combined with _count in the query %s?%s", q.resourceType, q.query)
+		}
+		if outputFile != "" && q.filename != "" {
+			return errors.New("output file names in the query file can't be combined with -o/--output-file")
+		}
+		if outputFile == stdoutFilename && hasIncludes(q.query) {
+			return errors.New("_include and _revinclude can't be used when writing to stdout")
+		}
+	}
+
+	downloads := make([]*resourceTypeDownload, 0, len(queries))
+	for _, q := range queries {
+		downloads = append(downloads, &resourceTypeDownload{resourceType: q.resourceType, query: q.query})
+	}
+
+	if outputDir != "" {
+		filenames, err := queryOutputFilenames(queries, outputDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return fmt.Errorf("could not create the output directory %s: %v", outputDir, err)
+		}
+		checkOutputWriterFilesOrDie(filenames, options)
+		for i, download := range downloads {
+			download.output = createOutputWriterOrDie(filenames[i], options)
+			download.includes = newIncludeRouter(filenames[i])
+		}
+		return downloadQueriesInto(downloads, transform)
+	}
+
+	output := createOutputWriterOrDie(outputFile, options)
+	sink := &sharedSink{sink: bufio.NewWriter(output)}
+	var includes *includeRouter
+	if outputFile != stdoutFilename {
+		includes = newIncludeRouter(outputFile)
+	}
+	for _, download := range downloads {
+		download.output = output
+		download.sink = sink
+		download.includes = includes
+	}
+	return downloadQueriesIntoOne(downloads, output, sink, includes, transform)
+}
+
+// downloadQueriesInto downloads the given queries into their own output files.
+func downloadQueriesInto(downloads []*resourceTypeDownload, transform resourceTransform) error {
+	startTime := time.Now()
+	downloadResourceTypes(client, downloads, "", usePost, transform, downloadConcurrency, os.Stderr)
+	totalDuration := time.Since(startTime)
+
+	for _, download := range downloads {
+		// failed downloads aren't committed, so that --force doesn't replace existing files
+		if download.err != nil {
+			download.includes.flush()
+		} else if err := download.output.commit(); err != nil {
+			download.err = fmt.Errorf("could not write the output file %s: %v", download.output, err)
+		} else if err := download.includes.close(); err != nil {
+			download.err = fmt.Errorf("could not write the included resources: %v", err)
+		} else {
+			verifyResourceTypeDownload(download)
+		}
+	}
+
+	return reportResourceTypeDownloads(downloads, "queries", totalDuration)
+}
+
+// downloadQueriesIntoOne downloads the given queries into the given shared output. The output is
+// only committed if all queries were downloaded successfully. No manifest is written, because the
+// output can contain resources of several types.
+func downloadQueriesIntoOne(downloads []*resourceTypeDownload, output *outputWriter, sink *sharedSink,
+	includes *includeRouter, transform resourceTransform) error {
+	startTime := time.Now()
+	downloadResourceTypes(client, downloads, "", usePost, transform, downloadConcurrency, os.Stderr)
+	totalDuration := time.Since(startTime)
+
+	failed := false
+	for _, download := range downloads {
+		if download.err != nil {
+			failed = true
+		} else {
+			verifyResourceTypeDownload(download)
+		}
+	}
+
+	var err error
+	if err = sink.sink.Flush(); err == nil && !failed {
+		if err = output.commit(); err == nil && includes != nil {
+			err = includes.close()
+		}
+	} else if includes != nil {
+		includes.flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the output file %s: %v\n", output, err)
+		removeTempOutputFiles()
+		os.Exit(1)
+	}
+
+	return reportResourceTypeDownloads(downloads, "queries", totalDuration)
+}
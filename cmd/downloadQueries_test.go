@@ -0,0 +1,167 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDownloadQueries(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		queries, err := readDownloadQueries(strings.NewReader(`# cohort
+Patient?gender=female  patients.ndjson
+
+Observation?code=http://loinc.org|8310-5&_count=1000
+Condition
+`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, []downloadQuery{
+			{resourceType: "Patient", query: "gender=female", filename: "patients.ndjson"},
+			{resourceType: "Observation", query: "code=http://loinc.org|8310-5&_count=1000"},
+			{resourceType: "Condition"},
+		}, queries)
+	})
+
+	t.Run("UnknownResourceType", func(t *testing.T) {
+		_, err := readDownloadQueries(strings.NewReader("Patient\nFoo?bar=baz\n"))
+		assert.EqualError(t, err, "line 2: unknown resource type `Foo`")
+	})
+
+	t.Run("InvalidQuery", func(t *testing.T) {
+		_, err := readDownloadQueries(strings.NewReader("Patient?name=%zz\n"))
+		assert.ErrorContains(t, err, "line 1: could not parse the FHIR search query")
+	})
+
+	t.Run("TooManyFields", func(t *testing.T) {
+		_, err := readDownloadQueries(strings.NewReader("Patient?name=John Doe patients.ndjson\n"))
+		assert.ErrorContains(t, err, "line 1: expect a search like Patient?gender=female")
+	})
+}
+
+func TestQueryOutputFilenames(t *testing.T) {
+	queries := []downloadQuery{
+		{resourceType: "Patient", filename: "patients.ndjson"},
+		{resourceType: "Observation"},
+	}
+
+	filenames, err := queryOutputFilenames(queries, "out")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("out", "patients.ndjson"), filepath.Join("out", "Observation-2.ndjson")}, filenames)
+
+	_, err = queryOutputFilenames(append(queries, downloadQuery{resourceType: "Patient", filename: "patients.ndjson"}), "out")
+	assert.EqualError(t, err, "the output file "+filepath.Join("out", "patients.ndjson")+" is used by several queries")
+}
+
+func TestSharedSink(t *testing.T) {
+	var buffer bytes.Buffer
+	sink := &sharedSink{sink: bufio.NewWriter(&buffer)}
+
+	var wg sync.WaitGroup
+	for _, line := range []string{"foo\n", "bar\n"} {
+		line := line
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, _ = sink.Write([]byte(line))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, sink.sink.Flush())
+
+	lines := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+	assert.Len(t, lines, 2000)
+	for _, line := range lines {
+		assert.Contains(t, []string{"foo", "bar"}, line)
+	}
+}
+
+func TestDownloadQueries(t *testing.T) {
+	server := newSearchServer(t, map[string]int{"Patient": 2, "Observation": 3})
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	previousClient, previousConcurrency := client, downloadConcurrency
+	client = fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	downloadConcurrency = 2
+	defer func() {
+		client, downloadConcurrency = previousClient, previousConcurrency
+		queriesFile = ""
+		outputDir = ""
+		outputFile = ""
+	}()
+
+	dir := t.TempDir()
+	queriesFile = filepath.Join(dir, "queries.txt")
+	if err := os.WriteFile(queriesFile, []byte("Patient?gender=female patients.ndjson\nObservation?code=foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("OwnOutputs", func(t *testing.T) {
+		outputDir = filepath.Join(dir, "own")
+		defer func() { outputDir = "" }()
+
+		assert.NoError(t, downloadQueries(nil))
+
+		assert.Len(t, readLines(t, filepath.Join(outputDir, "patients.ndjson")), 2)
+		assert.Len(t, readLines(t, filepath.Join(outputDir, "Observation-2.ndjson")), 3)
+		manifest, err := readImportManifest(filepath.Join(outputDir, manifestBasename))
+		if assert.NoError(t, err) {
+			assert.Len(t, manifest.Output, 2)
+		}
+	})
+
+	t.Run("CombinedOutput", func(t *testing.T) {
+		outputFile = filepath.Join(dir, "cohort.ndjson")
+		defer func() { outputFile = "" }()
+
+		assert.ErrorContains(t, downloadQueries(nil), "output file names in the query file can't be combined")
+
+		queriesFile = filepath.Join(dir, "combined.txt")
+		if err := os.WriteFile(queriesFile, []byte("Patient?gender=female\nObservation?code=foo\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, downloadQueries(nil))
+
+		lines := readLines(t, outputFile)
+		sort.Strings(lines)
+		assert.Equal(t, []string{
+			`{"resourceType":"Observation","id":"0"}`,
+			`{"resourceType":"Observation","id":"1"}`,
+			`{"resourceType":"Observation","id":"2"}`,
+			`{"resourceType":"Patient","id":"0"}`,
+			`{"resourceType":"Patient","id":"1"}`,
+		}, lines)
+		assert.NoFileExists(t, filepath.Join(dir, manifestBasename))
+	})
+
+	t.Run("OutputRequired", func(t *testing.T) {
+		assert.ErrorContains(t, downloadQueries(nil), "--queries requires either -o/--output-file")
+	})
+}
@@ -0,0 +1,458 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/samply/blazectl/util"
+)
+
+// stateFileSuffix is appended to the name of the output file to get the name of the state file.
+const stateFileSuffix = ".state"
+
+var resumeDownload bool
+var sortForResume bool
+
+// downloadState is the state of the download of a single resource type. It is saved after every
+// page, so that an interrupted download can be resumed.
+type downloadState struct {
+	ResourceType string `json:"resourceType"`
+	Query        string `json:"query"`
+	// number of completely written pages
+	Pages int `json:"pages"`
+	// URL of the next page, empty before the first and after the last page
+	NextLink string `json:"nextLink,omitempty"`
+	// number of bytes of the output file up to the end of the last completely written page
+	Offset    int64 `json:"offset"`
+	Resources int   `json:"resources"`
+	// whether the search is sorted by _lastUpdated, so that it can be resumed without the next link
+	Sorted bool `json:"sorted,omitempty"`
+	// meta.lastUpdated of the last written resource, only tracked if the search is sorted
+	LastUpdated string `json:"lastUpdated,omitempty"`
+	// ids of the written resources whose meta.lastUpdated equals LastUpdated
+	LastUpdatedIds []string `json:"lastUpdatedIds,omitempty"`
+	// time of the server at which the first page was generated
+	ServerTime string `json:"serverTime,omitempty"`
+}
+
+func (s *downloadState) complete() bool {
+	return s.Pages > 0 && s.NextLink == ""
+}
+
+func readDownloadState(filename string) (*downloadState, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("could not parse the state file %s: %v", filename, err)
+	}
+	return &state, nil
+}
+
+// save writes the state into a temporary file which is renamed to the given filename afterwards,
+// so that the state file is never left half written.
+func (s *downloadState) save(filename string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// openOutputFileForResume opens the output file of a download to resume and truncates it to the
+// given offset, removing a partially written page including a partial trailing line.
+func openOutputFileForResume(filename string, offset int64) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() < offset {
+		file.Close()
+		return nil, fmt.Errorf("the output file %s has only %d bytes but the state file records %d bytes",
+			filename, info.Size(), offset)
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// sortsByLastUpdated returns true if the given query is sorted by _lastUpdated.
+func sortsByLastUpdated(query string) bool {
+	values, err := url.ParseQuery(query)
+	return err == nil && values.Get("_sort") == "_lastUpdated"
+}
+
+// searchQuery returns the query to search with. Sorted downloads are sorted by _lastUpdated, so
+// that they can be resumed even if the next link has expired.
+func (s *downloadState) searchQuery() (string, error) {
+	if !s.Sorted {
+		return s.Query, nil
+	}
+	query, err := url.ParseQuery(s.Query)
+	if err != nil {
+		return "", err
+	}
+	query.Set("_sort", "_lastUpdated")
+	return query.Encode(), nil
+}
+
+// fallbackQuery returns the query used to download the remaining resources if the saved next link
+// has expired. Resources updated before the last written resource are excluded.
+func fallbackQuery(state *downloadState) (string, error) {
+	query, err := state.searchQuery()
+	if err != nil || state.LastUpdated == "" {
+		return query, err
+	}
+	values, _ := url.ParseQuery(query)
+	values.Add("_lastUpdated", "ge"+state.LastUpdated)
+	return values.Encode(), nil
+}
+
+// isExpiredLink returns true if the given error response means that a next link has expired.
+func isExpiredLink(errResponse *util.ErrorResponse) bool {
+	return errResponse != nil &&
+		(errResponse.StatusCode == http.StatusNotFound || errResponse.StatusCode == http.StatusGone)
+}
+
+// resumableDownload downloads the resources of a single type into the output file and saves its
+// state after every page.
+type resumableDownload struct {
+	client  *fhir.Client
+	usePost bool
+	state   *downloadState
+	// state isn't saved if empty
+	stateFile string
+	counter   *countingWriter
+	sink      *bufio.Writer
+	includes  *includeRouter
+	transform resourceTransform
+	// meta.lastUpdated of the last resource and the ids of all resources with the same
+	// meta.lastUpdated up to the current resource
+	lastUpdated    string
+	lastUpdatedIds []string
+	// the saved next link expired and the search isn't sorted, so the download can't be resumed
+	expired bool
+	// first error saving the state
+	err error
+}
+
+func newResumableDownload(client *fhir.Client, usePost bool, state *downloadState, outputFile string,
+	file io.Writer, includes *includeRouter, transform resourceTransform) *resumableDownload {
+	counter := &countingWriter{w: file, n: state.Offset}
+	return &resumableDownload{
+		client:         client,
+		usePost:        usePost,
+		state:          state,
+		stateFile:      outputFile + stateFileSuffix,
+		counter:        counter,
+		sink:           bufio.NewWriter(counter),
+		includes:       includes,
+		transform:      transform,
+		lastUpdated:    state.LastUpdated,
+		lastUpdatedIds: state.LastUpdatedIds,
+	}
+}
+
+// trackingTransform returns the transform of the download, extended by keeping track of
+// meta.lastUpdated if the search is sorted and its state is saved. If skipWritten is true,
+// resources with the meta.lastUpdated of the last written resource which were already written are
+// skipped.
+func (d *resumableDownload) trackingTransform(skipWritten bool) resourceTransform {
+	if !d.state.Sorted || d.stateFile == "" {
+		return d.transform
+	}
+
+	written := make(map[string]bool)
+	if skipWritten {
+		for _, id := range d.state.LastUpdatedIds {
+			written[id] = true
+		}
+	}
+	boundary := d.state.LastUpdated
+
+	return func(resource json.RawMessage) (json.RawMessage, error) {
+		head := struct {
+			Id   string `json:"id"`
+			Meta struct {
+				LastUpdated string `json:"lastUpdated"`
+			} `json:"meta"`
+		}{}
+		if err := json.Unmarshal(resource, &head); err != nil {
+			return nil, err
+		}
+		if head.Meta.LastUpdated == boundary && written[head.Id] {
+			return nil, nil
+		}
+
+		if head.Meta.LastUpdated != d.lastUpdated {
+			d.lastUpdated = head.Meta.LastUpdated
+			d.lastUpdatedIds = nil
+		}
+		d.lastUpdatedIds = append(d.lastUpdatedIds, head.Id)
+
+		if d.transform != nil {
+			return d.transform(resource)
+		}
+		return resource, nil
+	}
+}
+
+func (d *resumableDownload) pageDone(page *downloadBundle, resources int) {
+	if err := d.sink.Flush(); err != nil {
+		if d.err == nil {
+			d.err = &resourceWriteError{requestURL: page.associatedRequestURL, err: err}
+		}
+		return
+	}
+
+	d.state.Pages++
+	d.state.Offset = d.counter.n
+	d.state.Resources += resources
+	d.state.NextLink = ""
+	if page.nextPageURL != nil {
+		d.state.NextLink = page.nextPageURL.String()
+	}
+	if d.lastUpdated != "" {
+		d.state.LastUpdated = d.lastUpdated
+		d.state.LastUpdatedIds = append([]string{}, d.lastUpdatedIds...)
+	}
+	if d.state.ServerTime == "" && !page.serverTime.IsZero() {
+		d.state.ServerTime = page.serverTime.Format(time.RFC3339Nano)
+	}
+	if d.stateFile == "" {
+		return
+	}
+	if err := d.state.save(d.stateFile); err != nil && d.err == nil {
+		d.err = fmt.Errorf("could not save the state of the download: %v", err)
+	}
+}
+
+// run downloads the remaining resources starting at the saved next link. If the server responds
+// to the saved next link with 404 or 410, the link is considered expired. Searches sorted by
+// _lastUpdated are then continued by searching again for the resources updated since the last
+// written resource. Other errors, like a temporarily unavailable server, fail the download, so that
+// it can be resumed again later.
+func (d *resumableDownload) run() (commandStats, error) {
+	var startPageURL *url.URL
+	if d.state.NextLink != "" {
+		var err error
+		if startPageURL, err = url.Parse(d.state.NextLink); err != nil {
+			return commandStats{}, fmt.Errorf("could not parse the next link of the state file: %v", err)
+		}
+	}
+
+	query, err := d.state.searchQuery()
+	if err != nil {
+		return commandStats{}, err
+	}
+	stats, err := downloadResourceTypeFrom(d.client, d.state.ResourceType, query, d.usePost,
+		startPageURL, d.sink, d.includes, d.trackingTransform(false), d.pageDone)
+
+	if err != nil && startPageURL != nil && stats.totalPages == 1 && isExpiredLink(stats.error) {
+		if !d.state.Sorted {
+			d.expired = true
+			return stats, fmt.Errorf("the saved next link has expired and the download can't be continued without it, because it isn't sorted by _lastUpdated, which --resumable does: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "The saved next link has expired, searching again for the resources updated since %s.\n",
+			d.state.LastUpdated)
+		if query, err = fallbackQuery(d.state); err != nil {
+			return commandStats{}, err
+		}
+		stats, err = downloadResourceTypeFrom(d.client, d.state.ResourceType, query, d.usePost, nil, d.sink,
+			d.includes, d.trackingTransform(true), d.pageDone)
+	}
+
+	if err == nil {
+		err = d.err
+	}
+	return stats, err
+}
+
+// writeResumableManifest writes the manifest of a completed download. The checksum of a resumed
+// output file is calculated by reading it, because the output writer only saw the resumed part.
+func writeResumableManifest(state *downloadState, outputFile string, output *outputWriter,
+	includes *includeRouter) error {
+	manifest := newDownloadManifest(filepath.Dir(outputFile))
+	manifest.setRequest(state.ResourceType, state.Query)
+	if t, err := time.Parse(time.RFC3339Nano, state.ServerTime); err == nil {
+		manifest.setTransactionTime(t)
+	}
+	if resumeDownload {
+		checksum, err := fileChecksum(outputFile)
+		if err != nil {
+			return err
+		}
+		manifest.addFile(state.ResourceType, outputFile, state.Resources, checksum)
+	} else {
+		manifest.addOutput(state.ResourceType, output)
+	}
+	if err := manifest.addIncludes(includes); err != nil {
+		return err
+	}
+	manifest.writeOrWarn()
+	return nil
+}
+
+// downloadResumableOrDie downloads the resources of the given type and query into the output file.
+// With --resume, a previously interrupted download is continued. With --resumable, the search is
+// sorted by _lastUpdated, so that it can be continued after its next link expired. Included
+// resources are written next to the output file, which isn't supported when resuming.
+//
+// Returns the final state of the download.
+func downloadResumableOrDie(resourceType string, fhirSearchQuery string, outputFile string,
+	transform resourceTransform) (*downloadState, error) {
+	stateFile := outputFile + stateFileSuffix
+
+	options, err := downloadOutputOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	var output *outputWriter
+	var state *downloadState
+	// the state can't be used to resume downloads to stdout, into temporary files or into
+	// compressed or sharded files
+	saveState := outputFile != stdoutFilename && !forceOutput && options.compression == "" && !options.sharded()
+	if resumeDownload {
+		if hasIncludes(fhirSearchQuery) {
+			return nil, errors.New("--resume can't be used with _include or _revinclude")
+		}
+		if !saveState {
+			return nil, errors.New("--resume can't be used with --compress, --max-lines-per-file or --max-bytes-per-file")
+		}
+		if state, err = readDownloadState(stateFile); err != nil {
+			return nil, fmt.Errorf("could not read the state of the download to resume: %v", err)
+		}
+		if state.ResourceType != resourceType || state.Query != fhirSearchQuery {
+			return nil, fmt.Errorf("the download to resume is of resource type %s with query `%s`", state.ResourceType,
+				state.Query)
+		}
+		if state.complete() {
+			fmt.Fprintf(os.Stderr, "The download of %d resources is already complete.\n", state.Resources)
+			return state, os.Remove(stateFile)
+		}
+		file, err := openOutputFileForResume(outputFile, state.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("could not open the output file to resume the download: %v", err)
+		}
+		output = wrapOutputFile(file)
+		fmt.Fprintf(os.Stderr, "Resuming the download after %d resources in %d pages.\n", state.Resources, state.Pages)
+	} else {
+		if sortForResume {
+			if !saveState {
+				return nil, errors.New("--resumable can't be used with --compress, --max-lines-per-file, --max-bytes-per-file or --force")
+			}
+			if values, _ := url.ParseQuery(fhirSearchQuery); values.Has("_sort") && !sortsByLastUpdated(fhirSearchQuery) {
+				return nil, errors.New("--resumable can't be used with a query sorted by another search parameter than _lastUpdated")
+			}
+		}
+		output = createOutputWriterOrDie(outputFile, options)
+		state = &downloadState{ResourceType: resourceType, Query: fhirSearchQuery,
+			Sorted: saveState && (sortForResume || sortsByLastUpdated(fhirSearchQuery))}
+		if appendOutput {
+			info, err := output.file.Stat()
+			if err != nil {
+				return nil, err
+			}
+			state.Offset = info.Size()
+		}
+	}
+
+	includes := newIncludeRouter(outputFile)
+	download := newResumableDownload(client, usePost, state, outputFile, output, includes, transform)
+	if !saveState {
+		download.stateFile = ""
+	}
+	stats, err := download.run()
+	if flushErr := includes.flush(); flushErr != nil && err == nil {
+		err = &resourceWriteError{err: flushErr}
+	}
+	if err != nil && state.Pages > 0 && saveState && !download.expired {
+		fmt.Fprintf(os.Stderr, "The download can be resumed with --resume.\n")
+	}
+	exitOnDownloadError(stats, err)
+
+	if err := download.sink.Flush(); err != nil {
+		return nil, err
+	}
+	if err := output.commit(); err != nil {
+		return nil, err
+	}
+	if err := includes.close(); err != nil {
+		return nil, err
+	}
+	if saveState {
+		if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	verifyDownloadOrDie(&stats)
+
+	if options.compression != "" || options.sharded() {
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", output)
+	}
+	if writesManifest(outputFile) {
+		if err := writeResumableManifest(state, outputFile, output, includes); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprint(os.Stderr, includes.String())
+	fmt.Fprintln(os.Stderr, stats.String())
+
+	if outputStatisticsFileName != "" {
+		writeDownloadStatisticsOrDie(outputStatisticsFileName, []*commandStats{&stats})
+	}
+	return state, nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+// patientLastUpdated returns meta.lastUpdated of the i-th Patient of the paging server. The
+// Patients 1 and 2 share the same meta.lastUpdated.
+func patientLastUpdated(i int) string {
+	day := i + 1
+	if i >= 2 {
+		day = i
+	}
+	return fmt.Sprintf("2022-01-%02dT00:00:00Z", day)
+}
+
+// newPagingServer returns a server responding to searches with the given number of pages of two
+// Patients each, sorted by meta.lastUpdated. The search parameter _lastUpdated=ge is supported.
+// Next links with expired=true respond with a 410 status and next links with unavailable=true
+// with a 503 status.
+func newPagingServer(t *testing.T, pages int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("expired") == "true" || query.Get("unavailable") == "true" {
+			if query.Get("expired") == "true" {
+				w.WriteHeader(http.StatusGone)
+			} else {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_, _ = w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "not-found"}]}`))
+			return
+		}
+
+		searchMode := fm.SearchEntryModeMatch
+		var entries []fm.BundleEntry
+		for i := 0; i < 2*pages; i++ {
+			if patientLastUpdated(i) < strings.TrimPrefix(query.Get("_lastUpdated"), "ge") {
+				continue
+			}
+			entries = append(entries, fm.BundleEntry{
+				Resource: []byte(fmt.Sprintf(`{"resourceType": "Patient", "id": "%d", "meta": {"lastUpdated": "%s"}}`, i, patientLastUpdated(i))),
+				Search:   &fm.BundleEntrySearch{Mode: &searchMode},
+			})
+		}
+
+		page, _ := strconv.Atoi(query.Get("page"))
+		response := fm.Bundle{Type: fm.BundleTypeSearchset}
+		for i := 2 * page; i < 2*page+2 && i < len(entries); i++ {
+			response.Entry = append(response.Entry, entries[i])
+		}
+		if 2*page+2 < len(entries) {
+			query.Set("page", strconv.Itoa(page+1))
+			response.Link = append(response.Link, fm.BundleLink{
+				Relation: "next",
+				Url:      server.URL + "/Patient?" + query.Encode(),
+			})
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Error(err)
+		}
+	}))
+	return server
+}
+
+func readLines(t *testing.T, filename string) []string {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func TestResumableDownload(t *testing.T) {
+	server := newPagingServer(t, 3)
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	firstPage := `{"resourceType":"Patient","id":"0","meta":{"lastUpdated":"2022-01-01T00:00:00Z"}}` + "\n" +
+		`{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2022-01-02T00:00:00Z"}}` + "\n"
+
+	t.Run("SavesStateAfterEveryPage", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		file, _ := os.Create(filename)
+		defer file.Close()
+		state := &downloadState{ResourceType: "Patient", Sorted: true}
+
+		stats, err := newResumableDownload(client, false, state, filename, file, nil, nil).run()
+
+		assert.NoError(t, err)
+		assert.Equal(t, 3, stats.totalPages)
+		assert.Len(t, readLines(t, filename), 6)
+		saved, err := readDownloadState(filename + stateFileSuffix)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, saved.Pages)
+		assert.Equal(t, 6, saved.Resources)
+		assert.Equal(t, "2022-01-05T00:00:00Z", saved.LastUpdated)
+		assert.Equal(t, []string{"5"}, saved.LastUpdatedIds)
+		info, _ := os.Stat(filename)
+		assert.Equal(t, info.Size(), saved.Offset)
+		assert.True(t, saved.complete())
+		// the test server sends a Date header
+		assert.NotEmpty(t, saved.ServerTime)
+	})
+
+	t.Run("ResumesAtNextLink", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte(firstPage+`{"resourceType":"Patient","id":"2","me`), 0644)
+		state := &downloadState{ResourceType: "Patient", Pages: 1, Offset: int64(len(firstPage)), Resources: 2,
+			NextLink: server.URL + "/Patient?page=1"}
+
+		file, err := openOutputFileForResume(filename, state.Offset)
+		assert.NoError(t, err)
+		defer file.Close()
+		stats, err := newResumableDownload(client, false, state, filename, file, nil, nil).run()
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, stats.totalPages)
+		lines := readLines(t, filename)
+		assert.Len(t, lines, 6)
+		assert.Contains(t, lines[2], `"id":"2"`)
+		assert.Equal(t, 6, state.Resources)
+	})
+
+	t.Run("SearchesSinceLastUpdatedIfNextLinkExpired", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte(firstPage), 0644)
+		state := &downloadState{ResourceType: "Patient", Pages: 1, Offset: int64(len(firstPage)), Resources: 2,
+			NextLink: server.URL + "/Patient?page=1&expired=true", Sorted: true,
+			LastUpdated: "2022-01-02T00:00:00Z", LastUpdatedIds: []string{"1"}}
+
+		file, err := openOutputFileForResume(filename, state.Offset)
+		assert.NoError(t, err)
+		defer file.Close()
+		_, err = newResumableDownload(client, false, state, filename, file, nil, nil).run()
+
+		assert.NoError(t, err)
+		lines := readLines(t, filename)
+		assert.Len(t, lines, 6)
+		for i, line := range lines {
+			assert.Contains(t, line, fmt.Sprintf(`"id":"%d"`, i))
+		}
+	})
+
+	t.Run("FailsIfUnsortedNextLinkExpired", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte(firstPage), 0644)
+		state := &downloadState{ResourceType: "Patient", Pages: 1, Offset: int64(len(firstPage)), Resources: 2,
+			NextLink: server.URL + "/Patient?page=1&expired=true"}
+
+		file, err := openOutputFileForResume(filename, state.Offset)
+		assert.NoError(t, err)
+		defer file.Close()
+		download := newResumableDownload(client, false, state, filename, file, nil, nil)
+		_, err = download.run()
+
+		assert.ErrorContains(t, err, "isn't sorted by _lastUpdated")
+		assert.True(t, download.expired)
+		assert.Len(t, readLines(t, filename), 2)
+	})
+
+	t.Run("FailsIfServerUnavailable", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte(firstPage), 0644)
+		state := &downloadState{ResourceType: "Patient", Pages: 1, Offset: int64(len(firstPage)), Resources: 2,
+			NextLink: server.URL + "/Patient?page=1&unavailable=true", Sorted: true,
+			LastUpdated: "2022-01-02T00:00:00Z", LastUpdatedIds: []string{"1"}}
+
+		file, err := openOutputFileForResume(filename, state.Offset)
+		assert.NoError(t, err)
+		defer file.Close()
+		download := newResumableDownload(client, false, state, filename, file, nil, nil)
+		_, err = download.run()
+
+		assert.Error(t, err)
+		assert.False(t, download.expired)
+		assert.Len(t, readLines(t, filename), 2)
+	})
+}
+
+func TestDownloadResumableOrDie(t *testing.T) {
+	var sorts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sorts = append(sorts, r.URL.Query().Get("_sort"))
+		_, _ = w.Write([]byte(`{"resourceType": "Bundle", "type": "searchset"}`))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	previousClient := client
+	client = fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	defer func() {
+		client = previousClient
+		sortForResume = false
+	}()
+
+	t.Run("KeepsQuery", func(t *testing.T) {
+		sorts = nil
+
+		state, err := downloadResumableOrDie("Patient", "gender=female", filepath.Join(t.TempDir(), "plain.ndjson"), nil)
+
+		assert.NoError(t, err)
+		assert.False(t, state.Sorted)
+		assert.Equal(t, []string{""}, sorts)
+	})
+
+	t.Run("Resumable", func(t *testing.T) {
+		sorts = nil
+		sortForResume = true
+		defer func() { sortForResume = false }()
+
+		state, err := downloadResumableOrDie("Patient", "gender=female", filepath.Join(t.TempDir(), "sorted.ndjson"), nil)
+
+		assert.NoError(t, err)
+		assert.True(t, state.Sorted)
+		assert.Equal(t, []string{"_lastUpdated"}, sorts)
+	})
+
+	t.Run("ResumableSortedOtherwise", func(t *testing.T) {
+		sortForResume = true
+		defer func() { sortForResume = false }()
+
+		_, err := downloadResumableOrDie("Patient", "_sort=birthdate", filepath.Join(t.TempDir(), "birthdate.ndjson"), nil)
+
+		assert.ErrorContains(t, err, "--resumable can't be used with a query sorted by another search parameter")
+	})
+}
+
+func TestDownloadState(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "patient.ndjson.state")
+	state := downloadState{ResourceType: "Patient", Query: "gender=female", Pages: 2,
+		NextLink: "http://localhost/Patient?page=2", Offset: 42, Resources: 4}
+
+	assert.NoError(t, state.save(filename))
+	saved, err := readDownloadState(filename)
+
+	assert.NoError(t, err)
+	assert.Equal(t, state, *saved)
+	assert.False(t, saved.complete())
+	_, err = os.Stat(filename + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenOutputFileForResume(t *testing.T) {
+	t.Run("TruncatesPartialLine", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte("{\"id\":\"0\"}\n{\"id\""), 0644)
+
+		file, err := openOutputFileForResume(filename, 11)
+		assert.NoError(t, err)
+		_, _ = file.Write([]byte("{\"id\":\"1\"}\n"))
+		file.Close()
+
+		content, _ := os.ReadFile(filename)
+		assert.Equal(t, "{\"id\":\"0\"}\n{\"id\":\"1\"}\n", string(content))
+	})
+
+	t.Run("FileTooShort", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		_ = os.WriteFile(filename, []byte("{}\n"), 0644)
+
+		_, err := openOutputFileForResume(filename, 11)
+		assert.Error(t, err)
+	})
+}
+
+func TestSortsByLastUpdated(t *testing.T) {
+	assert.False(t, sortsByLastUpdated("gender=female"))
+	assert.True(t, sortsByLastUpdated("_sort=_lastUpdated"))
+	assert.False(t, sortsByLastUpdated("_sort=birthdate"))
+}
+
+func TestFallbackQuery(t *testing.T) {
+	t.Run("Sorted", func(t *testing.T) {
+		query, err := fallbackQuery(&downloadState{Query: "gender=female", Sorted: true, LastUpdated: "2022-01-01T00:00:00Z"})
+		assert.NoError(t, err)
+		assert.Equal(t, "_lastUpdated=ge2022-01-01T00%3A00%3A00Z&_sort=_lastUpdated&gender=female", query)
+	})
+
+	t.Run("NothingWrittenYet", func(t *testing.T) {
+		query, err := fallbackQuery(&downloadState{Query: "gender=female", Sorted: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "_sort=_lastUpdated&gender=female", query)
+	})
+}
@@ -0,0 +1,353 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var compressOutput string
+var maxLinesPerFile int
+var maxBytesPerFile string
+
+// compressionExtensions maps the supported compressions to the extension of their files.
+var compressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// outputOptions configure how an outputWriter writes its files.
+type outputOptions struct {
+	// gzip, zstd or empty for no compression
+	compression string
+	// a new shard is started after this number of lines or uncompressed bytes, zero for no limit
+	maxLines int
+	maxBytes int64
+}
+
+// downloadOutputOptions returns the output options given by the flags of the download command.
+func downloadOutputOptions() (outputOptions, error) {
+	options := outputOptions{compression: compressOutput, maxLines: maxLinesPerFile}
+	if _, ok := compressionExtensions[compressOutput]; compressOutput != "" && !ok {
+		return options, fmt.Errorf("unknown compression `%s`, expect gzip or zstd", compressOutput)
+	}
+	if maxLinesPerFile < 0 {
+		return options, fmt.Errorf("invalid --max-lines-per-file %d", maxLinesPerFile)
+	}
+	if maxBytesPerFile != "" {
+		var err error
+		if options.maxBytes, err = parseByteSize(maxBytesPerFile); err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+func (o outputOptions) sharded() bool {
+	return o.maxLines > 0 || o.maxBytes > 0
+}
+
+// filename returns the name of the file with the given zero-based shard index for the output file
+// with the given name. Shards are numbered like patient-0001.ndjson and compressed files get the
+// extension of their compression, like patient.ndjson.gz.
+func (o outputOptions) filename(filename string, shard int) string {
+	if filename == stdoutFilename {
+		return filename
+	}
+	if o.sharded() {
+		filename = shardFilename(filename, shard)
+	}
+	if extension := compressionExtensions[o.compression]; !strings.HasSuffix(filename, extension) {
+		filename += extension
+	}
+	return filename
+}
+
+// existingFiles returns the names of the existing files of the output file with the given name.
+// If the output is sharded, these are all existing shards, like patient-0001.ndjson to
+// patient-0042.ndjson, regardless of their number.
+func (o outputOptions) existingFiles(filename string) ([]string, error) {
+	if filename == stdoutFilename {
+		return nil, nil
+	}
+	first := o.filename(filename, 0)
+	if !o.sharded() {
+		if _, err := os.Stat(first); os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return []string{first}, nil
+	}
+
+	// the shard number 0001 of the first shard is replaced by any number of at least four digits
+	dir, base := filepath.Dir(first), filepath.Base(first)
+	idx := strings.LastIndex(base, "0001")
+	prefix, suffix := base[:idx], base[idx+4:]
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if len(name) < len(prefix)+4+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if number := name[len(prefix) : len(name)-len(suffix)]; strings.Trim(number, "0123456789") == "" {
+			filenames = append(filenames, filepath.Join(dir, name))
+		}
+	}
+	return filenames, nil
+}
+
+// checkOutputWriterFilesOrDie exits like createOutputFileOrDie if a file of one of the output files
+// with the given names does already exist, unless --append or --force is given. It is used before
+// creating several output files, so that no file is created if another one exists. All shards are
+// checked, so that an existing shard is never found in the middle of a download.
+func checkOutputWriterFilesOrDie(filenames []string, options outputOptions) {
+	if appendOutput || forceOutput {
+		return
+	}
+	for _, filename := range filenames {
+		existing, err := options.existingFiles(filename)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not check the output file %s: %v\n", filename, err)
+			os.Exit(4)
+		}
+		if len(existing) > 0 {
+			fmt.Fprintf(os.Stderr, "The output file %s does already exist.\n", existing[0])
+			os.Exit(3)
+		}
+	}
+}
+
+// parseByteSize parses sizes like 1024, 512K, 100M or 2GiB. Units are binary multiples.
+func parseByteSize(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		if i := strings.IndexByte("KMGT", value[n-1]); i >= 0 {
+			multiplier = int64(1) << (10 * (i + 1))
+			value = value[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size `%s`, expect a positive number of bytes like 1024, 512K, 100M or 2G", s)
+	}
+	return size * multiplier, nil
+}
+
+// outputWriter writes NDJSON into the output file, optionally compressing it and rolling it into
+// numbered shards. Shards are only started at line boundaries, so that every shard is a valid
+// NDJSON file. The writer sits behind the buffered sink of a download.
+//
+// With --force, no existing file is replaced before commit, so that a failed download leaves all
+// existing shards untouched. Existing shards beyond the number of written shards are removed on
+// commit.
+type outputWriter struct {
+	filename string
+	options  outputOptions
+	// names of all files written so far
+	filenames []string
+	// number of lines and hex encoded SHA-256 checksums of all committed shards
+	counts    []int
+	checksums []string
+	// closed files of all finished shards, which replace their output files on commit
+	closed []*os.File
+	// file of the current shard, nil before the next shard is started
+	file *os.File
+	// checksum of the bytes written to the file of the current shard
+	hash hash.Hash
+	// writes into the file, compressed if a compression is given
+	sink       io.Writer
+	compressor io.WriteCloser
+	// lines and uncompressed bytes of the current shard
+	lines int
+	bytes int64
+}
+
+// createOutputWriterOrDie creates the output writer of the given output file. The file of the first
+// shard is created like createOutputFileOrDie after checking that no shard does already exist.
+func createOutputWriterOrDie(filename string, options outputOptions) *outputWriter {
+	checkOutputWriterFilesOrDie([]string{filename}, options)
+	w := &outputWriter{filename: filename, options: options}
+	if err := w.open(createOutputFileOrDie(options.filename(filename, 0))); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create the output file %s: %v\n", filename, err)
+		os.Exit(4)
+	}
+	return w
+}
+
+// wrapOutputFile returns an output writer writing into the given file without compression and
+// shards.
+func wrapOutputFile(file *os.File) *outputWriter {
+	w := &outputWriter{filename: file.Name()}
+	w.open(file)
+	return w
+}
+
+func (w *outputWriter) open(file *os.File) error {
+	w.file = file
+	w.filenames = append(w.filenames, outputFilename(file))
+	w.lines = 0
+	w.bytes = 0
+	w.hash = sha256.New()
+	w.sink = io.MultiWriter(file, w.hash)
+	w.compressor = nil
+
+	switch w.options.compression {
+	case "gzip":
+		w.compressor = gzip.NewWriter(w.sink)
+	case "zstd":
+		encoder, err := zstd.NewWriter(w.sink)
+		if err != nil {
+			return err
+		}
+		w.compressor = encoder
+	}
+	if w.compressor != nil {
+		w.sink = w.compressor
+	}
+	return nil
+}
+
+// next starts the next shard.
+func (w *outputWriter) next() error {
+	filename := w.options.filename(w.filename, len(w.filenames))
+	file, err := openOutputFile(filename)
+	if os.IsExist(err) {
+		return fmt.Errorf("the output file %s does already exist", filename)
+	}
+	if err != nil {
+		return err
+	}
+	return w.open(file)
+}
+
+func (w *outputWriter) full() bool {
+	return (w.options.maxLines > 0 && w.lines >= w.options.maxLines) ||
+		(w.options.maxBytes > 0 && w.bytes >= w.options.maxBytes)
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if w.file == nil {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p
+		end := bytes.IndexByte(p, '\n')
+		if end >= 0 {
+			chunk = p[:end+1]
+		}
+		n, err := w.sink.Write(chunk)
+		written += n
+		w.bytes += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+
+		if end >= 0 {
+			w.lines++
+			if w.options.sharded() && w.full() {
+				if err := w.closeShard(); err != nil {
+					return written, err
+				}
+			}
+		}
+	}
+	return written, nil
+}
+
+// closeShard finishes the compression and closes the file of the current shard. The file replaces
+// its output file only on commit.
+func (w *outputWriter) closeShard() error {
+	if w.compressor != nil {
+		if err := w.compressor.Close(); err != nil {
+			return err
+		}
+	}
+	w.counts = append(w.counts, w.lines)
+	w.checksums = append(w.checksums, hex.EncodeToString(w.hash.Sum(nil)))
+	w.closed = append(w.closed, w.file)
+	err := closeOutputFile(w.file)
+	w.file = nil
+	return err
+}
+
+// commit finishes the current shard and replaces the output files by the files of all shards. The
+// writer must not be used afterwards.
+func (w *outputWriter) commit() error {
+	if w.file != nil {
+		if err := w.closeShard(); err != nil {
+			return err
+		}
+	}
+	for _, file := range w.closed {
+		if err := replaceOutputFile(file); err != nil {
+			return err
+		}
+	}
+	if forceOutput && w.options.sharded() {
+		return w.removeStaleShards()
+	}
+	return nil
+}
+
+// removeStaleShards removes the existing shards of a previous download which weren't written by
+// this writer.
+func (w *outputWriter) removeStaleShards() error {
+	existing, err := w.options.existingFiles(w.filename)
+	if err != nil {
+		return err
+	}
+	written := make(map[string]bool, len(w.filenames))
+	for _, filename := range w.filenames {
+		written[filepath.Clean(filename)] = true
+	}
+	for _, filename := range existing {
+		if !written[filepath.Clean(filename)] {
+			if err := os.Remove(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// String returns the names of all written files.
+func (w *outputWriter) String() string {
+	return strings.Join(w.filenames, ", ")
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"1024": 1024,
+		"512K": 512 << 10,
+		"100M": 100 << 20,
+		"2G":   2 << 30,
+		"2GiB": 2 << 30,
+		"1tb":  1 << 40,
+	} {
+		size, err := parseByteSize(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, size, s)
+	}
+
+	for _, s := range []string{"", "G", "-1", "0", "1X"} {
+		_, err := parseByteSize(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestOutputOptionsFilename(t *testing.T) {
+	assert.Equal(t, "patient.ndjson", outputOptions{}.filename("patient.ndjson", 0))
+	assert.Equal(t, "patient.ndjson.gz", outputOptions{compression: "gzip"}.filename("patient.ndjson", 0))
+	assert.Equal(t, "patient.ndjson.gz", outputOptions{compression: "gzip"}.filename("patient.ndjson.gz", 0))
+	assert.Equal(t, "patient-0002.ndjson.zst", outputOptions{compression: "zstd", maxLines: 10}.filename("patient.ndjson", 1))
+	assert.Equal(t, "-", outputOptions{compression: "gzip"}.filename("-", 0))
+}
+
+func TestOutputOptionsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "patient.ndjson")
+	for _, name := range []string{"patient-0001.ndjson.gz", "patient-0002.ndjson.gz", "patient-12345.ndjson.gz",
+		"patient-0003.ndjson", "patient-2022-10-01.ndjson.gz", ".patient-0004.ndjson.gz.123.tmp"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	existing, err := outputOptions{compression: "gzip", maxLines: 1}.existingFiles(filename)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{filepath.Join(dir, "patient-0001.ndjson.gz"), filepath.Join(dir, "patient-0002.ndjson.gz"),
+		filepath.Join(dir, "patient-12345.ndjson.gz")}, existing)
+
+	existing, err = outputOptions{}.existingFiles(filename)
+	assert.NoError(t, err)
+	assert.Empty(t, existing)
+}
+
+func TestOutputWriter(t *testing.T) {
+	t.Run("MaxLines", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		w := createOutputWriterOrDie(filename, outputOptions{maxLines: 2})
+
+		// lines are split over several writes
+		for _, chunk := range []string{"a\nb", "\nc\n", "d\ne\n"} {
+			_, err := w.Write([]byte(chunk))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, w.commit())
+
+		assert.Equal(t, []string{"a", "b"}, readLines(t, shardFilename(filename, 0)))
+		assert.Equal(t, []string{"c", "d"}, readLines(t, shardFilename(filename, 1)))
+		assert.Equal(t, []string{"e"}, readLines(t, shardFilename(filename, 2)))
+		assert.Len(t, w.filenames, 3)
+	})
+
+	t.Run("MaxBytesDoesNotLeaveEmptyShard", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		w := createOutputWriterOrDie(filename, outputOptions{maxBytes: 4})
+
+		_, err := w.Write([]byte("ab\ncd\nef\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.commit())
+
+		assert.Equal(t, []string{"ab", "cd"}, readLines(t, shardFilename(filename, 0)))
+		assert.Equal(t, []string{"ef"}, readLines(t, shardFilename(filename, 1)))
+		_, err = os.Stat(shardFilename(filename, 2))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Gzip", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		w := createOutputWriterOrDie(filename, outputOptions{compression: "gzip"})
+		sink := bufio.NewWriter(w)
+		_, err := sink.WriteString("a\nb\n")
+		assert.NoError(t, err)
+		assert.NoError(t, sink.Flush())
+		assert.NoError(t, w.commit())
+
+		file, err := os.Open(filename + ".gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		reader, err := gzip.NewReader(file)
+		assert.NoError(t, err)
+		content, err := io.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, "a\nb\n", string(content))
+	})
+
+	t.Run("ZstdShards", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		w := createOutputWriterOrDie(filename, outputOptions{compression: "zstd", maxLines: 1})
+		_, err := w.Write([]byte("a\nb\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.commit())
+
+		for i, expected := range []string{"a\n", "b\n"} {
+			file, err := os.Open(shardFilename(filename, i) + ".zst")
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder, err := zstd.NewReader(file)
+			assert.NoError(t, err)
+			content, err := io.ReadAll(decoder)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(content))
+			decoder.Close()
+			file.Close()
+		}
+	})
+}
+
+func TestOutputWriterForce(t *testing.T) {
+	forceOutput = true
+	defer func() {
+		forceOutput = false
+		removeTempOutputFiles()
+	}()
+
+	writeShards := func(t *testing.T, filename string, lines []string) {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for i, line := range lines {
+			if err := os.WriteFile(shardFilename(filename, i), []byte(line+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	t.Run("FailedDownloadKeepsExistingShards", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		writeShards(t, filename, []string{"old-a", "old-b", "old-c"})
+
+		w := createOutputWriterOrDie(filename, outputOptions{maxLines: 1})
+		_, err := w.Write([]byte("a\nb\n"))
+		assert.NoError(t, err)
+		// the download fails before commit
+		removeTempOutputFiles()
+
+		for i, expected := range []string{"old-a", "old-b", "old-c"} {
+			assert.Equal(t, []string{expected}, readLines(t, shardFilename(filename, i)))
+		}
+		entries, _ := os.ReadDir(filepath.Dir(filename))
+		assert.Len(t, entries, 3, "no temporary files are left")
+	})
+
+	t.Run("CommitRemovesStaleShards", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.ndjson")
+		writeShards(t, filename, []string{"old-a", "old-b", "old-c"})
+
+		w := createOutputWriterOrDie(filename, outputOptions{maxLines: 1})
+		_, err := w.Write([]byte("a\nb\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, w.commit())
+
+		assert.Equal(t, []string{"a"}, readLines(t, shardFilename(filename, 0)))
+		assert.Equal(t, []string{"b"}, readLines(t, shardFilename(filename, 1)))
+		assert.NoFileExists(t, shardFilename(filename, 2))
+	})
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+var since string
+var datedOutput bool
+var downloadDeletions bool
+
+// fhirDateTimePattern matches FHIR dates and date times like 2022, 2022-10-01 or
+// 2022-10-01T02:00:00Z.
+var fhirDateTimePattern = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2}(T[0-9:.]+(Z|[+-]\d{2}:\d{2})?)?)?)?$`)
+
+// syncState is the content of the sync file used with --since. It records the time of the server
+// at which the last successful download started.
+type syncState struct {
+	ServerTime string `json:"serverTime"`
+}
+
+// parseSince parses the value of the --since flag which is either a FHIR date time or the name
+// of a sync file.
+//
+// Returns the lower bound of _lastUpdated, which is empty if the sync file doesn't exist yet, and
+// the name of the sync file, which is empty if a date time was given.
+func parseSince(value string) (bound string, syncFile string, err error) {
+	if fhirDateTimePattern.MatchString(value) {
+		return value, "", nil
+	}
+
+	data, err := os.ReadFile(value)
+	if os.IsNotExist(err) {
+		return "", value, nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+	var state syncState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", "", fmt.Errorf("could not parse the sync file %s: %v", value, err)
+	}
+	if state.ServerTime == "" {
+		return "", "", fmt.Errorf("missing server time in the sync file %s", value)
+	}
+	return state.ServerTime, value, nil
+}
+
+// writeSyncFile records the given server time in the sync file.
+func writeSyncFile(filename string, serverTime string) error {
+	data, err := json.Marshal(syncState{ServerTime: serverTime})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// sinceQuery adds a _lastUpdated parameter to the given FHIR search query, which limits the
+// resources to those updated after the given bound.
+func sinceQuery(fhirSearchQuery string, bound string) (string, error) {
+	query, err := url.ParseQuery(fhirSearchQuery)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the FHIR search query: %v", err)
+	}
+	query.Add("_lastUpdated", "gt"+bound)
+	return query.Encode(), nil
+}
+
+// datedFilename inserts the given time in front of the .ndjson extension of the given filename.
+func datedFilename(filename string, t time.Time) string {
+	return siblingFilename(filename, t.UTC().Format("20060102T150405Z"))
+}
+
+// siblingFilename inserts the given suffix in front of the .ndjson extension of the given filename.
+func siblingFilename(filename string, suffix string) string {
+	if strings.HasSuffix(filename, ".ndjson") {
+		return fmt.Sprintf("%s-%s.ndjson", strings.TrimSuffix(filename, ".ndjson"), suffix)
+	}
+	return fmt.Sprintf("%s-%s", filename, suffix)
+}
+
+// tombstone is written for every deleted resource.
+type tombstone struct {
+	ResourceType string `json:"resourceType"`
+	Id           string `json:"id"`
+	Deleted      string `json:"deleted,omitempty"`
+}
+
+// historyEntryId returns the id of the resource of the given history entry.
+func historyEntryId(entry fm.BundleEntry) string {
+	if entry.Request != nil {
+		if _, id, found := strings.Cut(entry.Request.Url, "/"); found {
+			id, _, _ = strings.Cut(id, "/")
+			return id
+		}
+	}
+	if entry.FullUrl != nil {
+		parts := strings.Split(strings.TrimSuffix(*entry.FullUrl, "/"), "/")
+		return parts[len(parts)-1]
+	}
+	return ""
+}
+
+// tombstoneWriter writes a tombstone for every entry of history pages which deletes a resource and
+// is the most recent entry of that resource. History entries are ordered from the most recent to
+// the oldest, so only the first entry of every id counts. The ids are recorded in seen.
+type tombstoneWriter struct {
+	resourceType string
+	seen         map[string]bool
+	sink         io.Writer
+	transform    resourceTransform
+}
+
+// writeEntry writes the tombstone of the given history entry, if there is one, and counts it as
+// resource of the page.
+func (w *tombstoneWriter) writeEntry(entry *fm.BundleEntry, page *downloadBundle) error {
+	id := historyEntryId(*entry)
+	if id == "" || w.seen[id] {
+		return nil
+	}
+	w.seen[id] = true
+	if entry.Request == nil || entry.Request.Method != fm.HTTPVerbDELETE {
+		return nil
+	}
+
+	t := tombstone{ResourceType: w.resourceType, Id: id}
+	if entry.Response != nil && entry.Response.LastModified != nil {
+		t.Deleted = *entry.Response.LastModified
+	}
+	line, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if w.transform != nil {
+		if line, err = w.transform(line); err != nil {
+			return fmt.Errorf("could not transform a tombstone: %v", err)
+		}
+	}
+	if _, err := w.sink.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write a tombstone: %v", err)
+	}
+	page.resources++
+	return nil
+}
+
+// downloadTombstones downloads the history of the given resource type since the given bound and
+// writes a tombstone for every resource deleted since then.
+//
+// Returns the statistics of the history download and the number of written tombstones.
+func downloadTombstones(client *fhir.Client, resourceType string, bound string, sink io.Writer,
+	transform resourceTransform) (commandStats, int, error) {
+	var stats commandStats
+	var tombstones int
+	startTime := time.Now()
+	writer := &tombstoneWriter{resourceType: resourceType, seen: make(map[string]bool), sink: sink,
+		transform: transform}
+
+	var err error
+	downloadResources(client, resourceType+"/_history", url.Values{"_since": {bound}}.Encode(), false,
+		writer.writeEntry, func(page *downloadBundle) bool {
+			stats.totalPages++
+			stats.bundles = append(stats.bundles, *page)
+
+			var writeErr *resourceWriteError
+			if page.err != nil && !errors.As(page.err, &writeErr) {
+				stats.error = page.errResponse
+				err = page.err
+				return false
+			}
+
+			stats.requestDurations = append(stats.requestDurations, page.stats.requestDuration)
+			stats.processingDurations = append(stats.processingDurations, page.stats.processingDuration)
+			stats.totalBytesIn += page.stats.totalBytesIn
+			stats.resourcesPerPage = append(stats.resourcesPerPage, page.resources)
+			tombstones += page.resources
+			err = page.err
+			return err == nil
+		})
+
+	stats.totalDuration = time.Since(startTime)
+	return stats, tombstones, err
+}
+
+// downloadTombstonesOrDie writes a tombstone for every resource of the given type deleted since
+// the given bound into the given file.
+func downloadTombstonesOrDie(resourceType string, bound string, filename string, transform resourceTransform) {
+	file := createOutputFileOrDie(filename)
+	sink := bufio.NewWriter(file)
+
+	stats, tombstones, err := downloadTombstones(client, resourceType, bound, sink, transform)
+	if flushErr := sink.Flush(); flushErr != nil && err == nil {
+		err = &resourceWriteError{err: flushErr}
+	}
+	exitOnDownloadError(stats, err)
+	if err := commitOutputFile(file); err != nil {
+		exitOnDownloadError(stats, &resourceWriteError{err: err})
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %d deleted resources to %s\n", tombstones, filename)
+}
+
+// downloadSinceOrDie downloads the resources of the given type updated since the bound given by
+// --since into the output file, which is dated with --dated. With --deletions, the resources
+// deleted since the bound are written to a separate file. If --since names a sync file, the
+// server time of the download is recorded in it afterwards.
+func downloadSinceOrDie(resourceType string, transform resourceTransform) error {
+	query := fhirSearchQuery
+	var bound, syncFile string
+	if since != "" {
+		var err error
+		if bound, syncFile, err = parseSince(since); err != nil {
+			return err
+		}
+		if bound != "" {
+			if query, err = sinceQuery(query, bound); err != nil {
+				return err
+			}
+		}
+	}
+
+	filename := outputFile
+	if datedOutput {
+		filename = datedFilename(outputFile, time.Now())
+	}
+
+	state, err := downloadResumableOrDie(resourceType, query, filename, transform)
+	if err != nil {
+		return err
+	}
+
+	if downloadDeletions && bound != "" {
+		downloadTombstonesOrDie(resourceType, bound, siblingFilename(filename, "deleted"), transform)
+	}
+
+	if state.ServerTime != "" {
+		fmt.Fprintf(os.Stderr, "Server time of the download: %s\n", state.ServerTime)
+	}
+	if syncFile != "" {
+		if state.ServerTime == "" {
+			return fmt.Errorf("could not record the server time in the sync file %s, because the server didn't return it", syncFile)
+		}
+		if err := writeSyncFile(syncFile, state.ServerTime); err != nil {
+			return fmt.Errorf("could not write the sync file %s: %v", syncFile, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSince(t *testing.T) {
+	t.Run("DateTime", func(t *testing.T) {
+		for _, value := range []string{"2022", "2022-10", "2022-10-01", "2022-10-01T02:00:00Z", "2022-10-01T02:00:00.123+02:00"} {
+			bound, syncFile, err := parseSince(value)
+			assert.NoError(t, err)
+			assert.Equal(t, value, bound)
+			assert.Empty(t, syncFile)
+		}
+	})
+
+	t.Run("MissingSyncFile", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.sync")
+
+		bound, syncFile, err := parseSince(filename)
+
+		assert.NoError(t, err)
+		assert.Empty(t, bound)
+		assert.Equal(t, filename, syncFile)
+	})
+
+	t.Run("ExistingSyncFile", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.sync")
+		assert.NoError(t, writeSyncFile(filename, "2022-10-01T02:00:00.123Z"))
+
+		bound, syncFile, err := parseSince(filename)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "2022-10-01T02:00:00.123Z", bound)
+		assert.Equal(t, filename, syncFile)
+	})
+
+	t.Run("InvalidSyncFile", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "patient.sync")
+		_ = os.WriteFile(filename, []byte("{}"), 0644)
+
+		_, _, err := parseSince(filename)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestSinceQuery(t *testing.T) {
+	query, err := sinceQuery("gender=female", "2022-10-01")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "_lastUpdated=gt2022-10-01&gender=female", query)
+}
+
+func TestSiblingFilename(t *testing.T) {
+	assert.Equal(t, "dir/patient-deleted.ndjson", siblingFilename("dir/patient.ndjson", "deleted"))
+	assert.Equal(t, "patient-deleted", siblingFilename("patient", "deleted"))
+	assert.Equal(t, "patient-20221001T020000Z.ndjson",
+		datedFilename("patient.ndjson", time.Date(2022, 10, 1, 4, 0, 0, 0, time.FixedZone("CEST", 7200))))
+}
+
+func historyEntry(method fm.HTTPVerb, requestUrl string, lastModified string) fm.BundleEntry {
+	return fm.BundleEntry{
+		Request:  &fm.BundleEntryRequest{Method: method, Url: requestUrl},
+		Response: &fm.BundleEntryResponse{Status: "200", LastModified: &lastModified},
+	}
+}
+
+func TestWriteTombstones(t *testing.T) {
+	fullUrl := "http://localhost/Patient/3"
+	created := historyEntry(fm.HTTPVerbPOST, "Patient", "2022-10-01T00:00:00Z")
+	created.FullUrl = &fullUrl
+	// most recent entries first
+	entries := []fm.BundleEntry{
+		historyEntry(fm.HTTPVerbDELETE, "Patient/1", "2022-10-03T00:00:00Z"),
+		historyEntry(fm.HTTPVerbPUT, "Patient/2", "2022-10-03T00:00:00Z"),
+		historyEntry(fm.HTTPVerbDELETE, "Patient/2", "2022-10-02T00:00:00Z"),
+		historyEntry(fm.HTTPVerbPUT, "Patient/1", "2022-10-01T00:00:00Z"),
+		created,
+	}
+	seen := make(map[string]bool)
+	var sink bytes.Buffer
+	writer := &tombstoneWriter{resourceType: "Patient", seen: seen, sink: &sink}
+
+	var page downloadBundle
+	for i := range entries {
+		assert.NoError(t, writer.writeEntry(&entries[i], &page))
+	}
+
+	assert.Equal(t, 1, page.resources)
+	assert.Equal(t, `{"resourceType":"Patient","id":"1","deleted":"2022-10-03T00:00:00Z"}`+"\n", sink.String())
+	assert.Equal(t, map[string]bool{"1": true, "2": true, "3": true}, seen)
+}
+
+func TestDownloadTombstones(t *testing.T) {
+	var requestedURL *url.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL
+		response := fm.Bundle{Type: fm.BundleTypeHistory, Entry: []fm.BundleEntry{
+			historyEntry(fm.HTTPVerbDELETE, "Patient/1", "2022-10-03T00:00:00Z"),
+		}}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	var sink bytes.Buffer
+
+	stats, tombstones, err := downloadTombstones(client, "Patient", "2022-10-01", &sink, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tombstones)
+	assert.Equal(t, 1, stats.totalPages)
+	assert.Equal(t, "/Patient/_history", requestedURL.Path)
+	assert.Equal(t, "2022-10-01", requestedURL.Query().Get("_since"))
+}
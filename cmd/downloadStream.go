@@ -0,0 +1,144 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// entryHandler handles a single entry of a page while the page is decoded. The entry is only valid
+// during the call. Written resources are counted in the page.
+type entryHandler func(entry *fm.BundleEntry, page *downloadBundle) error
+
+// searchPage holds everything of a search result page except its entries.
+type searchPage struct {
+	meta  *fm.Meta
+	total *int
+	links []fm.BundleLink
+}
+
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodePage decodes a search result page from the given reader without holding its entries in
+// memory. Every entry is passed to handleEntry as soon as it is decoded, so that only one entry is
+// held at a time, regardless of the size of the page. Entries are skipped if handleEntry is nil.
+//
+// Errors of handleEntry are returned as resourceWriteError, all other errors mean that the page
+// couldn't be read or isn't valid JSON.
+func decodePage(r io.Reader, page *downloadBundle, handleEntry entryHandler) (searchPage, error) {
+	var result searchPage
+	decoder := json.NewDecoder(r)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return result, err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return result, err
+		}
+		switch token {
+		case "meta":
+			err = decoder.Decode(&result.meta)
+		case "total":
+			err = decoder.Decode(&result.total)
+		case "link":
+			err = decoder.Decode(&result.links)
+		case "entry":
+			err = decodeEntries(decoder, page, handleEntry)
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, expectDelim(decoder, '}')
+}
+
+// decodeEntries decodes the entry array of a page one entry after another.
+func decodeEntries(decoder *json.Decoder, page *downloadBundle, handleEntry entryHandler) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected the entries to be an array but got %v", token)
+	}
+
+	for decoder.More() {
+		var entry fm.BundleEntry
+		if err := decoder.Decode(&entry); err != nil {
+			return err
+		}
+		if handleEntry == nil {
+			continue
+		}
+		if err := handleEntry(&entry, page); err != nil {
+			return &resourceWriteError{requestURL: page.associatedRequestURL, err: err}
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+// expectDelim reads the next token and returns an error if it isn't the given delimiter.
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v but got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue reads the next value token by token, so that even large values are never held in
+// memory.
+func skipValue(decoder *json.Decoder) error {
+	var depth int
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
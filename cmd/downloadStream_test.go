@@ -0,0 +1,114 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodePage(t *testing.T) {
+	t.Run("LinksAfterEntries", func(t *testing.T) {
+		data := `{"resourceType": "Bundle", "type": "searchset", "total": 2,
+			"meta": {"lastUpdated": "2022-10-01T02:00:00Z"},
+			"entry": [{"resource": {"id": "0"}}, {"resource": {"id": "1"}}],
+			"link": [{"relation": "next", "url": "http://localhost/Patient?page=1"}],
+			"extension": [{"url": "foo", "valueString": "[{bar}]"}]}`
+
+		var ids []string
+		var page downloadBundle
+		head, err := decodePage(strings.NewReader(data), &page, func(entry *fm.BundleEntry, _ *downloadBundle) error {
+			ids = append(ids, string(entry.Resource))
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{`{"id": "0"}`, `{"id": "1"}`}, ids)
+		assert.Equal(t, 2, *head.total)
+		assert.Equal(t, "2022-10-01T02:00:00Z", *head.meta.LastUpdated)
+		assert.Equal(t, []fm.BundleLink{{Relation: "next", Url: "http://localhost/Patient?page=1"}}, head.links)
+	})
+
+	t.Run("NoEntries", func(t *testing.T) {
+		for _, data := range []string{`{}`, `{"entry": null}`, `{"entry": []}`} {
+			var page downloadBundle
+			_, err := decodePage(strings.NewReader(data), &page, countEntries)
+
+			assert.NoError(t, err, data)
+			assert.Equal(t, 0, page.resources, data)
+		}
+	})
+
+	t.Run("InvalidPage", func(t *testing.T) {
+		for _, data := range []string{``, `[]`, `{"entry": {}}`, `{"entry": [{"resource": {}}`} {
+			var page downloadBundle
+			_, err := decodePage(strings.NewReader(data), &page, countEntries)
+
+			var writeErr *resourceWriteError
+			assert.Error(t, err, data)
+			assert.False(t, errors.As(err, &writeErr), data)
+		}
+	})
+
+	t.Run("HandlerFails", func(t *testing.T) {
+		var page downloadBundle
+		_, err := decodePage(strings.NewReader(`{"entry": [{"resource": {}}]}`), &page,
+			func(*fm.BundleEntry, *downloadBundle) error {
+				return errors.New("disk full")
+			})
+
+		var writeErr *resourceWriteError
+		assert.True(t, errors.As(err, &writeErr))
+		assert.ErrorContains(t, err, "disk full")
+	})
+
+	t.Run("HandlesEntriesWhileReceived", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		handled := make(chan string)
+		go func() {
+			_, _ = io.WriteString(writer, `{"entry": [{"resource": {"id": "0"}},`)
+			// the first entry is handled before the rest of the page is sent
+			<-handled
+			_, _ = io.WriteString(writer, `{"resource": {"id": "1"}}]}`)
+			_ = writer.Close()
+		}()
+
+		var page downloadBundle
+		_, err := decodePage(reader, &page, func(entry *fm.BundleEntry, page *downloadBundle) error {
+			page.resources++
+			if page.resources == 1 {
+				handled <- string(entry.Resource)
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, page.resources)
+	})
+}
+
+func TestCountingReader(t *testing.T) {
+	reader := &countingReader{r: strings.NewReader("foobar")}
+
+	_, err := io.ReadAll(reader)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), reader.n)
+}
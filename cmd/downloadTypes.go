@@ -0,0 +1,315 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/vbauerster/mpb/v7"
+	"github.com/vbauerster/mpb/v7/decor"
+)
+
+var downloadAll bool
+var outputDir string
+
+// resourceTypeDownload is the download of all resources of one type into its own file.
+type resourceTypeDownload struct {
+	resourceType string
+	// own FHIR search query of the download, the query of all downloads is used if empty
+	query  string
+	output *outputWriter
+	// resources are written to sink instead of output unless it is nil, which is used if several
+	// downloads share their output
+	sink io.Writer
+	// included resources are written to includes unless it is nil
+	includes *includeRouter
+	// expected number of resources used to show progress, zero if unknown
+	total int
+	stats commandStats
+	err   error
+}
+
+// name returns the resource type of the download followed by its own query if it has one.
+func (d *resourceTypeDownload) name() string {
+	if d.query == "" {
+		return d.resourceType
+	}
+	return d.resourceType + "?" + d.query
+}
+
+// downloadResourceTypes downloads the resources of all given downloads into their files. At most
+// concurrency downloads run at the same time. The progress of every running download and the
+// overall progress is written to progressOut.
+func downloadResourceTypes(client *fhir.Client, downloads []*resourceTypeDownload, fhirSearchQuery string,
+	usePost bool, transform resourceTransform, concurrency int, progressOut io.Writer) {
+
+	p := mpb.New(mpb.WithOutput(progressOut))
+	overall := p.AddBar(0,
+		mpb.BarPriority(len(downloads)),
+		mpb.PrependDecorators(
+			decor.Name("download", decor.WC{W: 7, C: decor.DidentRight}),
+			decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 60, decor.WC{W: 4}), "done"),
+		),
+		mpb.AppendDecorators(decor.CountersNoUnit("%d / %d")),
+	)
+	var overallTotal int
+	for _, download := range downloads {
+		overallTotal += download.total
+	}
+	if overallTotal > 0 {
+		overall.SetTotal(int64(overallTotal), false)
+	}
+
+	limiter := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for _, download := range downloads {
+		download := download
+		wg.Add(1)
+		limiter <- true
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+
+			bar := p.AddBar(0,
+				mpb.BarRemoveOnComplete(),
+				mpb.PrependDecorators(
+					decor.Name(download.name(), decor.WC{W: 7, C: decor.DidentRight}),
+					decor.CountersNoUnit("%d / %d", decor.WC{W: 4}),
+				),
+			)
+			if download.total > 0 {
+				bar.SetTotal(int64(download.total), false)
+			}
+
+			query := fhirSearchQuery
+			if download.query != "" {
+				query = download.query
+			}
+			sink := download.sink
+			var buffered *bufio.Writer
+			if sink == nil {
+				buffered = bufio.NewWriter(download.output)
+				sink = buffered
+			}
+			download.stats, download.err = downloadResourceType(client, download.resourceType, query,
+				usePost, sink, download.includes, transform, func(_ *downloadBundle, resources int) {
+					bar.IncrBy(resources)
+					overall.IncrBy(resources)
+				})
+			if buffered != nil {
+				if err := buffered.Flush(); err != nil && download.err == nil {
+					download.err = fmt.Errorf("could not write the output file %s: %v", download.output, err)
+				}
+			}
+
+			if download.err != nil {
+				bar.Abort(true)
+			} else {
+				bar.SetTotal(-1, true)
+			}
+		}()
+	}
+
+	wg.Wait()
+	overall.SetTotal(-1, true)
+	p.Wait()
+}
+
+// downloadMultipleResourceTypes downloads the resources of the given types, or of all types the
+// server supports searching for if --all is given, into one Type.ndjson file per type in the
+// output directory.
+func downloadMultipleResourceTypes(args []string, transform resourceTransform) error {
+	if downloadAll && len(args) > 0 {
+		return errors.New("--all can't be combined with resource type arguments")
+	}
+	if outputDir == "" {
+		return errors.New("requires the -d/--output-dir flag when downloading multiple resource types")
+	}
+	if outputFile != "" {
+		return errors.New("-o/--output-file can't be used when downloading multiple resource types, use -d/--output-dir instead")
+	}
+	options, err := downloadOutputOptions()
+	if err != nil {
+		return err
+	}
+
+	var types []fm.ResourceType
+	if downloadAll {
+		var err error
+		if types, err = fetchResourceTypesWithSearchTypeInteraction(client); err != nil {
+			return fmt.Errorf("could not fetch the resource types supported by the server: %v", err)
+		}
+	} else {
+		for _, arg := range args {
+			resourceType, err := parseResourceType(arg)
+			if err != nil {
+				return err
+			}
+			types = append(types, resourceType)
+		}
+	}
+
+	totals, err := fetchResourcesTotal(client, types)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Could not fetch the resource totals, progress will be shown without them: %v\n", err)
+	}
+
+	var downloads []*resourceTypeDownload
+	for _, resourceType := range types {
+		total, known := totals[resourceType]
+		// skip the empty types of all types the server supports, but keep explicitly requested ones
+		if downloadAll && known && total == 0 {
+			continue
+		}
+		downloads = append(downloads, &resourceTypeDownload{resourceType: resourceType.Code(), total: total})
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("could not create the output directory %s: %v", outputDir, err)
+	}
+	filenames := make([]string, 0, len(downloads))
+	for _, download := range downloads {
+		filenames = append(filenames, filepath.Join(outputDir, download.resourceType+".ndjson"))
+	}
+	checkOutputWriterFilesOrDie(filenames, options)
+	for i, download := range downloads {
+		download.output = createOutputWriterOrDie(filenames[i], options)
+		download.includes = newIncludeRouter(filenames[i])
+	}
+
+	startTime := time.Now()
+	downloadResourceTypes(client, downloads, fhirSearchQuery, usePost, transform, downloadConcurrency, os.Stderr)
+	totalDuration := time.Since(startTime)
+
+	for _, download := range downloads {
+		// failed downloads aren't committed, so that --force doesn't replace existing files
+		if download.err != nil {
+			download.includes.flush()
+		} else if err := download.output.commit(); err != nil {
+			download.err = fmt.Errorf("could not write the output file %s: %v", download.output, err)
+		} else if err := download.includes.close(); err != nil {
+			download.err = fmt.Errorf("could not write the included resources: %v", err)
+		} else {
+			verifyResourceTypeDownload(download)
+		}
+	}
+
+	return reportResourceTypeDownloads(downloads, "resource types", totalDuration)
+}
+
+// verifyResourceTypeDownload fails the given download if it is verified and incomplete.
+func verifyResourceTypeDownload(download *resourceTypeDownload) {
+	if download.stats.verification == nil {
+		return
+	}
+	if err := download.stats.verification.verify(); err != nil {
+		download.err = fmt.Errorf("the verification failed: %v", err)
+	}
+}
+
+// reportResourceTypeDownloads prints the statistics of the given downloads, which are called what
+// in the summary, and exits with a non-success error code if one of them failed. Otherwise, a
+// manifest listing the output files of all downloads is written into the output directory.
+func reportResourceTypeDownloads(downloads []*resourceTypeDownload, what string, totalDuration time.Duration) error {
+	allStats := make([]*commandStats, 0, len(downloads))
+	for _, download := range downloads {
+		allStats = append(allStats, &download.stats)
+	}
+
+	fmt.Fprint(os.Stderr, fmtResourceTypeDownloads(downloads, what, totalDuration))
+
+	if outputStatisticsFileName != "" {
+		writeDownloadStatisticsOrDie(outputStatisticsFileName, allStats)
+	}
+
+	for _, download := range downloads {
+		if download.err != nil {
+			removeTempOutputFiles()
+			os.Exit(1)
+		}
+	}
+
+	if !appendOutput && outputDir != "" {
+		manifest := newDownloadManifest(outputDir)
+		manifest.manifest.Request = strings.TrimSuffix(server, "/")
+		for _, download := range downloads {
+			manifest.addStats(&download.stats)
+			manifest.addOutput(download.resourceType, download.output)
+			if err := manifest.addIncludes(download.includes); err != nil {
+				return fmt.Errorf("could not write the manifest: %v", err)
+			}
+		}
+		manifest.writeOrWarn()
+	}
+	return nil
+}
+
+// parseResourceType parses the given resource type like Patient.
+func parseResourceType(s string) (fm.ResourceType, error) {
+	var resourceType fm.ResourceType
+	if err := json.Unmarshal([]byte(fmt.Sprintf("%q", s)), &resourceType); err != nil {
+		return resourceType, fmt.Errorf("unknown resource type `%s`", s)
+	}
+	return resourceType, nil
+}
+
+// fmtResourceTypeDownloads formats the statistics of every download followed by a summary over all
+// downloads, which are called what in the summary.
+func fmtResourceTypeDownloads(downloads []*resourceTypeDownload, what string, totalDuration time.Duration) string {
+	builder := strings.Builder{}
+
+	var resources int
+	var failed []string
+	// downloads sharing their output share the included resources, which are listed only once
+	listed := make(map[*includeRouter]bool)
+	for _, download := range downloads {
+		builder.WriteString(fmt.Sprintf("%s -> %s\n", download.name(), download.output))
+		if download.includes != nil && !listed[download.includes] {
+			listed[download.includes] = true
+			builder.WriteString(download.includes.String())
+		}
+		if download.err != nil {
+			failed = append(failed, download.name())
+			builder.WriteString(fmt.Sprintf("  Failed to download resources: %v\n", download.err))
+		}
+		builder.WriteString(util.Indent(2, strings.TrimSuffix(download.stats.String(), "\n")) + "\n\n")
+
+		for _, n := range download.stats.resourcesPerPage {
+			if n > 0 {
+				resources += n
+			}
+		}
+	}
+
+	builder.WriteString(fmt.Sprintf("Downloaded %d resources of %d %s in %s\n", resources,
+		len(downloads), what, util.FmtDurationHumanReadable(totalDuration)))
+	if len(failed) > 0 {
+		builder.WriteString(fmt.Sprintf("Failed to download %d %s: %s\n", len(failed), what,
+			strings.Join(failed, ", ")))
+	}
+	return builder.String()
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSearchServer returns a server responding to type searches with a single page containing the
+// given number of resources per type. Types without resources respond with a 404 status.
+func newSearchServer(t *testing.T, resourcesPerType map[string]int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resourceType := strings.TrimPrefix(r.URL.Path, "/")
+		n, ok := resourcesPerType[resourceType]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "not-found"}]}`))
+			return
+		}
+
+		searchMode := fm.SearchEntryModeMatch
+		response := fm.Bundle{Type: fm.BundleTypeSearchset, Total: &n}
+		for i := 0; i < n; i++ {
+			response.Entry = append(response.Entry, fm.BundleEntry{
+				Resource: []byte(fmt.Sprintf(`{"resourceType": "%s", "id": "%d"}`, resourceType, i)),
+				Search:   &fm.BundleEntrySearch{Mode: &searchMode},
+			})
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func TestDownloadResourceTypes(t *testing.T) {
+	server := newSearchServer(t, map[string]int{"Patient": 2, "Observation": 3})
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	dir := t.TempDir()
+	var downloads []*resourceTypeDownload
+	for _, resourceType := range []string{"Patient", "Observation", "Condition"} {
+		file, err := os.Create(filepath.Join(dir, resourceType+".ndjson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		downloads = append(downloads, &resourceTypeDownload{resourceType: resourceType, output: wrapOutputFile(file), total: 2})
+	}
+
+	downloadResourceTypes(client, downloads, "", false, nil, 2, io.Discard)
+
+	for i, expectedResources := range []int{2, 3} {
+		download := downloads[i]
+		assert.NoError(t, download.err)
+		assert.Equal(t, []int{expectedResources}, download.stats.resourcesPerPage)
+
+		content, err := os.ReadFile(download.output.file.Name())
+		assert.NoError(t, err)
+		assert.Equal(t, expectedResources, strings.Count(string(content), "\n"))
+		assert.Contains(t, string(content), fmt.Sprintf(`{"resourceType":"%s","id":"0"}`, download.resourceType))
+	}
+
+	assert.Error(t, downloads[2].err)
+	if assert.NotNil(t, downloads[2].stats.error) {
+		assert.Equal(t, http.StatusNotFound, downloads[2].stats.error.StatusCode)
+	}
+}
+
+func TestParseResourceType(t *testing.T) {
+	t.Run("Known", func(t *testing.T) {
+		resourceType, err := parseResourceType("Patient")
+		assert.NoError(t, err)
+		assert.Equal(t, fm.ResourceTypePatient, resourceType)
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, err := parseResourceType("Foo")
+		assert.Error(t, err)
+	})
+}
+
+func TestFmtResourceTypeDownloads(t *testing.T) {
+	dir := t.TempDir()
+	patients, _ := os.Create(filepath.Join(dir, "Patient.ndjson"))
+	defer patients.Close()
+	conditions, _ := os.Create(filepath.Join(dir, "Condition.ndjson"))
+	defer conditions.Close()
+
+	downloads := []*resourceTypeDownload{
+		{resourceType: "Patient", output: wrapOutputFile(patients), stats: commandStats{totalPages: 2, resourcesPerPage: []int{3, 1},
+			requestDurations: []float64{0.1, 0.1}, processingDurations: []float64{0.1, 0.1}}},
+		{resourceType: "Condition", output: wrapOutputFile(conditions), err: fmt.Errorf("foo"),
+			stats: commandStats{totalPages: 1, resourcesPerPage: []int{-1}}},
+	}
+
+	str := fmtResourceTypeDownloads(downloads, "resource types", time.Second)
+
+	assert.Contains(t, str, "Patient -> "+patients.Name()+"\n  Pages")
+	assert.Contains(t, str, "  Failed to download resources: foo\n")
+	assert.Contains(t, str, "Downloaded 4 resources of 2 resource types in 1s\n")
+	assert.True(t, strings.HasSuffix(str, "Failed to download 1 resource types: Condition\n"))
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// maxReportedDuplicates is the number of duplicate ids shown if a verification fails.
+const maxReportedDuplicates = 5
+
+var verifyDownload bool
+
+// downloadVerification collects what is needed to verify that a download received every matching
+// resource exactly once.
+type downloadVerification struct {
+	// number of matching resources reported by every search, nil if a search reported none
+	totals []*int
+	// error while determining the total of a search without one
+	totalErr error
+	// number of matching resources received
+	resources int
+	ids       map[string]bool
+	// ids of resources received more than once
+	duplicates []string
+}
+
+func newDownloadVerification() *downloadVerification {
+	return &downloadVerification{ids: make(map[string]bool)}
+}
+
+// verificationQuery returns the given search query asking the server for an accurate total, unless
+// the query already specifies how to calculate the total.
+func verificationQuery(query url.Values) url.Values {
+	if query.Get("_total") != "" {
+		return query
+	}
+	result := rangeQuery(query, nil, nil)
+	result.Set("_total", "accurate")
+	return result
+}
+
+// addSearch records the total reported on the first page of a search. If the server didn't report
+// one, it is determined by a _summary=count search with the given query.
+func (v *downloadVerification) addSearch(client *fhir.Client, resourceType string, query string,
+	page *downloadBundle) {
+	if page.total != nil {
+		v.totals = append(v.totals, page.total)
+		return
+	}
+
+	values, err := url.ParseQuery(query)
+	if err == nil {
+		var totals []int
+		if totals, err = fetchSearchTotals(client, resourceType, []url.Values{values}); err == nil {
+			v.totals = append(v.totals, &totals[0])
+			return
+		}
+	}
+	v.totals = append(v.totals, nil)
+	if v.totalErr == nil {
+		v.totalErr = err
+	}
+}
+
+// addEntry records the matching resource of the given entry. Unparsable resources are ignored,
+// because they fail to be written anyway.
+func (v *downloadVerification) addEntry(entry *fm.BundleEntry) {
+	var resource struct {
+		ResourceType string `json:"resourceType"`
+		Id           string `json:"id"`
+	}
+	if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+		return
+	}
+	v.add(resource.ResourceType + "/" + resource.Id)
+}
+
+func (v *downloadVerification) add(id string) {
+	v.resources++
+	if v.ids[id] {
+		v.duplicates = append(v.duplicates, id)
+	}
+	v.ids[id] = true
+}
+
+// expected returns the number of resources all searches reported together and false if that
+// number isn't known.
+func (v *downloadVerification) expected() (int, bool) {
+	var expected int
+	for _, total := range v.totals {
+		if total == nil {
+			return 0, false
+		}
+		expected += *total
+	}
+	return expected, true
+}
+
+// merge adds the searches and resources of the other verification. Resources received by both
+// downloads count as duplicates.
+func (v *downloadVerification) merge(other *downloadVerification) {
+	v.totals = append(v.totals, other.totals...)
+	if v.totalErr == nil {
+		v.totalErr = other.totalErr
+	}
+	v.duplicates = append(v.duplicates, other.duplicates...)
+	for id := range other.ids {
+		if v.ids[id] {
+			v.duplicates = append(v.duplicates, id)
+		}
+		v.ids[id] = true
+	}
+	v.resources += other.resources
+}
+
+// verify returns an error describing why the download is incomplete or contains duplicates.
+func (v *downloadVerification) verify() error {
+	var problems []string
+
+	if expected, ok := v.expected(); !ok {
+		problems = append(problems, fmt.Sprintf("the expected number of resources is unknown: %v", v.totalErr))
+	} else if expected != v.resources {
+		problems = append(problems, fmt.Sprintf("the server reported %d matching resources but %d were downloaded",
+			expected, v.resources))
+	}
+
+	if len(v.duplicates) > 0 {
+		duplicates := append([]string(nil), v.duplicates...)
+		sort.Strings(duplicates)
+		if len(duplicates) > maxReportedDuplicates {
+			duplicates = append(duplicates[:maxReportedDuplicates], "...")
+		}
+		problems = append(problems, fmt.Sprintf("%d resources were downloaded more than once: %s",
+			len(v.duplicates), strings.Join(duplicates, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// verifyDownloadOrDie exits with a non-success error code if the download of the given statistics
+// is verified and incomplete. The statistics are reported before.
+func verifyDownloadOrDie(stats *commandStats) {
+	if stats.verification == nil {
+		return
+	}
+	if err := stats.verification.verify(); err != nil {
+		fmt.Fprintln(os.Stderr, stats.String())
+		fmt.Fprintf(os.Stderr, "The verification of the download failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Verified that all %d resources were downloaded exactly once.\n",
+		stats.verification.resources)
+}
@@ -0,0 +1,204 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerificationQuery(t *testing.T) {
+	query := url.Values{"gender": {"female"}}
+	assert.Equal(t, "_total=accurate&gender=female", verificationQuery(query).Encode())
+	assert.Equal(t, "gender=female", query.Encode())
+
+	assert.Equal(t, "_total=estimate", verificationQuery(url.Values{"_total": {"estimate"}}).Encode())
+}
+
+func TestDownloadVerification(t *testing.T) {
+	total := func(n int) *int { return &n }
+
+	t.Run("Complete", func(t *testing.T) {
+		v := newDownloadVerification()
+		v.totals = []*int{total(2)}
+		v.add("Patient/0")
+		v.add("Patient/1")
+		assert.NoError(t, v.verify())
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		v := newDownloadVerification()
+		v.totals = []*int{total(3)}
+		v.add("Patient/0")
+		assert.EqualError(t, v.verify(), "the server reported 3 matching resources but 1 were downloaded")
+	})
+
+	t.Run("Duplicates", func(t *testing.T) {
+		v := newDownloadVerification()
+		v.totals = []*int{total(3)}
+		v.add("Patient/1")
+		v.add("Patient/0")
+		v.add("Patient/1")
+		assert.EqualError(t, v.verify(), "1 resources were downloaded more than once: Patient/1")
+	})
+
+	t.Run("UnknownTotal", func(t *testing.T) {
+		v := newDownloadVerification()
+		v.totals = []*int{total(1), nil}
+		v.totalErr = fmt.Errorf("not supported")
+		assert.EqualError(t, v.verify(), "the expected number of resources is unknown: not supported")
+	})
+
+	t.Run("MergeFindsDuplicatesAcrossDownloads", func(t *testing.T) {
+		first := newDownloadVerification()
+		first.totals = []*int{total(2)}
+		first.add("Patient/0")
+		first.add("Patient/1")
+		second := newDownloadVerification()
+		second.totals = []*int{total(1)}
+		second.add("Patient/1")
+
+		var stats commandStats
+		stats.merge(&commandStats{verification: first})
+		stats.merge(&commandStats{verification: second})
+
+		expected, ok := stats.verification.expected()
+		assert.True(t, ok)
+		assert.Equal(t, 3, expected)
+		assert.Equal(t, 3, stats.verification.resources)
+		assert.Equal(t, []string{"Patient/1"}, stats.verification.duplicates)
+		assert.Contains(t, stats.String(), "Duplicates 	[total]			1\n")
+	})
+}
+
+// newVerificationServer returns a server which returns the given pages of patients, linked by next
+// links. The first page contains the given total unless it is nil. Searches with _summary=count in
+// a batch are answered with the number of distinct patients.
+func newVerificationServer(t *testing.T, pages [][]string, total *int) (*httptest.Server, *url.Values) {
+	var firstQuery url.Values
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+
+		if r.Method == http.MethodPost {
+			body, _ := io.ReadAll(r.Body)
+			batch, err := fm.UnmarshalBundle(body)
+			if !assert.NoError(t, err) {
+				return
+			}
+			distinct := make(map[string]bool)
+			for _, page := range pages {
+				for _, id := range page {
+					distinct[id] = true
+				}
+			}
+			count := len(distinct)
+			searchset, _ := json.Marshal(fm.Bundle{Type: fm.BundleTypeSearchset, Total: &count})
+			response := fm.Bundle{Type: fm.BundleTypeBatchResponse}
+			for range batch.Entry {
+				response.Entry = append(response.Entry, fm.BundleEntry{
+					Resource: searchset,
+					Response: &fm.BundleEntryResponse{Status: "200"},
+				})
+			}
+			_ = json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		var page int
+		if p := r.URL.Query().Get("page"); p != "" {
+			_, _ = fmt.Sscan(p, &page)
+		} else {
+			firstQuery = r.URL.Query()
+		}
+
+		bundle := fm.Bundle{Type: fm.BundleTypeSearchset}
+		if page == 0 {
+			bundle.Total = total
+		}
+		for _, id := range pages[page] {
+			bundle.Entry = append(bundle.Entry, fm.BundleEntry{
+				Resource: json.RawMessage(fmt.Sprintf(`{"resourceType":"Patient","id":"%s"}`, id)),
+			})
+		}
+		if page+1 < len(pages) {
+			bundle.Link = append(bundle.Link, fm.BundleLink{
+				Relation: "next",
+				Url:      fmt.Sprintf("%s/Patient?page=%d", server.URL, page+1),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(bundle)
+	}))
+	return server, &firstQuery
+}
+
+func TestDownloadResourceTypeVerified(t *testing.T) {
+	verifyDownload = true
+	defer func() { verifyDownload = false }()
+
+	download := func(t *testing.T, pages [][]string, total *int) (commandStats, url.Values) {
+		server, firstQuery := newVerificationServer(t, pages, total)
+		defer server.Close()
+
+		baseURL, _ := url.ParseRequestURI(server.URL)
+		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+		stats, err := downloadResourceType(client, "Patient", "gender=female", false, io.Discard, nil, nil, nil)
+		assert.NoError(t, err)
+		return stats, *firstQuery
+	}
+
+	t.Run("Complete", func(t *testing.T) {
+		three := 3
+		stats, query := download(t, [][]string{{"0", "1"}, {"2"}}, &three)
+
+		assert.Equal(t, "accurate", query.Get("_total"))
+		assert.Equal(t, "female", query.Get("gender"))
+		assert.NoError(t, stats.verification.verify())
+		assert.Contains(t, stats.String(), "Expected 	[total]			3\n")
+	})
+
+	t.Run("RepeatedResource", func(t *testing.T) {
+		three := 3
+		stats, _ := download(t, [][]string{{"0", "1"}, {"1"}}, &three)
+
+		err := stats.verification.verify()
+		assert.ErrorContains(t, err, "1 resources were downloaded more than once: Patient/1")
+		assert.NotContains(t, err.Error(), "matching resources")
+	})
+
+	t.Run("SkippedResource", func(t *testing.T) {
+		three := 3
+		stats, _ := download(t, [][]string{{"0"}, {"2"}}, &three)
+
+		assert.EqualError(t, stats.verification.verify(), "the server reported 3 matching resources but 2 were downloaded")
+	})
+
+	t.Run("CountsWithoutTotal", func(t *testing.T) {
+		stats, _ := download(t, [][]string{{"0", "1"}, {"1"}}, nil)
+
+		// the server counts 2 distinct patients but 3 were received
+		assert.EqualError(t, stats.verification.verify(), "the server reported 2 matching resources but 3 were downloaded; "+
+			"1 resources were downloaded more than once: Patient/1")
+	})
+}
@@ -17,8 +17,11 @@ package cmd
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/samply/blazectl/data"
 	"github.com/samply/blazectl/fhir"
+	"github.com/samply/blazectl/util"
 	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
 	"github.com/stretchr/testify/assert"
 	"io"
@@ -27,8 +30,15 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
+// countEntries counts the entries of a page as resources without writing them.
+func countEntries(_ *fm.BundleEntry, page *downloadBundle) error {
+	page.resources++
+	return nil
+}
+
 func TestDownloadResources(t *testing.T) {
 
 	t.Run("RequestToFHIRServerFails", func(t *testing.T) {
@@ -36,13 +46,11 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.NotNil(t, bundle.err)
-		}
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 	})
 
@@ -56,13 +64,11 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.NotNil(t, bundle.err)
-		}
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 	})
 
@@ -76,14 +82,12 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.Nil(t, bundle.err)
-			assert.Empty(t, bundle.rawEntries)
-		}
+			assert.Equal(t, 0, bundle.resources)
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 	})
 
@@ -108,15 +112,13 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.NotNil(t, bundle.err)
 			assert.NotNil(t, bundle.errResponse)
 			assert.NotNil(t, bundle.stats)
-		}
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 	})
 
@@ -171,16 +173,14 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.Nil(t, bundle.err)
 			assert.Nil(t, bundle.errResponse)
-			assert.NotNil(t, bundle.rawEntries)
+			assert.Equal(t, 2, bundle.resources)
 			assert.NotNil(t, bundle.stats)
-		}
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 	})
 
@@ -212,16 +212,14 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.Nil(t, bundle.err)
 			assert.Nil(t, bundle.errResponse)
-			assert.NotNil(t, bundle.rawEntries)
+			assert.Equal(t, 1, bundle.resources)
 			assert.NotNil(t, bundle.stats)
-		}
+			return true
+		})
 		assert.Equal(t, 1, bundles)
 		assert.Equal(t, 1, requestCounter)
 	})
@@ -293,37 +291,182 @@ func TestDownloadResources(t *testing.T) {
 		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
 
 		var bundles int
-		bundleChannel := make(chan downloadBundle)
-
-		go downloadResources(client, "foo", "", false, bundleChannel)
-		for bundle := range bundleChannel {
+		downloadResources(client, "foo", "", false, countEntries, func(bundle *downloadBundle) bool {
 			bundles++
 			assert.Nil(t, bundle.err)
 			assert.Nil(t, bundle.errResponse)
-			assert.NotNil(t, bundle.rawEntries)
+			assert.Equal(t, 1, bundle.resources)
 			assert.NotNil(t, bundle.stats)
-		}
+			return true
+		})
 		assert.Equal(t, 2, bundles)
 		assert.Equal(t, 2, requestCounter)
 	})
+
+	t.Run("NextPageIsRequestedWhileEntriesAreHandled", func(t *testing.T) {
+		secondPageRequested := make(chan bool, 1)
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("page") == "2" {
+				secondPageRequested <- true
+				_, _ = w.Write([]byte(`{"entry": [{"resource": {"id": "1"}}]}`))
+				return
+			}
+			_, _ = fmt.Fprintf(w, `{"entry": [{"resource": {"id": "0"}}], "link": [{"relation": "next", "url": "%s/foo?page=2"}]}`, server.URL)
+		}))
+		defer server.Close()
+
+		baseURL, _ := url.ParseRequestURI(server.URL)
+		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+		var bundles int
+		downloadResources(client, "foo", "", false, func(entry *fm.BundleEntry, page *downloadBundle) error {
+			if page.associatedRequestURL.Query().Get("page") == "" {
+				select {
+				case <-secondPageRequested:
+				case <-time.After(5 * time.Second):
+					t.Error("the second page wasn't requested while the first one was handled")
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+			return countEntries(entry, page)
+		}, func(bundle *downloadBundle) bool {
+			bundles++
+			assert.Nil(t, bundle.err)
+			assert.Equal(t, 1, bundle.resources)
+			// the time spent handling the entries doesn't count as request duration
+			assert.Less(t, bundle.stats.requestDuration, 0.2)
+			return true
+		})
+		assert.Equal(t, 2, bundles)
+	})
+
+	t.Run("HandlerFails", func(t *testing.T) {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, `{"entry": [{"resource": {"id": "0"}}], "link": [{"relation": "next", "url": "%s/foo"}]}`, server.URL)
+		}))
+		defer server.Close()
+
+		baseURL, _ := url.ParseRequestURI(server.URL)
+		client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+		var bundles int
+		downloadResources(client, "foo", "", false, func(*fm.BundleEntry, *downloadBundle) error {
+			return errors.New("disk full")
+		}, func(bundle *downloadBundle) bool {
+			bundles++
+			var writeErr *resourceWriteError
+			assert.True(t, errors.As(bundle.err, &writeErr))
+			return false
+		})
+		assert.Equal(t, 1, bundles)
+	})
+}
+
+func TestServerTime(t *testing.T) {
+	t.Run("BundleMeta", func(t *testing.T) {
+		lastUpdated := "2022-10-01T02:00:00.123Z"
+		header := http.Header{"Date": {"Sat, 01 Oct 2022 02:00:05 GMT"}}
+
+		assert.Equal(t, time.Date(2022, 10, 1, 2, 0, 0, 123000000, time.UTC),
+			serverTime(&fm.Meta{LastUpdated: &lastUpdated}, header))
+	})
+
+	t.Run("DateHeader", func(t *testing.T) {
+		header := http.Header{"Date": {"Sat, 01 Oct 2022 02:00:05 GMT"}}
+
+		assert.Equal(t, time.Date(2022, 10, 1, 2, 0, 4, 0, time.UTC), serverTime(nil, header))
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		assert.True(t, serverTime(nil, http.Header{}).IsZero())
+	})
+}
+
+func TestCommandStatsMerge(t *testing.T) {
+	first := commandStats{totalPages: 1, resourcesPerPage: []int{2}, requestDurations: []float64{0.1},
+		processingDurations: []float64{0.05}, totalBytesIn: 100, totalDuration: time.Second}
+	second := commandStats{totalPages: 2, resourcesPerPage: []int{3, -1}, requestDurations: []float64{0.2, 0.3},
+		processingDurations: []float64{0.1, 0.2}, totalBytesIn: 50, error: &util.ErrorResponse{StatusCode: 500}}
+
+	first.merge(&second)
+
+	assert.Equal(t, 3, first.totalPages)
+	assert.Equal(t, []int{2, 3, -1}, first.resourcesPerPage)
+	assert.Equal(t, []float64{0.1, 0.2, 0.3}, first.requestDurations)
+	assert.Equal(t, []float64{0.05, 0.1, 0.2}, first.processingDurations)
+	assert.Equal(t, int64(150), first.totalBytesIn)
+	assert.Equal(t, time.Second, first.totalDuration)
+	assert.Equal(t, 500, first.error.StatusCode)
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(_ []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestDownloadResourceType(t *testing.T) {
+	server := newSearchServer(t, map[string]int{"Patient": 2})
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	t.Run("Success", func(t *testing.T) {
+		var sink bytes.Buffer
+		var pages []int
+
+		stats, err := downloadResourceType(client, "Patient", "", false, &sink, nil, nil, func(_ *downloadBundle, resources int) {
+			pages = append(pages, resources)
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, stats.totalPages)
+		assert.Equal(t, []int{2}, pages)
+		assert.Equal(t, 2, bytes.Count(sink.Bytes(), []byte{'\n'}))
+	})
+
+	t.Run("DownloadFails", func(t *testing.T) {
+		stats, err := downloadResourceType(client, "Condition", "", false, io.Discard, nil, nil, nil)
+
+		assert.Error(t, err)
+		assert.NotNil(t, stats.error)
+		assert.Equal(t, []int{-1}, stats.resourcesPerPage)
+	})
+
+	t.Run("WriteFails", func(t *testing.T) {
+		_, err := downloadResourceType(client, "Patient", "", false, failingWriter{}, nil, nil, nil)
+
+		var writeErr *resourceWriteError
+		assert.True(t, errors.As(err, &writeErr))
+	})
+}
+
+// writePage decodes the given page and writes its resources with the given writer.
+func writePage(data []byte, writer *resourceWriter) (*downloadBundle, error) {
+	var page downloadBundle
+	_, err := decodePage(bytes.NewReader(data), &page, writer.writeEntry)
+	return &page, err
 }
 
 func TestWriteResource(t *testing.T) {
 	t.Run("EmptyRawData", func(t *testing.T) {
-		resources, outcomes, err := writeResources(&[]byte{}, io.Discard)
+		page, err := writePage([]byte("{}"), &resourceWriter{sink: io.Discard})
 
 		assert.Nil(t, err)
-		assert.Equal(t, 0, resources)
-		assert.Empty(t, outcomes)
+		assert.Equal(t, 0, page.resources)
+		assert.Empty(t, page.inlineOutcomes)
 	})
 
 	t.Run("InvalidBundleData", func(t *testing.T) {
-		invalidData := []byte("{\"invalid\": \"data\"}")
-		resources, outcomes, err := writeResources(&invalidData, io.Discard)
+		invalidData := []byte("{\"entry\": {\"invalid\": \"data\"}}")
+		page, err := writePage(invalidData, &resourceWriter{sink: io.Discard})
 
 		assert.NotNil(t, err)
-		assert.Equal(t, 0, resources)
-		assert.Empty(t, outcomes)
+		assert.Equal(t, 0, page.resources)
+		assert.Empty(t, page.inlineOutcomes)
 	})
 
 	t.Run("SingleBundleEntry", func(t *testing.T) {
@@ -335,12 +478,12 @@ func TestWriteResource(t *testing.T) {
 			Mode: &searchMode,
 		}
 
-		bundleRawJSON, _ := json.Marshal([]fm.BundleEntry{bundle})
-		resources, outcomes, err := writeResources(&bundleRawJSON, io.Discard)
+		bundleRawJSON, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{bundle}})
+		page, err := writePage(bundleRawJSON, &resourceWriter{sink: io.Discard})
 
 		assert.Nil(t, err)
-		assert.Equal(t, 1, resources)
-		assert.Empty(t, outcomes)
+		assert.Equal(t, 1, page.resources)
+		assert.Empty(t, page.inlineOutcomes)
 	})
 
 	t.Run("SingleBundleEntryIsInlineOutcome", func(t *testing.T) {
@@ -361,12 +504,12 @@ func TestWriteResource(t *testing.T) {
 			Mode: &searchMode,
 		}
 
-		bundleRawJSON, _ := json.Marshal([]fm.BundleEntry{bundle})
-		resources, outcomes, err := writeResources(&bundleRawJSON, io.Discard)
+		bundleRawJSON, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{bundle}})
+		page, err := writePage(bundleRawJSON, &resourceWriter{sink: io.Discard})
 
 		assert.Nil(t, err)
-		assert.Equal(t, 0, resources)
-		assert.NotEmpty(t, outcomes)
+		assert.Equal(t, 0, page.resources)
+		assert.NotEmpty(t, page.inlineOutcomes)
 	})
 
 	t.Run("MultipleBundleEntries", func(t *testing.T) {
@@ -383,12 +526,12 @@ func TestWriteResource(t *testing.T) {
 			Mode: &searchMode,
 		}
 
-		bundleRawJSON, _ := json.Marshal([]fm.BundleEntry{bundleA, bundleB})
-		resources, outcomes, err := writeResources(&bundleRawJSON, io.Discard)
+		bundleRawJSON, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{bundleA, bundleB}})
+		page, err := writePage(bundleRawJSON, &resourceWriter{sink: io.Discard})
 
 		assert.Nil(t, err)
-		assert.Equal(t, 2, resources)
-		assert.Empty(t, outcomes)
+		assert.Equal(t, 2, page.resources)
+		assert.Empty(t, page.inlineOutcomes)
 	})
 
 	t.Run("MultipleBundleEntriesWithSingleInlineOutcome", func(t *testing.T) {
@@ -414,11 +557,32 @@ func TestWriteResource(t *testing.T) {
 			Mode: &searchModeB,
 		}
 
-		bundleRawJSON, _ := json.Marshal([]fm.BundleEntry{bundleA, bundleB})
-		resources, outcomes, err := writeResources(&bundleRawJSON, io.Discard)
+		bundleRawJSON, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{bundleA, bundleB}})
+		page, err := writePage(bundleRawJSON, &resourceWriter{sink: io.Discard})
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, page.resources)
+		assert.NotEmpty(t, page.inlineOutcomes)
+	})
+
+	t.Run("TransformedBundleEntry", func(t *testing.T) {
+		searchMode := fm.SearchEntryModeMatch
+
+		var bundle fm.BundleEntry
+		bundle.Resource = []byte(`{"resourceType": "Patient", "name": [{"family": "Doe"}]}`)
+		bundle.Search = &fm.BundleEntrySearch{
+			Mode: &searchMode,
+		}
+
+		d, _ := newDeidentifier(data.Deidentification{Drop: []string{"Patient.name"}})
+
+		var sink bytes.Buffer
+		bundleRawJSON, _ := json.Marshal(fm.Bundle{Entry: []fm.BundleEntry{bundle}})
+		page, err := writePage(bundleRawJSON, &resourceWriter{sink: &sink, transform: d.resource})
 
 		assert.Nil(t, err)
-		assert.Equal(t, 1, resources)
-		assert.NotEmpty(t, outcomes)
+		assert.Equal(t, 1, page.resources)
+		assert.Empty(t, page.inlineOutcomes)
+		assert.Equal(t, "{\"resourceType\":\"Patient\"}\n", sink.String())
 	})
 }
@@ -0,0 +1,584 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/spf13/cobra"
+)
+
+var exportTypes []string
+var exportSince string
+var exportTypeFilters []string
+var exportPollInterval time.Duration
+var exportConcurrency int
+var exportStatusURL string
+
+// exportManifest is the response of the status endpoint of a completed bulk data export. It is
+// also written as manifest.json after a download.
+type exportManifest struct {
+	TransactionTime     string       `json:"transactionTime"`
+	Request             string       `json:"request"`
+	RequiresAccessToken bool         `json:"requiresAccessToken"`
+	Output              []exportFile `json:"output"`
+	Error               []exportFile `json:"error"`
+}
+
+type exportFile struct {
+	Type  string `json:"type"`
+	Url   string `json:"url"`
+	Count *int   `json:"count,omitempty"`
+	// hex encoded SHA-256 checksum of the file, only written by downloads
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+// exportResponseError is returned if the server responds with an unexpected status during a
+// bulk data export.
+type exportResponseError struct {
+	step     string
+	response *util.ErrorResponse
+}
+
+func (e *exportResponseError) Error() string {
+	return fmt.Sprintf("%s failed:\n%s", e.step, util.Indent(2, strings.TrimSuffix(e.response.String(), "\n")))
+}
+
+// errorResponseOf reads the body of the given response into an error response.
+func errorResponseOf(resp *http.Response) *util.ErrorResponse {
+	errorResponse := &util.ErrorResponse{StatusCode: resp.StatusCode}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		errorResponse.OtherError = err.Error()
+		return errorResponse
+	}
+	if outcome, err := fm.UnmarshalOperationOutcome(body); err == nil && len(outcome.Issue) > 0 {
+		errorResponse.OperationOutcome = &outcome
+		return errorResponse
+	}
+	errorResponse.OtherError = strings.TrimSpace(string(body))
+	return errorResponse
+}
+
+// exportPath returns the path of the kick-off endpoint relative to the base URL for the given
+// command arguments. No argument means a system level export.
+func exportPath(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	if args[0] == "Patient" {
+		return "Patient", nil
+	}
+	if id := strings.TrimPrefix(args[0], "Group/"); id != args[0] && id != "" && !strings.Contains(id, "/") {
+		return args[0], nil
+	}
+	return "", fmt.Errorf("invalid export level `%s`, expect Patient or Group/<id>", args[0])
+}
+
+// exportParameters returns the kick-off parameters given by the flags of the export command.
+func exportParameters() url.Values {
+	parameters := url.Values{}
+	if len(exportTypes) > 0 {
+		parameters.Set("_type", strings.Join(exportTypes, ","))
+	}
+	if exportSince != "" {
+		parameters.Set("_since", exportSince)
+	}
+	for _, typeFilter := range exportTypeFilters {
+		parameters.Add("_typeFilter", typeFilter)
+	}
+	return parameters
+}
+
+// kickOffExport starts a bulk data export at the given path and returns the URL of its status
+// endpoint.
+func kickOffExport(client *fhir.Client, path string, parameters url.Values) (*url.URL, error) {
+	req, err := client.NewBulkExportKickOffRequest(path, parameters)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, &exportResponseError{step: "Kick-off", response: errorResponseOf(resp)}
+	}
+	location := resp.Header.Get("Content-Location")
+	if location == "" {
+		return nil, errors.New("missing Content-Location header in the kick-off response")
+	}
+	statusURL, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the status URL `%s`: %v", location, err)
+	}
+	return req.URL.ResolveReference(statusURL), nil
+}
+
+// retryAfter returns the duration to wait given by a Retry-After header value in seconds or as
+// HTTP date. Returns the fallback if the value is missing or invalid.
+func retryAfter(value string, now time.Time, fallback time.Duration) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if wait := t.Sub(now); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return fallback
+}
+
+// exportPoller polls the status endpoint of a bulk data export until it is complete.
+type exportPoller struct {
+	client *fhir.Client
+	// interval used if the server doesn't send a Retry-After header
+	interval time.Duration
+	sleep    func(time.Duration)
+	// called with the X-Progress header whenever it changes
+	onProgress func(progress string)
+}
+
+func (p *exportPoller) poll(statusURL *url.URL) (*exportManifest, error) {
+	var lastProgress string
+	for {
+		req, err := p.client.NewBulkExportStatusRequest(statusURL)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var manifest exportManifest
+			err := json.NewDecoder(resp.Body).Decode(&manifest)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("could not parse the export manifest: %v", err)
+			}
+			return &manifest, nil
+		case http.StatusAccepted, http.StatusTooManyRequests:
+			resp.Body.Close()
+			if progress := resp.Header.Get("X-Progress"); progress != "" && progress != lastProgress {
+				lastProgress = progress
+				if p.onProgress != nil {
+					p.onProgress(progress)
+				}
+			}
+			p.sleep(retryAfter(resp.Header.Get("Retry-After"), time.Now(), p.interval))
+		default:
+			errorResponse := errorResponseOf(resp)
+			resp.Body.Close()
+			return nil, &exportResponseError{step: "Export", response: errorResponse}
+		}
+	}
+}
+
+// deleteExport deletes the bulk data export with the given status URL on the server.
+func deleteExport(client *fhir.Client, statusURL *url.URL) error {
+	req, err := client.NewBulkExportDeleteRequest(statusURL)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &exportResponseError{step: "Deleting the export", response: errorResponseOf(resp)}
+	}
+	return nil
+}
+
+// exportDownload is the download of one output or error file of a bulk data export.
+type exportDownload struct {
+	url      string
+	filename string
+	// number of resources announced in the manifest, nil if unknown
+	expected  *int
+	isError   bool
+	bytes     int64
+	resources int
+	// duration of the whole download in seconds
+	duration float64
+	err      error
+}
+
+// exportDownloads returns the downloads of all output and error files of the given manifest.
+// Output files are named after their type, like Patient.ndjson. If there are multiple files of
+// a type, they are numbered, like Patient-0001.ndjson. Error files are named errors.ndjson.
+func exportDownloads(manifest *exportManifest, dir string) []*exportDownload {
+	var downloads []*exportDownload
+	add := func(files []exportFile, isError bool) {
+		filesPerType := make(map[string]int)
+		for _, file := range files {
+			filesPerType[file.Type]++
+		}
+		indexPerType := make(map[string]int)
+		for _, file := range files {
+			filename := file.Type + ".ndjson"
+			if isError {
+				filename = "errors.ndjson"
+			}
+			if filesPerType[file.Type] > 1 {
+				filename = shardFilename(filename, indexPerType[file.Type])
+				indexPerType[file.Type]++
+			}
+			downloads = append(downloads, &exportDownload{
+				url:      file.Url,
+				filename: filepath.Join(dir, filename),
+				expected: file.Count,
+				isError:  isError,
+			})
+		}
+	}
+	add(manifest.Output, false)
+	add(manifest.Error, true)
+	return downloads
+}
+
+// downloadFilenames returns the filenames of the given downloads.
+func downloadFilenames(downloads []*exportDownload) []string {
+	filenames := make([]string, 0, len(downloads))
+	for _, download := range downloads {
+		filenames = append(filenames, download.filename)
+	}
+	return filenames
+}
+
+// ndjsonCounter counts the bytes and lines written to it.
+type ndjsonCounter struct {
+	bytes int64
+	lines int
+}
+
+func (c *ndjsonCounter) Write(p []byte) (int, error) {
+	c.bytes += int64(len(p))
+	c.lines += bytes.Count(p, []byte{'\n'})
+	return len(p), nil
+}
+
+// downloadExportFile downloads the file of the given download into its file. The file is written
+// under a temporary name and only renamed once it is complete, so that a failed download leaves
+// no partial file behind. The credentials of the client are only sent if the manifest requires an
+// access token and the file is served by the FHIR server, so that they never leak to other hosts
+// like object stores.
+func downloadExportFile(client *fhir.Client, download *exportDownload, requiresAccessToken bool) {
+	start := time.Now()
+	defer func() { download.duration = time.Since(start).Seconds() }()
+
+	fileURL, err := url.Parse(download.url)
+	if err != nil {
+		download.err = fmt.Errorf("could not parse the file URL `%s`: %v", download.url, err)
+		return
+	}
+	req, err := client.NewBulkExportFileRequest(fileURL)
+	if err != nil {
+		download.err = err
+		return
+	}
+	var resp *http.Response
+	if requiresAccessToken && client.IsServerURL(fileURL) {
+		resp, err = client.Do(req)
+	} else {
+		resp, err = client.DoWithoutAuth(req)
+	}
+	if err != nil {
+		download.err = err
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		download.err = &exportResponseError{step: "Download of " + download.url, response: errorResponseOf(resp)}
+		return
+	}
+
+	tempFilename := download.filename + ".tmp"
+	file, err := os.Create(tempFilename)
+	if err != nil {
+		download.err = err
+		return
+	}
+
+	sink := bufio.NewWriter(file)
+	counter := &ndjsonCounter{}
+	if _, err := io.Copy(io.MultiWriter(sink, counter), resp.Body); err != nil {
+		download.err = fmt.Errorf("could not download %s: %v", download.url, err)
+	} else if err := sink.Flush(); err != nil {
+		download.err = fmt.Errorf("could not write the file %s: %v", download.filename, err)
+	}
+	if err := file.Close(); err != nil && download.err == nil {
+		download.err = fmt.Errorf("could not write the file %s: %v", download.filename, err)
+	}
+	download.bytes = counter.bytes
+	download.resources = counter.lines
+
+	if download.err == nil {
+		download.err = os.Rename(tempFilename, download.filename)
+	}
+	if download.err != nil {
+		os.Remove(tempFilename)
+	}
+}
+
+// downloadExportFiles runs the given downloads with at most concurrency downloads at the same
+// time.
+func downloadExportFiles(client *fhir.Client, downloads []*exportDownload, requiresAccessToken bool, concurrency int) {
+	limiter := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for _, download := range downloads {
+		download := download
+		wg.Add(1)
+		limiter <- true
+		go func() {
+			defer wg.Done()
+			defer func() { <-limiter }()
+			downloadExportFile(client, download, requiresAccessToken)
+		}()
+	}
+	wg.Wait()
+}
+
+type exportStats struct {
+	// duration from the kick-off until the export was complete
+	exportDuration time.Duration
+	totalDuration  time.Duration
+	downloads      []*exportDownload
+}
+
+func (s *exportStats) String() string {
+	builder := strings.Builder{}
+
+	var files, resources, errorFiles, issues int
+	var totalBytesIn int64
+	durations := make([]float64, 0, len(s.downloads))
+	for _, download := range s.downloads {
+		totalBytesIn += download.bytes
+		durations = append(durations, download.duration)
+		if download.isError {
+			errorFiles++
+			issues += download.resources
+		} else {
+			files++
+			resources += download.resources
+		}
+	}
+
+	builder.WriteString(fmt.Sprintf("Files		[total]			%d\n", files))
+	builder.WriteString(fmt.Sprintf("Resources 	[total]			%d\n", resources))
+	builder.WriteString(fmt.Sprintf("Export		[duration]		%s\n", util.FmtDurationHumanReadable(s.exportDuration)))
+	builder.WriteString(fmt.Sprintf("Duration	[total]			%s\n", util.FmtDurationHumanReadable(s.totalDuration)))
+
+	if len(durations) > 0 {
+		p := util.CalculateDurationStatistics(durations)
+		builder.WriteString(fmt.Sprintf("Down. Latencies	[mean, 50, 95, 99, max]	%s, %s, %s, %s, %s\n", p.Mean, p.Q50, p.Q95, p.Q99, p.Max))
+		builder.WriteString(fmt.Sprintf("Bytes In	[total, mean]		%s, %s\n", util.FmtBytesHumanReadable(float32(totalBytesIn)), util.FmtBytesHumanReadable(float32(totalBytesIn)/float32(len(durations)))))
+	}
+
+	if errorFiles > 0 {
+		builder.WriteString(fmt.Sprintf("\nThe export reported %d issues in %d error files.\n", issues, errorFiles))
+	}
+
+	var problems []string
+	for _, download := range s.downloads {
+		if download.err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", download.url, download.err))
+		} else if download.expected != nil && *download.expected != download.resources {
+			problems = append(problems, fmt.Sprintf("%s: expected %d resources but got %d", download.url,
+				*download.expected, download.resources))
+		}
+	}
+	if len(problems) > 0 {
+		builder.WriteString("\nFailed Downloads:\n")
+		builder.WriteString(util.Indent(2, strings.Join(problems, "\n")) + "\n")
+	}
+
+	return builder.String()
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export [Patient | Group/<id>]",
+	Short: "Export FHIR resources using the Bulk Data API",
+	Long: `Exports FHIR resources using the asynchronous Bulk Data API and puts them into
+NDJSON files within the directory denoted by the -d/--output-dir flag.
+
+Without an argument, all resources of the server are exported. With Patient, all resources
+of the patient compartments are exported and with Group/<id>, the resources of the patients
+of the given group.
+
+The export can be limited to resource types with --type, to resources updated since a given
+time with --since and to resources matching search queries like
+"MedicationRequest?status=active" with --type-filter.
+
+After the export is kicked off, its status is polled every --poll-interval unless the
+server asks for another interval. Once the export is complete, all files are downloaded in
+parallel and the export is deleted on the server. If a download fails or an output file does
+already exist, the export is kept on the server and its status URL is printed. Files of a failed
+download are removed. With --status-url, the files of such a kept export are downloaded
+instead of kicking off a new export.
+Credentials are only sent with file downloads if the manifest requires an access token and
+the files are served by the FHIR server itself. Output files are named after their
+resource type, like Patient.ndjson. Multiple files of a type are numbered, like
+Patient-0001.ndjson, and files with issues reported by the server are named errors.ndjson.
+The manifest of the export is kept as manifest.json, so that the export can be loaded into
+another server with the import command.
+
+Example:
+
+	blazectl export --server http://localhost:8080/fhir -d ~/Downloads/export
+	blazectl export --server http://localhost:8080/fhir Group/0 --type Patient,Observation -d ~/Downloads/export
+	blazectl export --server http://localhost:8080/fhir --status-url http://localhost:8080/fhir/__async-status/1 -d ~/Downloads/export`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := exportPath(args)
+		if err != nil {
+			return err
+		}
+		var statusURL *url.URL
+		if exportStatusURL != "" {
+			if len(args) > 0 || len(exportParameters()) > 0 {
+				return errors.New("--status-url can't be combined with an export level, --type, --since or --type-filter")
+			}
+			if statusURL, err = url.Parse(exportStatusURL); err != nil || !statusURL.IsAbs() {
+				return fmt.Errorf("invalid --status-url `%s`", exportStatusURL)
+			}
+		}
+		if err := createClient(); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return fmt.Errorf("could not create the output directory %s: %v", outputDir, err)
+		}
+
+		startTime := time.Now()
+		if statusURL == nil {
+			if statusURL, err = kickOffExport(client, path, exportParameters()); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Printf("Kicked off the export with status URL %s\n", statusURL)
+
+			// delete the export on the server if the command is interrupted
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				fmt.Println("Interrupted, deleting the export ...")
+				if err := deleteExport(client, statusURL); err != nil {
+					fmt.Printf("Failed to delete the export: %v\n", err)
+				}
+				os.Exit(1)
+			}()
+		}
+
+		poller := exportPoller{
+			client:     client,
+			interval:   exportPollInterval,
+			sleep:      time.Sleep,
+			onProgress: func(progress string) { fmt.Printf("Export in progress: %s\n", progress) },
+		}
+		manifest, err := poller.poll(statusURL)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		stats := exportStats{exportDuration: time.Since(startTime)}
+
+		stats.downloads = exportDownloads(manifest, outputDir)
+		localManifest := &downloadManifest{filename: filepath.Join(outputDir, manifestBasename), manifest: *manifest}
+		for _, filename := range append(downloadFilenames(stats.downloads), localManifest.filename) {
+			if _, err := os.Stat(filename); err == nil {
+				fmt.Printf("The output file %s does already exist.\n", filename)
+				fmt.Printf("Kept the export on the server, its files can be downloaded into another directory with --status-url %s\n", statusURL)
+				os.Exit(3)
+			}
+		}
+
+		fmt.Printf("Downloading %d files ...\n", len(stats.downloads))
+		downloadExportFiles(client, stats.downloads, manifest.RequiresAccessToken, exportConcurrency)
+
+		failed := false
+		for _, download := range stats.downloads {
+			if download.err != nil {
+				failed = true
+			}
+		}
+		// the export is the only copy of the files, so it's kept if a download failed
+		if !failed {
+			if err := deleteExport(client, statusURL); err != nil {
+				fmt.Printf("Failed to delete the export: %v\n", err)
+			}
+		}
+		stats.totalDuration = time.Since(startTime)
+
+		// keep the manifest, so that the export can be imported later
+		if err := localManifest.write(); err != nil {
+			fmt.Printf("Failed to write the manifest: %v\n", err)
+		}
+
+		fmt.Println()
+		fmt.Print(stats.String())
+
+		if failed {
+			fmt.Printf("\nKept the export on the server, its files can be downloaded again with --status-url %s\n", statusURL)
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().StringVar(&server, "server", "", "the base URL of the server to use")
+	exportCmd.Flags().StringVarP(&outputDir, "output-dir", "d", "", "path to the directory the exported NDJSON files get written to")
+	exportCmd.Flags().StringSliceVar(&exportTypes, "type", nil, "comma separated resource types to export")
+	exportCmd.Flags().StringVar(&exportSince, "since", "", "only export resources updated since this FHIR instant")
+	exportCmd.Flags().StringArrayVar(&exportTypeFilters, "type-filter", nil, "search query like MedicationRequest?status=active resources have to match, can be repeated")
+	exportCmd.Flags().DurationVar(&exportPollInterval, "poll-interval", 5*time.Second, "interval to poll the status of the export if the server doesn't ask for another")
+	exportCmd.Flags().IntVarP(&exportConcurrency, "concurrency", "c", 4, "number of files downloaded in parallel")
+	exportCmd.Flags().StringVar(&exportStatusURL, "status-url", "", "download the files of a kept export from its status URL instead of kicking off a new export")
+
+	_ = exportCmd.MarkFlagRequired("server")
+	_ = exportCmd.MarkFlagRequired("output-dir")
+	_ = exportCmd.MarkFlagDirname("output-dir")
+}
@@ -0,0 +1,263 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+// exportServer is a stub of a server supporting the Bulk Data API. The export is complete after
+// pendingPolls polls of the status endpoint.
+type exportServer struct {
+	*httptest.Server
+	pendingPolls int
+	mutex        sync.Mutex
+	kickOff      *http.Request
+	polls        int
+	deleted      bool
+}
+
+func newExportServer(t *testing.T, pendingPolls int) *exportServer {
+	s := &exportServer{pendingPolls: pendingPolls}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		switch {
+		case r.URL.Path == "/Group/0/$export":
+			s.kickOff = r
+			w.Header().Set("Content-Location", "/status/1")
+			w.WriteHeader(http.StatusAccepted)
+		case r.URL.Path == "/status/1" && r.Method == http.MethodDelete:
+			s.deleted = true
+			w.WriteHeader(http.StatusAccepted)
+		case r.URL.Path == "/status/1":
+			s.polls++
+			if s.polls <= s.pendingPolls {
+				w.Header().Set("X-Progress", fmt.Sprintf("%d%%", 50*s.polls))
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			count := 2
+			manifest := exportManifest{
+				TransactionTime: "2022-10-01T00:00:00Z",
+				Request:         s.URL + "/Group/0/$export",
+				Output: []exportFile{
+					{Type: "Patient", Url: s.URL + "/files/patient", Count: &count},
+					{Type: "Observation", Url: s.URL + "/files/observation-0"},
+					{Type: "Observation", Url: s.URL + "/files/observation-1"},
+				},
+				Error: []exportFile{{Type: "OperationOutcome", Url: s.URL + "/files/errors"}},
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(manifest); err != nil {
+				t.Error(err)
+			}
+		case r.URL.Path == "/files/patient":
+			_, _ = w.Write([]byte("{\"resourceType\":\"Patient\",\"id\":\"0\"}\n{\"resourceType\":\"Patient\",\"id\":\"1\"}\n"))
+		case r.URL.Path == "/files/observation-0" || r.URL.Path == "/files/observation-1":
+			_, _ = w.Write([]byte("{\"resourceType\":\"Observation\",\"id\":\"0\"}\n"))
+		case r.URL.Path == "/files/errors":
+			_, _ = w.Write([]byte("{\"resourceType\":\"OperationOutcome\"}\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return s
+}
+
+func TestExportPath(t *testing.T) {
+	for _, args := range [][]string{{}, {"Patient"}, {"Group/0"}} {
+		path, err := exportPath(args)
+		assert.NoError(t, err)
+		if len(args) == 0 {
+			assert.Equal(t, "", path)
+		} else {
+			assert.Equal(t, args[0], path)
+		}
+	}
+
+	for _, arg := range []string{"Observation", "Group", "Group/", "Group/0/1"} {
+		_, err := exportPath([]string{arg})
+		assert.Error(t, err, arg)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 120*time.Second, retryAfter("120", now, time.Second))
+	assert.Equal(t, 30*time.Second, retryAfter("Sat, 01 Oct 2022 00:00:30 GMT", now, time.Second))
+	assert.Equal(t, time.Duration(0), retryAfter("Fri, 30 Sep 2022 00:00:00 GMT", now, time.Second))
+	assert.Equal(t, time.Second, retryAfter("", now, time.Second))
+	assert.Equal(t, time.Second, retryAfter("soon", now, time.Second))
+}
+
+func TestExport(t *testing.T) {
+	server := newExportServer(t, 2)
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	statusURL, err := kickOffExport(client, "Group/0", url.Values{"_type": {"Patient,Observation"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, server.URL+"/status/1", statusURL.String())
+	assert.Equal(t, "respond-async", server.kickOff.Header.Get("Prefer"))
+	assert.Equal(t, "Patient,Observation", server.kickOff.URL.Query().Get("_type"))
+
+	var progress []string
+	var sleeps []time.Duration
+	poller := exportPoller{
+		client:     client,
+		interval:   time.Minute,
+		sleep:      func(d time.Duration) { sleeps = append(sleeps, d) },
+		onProgress: func(p string) { progress = append(progress, p) },
+	}
+	manifest, err := poller.poll(statusURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"50%", "100%"}, progress)
+	assert.Equal(t, []time.Duration{time.Second, time.Second}, sleeps)
+	assert.Len(t, manifest.Output, 3)
+
+	dir := t.TempDir()
+	downloads := exportDownloads(manifest, dir)
+	downloadExportFiles(client, downloads, false, 2)
+
+	for i, filename := range []string{"Patient.ndjson", "Observation-0001.ndjson", "Observation-0002.ndjson", "errors.ndjson"} {
+		assert.NoError(t, downloads[i].err)
+		assert.Equal(t, filepath.Join(dir, filename), downloads[i].filename)
+		_, err := os.Stat(downloads[i].filename)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, downloads[0].resources)
+	assert.Equal(t, 1, downloads[1].resources)
+	assert.True(t, downloads[3].isError)
+
+	// the import finds the downloaded files
+	for _, file := range importFiles(manifest, dir) {
+		assert.NoError(t, checkImportFile(file))
+	}
+
+	stats := exportStats{downloads: downloads}
+	assert.Contains(t, stats.String(), "Resources 	[total]			4\n")
+	assert.Contains(t, stats.String(), "The export reported 1 issues in 1 error files.")
+	assert.NotContains(t, stats.String(), "Failed Downloads")
+
+	assert.NoError(t, deleteExport(client, statusURL))
+	assert.True(t, server.deleted)
+}
+
+func TestKickOffExportError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/fhir+json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"resourceType":"OperationOutcome","issue":[{"severity":"error","code":"invalid","diagnostics":"unknown type"}]}`))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	_, err := kickOffExport(client, "", url.Values{"_type": {"Foo"}})
+	if assert.Error(t, err) {
+		responseErr, ok := err.(*exportResponseError)
+		if assert.True(t, ok) {
+			assert.Equal(t, http.StatusBadRequest, responseErr.response.StatusCode)
+			assert.NotNil(t, responseErr.response.OperationOutcome)
+		}
+		assert.Contains(t, err.Error(), "unknown type")
+	}
+}
+
+func TestExportStatsCountMismatch(t *testing.T) {
+	expected := 3
+	stats := exportStats{downloads: []*exportDownload{{url: "http://localhost/files/0", expected: &expected, resources: 2}}}
+
+	assert.Contains(t, stats.String(), "http://localhost/files/0: expected 3 resources but got 2")
+}
+
+func TestDownloadExportFileCredentials(t *testing.T) {
+	var mutex sync.Mutex
+	authorized := make(map[string]bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		_, _, ok := r.BasicAuth()
+		authorized[r.Host+r.URL.Path] = ok
+		_, _ = w.Write([]byte("{\"resourceType\":\"Patient\",\"id\":\"0\"}\n"))
+	})
+	fhirServer := httptest.NewServer(handler)
+	defer fhirServer.Close()
+	objectStore := httptest.NewServer(handler)
+	defer objectStore.Close()
+
+	baseURL, _ := url.ParseRequestURI(fhirServer.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{BasicAuthUser: "user", BasicAuthPassword: "secret"})
+
+	for _, requiresAccessToken := range []bool{false, true} {
+		dir := t.TempDir()
+		downloads := []*exportDownload{
+			{url: fhirServer.URL + "/files/0", filename: filepath.Join(dir, "0.ndjson")},
+			{url: objectStore.URL + "/files/1", filename: filepath.Join(dir, "1.ndjson")},
+		}
+
+		downloadExportFiles(client, downloads, requiresAccessToken, 2)
+
+		assert.NoError(t, downloads[0].err)
+		assert.NoError(t, downloads[1].err)
+		assert.Equal(t, requiresAccessToken, authorized[baseURL.Host+"/files/0"])
+		assert.False(t, authorized[strings.TrimPrefix(objectStore.URL, "http://")+"/files/1"])
+	}
+}
+
+func TestDownloadExportFileFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the connection is closed before the announced content is sent
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write([]byte("{\"resourceType\":\"Patient\",\"id\":\"0\"}\n"))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+	dir := t.TempDir()
+	download := &exportDownload{url: server.URL + "/files/0", filename: filepath.Join(dir, "Patient.ndjson")}
+
+	downloadExportFile(client, download, false)
+
+	assert.Error(t, download.err)
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,525 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/spf13/cobra"
+)
+
+var importBatchSize int
+var importConcurrency int
+
+// importTypeOrder lists the resource types which are imported before all other types. Types in
+// the same group are imported together. Conformance and terminology resources come first, then
+// the resources clinical data refers to, like patients, their encounters and medications.
+var importTypeOrder = [][]string{
+	{"CodeSystem", "ValueSet", "ConceptMap", "NamingSystem", "StructureDefinition", "StructureMap",
+		"SearchParameter", "OperationDefinition", "CompartmentDefinition", "CapabilityStatement",
+		"ImplementationGuide", "GraphDefinition", "MessageDefinition", "Library", "Questionnaire"},
+	{"Organization", "Endpoint"},
+	{"Location", "HealthcareService"},
+	{"Practitioner"},
+	{"PractitionerRole"},
+	{"Patient"},
+	{"RelatedPerson", "Device", "Medication", "Substance"},
+	{"Group", "Account", "Coverage", "EpisodeOfCare"},
+	{"Encounter"},
+}
+
+// importStage returns the zero-based stage in which resources of the given type are imported.
+// Unknown types are imported in the last stage.
+func importStage(resourceType string) int {
+	for stage, resourceTypes := range importTypeOrder {
+		for _, t := range resourceTypes {
+			if t == resourceType {
+				return stage
+			}
+		}
+	}
+	return len(importTypeOrder)
+}
+
+// importFile is a local NDJSON file of one resource type listed in a manifest.
+type importFile struct {
+	resourceType string
+	filename     string
+}
+
+// importFiles returns the local files of all output files of the given manifest in import order.
+// Relative URLs are resolved against the directory of the manifest. Files referenced by HTTP URLs
+// are expected to be downloaded by the export command into that directory.
+func importFiles(manifest *exportManifest, dir string) []importFile {
+	downloads := exportDownloads(manifest, dir)
+	files := make([]importFile, 0, len(manifest.Output))
+	for i, output := range manifest.Output {
+		filename := filepath.FromSlash(output.Url)
+		if u, err := url.Parse(output.Url); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			filename = downloads[i].filename
+		} else if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		files = append(files, importFile{resourceType: output.Type, filename: filename})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return importStage(files[i].resourceType) < importStage(files[j].resourceType)
+	})
+	return files
+}
+
+// readImportManifest reads the manifest with the given filename.
+func readImportManifest(filename string) (*exportManifest, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var manifest exportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest %s: %v", filename, err)
+	}
+	return &manifest, nil
+}
+
+// checkImportFile returns an error if the given file can't be imported.
+func checkImportFile(file importFile) error {
+	for _, extension := range compressionExtensions {
+		if strings.HasSuffix(file.filename, extension) {
+			return fmt.Errorf("the file %s is compressed, please decompress it first", file.filename)
+		}
+	}
+	if _, err := os.Stat(file.filename); err != nil {
+		return fmt.Errorf("the %s file %s can't be found: %v", file.resourceType, file.filename, err)
+	}
+	return nil
+}
+
+// resourceChunks returns one bundle for every batchSize resources of the given NDJSON file. The
+// resources of each bundle are uploaded together in one batch bundle.
+func resourceChunks(filename string, batchSize int) ([]bundle, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	calcRes := make(chan util.FileChunkCalculationResult)
+	go util.CalculateFileChunks(bufio.NewReader(f), MultiBundleFileBundleDelimiter, calcRes)
+
+	var bundles []bundle
+	var current *bundleIdentifier
+	var lines int
+	for res := range calcRes {
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		if res.FileChunk.StartBytes == res.FileChunk.EndBytes {
+			continue
+		}
+		if current == nil {
+			current = &bundleIdentifier{
+				filename:     filename,
+				bundleNumber: len(bundles) + 1,
+				startBytes:   res.FileChunk.StartBytes,
+				resources:    true,
+			}
+		}
+		current.endBytes = res.FileChunk.EndBytes
+		lines++
+		if lines == batchSize {
+			bundles = append(bundles, bundle{id: *current})
+			current = nil
+			lines = 0
+		}
+	}
+	if current != nil {
+		bundles = append(bundles, bundle{id: *current})
+	}
+	return bundles, nil
+}
+
+// resourceBatchBundle packs the given NDJSON resources into a batch bundle. Resources with an id
+// are updated, so that references between the resources stay intact, all other resources are
+// created.
+func resourceBatchBundle(data []byte) ([]byte, error) {
+	batch := fm.Bundle{Type: fm.BundleTypeBatch}
+	for i, line := range bytes.Split(data, []byte{MultiBundleFileBundleDelimiter}) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var resource struct {
+			ResourceType string `json:"resourceType"`
+			Id           string `json:"id"`
+		}
+		if err := json.Unmarshal(line, &resource); err != nil {
+			return nil, fmt.Errorf("error while parsing the resource in line %d of the chunk: %w", i+1, err)
+		}
+		if resource.ResourceType == "" {
+			return nil, fmt.Errorf("missing resourceType in line %d of the chunk", i+1)
+		}
+
+		request := &fm.BundleEntryRequest{Method: fm.HTTPVerbPOST, Url: resource.ResourceType}
+		if resource.Id != "" {
+			request = &fm.BundleEntryRequest{Method: fm.HTTPVerbPUT, Url: resource.ResourceType + "/" + resource.Id}
+		}
+		batch.Entry = append(batch.Entry, fm.BundleEntry{Resource: line, Request: request})
+	}
+	return json.Marshal(batch)
+}
+
+// importStages groups the chunks of the given files by their import stage.
+func importStages(files []importFile, batchSize int) ([][]bundle, error) {
+	var stages [][]bundle
+	lastStage := -1
+	for _, file := range files {
+		chunks, err := resourceChunks(file.filename, batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading %s: %w", file.filename, err)
+		}
+		if stage := importStage(file.resourceType); stage != lastStage {
+			stages = append(stages, nil)
+			lastStage = stage
+		}
+		stages[len(stages)-1] = append(stages[len(stages)-1], chunks...)
+	}
+	return stages, nil
+}
+
+// isReferentialIntegrityError returns true if the given entry was rejected because it refers to a
+// resource the server doesn't know yet. Blaze responds with 409 Conflict in that case.
+func isReferentialIntegrityError(errorResponse util.ErrorResponse) bool {
+	return errorResponse.StatusCode == http.StatusConflict
+}
+
+// retryableEntries returns the failed entries of the given result which failed with a referential
+// integrity error.
+func retryableEntries(result bundleUploadResult) []failedEntry {
+	var entries []failedEntry
+	for _, entry := range result.failedEntries {
+		if isReferentialIntegrityError(entry.errorResponse) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// chunkLines returns the non-empty NDJSON lines of the chunk identified by the given id. Line i is
+// the resource of entry i of the batch bundle of the chunk.
+func chunkLines(id bundleIdentifier) ([][]byte, error) {
+	reader, closer, err := openBundle(&id)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte{MultiBundleFileBundleDelimiter}) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// retryEntries uploads the entries of the given result which failed with a referential integrity
+// error again in one batch bundle. Entries which succeed are removed from the failed entries and
+// counted in the result. Returns the number of entries which succeeded.
+func retryEntries(consumer *uploadBundleConsumer, result *bundleUploadResult) int {
+	entries := retryableEntries(*result)
+	if len(entries) == 0 {
+		return 0
+	}
+	lines, err := chunkLines(result.id)
+	if err != nil {
+		return 0
+	}
+
+	var data []byte
+	indices := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		if entry.index >= len(lines) {
+			return 0
+		}
+		data = append(append(data, lines[entry.index]...), MultiBundleFileBundleDelimiter)
+		indices = append(indices, entry.index)
+	}
+	batch, err := resourceBatchBundle(data)
+	if err != nil {
+		return 0
+	}
+	retry := consumer.uploadData(result.id, batch)
+	if retry.err != nil || retry.uploadInfo.statusCode != http.StatusOK || retry.inspectionErr != nil {
+		return 0
+	}
+	result.uploadInfo.bytesOut += retry.uploadInfo.bytesOut
+	result.uploadInfo.bytesIn += retry.uploadInfo.bytesIn
+
+	stillFailed := make(map[int]failedEntry)
+	for _, entry := range retry.failedEntries {
+		stillFailed[indices[entry.index]] = failedEntry{index: indices[entry.index], errorResponse: entry.errorResponse}
+	}
+	var failedEntries []failedEntry
+	var succeeded int
+	for _, entry := range result.failedEntries {
+		if !isReferentialIntegrityError(entry.errorResponse) {
+			failedEntries = append(failedEntries, entry)
+		} else if failed, ok := stillFailed[entry.index]; ok {
+			failedEntries = append(failedEntries, failed)
+		} else {
+			succeeded++
+		}
+	}
+	result.failedEntries = failedEntries
+
+	if result.resourceCounts == nil {
+		result.resourceCounts = make(map[string]resourceCounts)
+	}
+	for resourceType, counts := range retry.resourceCounts {
+		c := result.resourceCounts[resourceType]
+		c.add(counts)
+		result.resourceCounts[resourceType] = c
+	}
+	return succeeded
+}
+
+// retryHeldResults retries the entries of the held results which failed with a referential
+// integrity error, until no more of them succeed. Results without such entries left are sent to
+// results, all others are returned.
+func retryHeldResults(consumer *uploadBundleConsumer, held []bundleUploadResult, concurrency int,
+	results chan<- bundleUploadResult) []bundleUploadResult {
+	for {
+		succeeded := make([]int, len(held))
+		limiter := make(chan bool, concurrency)
+		var wg sync.WaitGroup
+		for i := range held {
+			i := i
+			wg.Add(1)
+			limiter <- true
+			go func() {
+				defer wg.Done()
+				defer func() { <-limiter }()
+				succeeded[i] = retryEntries(consumer, &held[i])
+			}()
+		}
+		wg.Wait()
+
+		var total int
+		for _, n := range succeeded {
+			total += n
+		}
+		if total == 0 {
+			break
+		}
+	}
+
+	var remaining []bundleUploadResult
+	for _, result := range held {
+		if len(retryableEntries(result)) > 0 {
+			remaining = append(remaining, result)
+		} else {
+			results <- result
+		}
+	}
+	return remaining
+}
+
+// importBundles uploads the given stages one after another, so that the resources of a stage can
+// refer to the resources of all previous stages. No further stage is started once the error
+// budget of the consumer is exceeded.
+//
+// Resources can also refer to resources of the same stage, which are uploaded in parallel, or of
+// later stages. Entries rejected because of such references are held back and uploaded again after
+// every stage, until no more of them succeed. Results of bundles with such entries are only
+// reported after they succeeded or at the end of the import.
+func importBundles(consumer *uploadBundleConsumer, stages [][]bundle, concurrency int) {
+	results := consumer.uploadResults
+	var held []bundleUploadResult
+	defer func() {
+		for _, result := range held {
+			results <- result
+		}
+		consumer.uploadResults = results
+	}()
+
+	for _, stage := range stages {
+		stage := stage
+		stageResults := make(chan bundleUploadResult)
+		consumer.uploadResults = stageResults
+		go func() {
+			var wg sync.WaitGroup
+			consumer.uploadBundles(stage, concurrency, &wg)
+			wg.Wait()
+			close(stageResults)
+		}()
+
+		for result := range stageResults {
+			if len(retryableEntries(result)) > 0 {
+				held = append(held, result)
+			} else {
+				results <- result
+			}
+		}
+		held = retryHeldResults(consumer, held, concurrency, results)
+		if consumer.budget.exceeded() != "" {
+			return
+		}
+	}
+}
+
+var importCmd = &cobra.Command{
+	Use:   "import [manifest]",
+	Short: "Import a Bulk Data export",
+	Long: `You can import the NDJSON files of a Bulk Data export into a server, using
+the manifest of the export.
+
+The output files are located relative to the manifest. Files referenced by
+URL are expected to be downloaded by the export command into the directory
+of the manifest. Files written by the download command can be imported the
+same way. Error files are ignored.
+
+The resource types are imported one stage after another, so that references
+between resources stay intact: conformance and terminology resources first,
+followed by Organization, Location, Practitioner, PractitionerRole, Patient,
+resources like Device and Medication, EpisodeOfCare, Encounter and finally
+all other types. Entries the server rejects with 409 Conflict, because they
+refer to resources it doesn't know yet, are uploaded again after every stage
+until no more of them succeed.
+
+The resources of every file are uploaded in batch bundles of --batch-size
+resources. Resources with an id are updated under that id and all others
+are created. The upload will be parallel according to the --concurrency
+flag and an upload statistic will be printed after the import.
+
+Examples:
+
+  blazectl export --server http://localhost:8080/fhir -d export
+  blazectl import --server http://localhost:8081/fhir export/manifest.json`,
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"json"}, cobra.ShellCompDirectiveFilterFileExt
+	},
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("requires a manifest argument")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if importBatchSize <= 0 {
+			return fmt.Errorf("invalid --batch-size %d", importBatchSize)
+		}
+
+		manifest, err := readImportManifest(args[0])
+		if err != nil {
+			return err
+		}
+
+		files := importFiles(manifest, filepath.Dir(args[0]))
+		if len(files) == 0 {
+			fmt.Println("Found no files to import.")
+			return nil
+		}
+		for _, file := range files {
+			if err := checkImportFile(file); err != nil {
+				return err
+			}
+		}
+
+		err = createClient()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Inspecting %d files eligible for import from %s... ", len(files), args[0])
+		stages, err := importStages(files, importBatchSize)
+		if err != nil {
+			fmt.Println()
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println("DONE")
+
+		var bundles []bundle
+		for _, stage := range stages {
+			bundles = append(bundles, stage...)
+		}
+		fmt.Printf("Starting Import of %d batch bundles in %d stages to %s ...\n", len(bundles), len(stages), server)
+
+		uploadResultCh := make(chan bundleUploadResult)
+		aggregatedUploadResultsCh := make(chan aggregatedUploadResults)
+		progress := createProgress(bundles)
+
+		start := time.Now()
+		bundleConsumer := newUploadBundleConsumer(client, uploadResultCh)
+		bundleConsumer.progress = progress
+		bundleConsumer.budget = newErrorBudget(maxErrors, maxErrorRate)
+		go aggregateUploadResults(uploadResultCh, aggregatedUploadResultsCh, progress, nil, bundleConsumer.budget)
+
+		importBundles(bundleConsumer, stages, importConcurrency)
+
+		close(uploadResultCh)
+		if bundleConsumer.budget.exceeded() != "" {
+			progress.abort()
+		}
+		progress.wait()
+		client.CloseIdleConnections()
+
+		aggResults := <-aggregatedUploadResultsCh
+
+		if reason := bundleConsumer.budget.exceeded(); reason != "" {
+			fmt.Printf("Stopped the import because %s. Skipped %d bundles.\n", reason,
+				len(bundles)-aggResults.totalProcessedBundles)
+		}
+
+		printUploadStatistics(aggResults, importConcurrency, time.Since(start))
+		printUploadProblems(aggResults)
+
+		if len(aggResults.errorResponses) > 0 || len(aggResults.entryErrorResponses) > 0 || len(aggResults.errors) > 0 {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+
+	importCmd.Flags().StringVar(&server, "server", "", "the base URL of the server to use")
+	importCmd.Flags().IntVarP(&importConcurrency, "concurrency", "c", 2, "number of parallel uploads")
+	importCmd.Flags().IntVar(&importBatchSize, "batch-size", 100, "number of resources uploaded together in one batch bundle")
+	importCmd.Flags().IntVar(&maxErrors, "max-errors", 0, "stop the import once this number of bundles failed, zero means unlimited")
+	importCmd.Flags().Float64Var(&maxErrorRate, "max-error-rate", 0, "stop the import once more than this percentage of bundles failed, zero means unlimited")
+
+	_ = importCmd.MarkFlagRequired("server")
+}
@@ -0,0 +1,308 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportStage(t *testing.T) {
+	assert.Less(t, importStage("CodeSystem"), importStage("Organization"))
+	assert.Less(t, importStage("Organization"), importStage("Practitioner"))
+	assert.Less(t, importStage("Practitioner"), importStage("Patient"))
+	assert.Less(t, importStage("Patient"), importStage("Medication"))
+	assert.Less(t, importStage("Medication"), importStage("EpisodeOfCare"))
+	assert.Less(t, importStage("EpisodeOfCare"), importStage("Encounter"))
+	assert.Less(t, importStage("Encounter"), importStage("Observation"))
+	assert.Less(t, importStage("Medication"), importStage("MedicationRequest"))
+	assert.Equal(t, importStage("Observation"), importStage("Condition"))
+}
+
+func TestImportFiles(t *testing.T) {
+	manifest := &exportManifest{Output: []exportFile{
+		{Type: "Observation", Url: "http://localhost:8080/fhir/__bulk-data/1"},
+		{Type: "Patient", Url: "http://localhost:8080/fhir/__bulk-data/2"},
+		{Type: "Observation", Url: "http://localhost:8080/fhir/__bulk-data/3"},
+		{Type: "Organization", Url: "types/organization.ndjson"},
+		{Type: "ValueSet", Url: "/data/value-set.ndjson"},
+	}}
+
+	files := importFiles(manifest, "export")
+
+	assert.Equal(t, []importFile{
+		{resourceType: "ValueSet", filename: filepath.FromSlash("/data/value-set.ndjson")},
+		{resourceType: "Organization", filename: filepath.Join("export", "types", "organization.ndjson")},
+		{resourceType: "Patient", filename: filepath.Join("export", "Patient.ndjson")},
+		{resourceType: "Observation", filename: filepath.Join("export", "Observation-0001.ndjson")},
+		{resourceType: "Observation", filename: filepath.Join("export", "Observation-0002.ndjson")},
+	}, files)
+}
+
+func TestCheckImportFile(t *testing.T) {
+	assert.ErrorContains(t, checkImportFile(importFile{resourceType: "Patient", filename: "patient.ndjson.gz"}), "compressed")
+	assert.ErrorContains(t, checkImportFile(importFile{resourceType: "Patient", filename: filepath.Join(t.TempDir(), "patient.ndjson")}), "can't be found")
+}
+
+func TestResourceChunks(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "patient.ndjson")
+	if err := os.WriteFile(filename, []byte("{\"resourceType\":\"Patient\",\"id\":\"0\"}\n\n"+
+		"{\"resourceType\":\"Patient\",\"id\":\"1\"}\n{\"resourceType\":\"Patient\",\"id\":\"2\"}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := resourceChunks(filename, 2)
+	assert.NoError(t, err)
+	if !assert.Len(t, chunks, 2) {
+		return
+	}
+
+	var ids [][]string
+	for i, chunk := range chunks {
+		assert.Equal(t, i+1, chunk.id.bundleNumber)
+		data, err := readBundle(&chunk.id)
+		assert.NoError(t, err)
+		batch, err := fm.UnmarshalBundle(data)
+		assert.NoError(t, err)
+		assert.Equal(t, fm.BundleTypeBatch, batch.Type)
+
+		var chunkIds []string
+		for _, entry := range batch.Entry {
+			assert.Equal(t, fm.HTTPVerbPUT, entry.Request.Method)
+			chunkIds = append(chunkIds, entry.Request.Url)
+		}
+		ids = append(ids, chunkIds)
+	}
+	assert.Equal(t, [][]string{{"Patient/0", "Patient/1"}, {"Patient/2"}}, ids)
+}
+
+func TestResourceBatchBundle(t *testing.T) {
+	t.Run("WithoutId", func(t *testing.T) {
+		data, err := resourceBatchBundle([]byte("{\"resourceType\":\"Observation\"}\n"))
+		assert.NoError(t, err)
+		batch, err := fm.UnmarshalBundle(data)
+		assert.NoError(t, err)
+		if assert.Len(t, batch.Entry, 1) {
+			assert.Equal(t, fm.HTTPVerbPOST, batch.Entry[0].Request.Method)
+			assert.Equal(t, "Observation", batch.Entry[0].Request.Url)
+		}
+	})
+
+	t.Run("MissingResourceType", func(t *testing.T) {
+		_, err := resourceBatchBundle([]byte("{\"resourceType\":\"Patient\"}\n{\"id\":\"0\"}\n"))
+		assert.ErrorContains(t, err, "missing resourceType in line 2")
+	})
+
+	t.Run("InvalidJson", func(t *testing.T) {
+		_, err := resourceBatchBundle([]byte("{"))
+		assert.Error(t, err)
+	})
+}
+
+func TestImportBundles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, resourceType string, n int) importFile {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(f, "{\"resourceType\":\"%s\",\"id\":\"%d\"}\n", resourceType, i)
+		}
+		return importFile{resourceType: resourceType, filename: f.Name()}
+	}
+	files := []importFile{
+		write("Organization.ndjson", "Organization", 2),
+		write("Patient.ndjson", "Patient", 5),
+		write("Observation.ndjson", "Observation", 3),
+		write("Condition.ndjson", "Condition", 1),
+	}
+
+	var mutex sync.Mutex
+	var received []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, err := fm.UnmarshalBundle(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := fm.Bundle{Type: fm.BundleTypeBatchResponse}
+		mutex.Lock()
+		for _, entry := range request.Entry {
+			received = append(received, entry.Request.Url)
+			location := entry.Request.Url + "/_history/1"
+			response.Entry = append(response.Entry, fm.BundleEntry{
+				Response: &fm.BundleEntryResponse{Status: "201", Location: &location},
+			})
+		}
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	stages, err := importStages(files, 2)
+	assert.NoError(t, err)
+	assert.Len(t, stages, 3)
+
+	baseURL, _ := url.Parse(ts.URL)
+	uploadResults := make(chan bundleUploadResult)
+	aggregated := make(chan aggregatedUploadResults)
+	consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), uploadResults)
+	go aggregateUploadResults(uploadResults, aggregated, noopProgress{}, nil, nil)
+
+	importBundles(consumer, stages, 4)
+	close(uploadResults)
+	results := <-aggregated
+
+	assert.Equal(t, 1+3+2+1, results.totalProcessedBundles)
+	assert.Empty(t, results.errors)
+	assert.Equal(t, 2, results.resourceCounts["Organization"].created)
+	assert.Equal(t, 5, results.resourceCounts["Patient"].created)
+	assert.Equal(t, 3, results.resourceCounts["Observation"].created)
+
+	// all resources of a stage are uploaded before the next stage starts
+	stageOf := func(reference string) int {
+		return importStage(strings.Split(reference, "/")[0])
+	}
+	if assert.Len(t, received, 11) {
+		for i := 1; i < len(received); i++ {
+			assert.LessOrEqual(t, stageOf(received[i-1]), stageOf(received[i]), received)
+		}
+	}
+}
+
+// newReferentialIntegrityServer returns a server which rejects batch entries with 409 Conflict if
+// their resource refers to a resource it hasn't received yet, like Blaze does.
+func newReferentialIntegrityServer(t *testing.T) *httptest.Server {
+	var mutex sync.Mutex
+	received := make(map[string]bool)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, err := fm.UnmarshalBundle(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := fm.Bundle{Type: fm.BundleTypeBatchResponse}
+		mutex.Lock()
+		for _, entry := range request.Entry {
+			var resource struct {
+				References []struct {
+					Reference string `json:"reference"`
+				} `json:"references"`
+			}
+			if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+				t.Error(err)
+			}
+			var missing string
+			for _, reference := range resource.References {
+				if !received[reference.Reference] {
+					missing = reference.Reference
+				}
+			}
+			if missing != "" {
+				outcome, _ := json.Marshal(fm.OperationOutcome{Issue: []fm.OperationOutcomeIssue{{
+					Severity:    fm.IssueSeverityError,
+					Code:        fm.IssueTypeConflict,
+					Diagnostics: &missing,
+				}}})
+				response.Entry = append(response.Entry, fm.BundleEntry{
+					Response: &fm.BundleEntryResponse{Status: "409", Outcome: outcome},
+				})
+				continue
+			}
+			received[entry.Request.Url] = true
+			location := entry.Request.Url + "/_history/1"
+			response.Entry = append(response.Entry, fm.BundleEntry{
+				Response: &fm.BundleEntryResponse{Status: "201", Location: &location},
+			})
+		}
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/fhir+json")
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func TestImportBundlesRetriesReferences(t *testing.T) {
+	dir := t.TempDir()
+	write := func(resourceType string, lines ...string) importFile {
+		filename := filepath.Join(dir, resourceType+".ndjson")
+		if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return importFile{resourceType: resourceType, filename: filename}
+	}
+	files := []importFile{
+		// Organization.partOf refers to an Organization of the same stage
+		write("Organization",
+			`{"resourceType":"Organization","id":"1","references":[{"reference":"Organization/0"}]}`,
+			`{"resourceType":"Organization","id":"0"}`),
+		// Encounter.diagnosis refers to a Condition of a later stage
+		write("Encounter",
+			`{"resourceType":"Encounter","id":"0","references":[{"reference":"Organization/1"},{"reference":"Condition/0"}]}`),
+		write("Condition",
+			`{"resourceType":"Condition","id":"0"}`,
+			`{"resourceType":"Condition","id":"1","references":[{"reference":"Encounter/0"}]}`,
+			`{"resourceType":"Condition","id":"2","references":[{"reference":"Patient/missing"}]}`),
+	}
+	ts := newReferentialIntegrityServer(t)
+	defer ts.Close()
+
+	stages, err := importStages(files, 1)
+	assert.NoError(t, err)
+
+	baseURL, _ := url.Parse(ts.URL)
+	uploadResults := make(chan bundleUploadResult)
+	aggregated := make(chan aggregatedUploadResults)
+	consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), uploadResults)
+	go aggregateUploadResults(uploadResults, aggregated, noopProgress{}, nil, nil)
+
+	importBundles(consumer, stages, 2)
+	close(uploadResults)
+	results := <-aggregated
+
+	assert.Equal(t, 6, results.totalProcessedBundles)
+	assert.Empty(t, results.errors)
+	assert.Equal(t, 2, results.resourceCounts["Organization"].created)
+	assert.Equal(t, 1, results.resourceCounts["Encounter"].created)
+	assert.Equal(t, 2, results.resourceCounts["Condition"].created)
+	// only the reference to a resource missing in the export remains
+	if assert.Len(t, results.entryErrorResponses, 1) {
+		for id, errorResponse := range results.entryErrorResponses {
+			assert.Equal(t, 3, id.bundleId.bundleNumber)
+			assert.Equal(t, http.StatusConflict, errorResponse.StatusCode)
+		}
+	}
+}
@@ -16,6 +16,9 @@ package cmd
 
 import (
 	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCreateClient(t *testing.T) {
@@ -33,3 +36,17 @@ func TestCreateClient(t *testing.T) {
 		}
 	})
 }
+
+func TestConcurrencyDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		cmd          *cobra.Command
+		defaultValue string
+	}{
+		{downloadCmd, "4"},
+		{exportCmd, "4"},
+		{importCmd, "2"},
+		{uploadCmd, "2"},
+	} {
+		assert.Equal(t, tc.defaultValue, tc.cmd.Flags().Lookup("concurrency").Value.String(), tc.cmd.Name())
+	}
+}
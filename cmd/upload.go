@@ -16,8 +16,10 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -54,6 +56,8 @@ type bundleIdentifier struct {
 	bundleNumber int
 	startBytes   int64
 	endBytes     int64
+	// the chunk consists of NDJSON resources instead of bundles, see resourceBatchBundle
+	resources bool
 }
 
 type bundle struct {
@@ -64,63 +68,89 @@ type bundle struct {
 type uploadInfo struct {
 	statusCode         int
 	error              []byte
+	response           []byte
 	bytesOut, bytesIn  int64
 	requestDuration    time.Duration
 	processingDuration time.Duration
 }
 
-type CountingReader struct {
-	reader    io.Reader
-	BytesRead int64
-}
-
-func (r *CountingReader) Read(p []byte) (n int, err error) {
-	n, err = r.reader.Read(p)
-	r.BytesRead += int64(n)
-	return n, err
-}
-
-// Uploads a single bundle and returns either the status code of the response or
-// an error.
-func uploadBundle(client *fhir.Client, bundleId *bundleIdentifier) (uploadInfo, error) {
+// openBundle opens the bundle identified by bundleId for reading. It returns a reader of the
+// plain, uncompressed bundle content.
+//
+// Note: The callee has to make sure that the returned closer is closed properly.
+func openBundle(bundleId *bundleIdentifier) (io.Reader, io.Closer, error) {
 	file, err := os.Open(bundleId.filename)
 	if err != nil {
-		return uploadInfo{}, err
+		return nil, nil, err
 	}
-	defer file.Close()
 
 	var reader io.Reader
-	var bundleSize func() int64
 	if strings.HasSuffix(bundleId.filename, ".json") {
 		reader = bufio.NewReader(file)
-		bundleSize = func() int64 {
-			return bundleId.endBytes - bundleId.startBytes
-		}
 	} else if strings.HasSuffix(bundleId.filename, ".json.gz") {
-		rdr, err := gzip.NewReader(bufio.NewReader(file))
+		reader, err = gzip.NewReader(bufio.NewReader(file))
 		if err != nil {
-			return uploadInfo{}, err
-		}
-		reader = &CountingReader{reader: rdr}
-		bundleSize = func() int64 {
-			return reader.(*CountingReader).BytesRead
+			file.Close()
+			return nil, nil, err
 		}
 	} else if strings.HasSuffix(bundleId.filename, ".json.bz2") {
-		reader = &CountingReader{reader: bzip2.NewReader(bufio.NewReader(file))}
-		bundleSize = func() int64 {
-			return reader.(*CountingReader).BytesRead
-		}
+		reader = bzip2.NewReader(bufio.NewReader(file))
 	} else {
 		reader, err = NewFileChunkReader(file, bundleId.startBytes, bundleId.endBytes-bundleId.startBytes)
 		if err != nil {
-			return uploadInfo{}, err
-		}
-		bundleSize = func() int64 {
-			return bundleId.endBytes - bundleId.startBytes
+			file.Close()
+			return nil, nil, err
 		}
 	}
 
-	req, err := client.NewTransactionRequest(reader)
+	return reader, file, nil
+}
+
+// readBundle reads the whole plain content of the bundle identified by bundleId into memory.
+// Chunks of NDJSON resources are packed into a batch bundle.
+func readBundle(bundleId *bundleIdentifier) ([]byte, error) {
+	reader, closer, err := openBundle(bundleId)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil || !bundleId.resources {
+		return data, err
+	}
+	return resourceBatchBundle(data)
+}
+
+// uploadBundle uploads a single bundle read into memory and returns either the status code of the
+// response or an error.
+//
+// The body of a successful response is returned as well, so that the response bundle can be
+// inspected by the caller.
+func uploadBundle(client *fhir.Client, data []byte) (uploadInfo, error) {
+	var response []byte
+	var readErr error
+	info, err := sendBundle(client, bytes.NewReader(data), func(body io.Reader) {
+		response, readErr = io.ReadAll(body)
+	})
+	if err != nil {
+		return uploadInfo{}, err
+	}
+	if readErr != nil {
+		return uploadInfo{}, readErr
+	}
+	info.response = response
+	info.bytesOut = int64(len(data))
+	return info, nil
+}
+
+// Uploads a single bundle read from body and returns either the status code of the response or
+// an error.
+//
+// The body of a successful response is passed to handleResponse, which reads as much of it as it
+// needs. The rest is discarded. The number of bytes sent has to be set by the caller.
+func sendBundle(client *fhir.Client, body io.Reader, handleResponse func(io.Reader)) (uploadInfo, error) {
+	req, err := client.NewTransactionRequest(body)
 	if err != nil {
 		return uploadInfo{}, err
 	}
@@ -148,40 +178,53 @@ func uploadBundle(client *fhir.Client, bundleId *bundleIdentifier) (uploadInfo,
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 200 {
-		bodySize, err := io.Copy(io.Discard, resp.Body)
-		if err != nil {
+		responseBody := &countingReader{r: resp.Body}
+		handleResponse(responseBody)
+		if _, err := io.Copy(io.Discard, responseBody); err != nil {
 			return uploadInfo{}, err
 		}
 
 		return uploadInfo{
 			statusCode:         resp.StatusCode,
-			bytesOut:           bundleSize(),
-			bytesIn:            bodySize,
+			bytesIn:            responseBody.n,
 			requestDuration:    time.Since(requestStart),
 			processingDuration: processingDuration,
 		}, nil
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	errorBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return uploadInfo{}, fmt.Errorf("error while reading the FHIR error response: %v", err)
 	}
 
 	return uploadInfo{
 		statusCode:         resp.StatusCode,
-		error:              body,
-		bytesOut:           bundleSize(),
-		bytesIn:            int64(len(body)),
+		error:              errorBody,
+		bytesIn:            int64(len(errorBody)),
 		requestDuration:    time.Since(requestStart),
 		processingDuration: processingDuration,
 	}, nil
 }
 
 type bundleUploadResult struct {
-	id         bundleIdentifier
-	uploadInfo uploadInfo
-	err        error
-	duration   time.Duration
+	id            bundleIdentifier
+	uploadInfo    uploadInfo
+	idMappings    []idMapping
+	failedEntries []failedEntry
+	// resource counts of the bundle by resource type
+	resourceCounts map[string]resourceCounts
+	// pieces of a split bundle committed before a later piece failed, nil otherwise
+	partialCommit *partialCommit
+	// the bundle was uploaded successfully, but its response bundle couldn't be inspected
+	inspectionErr error
+	err           error
+	duration      time.Duration
+}
+
+// entryIdentifier identifies a single entry of a bundle by its zero-based index.
+type entryIdentifier struct {
+	bundleId bundleIdentifier
+	index    int
 }
 
 type aggregatedUploadResults struct {
@@ -191,13 +234,24 @@ type aggregatedUploadResults struct {
 	identifiers                 []bundleIdentifier
 	totalBytesIn, totalBytesOut int64
 	errorResponses              map[bundleIdentifier]util.ErrorResponse
-	errors                      map[bundleIdentifier]error
+	// error responses of single entries of batch bundles the server responded to with 200
+	entryErrorResponses map[entryIdentifier]util.ErrorResponse
+	// number of bundles containing at least one failed entry
+	bundlesWithFailedEntries int
+	resourceCounts           map[string]resourceCounts
+	// split bundles of which some pieces were committed although the bundle failed
+	partialCommits map[bundleIdentifier]*partialCommit
+	// successfully uploaded bundles whose response bundle couldn't be inspected
+	inspectionErrors map[bundleIdentifier]error
+	errors           map[bundleIdentifier]error
 }
 
 func aggregateUploadResults(
 	uploadResultCh chan bundleUploadResult,
 	aggregatedUploadResultsCh chan aggregatedUploadResults,
-	progress progress) {
+	progress progress,
+	idMappings *idMappingWriter,
+	budget *errorBudget) {
 
 	var totalProcessedBundles int
 	// keep track of bundle identifiers so we can identify which bundles might take longer than others
@@ -207,17 +261,42 @@ func aggregateUploadResults(
 	var totalBytesIn int64
 	var totalBytesOut int64
 	errorResponses := make(map[bundleIdentifier]util.ErrorResponse)
+	entryErrorResponses := make(map[entryIdentifier]util.ErrorResponse)
+	var bundlesWithFailedEntries int
+	resourceCountsByType := make(map[string]resourceCounts)
+	partialCommits := make(map[bundleIdentifier]*partialCommit)
+	inspectionErrors := make(map[bundleIdentifier]error)
 	errs := make(map[bundleIdentifier]error)
 
 	for uploadResult := range uploadResultCh {
-		progress.increment(uploadResult.duration)
+		progress.increment(uploadResult)
+		budget.record(uploadResult)
 		totalProcessedBundles += 1
 
+		// resources of committed pieces of failed split bundles are counted as well
+		for resourceType, counts := range uploadResult.resourceCounts {
+			c := resourceCountsByType[resourceType]
+			c.add(counts)
+			resourceCountsByType[resourceType] = c
+		}
+		if uploadResult.partialCommit != nil {
+			partialCommits[uploadResult.id] = uploadResult.partialCommit
+		}
+
 		if uploadResult.err != nil {
 			errs[uploadResult.id] = uploadResult.err
 		} else {
 			if uploadResult.uploadInfo.statusCode == http.StatusOK {
 				processingDurations = append(processingDurations, uploadResult.uploadInfo.processingDuration.Seconds())
+				if uploadResult.inspectionErr != nil {
+					inspectionErrors[uploadResult.id] = uploadResult.inspectionErr
+				}
+				if len(uploadResult.failedEntries) > 0 {
+					bundlesWithFailedEntries++
+				}
+				for _, entry := range uploadResult.failedEntries {
+					entryErrorResponses[entryIdentifier{bundleId: uploadResult.id, index: entry.index}] = entry.errorResponse
+				}
 			} else {
 				// add NaN to processingDurations to keep the length the same as requestDurations
 				processingDurations = append(processingDurations, math.NaN())
@@ -240,17 +319,28 @@ func aggregateUploadResults(
 			// add bundle identifier for eval
 			identifiers = append(identifiers, uploadResult.id)
 		}
+
+		if idMappings != nil && len(uploadResult.idMappings) > 0 {
+			if err := idMappings.write(uploadResult.id, uploadResult.idMappings); err != nil {
+				errs[uploadResult.id] = fmt.Errorf("error while writing the id mappings: %w", err)
+			}
+		}
 	}
 
 	aggregatedUploadResultsCh <- aggregatedUploadResults{
-		totalProcessedBundles: totalProcessedBundles,
-		requestDurations:      requestDurations,
-		processingDurations:   processingDurations,
-		totalBytesIn:          totalBytesIn,
-		totalBytesOut:         totalBytesOut,
-		errorResponses:        errorResponses,
-		errors:                errs,
-		identifiers:           identifiers,
+		totalProcessedBundles:    totalProcessedBundles,
+		requestDurations:         requestDurations,
+		processingDurations:      processingDurations,
+		totalBytesIn:             totalBytesIn,
+		totalBytesOut:            totalBytesOut,
+		errorResponses:           errorResponses,
+		entryErrorResponses:      entryErrorResponses,
+		bundlesWithFailedEntries: bundlesWithFailedEntries,
+		resourceCounts:           resourceCountsByType,
+		partialCommits:           partialCommits,
+		inspectionErrors:         inspectionErrors,
+		errors:                   errs,
+		identifiers:              identifiers,
 	}
 }
 
@@ -417,51 +507,569 @@ func (ubp *uploadBundleProducer) createUploadBundlesFromMultiBundleFiles(files [
 type uploadBundleConsumer struct {
 	client        *fhir.Client
 	uploadResults chan<- bundleUploadResult
+	// directory the upload started from, used to derive response file paths
+	baseDir string
+	// directory to store transaction-response bundles in, empty if they should not be stored
+	responsesDir string
+	// whether the id mappings between request and response entries should be collected
+	collectIdMappings bool
+	// transforms applied to every bundle before it is uploaded
+	transforms []bundleTransform
+	// bundles with more entries are split into several bundles, zero disables splitting
+	maxEntries int
+	// independent bundles with less entries are merged into batch bundles, zero disables merging
+	minEntries int
+	// whether the transforms add a Provenance to transaction bundles, which isn't counted
+	provenance bool
+	// progress is informed about uploads in flight
+	progress progress
+	// no new bundles are scheduled once the budget is exceeded, nil if there is no budget
+	budget *errorBudget
 }
 
 func newUploadBundleConsumer(client *fhir.Client, uploadResults chan<- bundleUploadResult) *uploadBundleConsumer {
 	return &uploadBundleConsumer{
 		client:        client,
 		uploadResults: uploadResults,
+		progress:      noopProgress{},
 	}
 }
 
 func (consumer *uploadBundleConsumer) uploadBundles(uploadBundles []bundle, concurrency int, wg *sync.WaitGroup) {
 	limiter := make(chan bool, concurrency)
 
-	for _, queueItem := range uploadBundles {
-		limiter <- true
-		wg.Add(1)
-		go func(b bundle, limiter <-chan bool, wg *sync.WaitGroup) {
-			defer func() { <-limiter }()
+	if consumer.minEntries <= 0 {
+		for _, queueItem := range uploadBundles {
+			if consumer.budget.exceeded() != "" {
+				return
+			}
+
+			b := queueItem
 			if b.err != nil {
-				consumer.uploadResults <- bundleUploadResult{id: b.id, err: b.err}
-			} else {
-				start := time.Now()
-				if uploadInfo, err := uploadBundle(consumer.client, &b.id); err != nil {
-					consumer.uploadResults <- bundleUploadResult{id: b.id, err: err, duration: time.Duration(time.Since(start).Nanoseconds() / int64(concurrency))}
-				} else {
-					consumer.uploadResults <- bundleUploadResult{id: b.id, uploadInfo: uploadInfo, duration: time.Duration(time.Since(start).Nanoseconds() / int64(concurrency))}
-				}
+				consumer.dispatch(limiter, wg, concurrency, func() []bundleUploadResult {
+					return []bundleUploadResult{{id: b.id, err: b.err}}
+				})
+				continue
+			}
+			consumer.dispatch(limiter, wg, concurrency, func() []bundleUploadResult {
+				return []bundleUploadResult{consumer.upload(b.id)}
+			})
+		}
+		return
+	}
+
+	// small bundles waiting to be merged into one batch bundle
+	var pending []preparedBundle
+	var pendingEntries int
+	pendingFullUrls := make(map[string]bool)
+	flush := func() {
+		merged := pending
+		consumer.dispatch(limiter, wg, concurrency, func() []bundleUploadResult {
+			return consumer.uploadMerged(merged)
+		})
+		pending = nil
+		pendingEntries = 0
+		pendingFullUrls = make(map[string]bool)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	for next := range consumer.prepareAll(uploadBundles, concurrency, done) {
+		result := <-next
+		if consumer.budget.exceeded() != "" {
+			return
+		}
+
+		prepared, err := result.prepared, result.err
+		if err != nil {
+			consumer.dispatch(limiter, wg, concurrency, func() []bundleUploadResult {
+				return []bundleUploadResult{{id: prepared.id, err: err}}
+			})
+			continue
+		}
+
+		if !consumer.isMergeable(prepared) {
+			consumer.dispatch(limiter, wg, concurrency, func() []bundleUploadResult {
+				return []bundleUploadResult{consumer.uploadData(prepared.id, prepared.data)}
+			})
+			continue
+		}
+
+		// the fullUrls of a batch bundle have to be unique
+		fullUrls := entryFullUrls(prepared.bundle)
+		for _, fullUrl := range fullUrls {
+			if pendingFullUrls[fullUrl] {
+				flush()
+				break
 			}
-			wg.Done()
-		}(queueItem, limiter, wg)
+		}
+		pending = append(pending, prepared)
+		pendingEntries += len(prepared.bundle.Entry)
+		for _, fullUrl := range fullUrls {
+			pendingFullUrls[fullUrl] = true
+		}
+		if pendingEntries >= consumer.minEntries {
+			flush()
+		}
+	}
+
+	if len(pending) > 0 && consumer.budget.exceeded() == "" {
+		flush()
+	}
+}
+
+// preparedResult is a prepared bundle or the error preparing it.
+type preparedResult struct {
+	prepared preparedBundle
+	err      error
+}
+
+// prepareAll prepares the given bundles in the background, so that reading, transforming and
+// parsing bundles doesn't hold up the upload. Up to concurrency bundles are prepared ahead at the
+// same time. The results are sent in the order of the bundles, each on its own channel. Preparing
+// stops once done is closed.
+func (consumer *uploadBundleConsumer) prepareAll(bundles []bundle, concurrency int,
+	done <-chan struct{}) <-chan chan preparedResult {
+
+	ordered := make(chan chan preparedResult, concurrency)
+	go func() {
+		defer close(ordered)
+		for _, queueItem := range bundles {
+			b := queueItem
+			result := make(chan preparedResult, 1)
+			select {
+			case ordered <- result:
+			case <-done:
+				return
+			}
+			go func() {
+				if b.err != nil {
+					result <- preparedResult{prepared: preparedBundle{id: b.id}, err: b.err}
+					return
+				}
+				prepared, err := consumer.prepare(b.id)
+				prepared.id = b.id
+				result <- preparedResult{prepared: prepared, err: err}
+			}()
+		}
+	}()
+	return ordered
+}
+
+// dispatch runs the given upload job in its own goroutine as soon as the limiter allows it and
+// sends the results of the job to the upload results channel. The job is dropped if the error
+// budget got exceeded while waiting for the limiter.
+func (consumer *uploadBundleConsumer) dispatch(limiter chan bool, wg *sync.WaitGroup, concurrency int,
+	job func() []bundleUploadResult) {
+
+	limiter <- true
+	if consumer.budget.exceeded() != "" {
+		<-limiter
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer func() { <-limiter }()
+		consumer.progress.uploadStarted()
+		start := time.Now()
+		results := job()
+		consumer.progress.uploadFinished()
+		duration := time.Duration(time.Since(start).Nanoseconds() / int64(concurrency*len(results)))
+		for _, result := range results {
+			result.duration = duration
+			consumer.uploadResults <- result
+		}
+		wg.Done()
+	}()
+}
+
+// preparedBundle is a bundle read into memory with all transforms applied.
+type preparedBundle struct {
+	id     bundleIdentifier
+	data   []byte
+	bundle fm.Bundle
+}
+
+// prepare reads the bundle identified by bundleId and applies all transforms of the consumer.
+func (consumer *uploadBundleConsumer) prepare(bundleId bundleIdentifier) (preparedBundle, error) {
+	data, err := consumer.read(bundleId)
+	if err != nil {
+		return preparedBundle{}, err
+	}
+
+	bundle, err := fm.UnmarshalBundle(data)
+	if err != nil {
+		return preparedBundle{}, fmt.Errorf("error while parsing the bundle: %w", err)
+	}
+	return preparedBundle{id: bundleId, data: data, bundle: bundle}, nil
+}
+
+// read reads the bundle identified by bundleId and applies all transforms of the consumer.
+func (consumer *uploadBundleConsumer) read(bundleId bundleIdentifier) ([]byte, error) {
+	data, err := readBundle(&bundleId)
+	if err != nil {
+		return nil, err
+	}
+	if len(consumer.transforms) > 0 {
+		if data, err = transformBundle(data, bundleId, consumer.transforms); err != nil {
+			return nil, fmt.Errorf("error while transforming the bundle: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// isMergeable returns true if the given bundle is small enough to be merged with other bundles and
+// none of its entries depend on each other.
+func (consumer *uploadBundleConsumer) isMergeable(prepared preparedBundle) bool {
+	if len(prepared.bundle.Entry) >= consumer.minEntries {
+		return false
+	}
+	if prepared.bundle.Type != fm.BundleTypeTransaction && prepared.bundle.Type != fm.BundleTypeBatch {
+		return false
+	}
+	independent, err := isIndependent(prepared.bundle)
+	return err == nil && independent
+}
+
+// upload uploads the bundle identified by bundleId and processes the response bundle according to
+// the configuration of the consumer. Bundles which are neither transformed nor split are streamed
+// from their file instead of being read into memory.
+func (consumer *uploadBundleConsumer) upload(bundleId bundleIdentifier) bundleUploadResult {
+	if len(consumer.transforms) == 0 && consumer.maxEntries <= 0 && !bundleId.resources {
+		return consumer.uploadStream(bundleId)
+	}
+
+	data, err := consumer.read(bundleId)
+	if err != nil {
+		return bundleUploadResult{id: bundleId, err: err}
+	}
+	return consumer.uploadData(bundleId, data)
+}
+
+// uploadStream uploads the bundle identified by bundleId directly from its file. The request and
+// response bundles are inspected while they are transferred, without holding their resources in
+// memory.
+func (consumer *uploadBundleConsumer) uploadStream(bundleId bundleIdentifier) bundleUploadResult {
+	reader, closer, err := openBundle(&bundleId)
+	if err != nil {
+		return bundleUploadResult{id: bundleId, err: err}
+	}
+	defer closer.Close()
+
+	body := newSkeletonReader(reader)
+	var response fm.Bundle
+	var responseErr, storeErr error
+	info, err := sendBundle(consumer.client, body, func(r io.Reader) {
+		if consumer.responsesDir == "" {
+			response, responseErr = decodeBundleSkeleton(r)
+			return
+		}
+		path := responseFilePath(consumer.responsesDir, consumer.baseDir, bundleId)
+		if storeErr = writeResponseBundle(path, r); storeErr == nil {
+			response, responseErr = readBundleSkeleton(path)
+		}
+	})
+	request, requestErr := body.skeleton()
+	if err != nil {
+		return bundleUploadResult{id: bundleId, err: err}
+	}
+	info.bytesOut = body.n
+
+	result := bundleUploadResult{id: bundleId, uploadInfo: info}
+	if info.statusCode != http.StatusOK {
+		return result
+	}
+	if storeErr != nil {
+		return bundleUploadResult{id: bundleId, err: fmt.Errorf("error while storing the response bundle: %w", storeErr)}
+	}
+	if requestErr != nil {
+		result.inspectionErr = fmt.Errorf("error while parsing the request bundle: %w", requestErr)
+		return result
+	}
+	if responseErr != nil {
+		result.inspectionErr = fmt.Errorf("error while parsing the response bundle: %w", responseErr)
+		return result
+	}
+	consumer.inspect(&result, request, response)
+	return result
+}
+
+// uploadData uploads the given bundle data, splitting it if necessary, and processes the response
+// bundle according to the configuration of the consumer.
+func (consumer *uploadBundleConsumer) uploadData(bundleId bundleIdentifier, data []byte) bundleUploadResult {
+	if consumer.maxEntries <= 0 {
+		uploadInfo, err := uploadBundle(consumer.client, data)
+		if err != nil {
+			return bundleUploadResult{id: bundleId, err: err}
+		}
+		return consumer.processResponse(bundleId, data, uploadInfo)
+	}
+
+	uploadInfo, partial, err := consumer.uploadSplit(data)
+	var result bundleUploadResult
+	if err != nil {
+		result = bundleUploadResult{id: bundleId, err: err}
+	} else {
+		result = consumer.processResponse(bundleId, data, uploadInfo)
+	}
+	if partial != nil {
+		consumer.addPartialCommit(&result, partial)
+	}
+	return result
+}
+
+// addPartialCommit adds the committed pieces of a failed split bundle to its result, so that their
+// resources are counted and their ids are mapped although the bundle as a whole failed.
+func (consumer *uploadBundleConsumer) addPartialCommit(result *bundleUploadResult, partial *partialCommit) {
+	result.partialCommit = partial
+	result.resourceCounts = tallyResourceCounts(partial.request, partial.response)
+	if consumer.collectIdMappings {
+		// the entries of committed pieces always match the entries of their responses
+		if mappings, err := extractIdMappings(partial.request, partial.response); err == nil {
+			result.idMappings = mappings
+		}
+	}
+}
+
+// uploadSplit uploads bundles with more than maxEntries entries in several pieces one after
+// another. The response bundles of all pieces are joined into one response bundle, so that the
+// result looks like the bundle was uploaded at once. The upload stops at the first piece that
+// fails. If pieces were committed before, they are returned as partial commit together with the
+// failure.
+func (consumer *uploadBundleConsumer) uploadSplit(data []byte) (uploadInfo, *partialCommit, error) {
+	bundle, err := fm.UnmarshalBundle(data)
+	if err != nil || len(bundle.Entry) <= consumer.maxEntries {
+		// let the server report invalid bundles
+		info, err := uploadBundle(consumer.client, data)
+		return info, nil, err
+	}
+
+	pieces, err := splitBundle(bundle, consumer.maxEntries)
+	if err != nil {
+		return uploadInfo{}, nil, fmt.Errorf("error while splitting the bundle: %w", err)
+	}
+
+	var combined uploadInfo
+	responses := make([]fm.Bundle, 0, len(pieces))
+	partial := func() *partialCommit {
+		if len(responses) == 0 {
+			return nil
+		}
+		return newPartialCommit(len(bundle.Entry), pieces, responses)
+	}
+	for _, piece := range pieces {
+		pieceData, err := json.Marshal(piece.bundle)
+		if err != nil {
+			return uploadInfo{}, partial(), fmt.Errorf("error while encoding a piece of the bundle: %w", err)
+		}
+
+		info, err := uploadBundle(consumer.client, pieceData)
+		if err != nil {
+			return uploadInfo{}, partial(), err
+		}
+		combined.bytesOut += info.bytesOut
+		combined.bytesIn += info.bytesIn
+		combined.requestDuration += info.requestDuration
+		combined.processingDuration += info.processingDuration
+
+		if info.statusCode != http.StatusOK {
+			combined.statusCode = info.statusCode
+			combined.error = info.error
+			return combined, partial(), nil
+		}
+
+		response, err := fm.UnmarshalBundle(info.response)
+		if err != nil {
+			return uploadInfo{}, partial(), fmt.Errorf("error while parsing the response bundle: %w", err)
+		}
+		responses = append(responses, response)
+	}
+
+	joined, err := joinResponses(pieces, responses)
+	if err != nil {
+		return uploadInfo{}, nil, fmt.Errorf("error while joining the response bundles: %w", err)
+	}
+	if combined.response, err = json.Marshal(joined); err != nil {
+		return uploadInfo{}, nil, fmt.Errorf("error while encoding the response bundle: %w", err)
+	}
+	combined.statusCode = http.StatusOK
+	return combined, nil, nil
+}
+
+// uploadMerged uploads the given bundles together in one batch bundle and returns one result for
+// each of the bundles. The response bundle is split accordingly and the transferred bytes are
+// attributed to the bundles in equal shares.
+func (consumer *uploadBundleConsumer) uploadMerged(prepared []preparedBundle) []bundleUploadResult {
+	errorResults := func(err error) []bundleUploadResult {
+		results := make([]bundleUploadResult, 0, len(prepared))
+		for _, p := range prepared {
+			results = append(results, bundleUploadResult{id: p.id, err: err})
+		}
+		return results
+	}
+
+	bundles := make([]fm.Bundle, 0, len(prepared))
+	sizes := make([]int, 0, len(prepared))
+	for _, p := range prepared {
+		bundles = append(bundles, p.bundle)
+		sizes = append(sizes, len(p.bundle.Entry))
+	}
+
+	data, err := json.Marshal(mergeBundles(bundles))
+	if err != nil {
+		return errorResults(fmt.Errorf("error while encoding the merged bundle: %w", err))
+	}
+
+	info, err := uploadBundle(consumer.client, data)
+	if err != nil {
+		return errorResults(err)
+	}
+
+	share := func(i int) uploadInfo {
+		n := int64(len(prepared))
+		shared := info
+		shared.response = nil
+		shared.bytesIn = info.bytesIn / n
+		shared.bytesOut = info.bytesOut / n
+		if i == 0 {
+			shared.bytesIn += info.bytesIn % n
+			shared.bytesOut += info.bytesOut % n
+		}
+		return shared
+	}
+
+	results := make([]bundleUploadResult, 0, len(prepared))
+	if info.statusCode != http.StatusOK {
+		for i, p := range prepared {
+			results = append(results, bundleUploadResult{id: p.id, uploadInfo: share(i)})
+		}
+		return results
+	}
+
+	response, err := fm.UnmarshalBundle(info.response)
+	if err != nil {
+		return errorResults(fmt.Errorf("error while parsing the response bundle: %w", err))
+	}
+	responses, err := splitResponse(response, sizes)
+	if err != nil {
+		return errorResults(fmt.Errorf("error while splitting the response bundle: %w", err))
+	}
+
+	for i, p := range prepared {
+		shared := share(i)
+		if shared.response, err = json.Marshal(responses[i]); err != nil {
+			results = append(results, bundleUploadResult{id: p.id, err: fmt.Errorf("error while encoding the response bundle: %w", err)})
+			continue
+		}
+		results = append(results, consumer.processResponse(p.id, p.data, shared))
+	}
+	return results
+}
+
+// processResponse processes the response bundle of the given request bundle according to the
+// configuration of the consumer.
+func (consumer *uploadBundleConsumer) processResponse(bundleId bundleIdentifier, requestBundle []byte,
+	uploadInfo uploadInfo) bundleUploadResult {
+
+	result := bundleUploadResult{id: bundleId, uploadInfo: uploadInfo}
+	if uploadInfo.statusCode != http.StatusOK {
+		return result
+	}
+
+	if consumer.responsesDir != "" {
+		path := responseFilePath(consumer.responsesDir, consumer.baseDir, bundleId)
+		if err := writeResponseBundle(path, bytes.NewReader(uploadInfo.response)); err != nil {
+			return bundleUploadResult{id: bundleId, err: fmt.Errorf("error while storing the response bundle: %w", err)}
+		}
+	}
+
+	request, err := decodeBundleSkeleton(bytes.NewReader(requestBundle))
+	if err != nil {
+		result.inspectionErr = fmt.Errorf("error while parsing the request bundle: %w", err)
+		return result
+	}
+	response, err := decodeBundleSkeleton(bytes.NewReader(uploadInfo.response))
+	if err != nil {
+		result.inspectionErr = fmt.Errorf("error while parsing the response bundle: %w", err)
+		return result
+	}
+	consumer.inspect(&result, request, response)
+	return result
+}
+
+// inspect detects the failed entries of the given response bundle, counts the uploaded resources
+// and collects the id mappings if configured. The server already processed the bundle, so errors
+// are recorded as inspection error instead of failing the upload.
+func (consumer *uploadBundleConsumer) inspect(result *bundleUploadResult, request fm.Bundle, response fm.Bundle) {
+	failedEntries, err := extractFailedEntries(response)
+	if err != nil {
+		result.inspectionErr = fmt.Errorf("error while inspecting the response bundle: %w", err)
+		return
+	}
+	result.failedEntries = failedEntries
+	if consumer.provenance {
+		result.resourceCounts = tallyResourceCounts(withoutStampedProvenance(request, response))
+	} else {
+		result.resourceCounts = tallyResourceCounts(request, response)
+	}
+
+	if consumer.collectIdMappings {
+		mappings, err := extractIdMappings(request, response)
+		if err != nil {
+			result.inspectionErr = fmt.Errorf("error while extracting the id mappings: %w", err)
+			return
+		}
+		result.idMappings = mappings
 	}
 }
 
 type progress interface {
-	increment(duration time.Duration)
+	// uploadStarted is called every time an upload starts
+	uploadStarted()
+	// uploadFinished is called every time an upload finished
+	uploadFinished()
+	// increment is called with the result of every processed bundle
+	increment(result bundleUploadResult)
+	// abort removes the progress display before all bundles are processed
+	abort()
 	wait()
 }
 
 type realProgress struct {
 	progress *mpb.Progress
+	bars     []*mpb.Bar
 	bar      *mpb.Bar
+	// bars of single large NDJSON files by filename
+	fileBars  map[string]*mpb.Bar
+	dashboard *uploadDashboard
+}
+
+func (rP realProgress) uploadStarted() {
+	rP.dashboard.uploadStarted()
 }
 
-func (rP realProgress) increment(duration time.Duration) {
-	rP.bar.Increment()
-	rP.bar.DecoratorEwmaUpdate(duration)
+func (rP realProgress) uploadFinished() {
+	rP.dashboard.uploadFinished()
+}
+
+func (rP realProgress) increment(result bundleUploadResult) {
+	rP.dashboard.add(result)
+	for _, bar := range rP.bars {
+		bar.Increment()
+	}
+	rP.bar.DecoratorEwmaUpdate(result.duration)
+	if fileBar, ok := rP.fileBars[result.id.filename]; ok {
+		fileBar.Increment()
+	}
+}
+
+func (rP realProgress) abort() {
+	for _, bar := range rP.bars {
+		bar.Abort(true)
+	}
+	for _, bar := range rP.fileBars {
+		bar.Abort(true)
+	}
 }
 
 func (rP realProgress) wait() {
@@ -471,7 +1079,19 @@ func (rP realProgress) wait() {
 type noopProgress struct {
 }
 
-func (nP noopProgress) increment(_ time.Duration) {
+func (nP noopProgress) uploadStarted() {
+	// nothing to do here
+}
+
+func (nP noopProgress) uploadFinished() {
+	// nothing to do here
+}
+
+func (nP noopProgress) increment(_ bundleUploadResult) {
+	// nothing to do here
+}
+
+func (nP noopProgress) abort() {
 	// nothing to do here
 }
 
@@ -479,30 +1099,243 @@ func (nP noopProgress) wait() {
 	// nothing to do here
 }
 
-func createRealProgress(numBundles int) progress {
+// createRealProgress creates a progress display consisting of the overall upload bar, two lines
+// of live statistics and, if perFile is true, one bar per large NDJSON file.
+func createRealProgress(bundles []bundle, perFile bool) progress {
 	p := mpb.New()
-	return realProgress{progress: p,
-		bar: p.AddBar(int64(numBundles),
-			mpb.BarRemoveOnComplete(),
-			mpb.PrependDecorators(
-				decor.Name("upload", decor.WC{W: 7, C: decor.DidentRight}),
-				decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 60, decor.WC{W: 4}), "done"),
-			),
-			mpb.AppendDecorators(decor.Percentage()),
+	dashboard := newUploadDashboard()
+	total := int64(len(bundles))
+
+	bar := p.AddBar(total,
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(
+			decor.Name("upload", decor.WC{W: 7, C: decor.DidentRight}),
+			decor.OnComplete(decor.EwmaETA(decor.ET_STYLE_GO, 60, decor.WC{W: 4}), "done"),
 		),
+		mpb.AppendDecorators(decor.Percentage()),
+	)
+	throughput := p.New(total, mpb.NopStyle(),
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(decor.Any(func(decor.Statistics) string {
+			return dashboard.throughput()
+		}, decor.WC{W: 7})),
+	)
+	problems := p.New(total, mpb.NopStyle(),
+		mpb.BarRemoveOnComplete(),
+		mpb.PrependDecorators(decor.Any(func(decor.Statistics) string {
+			return dashboard.problems()
+		}, decor.WC{W: 7})),
+	)
+
+	fileBars := make(map[string]*mpb.Bar)
+	if perFile {
+		for filename, count := range largeMultiBundleFiles(bundles) {
+			fileBars[filename] = p.AddBar(int64(count),
+				mpb.BarRemoveOnComplete(),
+				mpb.PrependDecorators(
+					decor.Name(filepath.Base(filename), decor.WC{W: 7, C: decor.DidentRight}),
+					decor.CountersNoUnit("%d / %d", decor.WC{W: 4}),
+				),
+				mpb.AppendDecorators(decor.Percentage()),
+			)
+		}
+	}
+
+	return realProgress{
+		progress:  p,
+		bars:      []*mpb.Bar{bar, throughput, problems},
+		bar:       bar,
+		fileBars:  fileBars,
+		dashboard: dashboard,
 	}
 }
 
-func createProgress(numBundles int) progress {
+func createProgress(bundles []bundle) progress {
 	if noProgress {
 		return noopProgress{}
 	} else {
-		return createRealProgress(numBundles)
+		return createRealProgress(bundles, perFileProgress)
+	}
+}
+
+// newConfiguredUploadBundleConsumer creates an upload bundle consumer configured according to the
+// flags of the upload command.
+func newConfiguredUploadBundleConsumer(baseDir string, uploadResults chan<- bundleUploadResult,
+	collectIdMappings bool, transforms []bundleTransform) *uploadBundleConsumer {
+
+	consumer := newUploadBundleConsumer(client, uploadResults)
+	consumer.baseDir = baseDir
+	consumer.responsesDir = responsesDir
+	consumer.collectIdMappings = collectIdMappings
+	consumer.transforms = transforms
+	consumer.maxEntries = maxEntriesPerBundle
+	consumer.minEntries = minEntriesPerBundle
+	consumer.provenance = createProvenance
+	return consumer
+}
+
+// uploadTransforms returns the bundle transforms configured by the flags of the upload command.
+// De-identification comes first, so that idempotent ids are derived from de-identified resources.
+// Stamping comes before the idempotent transform, so that references to Provenance targets are
+// rewritten together with all other references.
+func uploadTransforms() ([]bundleTransform, error) {
+	var transforms []bundleTransform
+	if deidentifyConfigFile != "" {
+		d, err := readDeidentifier(deidentifyConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, d.bundleTransform())
+	}
+	if len(uploadTags) > 0 || uploadSource != "" || createProvenance {
+		var tags []tagCoding
+		for _, tag := range uploadTags {
+			coding, err := parseTag(tag)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, coding)
+		}
+		transforms = append(transforms, stampTransform(tags, uploadSource, createProvenance, time.Now))
+	}
+	if idempotentMode != "" {
+		transforms = append(transforms, idempotentTransform(idempotentMode))
+	}
+	return transforms, nil
+}
+
+// createIdMappingWriterOrDie creates the id mapping file if one was requested. Returns a nil
+// writer if no id mapping file was requested. The returned function closes the file.
+func createIdMappingWriterOrDie() (*idMappingWriter, func()) {
+	if idMappingFileName == "" {
+		return nil, func() {}
+	}
+
+	f, err := os.Create(idMappingFileName)
+	if err != nil {
+		fmt.Printf("Failed to open id mapping file: %v\n", err)
+		os.Exit(1)
+	}
+
+	idMappings, err := newIdMappingWriter(f)
+	if err != nil {
+		fmt.Printf("Failed to write id mapping file: %v\n", err)
+		os.Exit(1)
+	}
+	return idMappings, func() { _ = f.Close() }
+}
+
+// printUploadStatistics prints the statistics of the given upload results, followed by the
+// resource counts by type.
+func printUploadStatistics(aggResults aggregatedUploadResults, concurrency int, duration time.Duration) {
+	fmt.Printf("Uploads          [total, concurrency]     %d, %d\n",
+		aggResults.totalProcessedBundles, concurrency)
+	fmt.Printf("Success          [ratio]                  %.2f %%\n",
+		float32(aggResults.totalProcessedBundles-len(aggResults.errors)-len(aggResults.errorResponses)-aggResults.bundlesWithFailedEntries)/float32(aggResults.totalProcessedBundles)*100)
+	fmt.Printf("Duration         [total]                  %s\n",
+		util.FmtDurationHumanReadable(duration))
+
+	if len(aggResults.requestDurations) > 0 {
+		requestStats := util.CalculateDurationStatistics(aggResults.requestDurations)
+		fmt.Printf("Requ. Latencies  [mean, 50, 95, 99, max]  %s, %s, %s, %s %s\n",
+			requestStats.Mean, requestStats.Q50, requestStats.Q95, requestStats.Q99, requestStats.Max)
+	}
+
+	if len(aggResults.processingDurations) > 0 {
+		processingStats := util.CalculateDurationStatistics(aggResults.processingDurations)
+		fmt.Printf("Proc. Latencies  [mean, 50, 95, 99, max]  %s, %s, %s, %s %s\n",
+			processingStats.Mean, processingStats.Q50, processingStats.Q95, processingStats.Q99, processingStats.Max)
+	}
+
+	totalTransfers := len(aggResults.requestDurations)
+	fmt.Printf("Bytes In         [total, mean]            %s, %s\n", util.FmtBytesHumanReadable(float32(aggResults.totalBytesIn)), util.FmtBytesHumanReadable(float32(aggResults.totalBytesIn)/float32(totalTransfers)))
+	fmt.Printf("Bytes Out        [total, mean]            %s, %s\n", util.FmtBytesHumanReadable(float32(aggResults.totalBytesOut)), util.FmtBytesHumanReadable(float32(aggResults.totalBytesOut)/float32(totalTransfers)))
+
+	errorFrequencies := make(map[int]int)
+	for _, errorResponse := range aggResults.errorResponses {
+		errorFrequencies[errorResponse.StatusCode]++
+	}
+	statusCodes := make([]string, 1, len(errorFrequencies)+1)
+	statusCodes[0] = fmt.Sprintf("200:%d", len(aggResults.processingDurations))
+	for statusCode, freq := range errorFrequencies {
+		statusCodes = append(statusCodes, fmt.Sprintf("%d:%d", statusCode, freq))
+	}
+	fmt.Printf("Status Codes     [code:count]             %s\n", strings.Join(statusCodes, ", "))
+
+	if len(aggResults.entryErrorResponses) > 0 {
+		entryErrorFrequencies := make(map[int]int)
+		for _, errorResponse := range aggResults.entryErrorResponses {
+			entryErrorFrequencies[errorResponse.StatusCode]++
+		}
+		entryStatusCodes := make([]string, 0, len(entryErrorFrequencies))
+		for statusCode, freq := range entryErrorFrequencies {
+			entryStatusCodes = append(entryStatusCodes, fmt.Sprintf("%d:%d", statusCode, freq))
+		}
+		fmt.Printf("Failed Entries   [code:count]             %s\n", strings.Join(entryStatusCodes, ", "))
+	}
+
+	if len(aggResults.resourceCounts) > 0 {
+		fmt.Println()
+		fmt.Println("Resources by Type:")
+		fmt.Println()
+		fmt.Print(fmtResourceCounts(aggResults.resourceCounts))
+	}
+}
+
+// printUploadProblems prints the non-OK responses and errors of the given upload results.
+func printUploadProblems(aggResults aggregatedUploadResults) {
+	if len(aggResults.errorResponses) > 0 || len(aggResults.entryErrorResponses) > 0 {
+		fmt.Println()
+		fmt.Println("Non-OK Responses:")
+		fmt.Println()
+		fmt.Print(fmtErrorClusters(clusterErrorResponses(aggResults.errorResponses, aggResults.entryErrorResponses)))
+	}
+	if len(aggResults.errors) > 0 {
+		fmt.Println("\nErrors:")
+		for bundleId, err := range aggResults.errors {
+			fmt.Printf("File: %s [Bundle: %d] : %v\n", bundleId.filename, bundleId.bundleNumber, err.Error())
+		}
+	}
+	if len(aggResults.partialCommits) > 0 {
+		fmt.Println("\nWARNING: Partially Committed Bundles:")
+		fmt.Println("The committed pieces of the following failed bundles stay on the server. Their resources are")
+		fmt.Println("counted above. Uploading the bundles again may duplicate them unless --idempotent is used.")
+		fmt.Println()
+		for _, bundleId := range partiallyCommittedBundleIds(aggResults) {
+			fmt.Printf("File: %s [Bundle: %d] : %s\n", bundleId.filename, bundleId.bundleNumber,
+				aggResults.partialCommits[bundleId])
+		}
+	}
+	if len(aggResults.inspectionErrors) > 0 {
+		fmt.Println("\nWARNING: Uninspected Responses:")
+		fmt.Println("The following bundles were uploaded successfully, but their response bundles could not be")
+		fmt.Println("inspected. Their failed entries, resources and id mappings are missing above.")
+		fmt.Println()
+		for _, bundleId := range uninspectedBundleIds(aggResults) {
+			fmt.Printf("File: %s [Bundle: %d] : %v\n", bundleId.filename, bundleId.bundleNumber,
+				aggResults.inspectionErrors[bundleId])
+		}
 	}
 }
 
 var concurrency int
 var outputStatisticsFileName string
+var responsesDir string
+var idMappingFileName string
+var verifyResourceCounts bool
+var idempotentMode string
+var maxEntriesPerBundle int
+var minEntriesPerBundle int
+var watchSpoolDir bool
+var perFileProgress bool
+var errorReportFileName string
+var maxErrors int
+var uploadTags []string
+var uploadSource string
+var createProvenance bool
+var maxErrorRate float64
+var watchPollInterval time.Duration
+var watchStatsInterval time.Duration
 
 // uploadCmd represents the upload command
 var uploadCmd = &cobra.Command{
@@ -510,12 +1343,73 @@ var uploadCmd = &cobra.Command{
 	Short: "Upload transaction bundles",
 	Long: `You can upload transaction bundles from JSON files inside a directory.
 
+Batch bundles are supported as well. Because the server responds to batch
+bundles with 200 even if single entries fail, the entries of each
+batch-response bundle are inspected and failed entries are reported.
+
 The upload will be parallel according to the --concurrency flag. A upload 
 statistic will be printed after the upload.
 
-Example:
-
-  blazectl upload my/bundles`,
+Non-OK responses that differ only in ids and numbers are grouped in the
+statistic. The details of every single non-OK response and error can be
+written to a JSON file with --error-report.
+
+With --max-errors or --max-error-rate, the upload stops once the given
+number of bundles failed or once more than the given percentage of bundles
+failed. The error rate is checked after 100 bundles were processed. Bundles
+already in flight are finished and the statistic is printed as usual.
+
+During the upload, the progress display shows the throughput in bytes and
+bundles per second, the number of uploads in flight and the rolling 95th
+percentile of the request latency, together with running counts of errors,
+non-OK responses by status code and failed entries. With --per-file, an
+additional progress bar is shown for every large NDJSON file.
+
+The transaction-response bundles returned by the server can be stored in the
+directory given by --responses-dir. With --id-mapping a CSV file is written
+that maps the fullUrl of every uploaded entry to the location and versionId
+assigned by the server.
+
+After the upload, the number of created, updated, unchanged and deleted
+resources is shown per resource type. With --verify-counts, the resources on
+the server are counted before and after the upload and the difference is
+shown as well.
+
+With --idempotent, POST entries are rewritten so that uploading the same
+bundles again doesn't create duplicate resources. In the default
+conditional-create mode, POST entries with an identifier become conditional
+creates. In put mode, and for resources without identifier, POST entries
+become PUT entries with an id derived from the identifier or the content.
+The mode has to be given with an equals sign, like --idempotent=put.
+
+With --deidentify, all resources are de-identified before the upload
+according to the given YAML config. Elements can be dropped, identifiers
+hashed, dates shifted, birth dates generalized and ids rewritten.
+
+With --tag system|code and --source uri, every uploaded resource is stamped
+with the given meta.tag codings and meta.source, so that all resources of a
+delivery can be found later. With --provenance, a Provenance resource naming
+blazectl, the input file and the upload time is added to every transaction
+bundle. The Provenance isn't counted as uploaded resource. Because it
+references all resources of its bundle, --provenance can't be combined with
+--max-entries.
+
+Bundles with more entries than --max-entries are split into several bundles
+which are uploaded one after another. Entries referencing each other stay
+in the same bundle. Bundles with less entries than --min-entries, whose
+entries don't reference each other, are merged into batch bundles. The
+statistics always refer to the original files and bundle numbers.
+
+With --watch, blazectl keeps running and uploads new files as soon as they
+are completely written. A file is complete if a marker file with the same
+name and the suffix .done exists or if its size didn't change between two
+scans. Uploaded files are moved into the processed or failed subdirectory
+of the watched directory. Rolling statistics are printed periodically.
+
+Examples:
+
+  blazectl upload my/bundles
+  blazectl upload --watch my/spool`,
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return nil, cobra.ShellCompDirectiveFilterDirs
 	},
@@ -524,6 +1418,9 @@ Example:
 			return errors.New("requires a directory argument")
 		}
 		if info, err := os.Stat(args[0]); os.IsNotExist(err) {
+			if args[0] == idempotentConditionalCreate || args[0] == idempotentPut {
+				return fmt.Errorf("directory `%s` doesn't exist, use --idempotent=%s to select the idempotent mode", args[0], args[0])
+			}
 			return fmt.Errorf("directory `%s` doesn't exist", args[0])
 		} else if !info.IsDir() {
 			return fmt.Errorf("`%s` isn't a directory", args[0])
@@ -532,13 +1429,50 @@ Example:
 		}
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if maxEntriesPerBundle > 0 && minEntriesPerBundle >= maxEntriesPerBundle {
+			return errors.New("--min-entries has to be less than --max-entries")
+		}
+		if createProvenance && maxEntriesPerBundle > 0 {
+			return errors.New("--provenance can't be combined with --max-entries, because the Provenance references all resources of its bundle")
+		}
+		if idempotentMode != "" && idempotentMode != idempotentConditionalCreate && idempotentMode != idempotentPut {
+			return fmt.Errorf("invalid idempotent mode `%s`, expect `%s` or `%s`", idempotentMode,
+				idempotentConditionalCreate, idempotentPut)
+		}
+
 		err := createClient()
 		if err != nil {
 			return err
 		}
 
+		transforms, err := uploadTransforms()
+		if err != nil {
+			return err
+		}
+
 		dir := args[0]
 
+		if watchSpoolDir {
+			if verifyResourceCounts || outputStatisticsFileName != "" || errorReportFileName != "" ||
+				maxErrors > 0 || maxErrorRate > 0 {
+				return errors.New("--verify-counts, --output, --error-report, --max-errors and --max-error-rate can't be used together with --watch")
+			}
+
+			idMappings, closeIdMappings := createIdMappingWriterOrDie()
+			defer closeIdMappings()
+
+			fmt.Printf("Watching %s for new files to upload to %s ...\n", dir, server)
+			uploader := newSpoolUploader(dir, func(uploadResults chan<- bundleUploadResult) *uploadBundleConsumer {
+				return newConfiguredUploadBundleConsumer(dir, uploadResults, idMappings != nil, transforms)
+			})
+			uploader.idMappings = idMappings
+			if err := uploader.watch(watchPollInterval, watchStatsInterval); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return nil
+		}
+
 		files, err := findProcessableFiles(dir)
 		if err != nil {
 			fmt.Println(err)
@@ -564,73 +1498,78 @@ Example:
 		fmt.Printf("Found %d bundles in total (from %d JSON files and from %d NDJSON files)\n",
 			len(uploadBundlesSummary.bundles), uploadBundlesSummary.singleBundlesFiles, uploadBundlesSummary.multiBundlesFiles)
 
-		progress := createProgress(len(uploadBundlesSummary.bundles))
+		idMappings, closeIdMappings := createIdMappingWriterOrDie()
+		defer closeIdMappings()
+
+		var resourceTypes []fm.ResourceType
+		var countsBefore map[fm.ResourceType]int
+		if verifyResourceCounts {
+			resourceTypes, err = fetchResourceTypesWithSearchTypeInteraction(client)
+			if err != nil {
+				fmt.Printf("Failed to count resources before the upload: %v\n", err)
+				os.Exit(1)
+			}
+			countsBefore, err = fetchResourcesTotal(client, resourceTypes)
+			if err != nil {
+				fmt.Printf("Failed to count resources before the upload: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		progress := createProgress(uploadBundlesSummary.bundles)
 
 		// Loop through bundles
 		var consumerWg sync.WaitGroup
 		start := time.Now()
-		bundleConsumer := newUploadBundleConsumer(client, uploadResultCh)
-		go aggregateUploadResults(uploadResultCh, aggregatedUploadResultsCh, progress)
+		bundleConsumer := newConfiguredUploadBundleConsumer(dir, uploadResultCh, idMappings != nil, transforms)
+		bundleConsumer.progress = progress
+		bundleConsumer.budget = newErrorBudget(maxErrors, maxErrorRate)
+		go aggregateUploadResults(uploadResultCh, aggregatedUploadResultsCh, progress, idMappings, bundleConsumer.budget)
 
 		bundleConsumer.uploadBundles(uploadBundlesSummary.bundles, concurrency, &consumerWg)
 
 		consumerWg.Wait()
 		close(uploadResultCh)
+		if bundleConsumer.budget.exceeded() != "" {
+			progress.abort()
+		}
 		progress.wait()
+
+		var countsAfter map[fm.ResourceType]int
+		if verifyResourceCounts {
+			countsAfter, err = fetchResourcesTotal(client, resourceTypes)
+			if err != nil {
+				fmt.Printf("Failed to count resources after the upload: %v\n", err)
+				os.Exit(1)
+			}
+		}
 		client.CloseIdleConnections()
 
 		aggResults := <-aggregatedUploadResultsCh
 
-		fmt.Printf("Uploads          [total, concurrency]     %d, %d\n",
-			aggResults.totalProcessedBundles, concurrency)
-		fmt.Printf("Success          [ratio]                  %.2f %%\n",
-			float32(aggResults.totalProcessedBundles-len(aggResults.errors)-len(aggResults.errorResponses))/float32(aggResults.totalProcessedBundles)*100)
-		fmt.Printf("Duration         [total]                  %s\n",
-			util.FmtDurationHumanReadable(time.Since(start)))
-
-		if len(aggResults.requestDurations) > 0 {
-			requestStats := util.CalculateDurationStatistics(aggResults.requestDurations)
-			fmt.Printf("Requ. Latencies  [mean, 50, 95, 99, max]  %s, %s, %s, %s %s\n",
-				requestStats.Mean, requestStats.Q50, requestStats.Q95, requestStats.Q99, requestStats.Max)
+		if idMappings != nil {
+			if err := idMappings.flush(); err != nil {
+				fmt.Printf("Failed to write id mapping file: %v\n", err)
+				os.Exit(1)
+			}
 		}
 
-		if len(aggResults.processingDurations) > 0 {
-			processingStats := util.CalculateDurationStatistics(aggResults.processingDurations)
-			fmt.Printf("Proc. Latencies  [mean, 50, 95, 99, max]  %s, %s, %s, %s %s\n",
-				processingStats.Mean, processingStats.Q50, processingStats.Q95, processingStats.Q99, processingStats.Max)
+		if reason := bundleConsumer.budget.exceeded(); reason != "" {
+			fmt.Printf("Stopped the upload because %s. Skipped %d bundles.\n", reason,
+				len(uploadBundlesSummary.bundles)-aggResults.totalProcessedBundles)
 		}
 
-		totalTransfers := len(aggResults.requestDurations)
-		fmt.Printf("Bytes In         [total, mean]            %s, %s\n", util.FmtBytesHumanReadable(float32(aggResults.totalBytesIn)), util.FmtBytesHumanReadable(float32(aggResults.totalBytesIn)/float32(totalTransfers)))
-		fmt.Printf("Bytes Out        [total, mean]            %s, %s\n", util.FmtBytesHumanReadable(float32(aggResults.totalBytesOut)), util.FmtBytesHumanReadable(float32(aggResults.totalBytesOut)/float32(totalTransfers)))
-
-		errorFrequencies := make(map[int]int)
-		for _, errorResponse := range aggResults.errorResponses {
-			errorFrequencies[errorResponse.StatusCode]++
-		}
-		statusCodes := make([]string, 1, len(errorFrequencies)+1)
-		statusCodes[0] = fmt.Sprintf("200:%d", len(aggResults.processingDurations))
-		for statusCode, freq := range errorFrequencies {
-			statusCodes = append(statusCodes, fmt.Sprintf("%d:%d", statusCode, freq))
-		}
-		fmt.Printf("Status Codes     [code:count]             %s\n", strings.Join(statusCodes, ", "))
+		printUploadStatistics(aggResults, concurrency, time.Since(start))
 
-		if len(aggResults.errorResponses) > 0 {
+		if verifyResourceCounts {
 			fmt.Println()
-			fmt.Println("Non-OK Responses:")
+			fmt.Println("Resources on Server [before -> after (delta)]:")
 			fmt.Println()
-			for bundleId, errorResponse := range aggResults.errorResponses {
-				fmt.Printf("File: %s [Bundle: %d]\n", bundleId.filename, bundleId.bundleNumber)
-				fmt.Printf("%s", util.Indent(4, errorResponse.String()))
-			}
-		}
-		if len(aggResults.errors) > 0 {
-			fmt.Println("\nErrors:")
-			for bundleId, err := range aggResults.errors {
-				fmt.Printf("File: %s [Bundle: %d] : %v\n", bundleId.filename, bundleId.bundleNumber, err.Error())
-			}
+			fmt.Print(fmtResourceCountDeltas(countsBefore, countsAfter, aggResults.resourceCounts))
 		}
 
+		printUploadProblems(aggResults)
+
 		// write statistics output file
 		if outputStatisticsFileName != "" {
 			f, err := os.Create(outputStatisticsFileName)
@@ -656,7 +1595,24 @@ Example:
 			fmt.Println("Wrote output file")
 		}
 
-		if len(aggResults.errorResponses) > 0 || len(aggResults.errors) > 0 {
+		if errorReportFileName != "" {
+			f, err := os.Create(errorReportFileName)
+			if err != nil {
+				fmt.Printf("Failed to open error report file: %v\n", err)
+				os.Exit(1)
+			}
+
+			defer f.Close()
+
+			if err := writeErrorReport(f, aggResults); err != nil {
+				fmt.Printf("Failed to write error report file: %v\n", err)
+				os.Exit(1)
+			}
+
+			fmt.Println("Wrote error report file")
+		}
+
+		if len(aggResults.errorResponses) > 0 || len(aggResults.entryErrorResponses) > 0 || len(aggResults.errors) > 0 {
 			os.Exit(1)
 		}
 		return nil
@@ -669,6 +1625,29 @@ func init() {
 	uploadCmd.Flags().StringVar(&server, "server", "", "the base URL of the server to use")
 	uploadCmd.Flags().IntVarP(&concurrency, "concurrency", "c", 2, "number of parallel uploads")
 	uploadCmd.Flags().StringVar(&outputStatisticsFileName, "output", "", "file to write detailed statistics to")
+	uploadCmd.Flags().StringVar(&errorReportFileName, "error-report", "", "JSON file to write the details of all non-OK responses and errors to")
+	uploadCmd.Flags().StringVar(&responsesDir, "responses-dir", "", "directory to store the transaction-response bundles in")
+	uploadCmd.Flags().StringVar(&idMappingFileName, "id-mapping", "", "CSV file to write the server assigned ids of all uploaded entries to")
+	uploadCmd.Flags().BoolVar(&verifyResourceCounts, "verify-counts", false, "count resources on the server before and after the upload")
+	uploadCmd.Flags().StringVar(&deidentifyConfigFile, "deidentify", "", "YAML file configuring the de-identification of all uploaded resources")
+	uploadCmd.Flags().StringArrayVar(&uploadTags, "tag", nil, "tag to add to meta.tag of every uploaded resource as system|code, can be repeated")
+	uploadCmd.Flags().StringVar(&uploadSource, "source", "", "URI to set as meta.source of every uploaded resource")
+	uploadCmd.Flags().BoolVar(&createProvenance, "provenance", false, "add a Provenance resource to every transaction bundle")
+	uploadCmd.Flags().StringVar(&idempotentMode, "idempotent", "", "rewrite POST entries to avoid duplicates on repeated uploads, select the mode with --idempotent=conditional-create or --idempotent=put")
+	uploadCmd.Flags().Lookup("idempotent").NoOptDefVal = idempotentConditionalCreate
+	uploadCmd.Flags().IntVar(&maxEntriesPerBundle, "max-entries", 0, "split bundles with more entries into several bundles")
+	uploadCmd.Flags().IntVar(&minEntriesPerBundle, "min-entries", 0, "merge independent bundles with less entries into batch bundles")
+	uploadCmd.Flags().IntVar(&maxErrors, "max-errors", 0, "stop the upload once this number of bundles failed, zero means unlimited")
+	uploadCmd.Flags().Float64Var(&maxErrorRate, "max-error-rate", 0, "stop the upload once more than this percentage of bundles failed, zero means unlimited")
+	uploadCmd.Flags().BoolVar(&perFileProgress, "per-file", false, "show one progress bar per large NDJSON file")
+	uploadCmd.Flags().BoolVar(&watchSpoolDir, "watch", false, "keep running and upload new files appearing in the directory")
+	uploadCmd.Flags().DurationVar(&watchPollInterval, "watch-interval", 10*time.Second, "interval in which the watched directory is scanned for new files")
+	uploadCmd.Flags().DurationVar(&watchStatsInterval, "stats-interval", time.Minute, "interval in which rolling statistics are printed in watch mode")
+
+	_ = uploadCmd.MarkFlagDirname("responses-dir")
+	_ = uploadCmd.MarkFlagFilename("id-mapping", "csv")
+	_ = uploadCmd.MarkFlagFilename("error-report", "json")
+	_ = uploadCmd.MarkFlagFilename("deidentify", "yaml", "yml")
 
 	_ = uploadCmd.MarkFlagRequired("server")
 }
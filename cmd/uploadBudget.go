@@ -0,0 +1,84 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sync"
+)
+
+// errorRateMinBundles is the number of bundles that have to be processed before the error rate
+// is checked, so that a few failures at the start don't exceed the budget.
+const errorRateMinBundles = 100
+
+// errorBudget keeps track of failed bundles during an upload and decides whether the upload should
+// stop. It is safe for concurrent use. A nil budget is never exceeded.
+type errorBudget struct {
+	mutex sync.Mutex
+	// maximum number of failed bundles, zero means unlimited
+	maxErrors int
+	// maximum percentage of failed bundles, zero means unlimited
+	maxErrorRate float64
+	processed    int
+	failed       int
+	// reason why the budget was exceeded, empty if it is not exceeded
+	reason string
+}
+
+func newErrorBudget(maxErrors int, maxErrorRate float64) *errorBudget {
+	if maxErrors <= 0 && maxErrorRate <= 0 {
+		return nil
+	}
+	return &errorBudget{maxErrors: maxErrors, maxErrorRate: maxErrorRate}
+}
+
+// record records the result of a processed bundle.
+func (b *errorBudget) record(result bundleUploadResult) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.processed++
+	if isFailedUpload(result) {
+		b.failed++
+	}
+	if b.reason != "" {
+		return
+	}
+
+	if b.maxErrors > 0 && b.failed >= b.maxErrors {
+		b.reason = fmt.Sprintf("%d bundles failed (max errors %d)", b.failed, b.maxErrors)
+		return
+	}
+	rate := float64(b.failed) / float64(b.processed) * 100
+	if b.maxErrorRate > 0 && b.processed >= errorRateMinBundles && rate > b.maxErrorRate {
+		b.reason = fmt.Sprintf("%.2f %% of %d bundles failed (max error rate %.2f %%)", rate, b.processed,
+			b.maxErrorRate)
+	}
+}
+
+// exceeded returns the reason why the budget is exceeded or an empty string if it isn't.
+func (b *errorBudget) exceeded() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reason
+}
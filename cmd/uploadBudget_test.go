@@ -0,0 +1,107 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+var okResult = bundleUploadResult{uploadInfo: uploadInfo{statusCode: http.StatusOK}}
+var failedResult = bundleUploadResult{uploadInfo: uploadInfo{statusCode: http.StatusUnprocessableEntity}}
+
+func TestErrorBudget(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		budget := newErrorBudget(0, 0)
+		assert.Nil(t, budget)
+
+		budget.record(failedResult)
+		assert.Equal(t, "", budget.exceeded())
+	})
+
+	t.Run("MaxErrors", func(t *testing.T) {
+		budget := newErrorBudget(2, 0)
+
+		budget.record(failedResult)
+		budget.record(okResult)
+		assert.Equal(t, "", budget.exceeded())
+
+		budget.record(failedResult)
+		assert.Equal(t, "2 bundles failed (max errors 2)", budget.exceeded())
+	})
+
+	t.Run("MaxErrorRate", func(t *testing.T) {
+		budget := newErrorBudget(0, 10)
+
+		for i := 0; i < errorRateMinBundles-1; i++ {
+			budget.record(failedResult)
+		}
+		assert.Equal(t, "", budget.exceeded(), "rate isn't checked before the minimum number of bundles")
+
+		budget.record(okResult)
+		assert.Equal(t, "99.00 % of 100 bundles failed (max error rate 10.00 %)", budget.exceeded())
+	})
+
+	t.Run("MaxErrorRateNotExceeded", func(t *testing.T) {
+		budget := newErrorBudget(0, 10)
+
+		for i := 0; i < errorRateMinBundles; i++ {
+			if i%10 == 0 {
+				budget.record(failedResult)
+			} else {
+				budget.record(okResult)
+			}
+		}
+		assert.Equal(t, "", budget.exceeded())
+	})
+}
+
+func TestUploadBundleConsumerStopsOnExceededBudget(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"resourceType": "OperationOutcome"}`))
+	}))
+	defer server.Close()
+	baseURL, _ := url.ParseRequestURI(server.URL)
+
+	data := []byte(`{"resourceType": "Bundle", "type": "transaction"}`)
+	var bundleData [][]byte
+	for i := 0; i < 20; i++ {
+		bundleData = append(bundleData, data)
+	}
+	bundles := writeTestBundles(t, bundleData...)
+
+	uploadResultCh := make(chan bundleUploadResult)
+	aggregatedUploadResultsCh := make(chan aggregatedUploadResults)
+	consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), uploadResultCh)
+	consumer.budget = newErrorBudget(3, 0)
+	go aggregateUploadResults(uploadResultCh, aggregatedUploadResultsCh, noopProgress{}, nil, consumer.budget)
+
+	var wg sync.WaitGroup
+	consumer.uploadBundles(bundles, 1, &wg)
+	wg.Wait()
+	close(uploadResultCh)
+	results := <-aggregatedUploadResultsCh
+
+	assert.Equal(t, "3 bundles failed (max errors 3)", consumer.budget.exceeded())
+	assert.GreaterOrEqual(t, results.totalProcessedBundles, 3)
+	assert.Less(t, results.totalProcessedBundles, 6)
+}
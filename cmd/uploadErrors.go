@@ -0,0 +1,239 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// maxClusterExamples is the number of example origins shown for every cluster of error responses.
+const maxClusterExamples = 3
+
+// errorOrigin identifies the bundle or the bundle entry an error response belongs to.
+type errorOrigin struct {
+	bundleId bundleIdentifier
+	// zero-based index of the failed entry, -1 if the whole bundle failed
+	index int
+}
+
+func (o errorOrigin) String() string {
+	if o.index < 0 {
+		return fmt.Sprintf("File: %s [Bundle: %d]", o.bundleId.filename, o.bundleId.bundleNumber)
+	}
+	return fmt.Sprintf("File: %s [Bundle: %d, Entry: %d]", o.bundleId.filename, o.bundleId.bundleNumber, o.index)
+}
+
+func (o errorOrigin) less(other errorOrigin) bool {
+	if o.bundleId.filename != other.bundleId.filename {
+		return o.bundleId.filename < other.bundleId.filename
+	}
+	if o.bundleId.bundleNumber != other.bundleId.bundleNumber {
+		return o.bundleId.bundleNumber < other.bundleId.bundleNumber
+	}
+	return o.index < other.index
+}
+
+// errorCluster is a group of error responses which have the same normalized form.
+type errorCluster struct {
+	normalized string
+	// the error response of the first origin
+	first   util.ErrorResponse
+	origins []errorOrigin
+}
+
+// clusterErrorResponses groups the error responses of whole bundles and single entries by their
+// normalized form. Clusters are ordered by descending size and origins within a cluster by file,
+// bundle number and entry index.
+func clusterErrorResponses(errorResponses map[bundleIdentifier]util.ErrorResponse,
+	entryErrorResponses map[entryIdentifier]util.ErrorResponse) []*errorCluster {
+
+	responses := make(map[errorOrigin]util.ErrorResponse, len(errorResponses)+len(entryErrorResponses))
+	for bundleId, errorResponse := range errorResponses {
+		responses[errorOrigin{bundleId: bundleId, index: -1}] = errorResponse
+	}
+	for entryId, errorResponse := range entryErrorResponses {
+		responses[errorOrigin{bundleId: entryId.bundleId, index: entryId.index}] = errorResponse
+	}
+
+	origins := make([]errorOrigin, 0, len(responses))
+	for origin := range responses {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool { return origins[i].less(origins[j]) })
+
+	var clusters []*errorCluster
+	clustersByKey := make(map[string]*errorCluster)
+	for _, origin := range origins {
+		errorResponse := responses[origin]
+		normalized := errorResponse.Normalized()
+		cluster, ok := clustersByKey[normalized]
+		if !ok {
+			cluster = &errorCluster{normalized: normalized, first: errorResponse}
+			clustersByKey[normalized] = cluster
+			clusters = append(clusters, cluster)
+		}
+		cluster.origins = append(cluster.origins, origin)
+	}
+
+	sort.SliceStable(clusters, func(i, j int) bool { return len(clusters[i].origins) > len(clusters[j].origins) })
+	return clusters
+}
+
+// fmtErrorClusters formats the given clusters. Clusters with a single error response are shown
+// with all details of the response. Larger clusters are shown with their size, a few example
+// origins and the normalized form of their error responses.
+func fmtErrorClusters(clusters []*errorCluster) string {
+	builder := strings.Builder{}
+	for _, cluster := range clusters {
+		if len(cluster.origins) == 1 {
+			builder.WriteString(fmt.Sprintf("%s\n", cluster.origins[0]))
+			builder.WriteString(util.Indent(4, strings.TrimSuffix(cluster.first.String(), "\n")) + "\n")
+			continue
+		}
+
+		examples := make([]string, 0, maxClusterExamples)
+		for i := 0; i < len(cluster.origins) && i < maxClusterExamples; i++ {
+			examples = append(examples, cluster.origins[i].String())
+		}
+		builder.WriteString(fmt.Sprintf("%d Responses, e.g. %s\n", len(cluster.origins), strings.Join(examples, ", ")))
+		builder.WriteString(util.Indent(4, strings.TrimSuffix(cluster.normalized, "\n")) + "\n")
+	}
+	return builder.String()
+}
+
+// errorReport contains the details of every non-OK response and every error of an upload.
+type errorReport struct {
+	ErrorResponses []errorReportEntry `json:"errorResponses"`
+	Errors         []errorReportEntry `json:"errors"`
+	// failed split bundles of which some pieces were committed
+	PartialCommits []partialCommitReportEntry `json:"partialCommits,omitempty"`
+	// successfully uploaded bundles whose response bundle couldn't be inspected
+	UninspectedResponses []errorReportEntry `json:"uninspectedResponses,omitempty"`
+}
+
+type partialCommitReportEntry struct {
+	File             string `json:"file"`
+	Bundle           int    `json:"bundle"`
+	Pieces           int    `json:"pieces"`
+	CommittedPieces  int    `json:"committedPieces"`
+	Entries          int    `json:"entries"`
+	CommittedEntries int    `json:"committedEntries"`
+}
+
+// sortBundleIds sorts the given bundle identifiers by file and bundle number.
+func sortBundleIds(bundleIds []bundleIdentifier) {
+	sort.Slice(bundleIds, func(i, j int) bool {
+		return errorOrigin{bundleId: bundleIds[i]}.less(errorOrigin{bundleId: bundleIds[j]})
+	})
+}
+
+// partiallyCommittedBundleIds returns the identifiers of the partially committed bundles of the
+// given upload results ordered by file and bundle number.
+func partiallyCommittedBundleIds(results aggregatedUploadResults) []bundleIdentifier {
+	bundleIds := make([]bundleIdentifier, 0, len(results.partialCommits))
+	for bundleId := range results.partialCommits {
+		bundleIds = append(bundleIds, bundleId)
+	}
+	sortBundleIds(bundleIds)
+	return bundleIds
+}
+
+// uninspectedBundleIds returns the identifiers of the bundles whose response bundle couldn't be
+// inspected ordered by file and bundle number.
+func uninspectedBundleIds(results aggregatedUploadResults) []bundleIdentifier {
+	bundleIds := make([]bundleIdentifier, 0, len(results.inspectionErrors))
+	for bundleId := range results.inspectionErrors {
+		bundleIds = append(bundleIds, bundleId)
+	}
+	sortBundleIds(bundleIds)
+	return bundleIds
+}
+
+type errorReportEntry struct {
+	File             string               `json:"file"`
+	Bundle           int                  `json:"bundle"`
+	Entry            *int                 `json:"entry,omitempty"`
+	StatusCode       int                  `json:"statusCode,omitempty"`
+	OperationOutcome *fm.OperationOutcome `json:"operationOutcome,omitempty"`
+	Error            string               `json:"error,omitempty"`
+}
+
+// writeErrorReport writes the details of all non-OK responses and errors of the given upload
+// results as JSON.
+func writeErrorReport(w io.Writer, results aggregatedUploadResults) error {
+	report := errorReport{ErrorResponses: []errorReportEntry{}, Errors: []errorReportEntry{}}
+
+	for _, cluster := range clusterErrorResponses(results.errorResponses, results.entryErrorResponses) {
+		for _, origin := range cluster.origins {
+			entry := errorReportEntry{File: origin.bundleId.filename, Bundle: origin.bundleId.bundleNumber}
+			var errorResponse util.ErrorResponse
+			if origin.index < 0 {
+				errorResponse = results.errorResponses[origin.bundleId]
+			} else {
+				index := origin.index
+				entry.Entry = &index
+				errorResponse = results.entryErrorResponses[entryIdentifier{bundleId: origin.bundleId, index: index}]
+			}
+			entry.StatusCode = errorResponse.StatusCode
+			entry.OperationOutcome = errorResponse.OperationOutcome
+			entry.Error = errorResponse.OtherError
+			report.ErrorResponses = append(report.ErrorResponses, entry)
+		}
+	}
+
+	bundleIds := make([]bundleIdentifier, 0, len(results.errors))
+	for bundleId := range results.errors {
+		bundleIds = append(bundleIds, bundleId)
+	}
+	sortBundleIds(bundleIds)
+	for _, bundleId := range bundleIds {
+		report.Errors = append(report.Errors, errorReportEntry{
+			File:   bundleId.filename,
+			Bundle: bundleId.bundleNumber,
+			Error:  results.errors[bundleId].Error(),
+		})
+	}
+
+	for _, bundleId := range partiallyCommittedBundleIds(results) {
+		partial := results.partialCommits[bundleId]
+		report.PartialCommits = append(report.PartialCommits, partialCommitReportEntry{
+			File:             bundleId.filename,
+			Bundle:           bundleId.bundleNumber,
+			Pieces:           partial.pieces,
+			CommittedPieces:  partial.committedPieces,
+			Entries:          partial.entries,
+			CommittedEntries: partial.committedEntries,
+		})
+	}
+
+	for _, bundleId := range uninspectedBundleIds(results) {
+		report.UninspectedResponses = append(report.UninspectedResponses, errorReportEntry{
+			File:   bundleId.filename,
+			Bundle: bundleId.bundleNumber,
+			Error:  results.inspectionErrors[bundleId].Error(),
+		})
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
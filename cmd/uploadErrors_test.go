@@ -0,0 +1,110 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func notFoundResponse(id int) util.ErrorResponse {
+	diagnostics := fmt.Sprintf("Resource `Patient/%d` not found.", id)
+	return util.ErrorResponse{
+		StatusCode: 404,
+		OperationOutcome: &fm.OperationOutcome{Issue: []fm.OperationOutcomeIssue{
+			{Severity: fm.IssueSeverityError, Code: fm.IssueTypeNotFound, Diagnostics: &diagnostics},
+		}},
+	}
+}
+
+func TestClusterErrorResponses(t *testing.T) {
+	errorResponses := map[bundleIdentifier]util.ErrorResponse{
+		{filename: "b.json", bundleNumber: 1}: notFoundResponse(1),
+		{filename: "a.json", bundleNumber: 1}: notFoundResponse(2),
+		{filename: "c.json", bundleNumber: 1}: {StatusCode: 500, OtherError: "internal error"},
+	}
+	entryErrorResponses := map[entryIdentifier]util.ErrorResponse{
+		{bundleId: bundleIdentifier{filename: "a.ndjson", bundleNumber: 2}, index: 3}: notFoundResponse(3),
+	}
+
+	clusters := clusterErrorResponses(errorResponses, entryErrorResponses)
+
+	assert.Equal(t, 2, len(clusters))
+	assert.Equal(t, []errorOrigin{
+		{bundleId: bundleIdentifier{filename: "a.json", bundleNumber: 1}, index: -1},
+		{bundleId: bundleIdentifier{filename: "a.ndjson", bundleNumber: 2}, index: 3},
+		{bundleId: bundleIdentifier{filename: "b.json", bundleNumber: 1}, index: -1},
+	}, clusters[0].origins)
+	assert.Equal(t, 1, len(clusters[1].origins))
+
+	t.Run("Format", func(t *testing.T) {
+		assert.Equal(t, `3 Responses, e.g. File: a.json [Bundle: 1], File: a.ndjson [Bundle: 2, Entry: 3], File: b.json [Bundle: 1]
+    StatusCode  : 404
+    Code        : `+fm.IssueTypeNotFound.Definition()+`
+    Diagnostics : Resource `+"`Patient/<id>`"+` not found.
+File: c.json [Bundle: 1]
+    StatusCode  : 500
+    Error       : internal error
+`, fmtErrorClusters(clusters))
+	})
+}
+
+func TestWriteErrorReport(t *testing.T) {
+	results := aggregatedUploadResults{
+		errorResponses: map[bundleIdentifier]util.ErrorResponse{
+			{filename: "a.json", bundleNumber: 1}: notFoundResponse(1),
+		},
+		entryErrorResponses: map[entryIdentifier]util.ErrorResponse{
+			{bundleId: bundleIdentifier{filename: "b.ndjson", bundleNumber: 2}, index: 0}: notFoundResponse(2),
+		},
+		errors: map[bundleIdentifier]error{
+			{filename: "c.json", bundleNumber: 1}: errors.New("error-103525"),
+		},
+		partialCommits: map[bundleIdentifier]*partialCommit{
+			{filename: "a.json", bundleNumber: 1}: {pieces: 3, committedPieces: 1, entries: 5, committedEntries: 2},
+		},
+		inspectionErrors: map[bundleIdentifier]error{
+			{filename: "d.json", bundleNumber: 1}: errors.New("error-151043"),
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, writeErrorReport(&buf, results))
+
+	var report map[string][]map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &report))
+
+	assert.Equal(t, 2, len(report["errorResponses"]))
+	assert.Equal(t, "a.json", report["errorResponses"][0]["file"])
+	assert.NotContains(t, report["errorResponses"][0], "entry")
+	assert.Equal(t, float64(404), report["errorResponses"][0]["statusCode"])
+	assert.Equal(t, "b.ndjson", report["errorResponses"][1]["file"])
+	assert.Equal(t, float64(0), report["errorResponses"][1]["entry"])
+	issue := report["errorResponses"][1]["operationOutcome"].(map[string]interface{})["issue"].([]interface{})[0]
+	assert.Equal(t, "Resource `Patient/2` not found.", issue.(map[string]interface{})["diagnostics"])
+	assert.Equal(t, []map[string]interface{}{{"file": "c.json", "bundle": float64(1), "error": "error-103525"}},
+		report["errors"])
+	assert.Equal(t, []map[string]interface{}{{"file": "a.json", "bundle": float64(1), "pieces": float64(3),
+		"committedPieces": float64(1), "entries": float64(5), "committedEntries": float64(2)}}, report["partialCommits"])
+	assert.Equal(t, []map[string]interface{}{{"file": "d.json", "bundle": float64(1), "error": "error-151043"}},
+		report["uninspectedResponses"])
+}
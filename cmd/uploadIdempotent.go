@@ -0,0 +1,282 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+const (
+	// idempotentConditionalCreate turns POST entries with an identifier into conditional creates.
+	idempotentConditionalCreate = "conditional-create"
+	// idempotentPut turns all POST entries into PUT entries with a deterministic id.
+	idempotentPut = "put"
+)
+
+// identifier is the part of a FHIR Identifier that is used to derive conditional creates and ids.
+type identifier struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+// firstIdentifier returns the first identifier with a value of the given resource. Depending on
+// the resource type, the identifier element is either a list or a single identifier.
+func firstIdentifier(resource map[string]json.RawMessage) (identifier, bool) {
+	raw, ok := resource["identifier"]
+	if !ok {
+		return identifier{}, false
+	}
+
+	var identifiers []identifier
+	if err := json.Unmarshal(raw, &identifiers); err != nil {
+		var single identifier
+		if err := json.Unmarshal(raw, &single); err != nil {
+			return identifier{}, false
+		}
+		identifiers = []identifier{single}
+	}
+
+	for _, ident := range identifiers {
+		if ident.Value != "" {
+			return ident, true
+		}
+	}
+	return identifier{}, false
+}
+
+// identifierSearchValue formats an identifier as value of the identifier search parameter.
+func identifierSearchValue(ident identifier) string {
+	if ident.System == "" {
+		return ident.Value
+	}
+	return ident.System + "|" + ident.Value
+}
+
+// deterministicId derives a FHIR resource id from the given parts. The same parts always result
+// in the same id.
+func deterministicId(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(hash[:16])
+}
+
+// contentHashId derives a FHIR resource id from the content of a resource. The id and meta
+// elements are ignored, because they don't belong to the content. If stableReference is given,
+// references are replaced by it before hashing, so that the id doesn't depend on fullUrls which
+// change with every delivery.
+func contentHashId(resourceType string, resource json.RawMessage,
+	stableReference func(reference string) (string, bool)) (string, error) {
+
+	object, err := decodeResource(resource)
+	if err != nil {
+		return "", err
+	}
+	delete(object, "id")
+	delete(object, "meta")
+	if stableReference != nil {
+		rewriteReferences(object, stableReference)
+	}
+
+	// encoding sorts the keys of all objects and compacts the values
+	content, err := encodeResource(object)
+	if err != nil {
+		return "", err
+	}
+	return deterministicId(resourceType, string(content)), nil
+}
+
+// putEntry turns the entry with the given index into a PUT of its resource with the given id.
+// References to the urn fullUrl of the entry are recorded in references.
+func putEntry(bundle *fm.Bundle, i int, resourceType string, id string, references map[string]string) error {
+	entry := bundle.Entry[i]
+	var resource map[string]json.RawMessage
+	if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+		return fmt.Errorf("could not parse the resource of entry with index %d: %v", i, err)
+	}
+	rawId, _ := json.Marshal(id)
+	resource["id"] = rawId
+	rewritten, err := json.Marshal(resource)
+	if err != nil {
+		return fmt.Errorf("could not encode the resource of entry with index %d: %v", i, err)
+	}
+	bundle.Entry[i].Resource = rewritten
+	bundle.Entry[i].Request.Method = fm.HTTPVerbPUT
+	bundle.Entry[i].Request.Url = resourceType + "/" + id
+
+	if entry.FullUrl != nil && strings.HasPrefix(*entry.FullUrl, "urn:") {
+		references[*entry.FullUrl] = resourceType + "/" + id
+	}
+	return nil
+}
+
+// contentIds derives the ids of the entries of a bundle whose resources have no identifier from
+// their content. References to other entries are hashed as stable references to these entries,
+// which are resolved recursively.
+type contentIds struct {
+	bundle *fm.Bundle
+	// resource types of the entries whose id is derived from their content, by index
+	resourceTypes map[int]string
+	// index of every entry with a urn fullUrl by fullUrl
+	fullUrls map[string]int
+	// new references of all entries turned into PUTs by fullUrl
+	references map[string]string
+	ids        map[int]string
+	resolving  map[int]bool
+	// number of resources with the same content seen so far by content hash
+	occurrences map[string]int
+}
+
+func newContentIds(bundle *fm.Bundle, resourceTypes map[int]string, references map[string]string) *contentIds {
+	fullUrls := make(map[string]int)
+	for i, entry := range bundle.Entry {
+		if entry.FullUrl != nil && strings.HasPrefix(*entry.FullUrl, "urn:") {
+			fullUrls[*entry.FullUrl] = i
+		}
+	}
+	return &contentIds{
+		bundle:        bundle,
+		resourceTypes: resourceTypes,
+		fullUrls:      fullUrls,
+		references:    references,
+		ids:           make(map[int]string),
+		resolving:     make(map[int]bool),
+		occurrences:   make(map[string]int),
+	}
+}
+
+// id derives the id of the entry with the given index and turns the entry into a PUT. Identical
+// resources get distinct ids, which are numbered in the order the resources are resolved.
+func (c *contentIds) id(i int) (string, error) {
+	if id, ok := c.ids[i]; ok {
+		return id, nil
+	}
+	c.resolving[i] = true
+	defer delete(c.resolving, i)
+
+	var referenceErr error
+	hash, err := contentHashId(c.resourceTypes[i], c.bundle.Entry[i].Resource, func(reference string) (string, bool) {
+		target, ok := c.fullUrls[reference]
+		if !ok {
+			return "", false
+		}
+		stable, err := c.stableReference(target)
+		if err != nil && referenceErr == nil {
+			referenceErr = err
+		}
+		return stable, true
+	})
+	if err == nil {
+		err = referenceErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not hash the resource of entry with index %d: %v", i, err)
+	}
+
+	id := hash
+	if n := c.occurrences[hash]; n > 0 {
+		id = deterministicId(hash, strconv.Itoa(n))
+	}
+	c.occurrences[hash]++
+	c.ids[i] = id
+	return id, putEntry(c.bundle, i, c.resourceTypes[i], id, c.references)
+}
+
+// stableReference returns a reference to the entry with the given index that doesn't depend on the
+// fullUrl of the entry.
+func (c *contentIds) stableReference(i int) (string, error) {
+	if resourceType, ok := c.resourceTypes[i]; ok {
+		if c.resolving[i] {
+			// entries referencing each other in a cycle can only be told apart by their position
+			return fmt.Sprintf("#entry-%d", i), nil
+		}
+		id, err := c.id(i)
+		return resourceType + "/" + id, err
+	}
+
+	request := c.bundle.Entry[i].Request
+	if request == nil {
+		return fmt.Sprintf("#entry-%d", i), nil
+	}
+	if request.IfNoneExist != nil {
+		return request.Url + "?" + *request.IfNoneExist, nil
+	}
+	return request.Url, nil
+}
+
+// idempotentTransform returns a transform that rewrites POST entries of a bundle so that uploading
+// the bundle repeatedly doesn't create duplicate resources.
+//
+// In conditional-create mode, POST entries with an identifier get an ifNoneExist search on that
+// identifier. In put mode, and for POST entries without identifier in conditional-create mode,
+// entries are turned into PUT entries with an id derived from the identifier or, if the resource
+// has no identifier, from its content. All references to the fullUrl of such an entry are
+// rewritten to the new resource id. Entries which already are conditional creates stay untouched.
+func idempotentTransform(mode string) bundleTransform {
+	return func(bundleId bundleIdentifier, bundle *fm.Bundle) error {
+		references := make(map[string]string)
+		hashed := make(map[int]string)
+		var hashedIndices []int
+
+		for i, entry := range bundle.Entry {
+			if entry.Request == nil || entry.Request.Method != fm.HTTPVerbPOST || len(entry.Resource) == 0 ||
+				entry.Request.IfNoneExist != nil {
+				continue
+			}
+
+			var resource map[string]json.RawMessage
+			if err := json.Unmarshal(entry.Resource, &resource); err != nil {
+				return fmt.Errorf("could not parse the resource of entry with index %d: %v", i, err)
+			}
+			var resourceType string
+			if err := json.Unmarshal(resource["resourceType"], &resourceType); err != nil || resourceType == "" {
+				return fmt.Errorf("missing resource type in entry with index %d", i)
+			}
+
+			ident, hasIdentifier := firstIdentifier(resource)
+			if hasIdentifier && mode == idempotentConditionalCreate {
+				ifNoneExist := "identifier=" + url.QueryEscape(identifierSearchValue(ident))
+				bundle.Entry[i].Request.IfNoneExist = &ifNoneExist
+				continue
+			}
+			if hasIdentifier {
+				id := deterministicId(resourceType, ident.System, ident.Value)
+				if err := putEntry(bundle, i, resourceType, id, references); err != nil {
+					return err
+				}
+				continue
+			}
+			hashed[i] = resourceType
+			hashedIndices = append(hashedIndices, i)
+		}
+
+		// content hashes are derived last, so that they can refer to the final form of all
+		// entries with an identifier
+		ids := newContentIds(bundle, hashed, references)
+		for _, i := range hashedIndices {
+			if _, err := ids.id(i); err != nil {
+				return err
+			}
+		}
+
+		return rewriteBundleReferences(bundle, references)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"testing"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+var idempotentTestBundle = []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+	{"fullUrl": "urn:uuid:1",
+	 "resource": {"resourceType": "Patient", "identifier": [{"system": "http://foo", "value": "a b"}]},
+	 "request": {"method": "POST", "url": "Patient"}},
+	{"fullUrl": "urn:uuid:2",
+	 "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:1"}},
+	 "request": {"method": "POST", "url": "Observation"}},
+	{"fullUrl": "urn:uuid:3",
+	 "resource": {"resourceType": "Condition", "identifier": [{"value": "c"}]},
+	 "request": {"method": "POST", "url": "Condition", "ifNoneExist": "identifier=other"}}]}`)
+
+func TestIdempotentTransform(t *testing.T) {
+	t.Run("ConditionalCreate", func(t *testing.T) {
+		bundle := unmarshalBundle(t, idempotentTestBundle)
+
+		err := idempotentTransform(idempotentConditionalCreate)(bundleIdentifier{}, &bundle)
+
+		assert.Nil(t, err)
+		assert.Equal(t, fm.HTTPVerbPOST, bundle.Entry[0].Request.Method)
+		assert.Equal(t, "identifier=http%3A%2F%2Ffoo%7Ca+b", *bundle.Entry[0].Request.IfNoneExist)
+
+		// the observation has no identifier and is turned into a PUT
+		assert.Equal(t, fm.HTTPVerbPUT, bundle.Entry[1].Request.Method)
+		assert.Regexp(t, "^Observation/[0-9a-f]{32}$", bundle.Entry[1].Request.Url)
+
+		// the reference to the conditionally created patient stays untouched
+		assert.Contains(t, string(bundle.Entry[1].Resource), "urn:uuid:1")
+
+		assert.Equal(t, "identifier=other", *bundle.Entry[2].Request.IfNoneExist)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		bundle := unmarshalBundle(t, idempotentTestBundle)
+
+		err := idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundle)
+
+		assert.Nil(t, err)
+		patientId := deterministicId("Patient", "http://foo", "a b")
+		assert.Equal(t, fm.HTTPVerbPUT, bundle.Entry[0].Request.Method)
+		assert.Equal(t, "Patient/"+patientId, bundle.Entry[0].Request.Url)
+		assert.Nil(t, bundle.Entry[0].Request.IfNoneExist)
+
+		var patient struct{ Id string }
+		_ = json.Unmarshal(bundle.Entry[0].Resource, &patient)
+		assert.Equal(t, patientId, patient.Id)
+
+		// the reference to the patient is rewritten to its new id
+		assert.Contains(t, string(bundle.Entry[1].Resource), `"reference":"Patient/`+patientId+`"`)
+
+		// the conditional create stays untouched
+		assert.Equal(t, fm.HTTPVerbPOST, bundle.Entry[2].Request.Method)
+	})
+
+	t.Run("Deterministic", func(t *testing.T) {
+		bundleA := unmarshalBundle(t, idempotentTestBundle)
+		bundleB := unmarshalBundle(t, idempotentTestBundle)
+
+		_ = idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundleA)
+		_ = idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundleB)
+
+		assert.Equal(t, bundleA.Entry[1].Request.Url, bundleB.Entry[1].Request.Url)
+	})
+
+	t.Run("IdsDontDependOnFullUrls", func(t *testing.T) {
+		delivery := func(patientUuid string, observationUuid string) fm.Bundle {
+			return unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+				{"fullUrl": "urn:uuid:`+patientUuid+`", "resource": {"resourceType": "Patient", "gender": "male"},
+				 "request": {"method": "POST", "url": "Patient"}},
+				{"fullUrl": "urn:uuid:`+observationUuid+`",
+				 "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:`+patientUuid+`"}},
+				 "request": {"method": "POST", "url": "Observation"}}]}`))
+		}
+		bundleA := delivery("a1", "a2")
+		bundleB := delivery("b1", "b2")
+
+		assert.Nil(t, idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundleA))
+		assert.Nil(t, idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundleB))
+
+		assert.Equal(t, bundleA.Entry[0].Request.Url, bundleB.Entry[0].Request.Url)
+		assert.Equal(t, bundleA.Entry[1].Request.Url, bundleB.Entry[1].Request.Url)
+		assert.Contains(t, string(bundleA.Entry[1].Resource), `"reference":"`+bundleA.Entry[0].Request.Url+`"`)
+	})
+
+	t.Run("IdenticalResources", func(t *testing.T) {
+		bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+			{"resource": {"resourceType": "Observation", "status": "final"}, "request": {"method": "POST", "url": "Observation"}},
+			{"resource": {"resourceType": "Observation", "status": "final"}, "request": {"method": "POST", "url": "Observation"}}]}`))
+		again := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+			{"resource": {"resourceType": "Observation", "status": "final"}, "request": {"method": "POST", "url": "Observation"}},
+			{"resource": {"resourceType": "Observation", "status": "final"}, "request": {"method": "POST", "url": "Observation"}}]}`))
+
+		assert.Nil(t, idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundle))
+		assert.Nil(t, idempotentTransform(idempotentPut)(bundleIdentifier{}, &again))
+
+		assert.NotEqual(t, bundle.Entry[0].Request.Url, bundle.Entry[1].Request.Url)
+		assert.Equal(t, bundle.Entry[1].Request.Url, again.Entry[1].Request.Url)
+	})
+
+	t.Run("ReferenceCycle", func(t *testing.T) {
+		bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+			{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Observation", "hasMember": [{"reference": "urn:uuid:2"}]},
+			 "request": {"method": "POST", "url": "Observation"}},
+			{"fullUrl": "urn:uuid:2", "resource": {"resourceType": "Observation", "derivedFrom": [{"reference": "urn:uuid:1"}]},
+			 "request": {"method": "POST", "url": "Observation"}}]}`))
+
+		assert.Nil(t, idempotentTransform(idempotentPut)(bundleIdentifier{}, &bundle))
+
+		assert.Contains(t, string(bundle.Entry[0].Resource), `"reference":"`+bundle.Entry[1].Request.Url+`"`)
+		assert.Contains(t, string(bundle.Entry[1].Resource), `"reference":"`+bundle.Entry[0].Request.Url+`"`)
+	})
+}
+
+func TestContentHashId(t *testing.T) {
+	idA, err := contentHashId("Patient", []byte(`{"resourceType": "Patient", "id": "1", "gender": "male"}`), nil)
+	assert.Nil(t, err)
+	idB, err := contentHashId("Patient", []byte(`{"gender":"male","resourceType":"Patient"}`), nil)
+	assert.Nil(t, err)
+	idC, err := contentHashId("Patient", []byte(`{"resourceType": "Patient", "gender": "female"}`), nil)
+	assert.Nil(t, err)
+
+	assert.Equal(t, idA, idB)
+	assert.NotEqual(t, idA, idC)
+}
@@ -0,0 +1,180 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samply/blazectl/util"
+)
+
+// dashboardWindow is the time window over which rates and latency percentiles are calculated.
+const dashboardWindow = 30 * time.Second
+
+// perFileMinBundles is the minimum number of bundles an NDJSON file needs to get its own progress
+// bar.
+const perFileMinBundles = 10
+
+type completedUpload struct {
+	at      time.Time
+	bytes   int64
+	latency float64
+}
+
+// uploadDashboard collects live statistics shown in the progress display during an upload. It is
+// safe for concurrent use.
+type uploadDashboard struct {
+	mutex    sync.Mutex
+	start    time.Time
+	inFlight int
+	// uploads completed within the dashboard window
+	recent        []completedUpload
+	statusCounts  map[int]int
+	errors        int
+	failedEntries int
+	now           func() time.Time
+}
+
+func newUploadDashboard() *uploadDashboard {
+	return &uploadDashboard{
+		start:        time.Now(),
+		statusCounts: make(map[int]int),
+		now:          time.Now,
+	}
+}
+
+func (d *uploadDashboard) uploadStarted() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.inFlight++
+}
+
+func (d *uploadDashboard) uploadFinished() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.inFlight--
+}
+
+func (d *uploadDashboard) add(result bundleUploadResult) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if result.err != nil {
+		d.errors++
+		return
+	}
+	if result.uploadInfo.statusCode != http.StatusOK {
+		d.statusCounts[result.uploadInfo.statusCode]++
+	}
+	d.failedEntries += len(result.failedEntries)
+
+	now := d.now()
+	d.prune(now)
+	d.recent = append(d.recent, completedUpload{
+		at:      now,
+		bytes:   result.uploadInfo.bytesOut,
+		latency: result.uploadInfo.requestDuration.Seconds(),
+	})
+}
+
+// prune removes all uploads which completed before the dashboard window.
+func (d *uploadDashboard) prune(now time.Time) {
+	var i int
+	for i < len(d.recent) && now.Sub(d.recent[i].at) > dashboardWindow {
+		i++
+	}
+	d.recent = d.recent[i:]
+}
+
+// throughput formats the bytes and bundles per second, the number of uploads in flight and the
+// 95th percentile of the request latency within the dashboard window.
+func (d *uploadDashboard) throughput() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+	d.prune(now)
+
+	window := now.Sub(d.start)
+	if window > dashboardWindow {
+		window = dashboardWindow
+	}
+
+	var bytes int64
+	latencies := make([]float64, 0, len(d.recent))
+	for _, upload := range d.recent {
+		bytes += upload.bytes
+		latencies = append(latencies, upload.latency)
+	}
+
+	var bytesPerSecond, bundlesPerSecond float64
+	if window > 0 {
+		bytesPerSecond = float64(bytes) / window.Seconds()
+		bundlesPerSecond = float64(len(d.recent)) / window.Seconds()
+	}
+
+	str := fmt.Sprintf("%s/s, %.1f bundles/s, in-flight %d", util.FmtBytesHumanReadable(float32(bytesPerSecond)),
+		bundlesPerSecond, d.inFlight)
+	if len(latencies) > 0 {
+		str += fmt.Sprintf(", p95 %s", util.CalculateDurationStatistics(latencies).Q95)
+	}
+	return str
+}
+
+// problems formats the running counts of errors, non-OK responses by status code and failed
+// entries.
+func (d *uploadDashboard) problems() string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	statusCodes := make([]int, 0, len(d.statusCounts))
+	for statusCode := range d.statusCounts {
+		statusCodes = append(statusCodes, statusCode)
+	}
+	sort.Ints(statusCodes)
+
+	nonOK := make([]string, 0, len(statusCodes))
+	for _, statusCode := range statusCodes {
+		nonOK = append(nonOK, fmt.Sprintf("%d:%d", statusCode, d.statusCounts[statusCode]))
+	}
+	if len(nonOK) == 0 {
+		nonOK = append(nonOK, "none")
+	}
+
+	return fmt.Sprintf("errors %d, non-OK %s, failed entries %d", d.errors, strings.Join(nonOK, " "),
+		d.failedEntries)
+}
+
+// largeMultiBundleFiles returns the number of bundles of every NDJSON file with at least
+// perFileMinBundles bundles.
+func largeMultiBundleFiles(bundles []bundle) map[string]int {
+	counts := make(map[string]int)
+	for _, b := range bundles {
+		if isMultiBundleFile(b.id.filename) {
+			counts[b.id.filename]++
+		}
+	}
+	for filename, count := range counts {
+		if count < perFileMinBundles {
+			delete(counts, filename)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadDashboard(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+
+	dashboard := newUploadDashboard()
+	dashboard.start = start
+	dashboard.now = func() time.Time { return now }
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, "0.00 B/s, 0.0 bundles/s, in-flight 0", dashboard.throughput())
+		assert.Equal(t, "errors 0, non-OK none, failed entries 0", dashboard.problems())
+	})
+
+	dashboard.uploadStarted()
+	dashboard.uploadStarted()
+	dashboard.uploadFinished()
+
+	now = start.Add(10 * time.Second)
+	for i := 0; i < 20; i++ {
+		dashboard.add(bundleUploadResult{uploadInfo: uploadInfo{statusCode: 200, bytesOut: 1024,
+			requestDuration: time.Second}})
+	}
+	dashboard.add(bundleUploadResult{uploadInfo: uploadInfo{statusCode: 503}})
+	dashboard.add(bundleUploadResult{uploadInfo: uploadInfo{statusCode: 400}})
+	dashboard.add(bundleUploadResult{uploadInfo: uploadInfo{statusCode: 400}})
+	dashboard.add(bundleUploadResult{uploadInfo: uploadInfo{statusCode: 200},
+		failedEntries: []failedEntry{{index: 1}, {index: 2}}})
+	dashboard.add(bundleUploadResult{err: errors.New("error-095010")})
+
+	t.Run("WithinWindow", func(t *testing.T) {
+		assert.Equal(t, "2.00 KiB/s, 2.4 bundles/s, in-flight 1, p95 1s", dashboard.throughput())
+		assert.Equal(t, "errors 1, non-OK 400:2 503:1, failed entries 2", dashboard.problems())
+	})
+
+	t.Run("AfterWindow", func(t *testing.T) {
+		now = start.Add(10*time.Second + dashboardWindow + time.Second)
+		assert.Equal(t, "0.00 B/s, 0.0 bundles/s, in-flight 1", dashboard.throughput())
+		assert.Equal(t, "errors 1, non-OK 400:2 503:1, failed entries 2", dashboard.problems())
+	})
+}
+
+func TestLargeMultiBundleFiles(t *testing.T) {
+	var bundles []bundle
+	for i := 1; i <= perFileMinBundles; i++ {
+		bundles = append(bundles, bundle{id: bundleIdentifier{filename: "large.ndjson", bundleNumber: i}})
+	}
+	bundles = append(bundles, bundle{id: bundleIdentifier{filename: "small.ndjson", bundleNumber: 1}})
+	for i := 1; i <= perFileMinBundles; i++ {
+		bundles = append(bundles, bundle{id: bundleIdentifier{filename: fmt.Sprintf("%d.json", i), bundleNumber: 1}})
+	}
+
+	assert.Equal(t, map[string]int{"large.ndjson": perFileMinBundles}, largeMultiBundleFiles(bundles))
+}
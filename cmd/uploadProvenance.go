@@ -0,0 +1,185 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// tagCoding is a coding added to meta.tag of uploaded resources.
+type tagCoding struct {
+	system, code string
+}
+
+// parseTag parses a tag given as system|code or just code.
+func parseTag(tag string) (tagCoding, error) {
+	system, code, found := strings.Cut(tag, "|")
+	if !found {
+		system, code = "", tag
+	}
+	if code == "" {
+		return tagCoding{}, fmt.Errorf("invalid tag `%s`, expect system|code", tag)
+	}
+	return tagCoding{system: system, code: code}, nil
+}
+
+// stampResource adds the given tags to meta.tag of the resource, unless they are already present,
+// and sets meta.source if source isn't empty.
+func stampResource(resource map[string]interface{}, tags []tagCoding, source string) {
+	meta, ok := resource["meta"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+		resource["meta"] = meta
+	}
+
+	existingTags, _ := meta["tag"].([]interface{})
+	for _, tag := range tags {
+		if !hasTag(existingTags, tag) {
+			coding := map[string]interface{}{"code": tag.code}
+			if tag.system != "" {
+				coding["system"] = tag.system
+			}
+			existingTags = append(existingTags, coding)
+		}
+	}
+	if len(existingTags) > 0 {
+		meta["tag"] = existingTags
+	}
+
+	if source != "" {
+		meta["source"] = source
+	}
+}
+
+func hasTag(tags []interface{}, tag tagCoding) bool {
+	for _, t := range tags {
+		coding, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		system, _ := coding["system"].(string)
+		code, _ := coding["code"].(string)
+		if system == tag.system && code == tag.code {
+			return true
+		}
+	}
+	return false
+}
+
+// stampTransform returns a transform adding the given tags and source to the meta of every entry
+// resource. If withProvenance is true, a Provenance resource is added to every transaction bundle.
+// It targets all resources created or updated by the bundle and names blazectl as agent and the
+// input file as source entity. The Provenance is stamped with the tags and the source as well.
+func stampTransform(tags []tagCoding, source string, withProvenance bool, now func() time.Time) bundleTransform {
+	return func(bundleId bundleIdentifier, bundle *fm.Bundle) error {
+		var targets []interface{}
+
+		for i, entry := range bundle.Entry {
+			if len(entry.Resource) == 0 {
+				continue
+			}
+
+			if len(tags) > 0 || source != "" {
+				resource, err := decodeResource(entry.Resource)
+				if err != nil {
+					return fmt.Errorf("entry with index %d: %v", i, err)
+				}
+				stampResource(resource, tags, source)
+				if bundle.Entry[i].Resource, err = encodeResource(resource); err != nil {
+					return fmt.Errorf("entry with index %d: %v", i, err)
+				}
+			}
+
+			if withProvenance && entry.Request != nil &&
+				(entry.Request.Method == fm.HTTPVerbPOST || entry.Request.Method == fm.HTTPVerbPUT) {
+				targets = append(targets, map[string]interface{}{"reference": targetReference(&bundle.Entry[i])})
+			}
+		}
+
+		if !withProvenance || bundle.Type != fm.BundleTypeTransaction || len(targets) == 0 {
+			return nil
+		}
+
+		provenance := map[string]interface{}{
+			"resourceType": "Provenance",
+			"target":       targets,
+			"recorded":     now().UTC().Format(time.RFC3339),
+			"agent": []interface{}{map[string]interface{}{
+				"who": map[string]interface{}{"display": "blazectl " + rootCmd.Version},
+			}},
+			"entity": []interface{}{map[string]interface{}{
+				"role": "source",
+				"what": map[string]interface{}{
+					"display": fmt.Sprintf("%s [Bundle: %d]", filepath.Base(bundleId.filename), bundleId.bundleNumber),
+				},
+			}},
+		}
+		if len(tags) > 0 || source != "" {
+			stampResource(provenance, tags, source)
+		}
+
+		resource, err := json.Marshal(provenance)
+		if err != nil {
+			return fmt.Errorf("could not encode the Provenance resource: %v", err)
+		}
+		fullUrl := "urn:uuid:" + uuid.NewString()
+		bundle.Entry = append(bundle.Entry, fm.BundleEntry{
+			FullUrl:  &fullUrl,
+			Resource: resource,
+			Request:  &fm.BundleEntryRequest{Method: fm.HTTPVerbPOST, Url: "Provenance"},
+		})
+		return nil
+	}
+}
+
+// targetReference returns a reference to the resource of the given entry which the server
+// resolves within the transaction. Entries without fullUrl get a new urn:uuid fullUrl.
+func targetReference(entry *fm.BundleEntry) string {
+	if entry.FullUrl != nil && *entry.FullUrl != "" {
+		return *entry.FullUrl
+	}
+	if entry.Request.Method == fm.HTTPVerbPUT && !strings.Contains(entry.Request.Url, "?") {
+		return entry.Request.Url
+	}
+	fullUrl := "urn:uuid:" + uuid.NewString()
+	entry.FullUrl = &fullUrl
+	return fullUrl
+}
+
+// withoutStampedProvenance returns the given request and response bundles without the Provenance
+// entry added by stampTransform, so that it isn't counted as uploaded resource. The Provenance is
+// the last entry of every transaction bundle with entries it targets, so a bundle ending with a
+// Provenance always got one. It is recognized by its URL only, because the idempotent transform
+// turns its POST into a PUT with a content hash id.
+func withoutStampedProvenance(request fm.Bundle, response fm.Bundle) (fm.Bundle, fm.Bundle) {
+	n := len(request.Entry)
+	if request.Type != fm.BundleTypeTransaction || n == 0 || len(response.Entry) != n {
+		return request, response
+	}
+	last := request.Entry[n-1].Request
+	if last == nil || (last.Url != "Provenance" && !strings.HasPrefix(last.Url, "Provenance/")) {
+		return request, response
+	}
+	request.Entry = request.Entry[:n-1]
+	response.Entry = response.Entry[:n-1]
+	return request, response
+}
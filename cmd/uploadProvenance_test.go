@@ -0,0 +1,144 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTag(t *testing.T) {
+	t.Run("SystemAndCode", func(t *testing.T) {
+		tag, err := parseTag("http://example.com/delivery|2022-10")
+		assert.NoError(t, err)
+		assert.Equal(t, tagCoding{system: "http://example.com/delivery", code: "2022-10"}, tag)
+	})
+
+	t.Run("CodeOnly", func(t *testing.T) {
+		tag, err := parseTag("2022-10")
+		assert.NoError(t, err)
+		assert.Equal(t, tagCoding{code: "2022-10"}, tag)
+	})
+
+	t.Run("MissingCode", func(t *testing.T) {
+		_, err := parseTag("http://example.com/delivery|")
+		assert.Error(t, err)
+	})
+}
+
+func TestStampTransform(t *testing.T) {
+	now := func() time.Time { return time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC) }
+	tags := []tagCoding{{system: "http://example.com/delivery", code: "d1"}}
+	bundleId := bundleIdentifier{filename: "/data/patients.ndjson", bundleNumber: 2}
+
+	t.Run("StampsTagAndSource", func(t *testing.T) {
+		bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "batch", "entry": [
+			{"resource": {"resourceType": "Patient", "meta": {"tag": [{"system": "http://example.com/delivery", "code": "d1"}]}},
+			 "request": {"method": "POST", "url": "Patient"}},
+			{"resource": {"resourceType": "Observation"}, "request": {"method": "POST", "url": "Observation"}}]}`))
+
+		err := stampTransform(tags, "http://example.com/source", false, now)(bundleId, &bundle)
+
+		assert.NoError(t, err)
+		assert.Len(t, bundle.Entry, 2)
+		for _, entry := range bundle.Entry {
+			resource, err := decodeResource(entry.Resource)
+			assert.NoError(t, err)
+			meta := resource["meta"].(map[string]interface{})
+			assert.Equal(t, "http://example.com/source", meta["source"])
+			assert.Len(t, meta["tag"], 1)
+		}
+	})
+
+	t.Run("AddsProvenanceToTransaction", func(t *testing.T) {
+		bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+			{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}},
+			{"resource": {"resourceType": "Observation", "id": "0"}, "request": {"method": "PUT", "url": "Observation/0"}},
+			{"resource": {"resourceType": "Condition"}, "request": {"method": "POST", "url": "Condition"}},
+			{"request": {"method": "DELETE", "url": "Encounter/0"}}]}`))
+
+		err := stampTransform(tags, "", true, now)(bundleId, &bundle)
+
+		assert.NoError(t, err)
+		if assert.Len(t, bundle.Entry, 5) {
+			provenanceEntry := bundle.Entry[4]
+			assert.Equal(t, fm.HTTPVerbPOST, provenanceEntry.Request.Method)
+			assert.Equal(t, "Provenance", provenanceEntry.Request.Url)
+			assert.NotNil(t, provenanceEntry.FullUrl)
+
+			provenance, err := decodeResource(provenanceEntry.Resource)
+			assert.NoError(t, err)
+			assert.Equal(t, "2022-10-01T12:00:00Z", provenance["recorded"])
+			assert.Equal(t, []interface{}{
+				map[string]interface{}{"reference": "urn:uuid:1"},
+				map[string]interface{}{"reference": "Observation/0"},
+				map[string]interface{}{"reference": *bundle.Entry[2].FullUrl},
+			}, provenance["target"])
+			entity := provenance["entity"].([]interface{})[0].(map[string]interface{})
+			assert.Equal(t, "patients.ndjson [Bundle: 2]", entity["what"].(map[string]interface{})["display"])
+			assert.Len(t, provenance["meta"].(map[string]interface{})["tag"], 1)
+		}
+	})
+
+	t.Run("NoProvenanceInBatch", func(t *testing.T) {
+		bundle := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "batch", "entry": [
+			{"resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}}]}`))
+
+		err := stampTransform(nil, "", true, now)(bundleId, &bundle)
+
+		assert.NoError(t, err)
+		assert.Len(t, bundle.Entry, 1)
+	})
+}
+
+func TestWithoutStampedProvenance(t *testing.T) {
+	request := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "request": {"method": "POST", "url": "Patient"}},
+		{"fullUrl": "urn:uuid:2", "request": {"method": "POST", "url": "Provenance"}}]}`))
+	response := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+		{"response": {"status": "201", "location": "Patient/A/_history/1"}},
+		{"response": {"status": "201", "location": "Provenance/B/_history/1"}}]}`))
+
+	t.Run("Transaction", func(t *testing.T) {
+		assert.Equal(t, map[string]resourceCounts{"Patient": {created: 1}},
+			tallyResourceCounts(withoutStampedProvenance(request, response)))
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		batch := request
+		batch.Type = fm.BundleTypeBatch
+
+		assert.Equal(t, map[string]resourceCounts{"Patient": {created: 1}, "Provenance": {created: 1}},
+			tallyResourceCounts(withoutStampedProvenance(batch, response)))
+	})
+	t.Run("Idempotent", func(t *testing.T) {
+		now := func() time.Time { return time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC) }
+		bundleId := bundleIdentifier{filename: "patients.ndjson", bundleNumber: 1}
+
+		for _, mode := range []string{idempotentPut, idempotentConditionalCreate} {
+			request := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+				{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient", "identifier": [{"system": "foo", "value": "1"}]},
+				 "request": {"method": "POST", "url": "Patient"}}]}`))
+			assert.NoError(t, stampTransform(nil, "", true, now)(bundleId, &request), mode)
+			assert.NoError(t, idempotentTransform(mode)(bundleId, &request), mode)
+
+			assert.Equal(t, map[string]resourceCounts{"Patient": {created: 1}},
+				tallyResourceCounts(withoutStampedProvenance(request, response)), mode)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/samply/blazectl/util"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// idMapping describes which resource the server created or updated for a single entry of an
+// uploaded bundle.
+type idMapping struct {
+	fullUrl   string
+	location  string
+	versionId string
+}
+
+// extractIdMappings pairs the entries of a request bundle with the entries of the corresponding
+// response bundle. The FHIR specification requires the response bundle to contain one entry for
+// each entry of the request bundle in the same order.
+func extractIdMappings(request fm.Bundle, response fm.Bundle) ([]idMapping, error) {
+	if len(request.Entry) != len(response.Entry) {
+		return nil, fmt.Errorf("expect %d response bundle entries but got %d", len(request.Entry), len(response.Entry))
+	}
+
+	mappings := make([]idMapping, 0, len(request.Entry))
+	for i, entry := range response.Entry {
+		mapping := idMapping{}
+		if request.Entry[i].FullUrl != nil {
+			mapping.fullUrl = *request.Entry[i].FullUrl
+		}
+		if entry.Response != nil {
+			if entry.Response.Location != nil {
+				mapping.location = *entry.Response.Location
+			}
+			mapping.versionId = versionIdOfResponse(entry.Response)
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// failedEntry describes an entry of a batch bundle the server could not process.
+type failedEntry struct {
+	index         int
+	errorResponse util.ErrorResponse
+}
+
+// extractFailedEntries returns all entries of a batch-response bundle whose response status is not
+// successful. The index of each failed entry is zero-based and matches the index of the entry in
+// the uploaded batch bundle.
+//
+// Transaction-response bundles never contain failed entries, because the server has to fail the
+// transaction as a whole instead.
+func extractFailedEntries(response fm.Bundle) ([]failedEntry, error) {
+	if response.Type != fm.BundleTypeBatchResponse {
+		return nil, nil
+	}
+
+	var failedEntries []failedEntry
+	for i, entry := range response.Entry {
+		if entry.Response == nil {
+			return nil, fmt.Errorf("missing response in entry with index %d", i)
+		}
+
+		statusCode, err := statusCodeOfResponse(entry.Response)
+		if err != nil {
+			return nil, fmt.Errorf("invalid response status in entry with index %d: %v", i, err)
+		}
+		if statusCode < 400 {
+			continue
+		}
+
+		errorResponse := util.ErrorResponse{StatusCode: statusCode}
+		if len(entry.Response.Outcome) > 0 {
+			operationOutcome, err := fm.UnmarshalOperationOutcome(entry.Response.Outcome)
+			if err != nil {
+				errorResponse.OtherError = string(entry.Response.Outcome)
+			} else {
+				errorResponse.OperationOutcome = &operationOutcome
+			}
+		}
+		failedEntries = append(failedEntries, failedEntry{index: i, errorResponse: errorResponse})
+	}
+	return failedEntries, nil
+}
+
+// statusCodeOfResponse parses the status code of a bundle entry response. The status of a response
+// starts with the 3-digit HTTP status code which can be followed by the reason phrase.
+func statusCodeOfResponse(response *fm.BundleEntryResponse) (int, error) {
+	status := strings.TrimSpace(response.Status)
+	if idx := strings.Index(status, " "); idx >= 0 {
+		status = status[:idx]
+	}
+	return strconv.Atoi(status)
+}
+
+// versionIdOfResponse returns the version id of the resource a bundle entry response refers to.
+// The version id is taken from the ETag if present and from the location otherwise.
+//
+// Returns an empty string if the version id is not known.
+func versionIdOfResponse(response *fm.BundleEntryResponse) string {
+	if response.Etag != nil {
+		etag := strings.TrimPrefix(*response.Etag, "W/")
+		return strings.Trim(etag, "\"")
+	}
+	if response.Location != nil {
+		if idx := strings.Index(*response.Location, "/_history/"); idx >= 0 {
+			return (*response.Location)[idx+len("/_history/"):]
+		}
+	}
+	return ""
+}
+
+// responseFilePath returns the path of the file the response bundle of the bundle identified by
+// bundleId is stored in. The directory structure of the input files relative to baseDir is
+// retained below responsesDir so that input files with the same name do not collide.
+func responseFilePath(responsesDir string, baseDir string, bundleId bundleIdentifier) string {
+	relPath, err := filepath.Rel(baseDir, bundleId.filename)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		relPath = filepath.Base(bundleId.filename)
+	}
+
+	name := filepath.Base(relPath)
+	for _, ext := range []string{".gz", ".bz2", ".json", ".ndjson"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+
+	return filepath.Join(responsesDir, filepath.Dir(relPath),
+		fmt.Sprintf("%s-%d.json", name, bundleId.bundleNumber))
+}
+
+// writeResponseBundle stores the response bundle read from r at path creating all missing
+// directories.
+func writeResponseBundle(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// decodeBundleSkeleton decodes the type and the entries of a bundle without their resources. Only
+// the fullUrl, request and response of every entry are kept, so that even large bundles can be
+// inspected without holding their resources in memory.
+func decodeBundleSkeleton(r io.Reader) (fm.Bundle, error) {
+	var bundle fm.Bundle
+	decoder := json.NewDecoder(r)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return bundle, err
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return bundle, err
+		}
+		switch token {
+		case "type":
+			err = decoder.Decode(&bundle.Type)
+		case "entry":
+			bundle.Entry, err = decodeEntrySkeletons(decoder)
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return bundle, err
+		}
+	}
+	return bundle, expectDelim(decoder, '}')
+}
+
+// decodeEntrySkeletons decodes the entry array of a bundle one entry after another.
+func decodeEntrySkeletons(decoder *json.Decoder) ([]fm.BundleEntry, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if token != json.Delim('[') {
+		return nil, fmt.Errorf("expected the entries to be an array but got %v", token)
+	}
+
+	var entries []fm.BundleEntry
+	for decoder.More() {
+		if err := expectDelim(decoder, '{'); err != nil {
+			return nil, err
+		}
+		var entry fm.BundleEntry
+		for decoder.More() {
+			token, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch token {
+			case "fullUrl":
+				err = decoder.Decode(&entry.FullUrl)
+			case "request":
+				err = decoder.Decode(&entry.Request)
+			case "response":
+				err = decoder.Decode(&entry.Response)
+			default:
+				err = skipValue(decoder)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(decoder, '}'); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, expectDelim(decoder, ']')
+}
+
+// readBundleSkeleton decodes the skeleton of the bundle stored in the file with the given name.
+func readBundleSkeleton(filename string) (fm.Bundle, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fm.Bundle{}, err
+	}
+	defer file.Close()
+	return decodeBundleSkeleton(bufio.NewReader(file))
+}
+
+// skeletonReader passes a request bundle through to the server while its skeleton is decoded in
+// the background, so that the bundle can be streamed from its file and inspected at the same time.
+type skeletonReader struct {
+	reader io.Reader
+	pipe   *io.PipeWriter
+	// number of bytes passed through
+	n      int64
+	result chan skeletonResult
+}
+
+type skeletonResult struct {
+	bundle fm.Bundle
+	err    error
+}
+
+func newSkeletonReader(r io.Reader) *skeletonReader {
+	pipeReader, pipeWriter := io.Pipe()
+	result := make(chan skeletonResult, 1)
+	go func() {
+		bundle, err := decodeBundleSkeleton(pipeReader)
+		// drain the pipe, so that passing the bundle through never blocks
+		_, _ = io.Copy(io.Discard, pipeReader)
+		result <- skeletonResult{bundle: bundle, err: err}
+	}()
+	return &skeletonReader{reader: io.TeeReader(r, pipeWriter), pipe: pipeWriter, result: result}
+}
+
+func (s *skeletonReader) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	s.n += int64(n)
+	if err == io.EOF {
+		s.pipe.Close()
+	} else if err != nil {
+		s.pipe.CloseWithError(err)
+	}
+	return n, err
+}
+
+// skeleton returns the skeleton of the bundle passed through. It fails if the bundle wasn't passed
+// through completely.
+func (s *skeletonReader) skeleton() (fm.Bundle, error) {
+	s.pipe.CloseWithError(errors.New("the bundle was not sent completely"))
+	result := <-s.result
+	return result.bundle, result.err
+}
+
+// idMappingWriter writes id mappings as CSV including the input file and bundle number each
+// mapping originates from.
+type idMappingWriter struct {
+	writer *csv.Writer
+}
+
+func newIdMappingWriter(w io.Writer) (*idMappingWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"filename", "bundle", "fullUrl", "location", "versionId"}); err != nil {
+		return nil, err
+	}
+	return &idMappingWriter{writer: writer}, nil
+}
+
+func (w *idMappingWriter) write(bundleId bundleIdentifier, mappings []idMapping) error {
+	for _, mapping := range mappings {
+		err := w.writer.Write([]string{
+			bundleId.filename,
+			strconv.Itoa(bundleId.bundleNumber),
+			mapping.fullUrl,
+			mapping.location,
+			mapping.versionId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes all buffered mappings and returns the first error that occurred while writing.
+func (w *idMappingWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func unmarshalBundle(t *testing.T, data []byte) fm.Bundle {
+	bundle, err := fm.UnmarshalBundle(data)
+	if err != nil {
+		t.Fatalf("can't parse the bundle: %v", err)
+	}
+	return bundle
+}
+
+func TestExtractIdMappings(t *testing.T) {
+	requestBundle := []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "request": {"method": "POST", "url": "Patient"}},
+		{"fullUrl": "urn:uuid:2", "request": {"method": "POST", "url": "Observation"}}]}`)
+
+	t.Run("MatchingEntries", func(t *testing.T) {
+		responseBundle := []byte(`{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+			{"response": {"status": "201", "location": "Patient/A/_history/1", "etag": "W/\"1\""}},
+			{"response": {"status": "201", "location": "Observation/B/_history/2"}}]}`)
+
+		mappings, err := extractIdMappings(unmarshalBundle(t, requestBundle), unmarshalBundle(t, responseBundle))
+
+		assert.Nil(t, err)
+		assert.Equal(t, []idMapping{
+			{fullUrl: "urn:uuid:1", location: "Patient/A/_history/1", versionId: "1"},
+			{fullUrl: "urn:uuid:2", location: "Observation/B/_history/2", versionId: "2"},
+		}, mappings)
+	})
+
+	t.Run("EntryCountMismatch", func(t *testing.T) {
+		responseBundle := []byte(`{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+			{"response": {"status": "201", "location": "Patient/A/_history/1"}}]}`)
+
+		_, err := extractIdMappings(unmarshalBundle(t, requestBundle), unmarshalBundle(t, responseBundle))
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestExtractFailedEntries(t *testing.T) {
+	t.Run("TransactionResponse", func(t *testing.T) {
+		responseBundle := []byte(`{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+			{"response": {"status": "201"}}]}`)
+
+		failedEntries, err := extractFailedEntries(unmarshalBundle(t, responseBundle))
+
+		assert.Nil(t, err)
+		assert.Empty(t, failedEntries)
+	})
+
+	t.Run("BatchResponseWithFailedEntries", func(t *testing.T) {
+		responseBundle := []byte(`{"resourceType": "Bundle", "type": "batch-response", "entry": [
+			{"response": {"status": "201 Created"}},
+			{"response": {"status": "422 Unprocessable Entity", "outcome": {"resourceType": "OperationOutcome",
+				"issue": [{"severity": "error", "code": "invariant", "diagnostics": "diagnostics-142516"}]}}},
+			{"response": {"status": "404"}}]}`)
+
+		failedEntries, err := extractFailedEntries(unmarshalBundle(t, responseBundle))
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(failedEntries))
+		assert.Equal(t, 1, failedEntries[0].index)
+		assert.Equal(t, 422, failedEntries[0].errorResponse.StatusCode)
+		assert.Equal(t, "diagnostics-142516", *failedEntries[0].errorResponse.OperationOutcome.Issue[0].Diagnostics)
+		assert.Equal(t, 2, failedEntries[1].index)
+		assert.Equal(t, 404, failedEntries[1].errorResponse.StatusCode)
+		assert.Nil(t, failedEntries[1].errorResponse.OperationOutcome)
+	})
+
+	t.Run("BatchResponseWithInvalidStatus", func(t *testing.T) {
+		responseBundle := []byte(`{"resourceType": "Bundle", "type": "batch-response", "entry": [
+			{"response": {"status": "created"}}]}`)
+
+		_, err := extractFailedEntries(unmarshalBundle(t, responseBundle))
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestVersionIdOfResponse(t *testing.T) {
+	etag := "W/\"42\""
+	location := "Patient/A/_history/23"
+
+	assert.Equal(t, "42", versionIdOfResponse(&fm.BundleEntryResponse{Etag: &etag, Location: &location}))
+	assert.Equal(t, "23", versionIdOfResponse(&fm.BundleEntryResponse{Location: &location}))
+	assert.Equal(t, "", versionIdOfResponse(&fm.BundleEntryResponse{}))
+}
+
+func TestResponseFilePath(t *testing.T) {
+	t.Run("FileInBaseDir", func(t *testing.T) {
+		path := responseFilePath("responses", "bundles", bundleIdentifier{
+			filename:     filepath.Join("bundles", "patient.json.gz"),
+			bundleNumber: 1,
+		})
+		assert.Equal(t, filepath.Join("responses", "patient-1.json"), path)
+	})
+
+	t.Run("FileInSubDir", func(t *testing.T) {
+		path := responseFilePath("responses", "bundles", bundleIdentifier{
+			filename:     filepath.Join("bundles", "a", "patients.ndjson"),
+			bundleNumber: 23,
+		})
+		assert.Equal(t, filepath.Join("responses", "a", "patients-23.json"), path)
+	})
+
+	t.Run("FileOutsideOfBaseDir", func(t *testing.T) {
+		path := responseFilePath("responses", "bundles", bundleIdentifier{
+			filename:     filepath.Join("other", "patient.json"),
+			bundleNumber: 1,
+		})
+		assert.Equal(t, filepath.Join("responses", "patient-1.json"), path)
+	})
+}
+
+func TestIdMappingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := newIdMappingWriter(&buf)
+	assert.Nil(t, err)
+
+	err = writer.write(bundleIdentifier{filename: "bundle.json", bundleNumber: 1}, []idMapping{
+		{fullUrl: "urn:uuid:1", location: "Patient/A/_history/1", versionId: "1"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, writer.flush())
+
+	assert.Equal(t, "filename,bundle,fullUrl,location,versionId\n"+
+		"bundle.json,1,urn:uuid:1,Patient/A/_history/1,1\n", buf.String())
+}
+
+func TestUploadBundleConsumerUpload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"resourceType": "Bundle", "type": "transaction-response", "entry": [
+			{"response": {"status": "201", "location": "Patient/A/_history/1"}}]}`))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	dir := t.TempDir()
+	bundlePath := filepath.Join(dir, "bundle.json")
+	bundleContent := []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "request": {"method": "POST", "url": "Patient"}}]}`)
+	if err := os.WriteFile(bundlePath, bundleContent, 0644); err != nil {
+		t.Fatal("can't create a temp json file")
+	}
+
+	responsesDir := filepath.Join(dir, "responses")
+	consumer := newUploadBundleConsumer(client, nil)
+	consumer.baseDir = dir
+	consumer.responsesDir = responsesDir
+	consumer.collectIdMappings = true
+
+	result := consumer.upload(bundleIdentifier{
+		filename:     bundlePath,
+		bundleNumber: 1,
+		endBytes:     int64(len(bundleContent)),
+	})
+
+	assert.Nil(t, result.err)
+	assert.Equal(t, http.StatusOK, result.uploadInfo.statusCode)
+	assert.Equal(t, []idMapping{{fullUrl: "urn:uuid:1", location: "Patient/A/_history/1", versionId: "1"}},
+		result.idMappings)
+	assert.FileExists(t, filepath.Join(responsesDir, "bundle-1.json"))
+}
+
+func TestDecodeBundleSkeleton(t *testing.T) {
+	t.Run("SkipsResources", func(t *testing.T) {
+		bundle, err := decodeBundleSkeleton(strings.NewReader(`{"resourceType": "Bundle", "type": "batch-response",
+			"entry": [{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient", "name": [{"family": "Doe"}]},
+				"request": {"method": "PUT", "url": "Patient/A"}, "response": {"status": "200"}}],
+			"link": [{"relation": "self", "url": "http://localhost"}]}`))
+
+		assert.NoError(t, err)
+		assert.Equal(t, fm.BundleTypeBatchResponse, bundle.Type)
+		if assert.Len(t, bundle.Entry, 1) {
+			entry := bundle.Entry[0]
+			assert.Equal(t, "urn:uuid:1", *entry.FullUrl)
+			assert.Nil(t, entry.Resource)
+			assert.Equal(t, fm.BundleEntryRequest{Method: fm.HTTPVerbPUT, Url: "Patient/A"}, *entry.Request)
+			assert.Equal(t, "200", entry.Response.Status)
+		}
+	})
+
+	t.Run("InvalidBundle", func(t *testing.T) {
+		for _, data := range []string{``, `[]`, `{"entry": {}}`, `{"entry": [[]]}`, `{"entry": [{}]`} {
+			_, err := decodeBundleSkeleton(strings.NewReader(data))
+			assert.Error(t, err, data)
+		}
+	})
+}
+
+func TestSkeletonReader(t *testing.T) {
+	t.Run("PassesBundleThrough", func(t *testing.T) {
+		data := `{"type": "transaction", "entry": [{"fullUrl": "urn:uuid:1", "resource": {}}]}  `
+		reader := newSkeletonReader(strings.NewReader(data))
+
+		passed, err := io.ReadAll(reader)
+		bundle, skeletonErr := reader.skeleton()
+
+		assert.NoError(t, err)
+		assert.Equal(t, data, string(passed))
+		assert.Equal(t, int64(len(data)), reader.n)
+		assert.NoError(t, skeletonErr)
+		assert.Equal(t, fm.BundleTypeTransaction, bundle.Type)
+		assert.Len(t, bundle.Entry, 1)
+	})
+
+	t.Run("NotPassedCompletely", func(t *testing.T) {
+		reader := newSkeletonReader(strings.NewReader(`{"type": "transaction", "entry": []}`))
+
+		_, _ = reader.Read(make([]byte, 5))
+		_, err := reader.skeleton()
+
+		assert.Error(t, err)
+	})
+
+	t.Run("InvalidBundle", func(t *testing.T) {
+		reader := newSkeletonReader(strings.NewReader(`{"type": [}`))
+
+		_, err := io.ReadAll(reader)
+		_, skeletonErr := reader.skeleton()
+
+		assert.NoError(t, err)
+		assert.Error(t, skeletonErr)
+	})
+}
+
+func TestUploadBundleConsumerUploadUninspectedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"resourceType": "Bundle", "entry": [`))
+	}))
+	defer server.Close()
+
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	bundlePath := filepath.Join(t.TempDir(), "bundle.json")
+	bundleContent := []byte(`{"resourceType": "Bundle", "type": "batch", "entry": [
+		{"request": {"method": "POST", "url": "Patient"}, "resource": {"resourceType": "Patient"}}]}`)
+	if err := os.WriteFile(bundlePath, bundleContent, 0644); err != nil {
+		t.Fatal("can't create a temp json file")
+	}
+
+	consumer := newUploadBundleConsumer(client, nil)
+	result := consumer.upload(bundleIdentifier{filename: bundlePath, bundleNumber: 1, endBytes: int64(len(bundleContent))})
+
+	assert.Nil(t, result.err)
+	assert.Equal(t, http.StatusOK, result.uploadInfo.statusCode)
+	assert.Equal(t, int64(len(bundleContent)), result.uploadInfo.bytesOut)
+	assert.ErrorContains(t, result.inspectionErr, "error while parsing the response bundle")
+}
@@ -0,0 +1,231 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// entryGroups partitions the entries of a bundle into groups of entries that depend on each other.
+// An entry depends on another entry if its resource references the fullUrl of the other entry or
+// the resource the other entry creates with PUT. Groups are returned in the order of their first
+// entry and contain entry indexes in ascending order.
+func entryGroups(bundle fm.Bundle) ([][]int, error) {
+	targets := make(map[string]int)
+	for i, entry := range bundle.Entry {
+		if entry.FullUrl != nil && *entry.FullUrl != "" {
+			targets[*entry.FullUrl] = i
+		}
+		if entry.Request != nil && entry.Request.Method == fm.HTTPVerbPUT && !strings.Contains(entry.Request.Url, "?") {
+			targets[entry.Request.Url] = i
+		}
+	}
+
+	parents := make([]int, len(bundle.Entry))
+	for i := range parents {
+		parents[i] = i
+	}
+	find := func(i int) int {
+		for parents[i] != i {
+			parents[i] = parents[parents[i]]
+			i = parents[i]
+		}
+		return i
+	}
+
+	for i, entry := range bundle.Entry {
+		if len(entry.Resource) == 0 {
+			continue
+		}
+		resource, err := decodeResource(entry.Resource)
+		if err != nil {
+			return nil, fmt.Errorf("entry with index %d: %v", i, err)
+		}
+		rewriteReferences(resource, func(reference string) (string, bool) {
+			if target, ok := targets[reference]; ok {
+				parents[find(i)] = find(target)
+			}
+			return "", false
+		})
+	}
+
+	var groups [][]int
+	groupIndexes := make(map[int]int)
+	for i := range bundle.Entry {
+		root := find(i)
+		if idx, ok := groupIndexes[root]; ok {
+			groups[idx] = append(groups[idx], i)
+		} else {
+			groupIndexes[root] = len(groups)
+			groups = append(groups, []int{i})
+		}
+	}
+	return groups, nil
+}
+
+// bundlePiece is a part of a split bundle together with the indexes its entries had in the
+// original bundle.
+type bundlePiece struct {
+	bundle  fm.Bundle
+	indexes []int
+}
+
+// splitBundle splits a bundle into pieces with at most maxEntries entries each. Entries that depend
+// on each other always end up in the same piece, so a piece can be larger than maxEntries if a
+// single group of dependent entries is larger. Entries keep their original order within a piece.
+func splitBundle(bundle fm.Bundle, maxEntries int) ([]bundlePiece, error) {
+	groups, err := entryGroups(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var pieces [][]int
+	var current []int
+	for _, group := range groups {
+		if len(current) > 0 && len(current)+len(group) > maxEntries {
+			pieces = append(pieces, current)
+			current = nil
+		}
+		current = append(current, group...)
+	}
+	if len(current) > 0 {
+		pieces = append(pieces, current)
+	}
+
+	result := make([]bundlePiece, 0, len(pieces))
+	for _, indexes := range pieces {
+		sort.Ints(indexes)
+		piece := bundle
+		piece.Id = nil
+		piece.Entry = make([]fm.BundleEntry, 0, len(indexes))
+		for _, idx := range indexes {
+			piece.Entry = append(piece.Entry, bundle.Entry[idx])
+		}
+		result = append(result, bundlePiece{bundle: piece, indexes: indexes})
+	}
+	return result, nil
+}
+
+// partialCommit describes the pieces of a split bundle which were committed before a later piece
+// failed. Committed pieces can't be rolled back, so they are reported together with the failure.
+type partialCommit struct {
+	pieces, committedPieces   int
+	entries, committedEntries int
+	// request and response bundles of the committed entries in the order of the committed pieces
+	request, response fm.Bundle
+}
+
+// newPartialCommit returns the partial commit of the given pieces of a bundle with the given
+// number of entries, given the response bundles of the committed pieces.
+func newPartialCommit(entries int, pieces []bundlePiece, responses []fm.Bundle) *partialCommit {
+	partial := &partialCommit{pieces: len(pieces), committedPieces: len(responses), entries: entries}
+	for i, response := range responses {
+		partial.request.Entry = append(partial.request.Entry, pieces[i].bundle.Entry...)
+		partial.response.Entry = append(partial.response.Entry, response.Entry...)
+		partial.response.Type = response.Type
+	}
+	partial.committedEntries = len(partial.request.Entry)
+	return partial
+}
+
+func (p *partialCommit) String() string {
+	return fmt.Sprintf("%d of %d pieces with %d of %d entries were committed before a piece failed",
+		p.committedPieces, p.pieces, p.committedEntries, p.entries)
+}
+
+// joinResponses joins the response bundles of the pieces of a split bundle into one response
+// bundle whose entries are in the order of the entries of the original bundle.
+func joinResponses(pieces []bundlePiece, responses []fm.Bundle) (fm.Bundle, error) {
+	var entryCount int
+	for _, piece := range pieces {
+		entryCount += len(piece.indexes)
+	}
+
+	joined := fm.Bundle{Entry: make([]fm.BundleEntry, entryCount)}
+	for i, response := range responses {
+		if len(response.Entry) != len(pieces[i].indexes) {
+			return fm.Bundle{}, fmt.Errorf("expect %d response bundle entries but got %d", len(pieces[i].indexes),
+				len(response.Entry))
+		}
+		joined.Type = response.Type
+		for j, entry := range response.Entry {
+			joined.Entry[pieces[i].indexes[j]] = entry
+		}
+	}
+	return joined, nil
+}
+
+// isIndependent returns true if no entry of the bundle depends on another entry of the bundle, so
+// that the entries can be uploaded in a batch together with entries of other bundles.
+func isIndependent(bundle fm.Bundle) (bool, error) {
+	groups, err := entryGroups(bundle)
+	if err != nil {
+		return false, err
+	}
+	return len(groups) == len(bundle.Entry), nil
+}
+
+// entryFullUrls returns the non-empty fullUrls of the entries of the given bundle.
+func entryFullUrls(bundle fm.Bundle) []string {
+	var fullUrls []string
+	for _, entry := range bundle.Entry {
+		if entry.FullUrl != nil && *entry.FullUrl != "" {
+			fullUrls = append(fullUrls, *entry.FullUrl)
+		}
+	}
+	return fullUrls
+}
+
+// mergeBundles merges the entries of the given bundles into a single batch bundle. The bundles
+// must not share fullUrls, because the fullUrls of a batch bundle have to be unique.
+func mergeBundles(bundles []fm.Bundle) fm.Bundle {
+	var entryCount int
+	for _, bundle := range bundles {
+		entryCount += len(bundle.Entry)
+	}
+
+	merged := fm.Bundle{Type: fm.BundleTypeBatch, Entry: make([]fm.BundleEntry, 0, entryCount)}
+	for _, bundle := range bundles {
+		merged.Entry = append(merged.Entry, bundle.Entry...)
+	}
+	return merged
+}
+
+// splitResponse splits the response bundle of a merged batch bundle into one response bundle for
+// each of the merged bundles. The sizes are the entry counts of the merged bundles.
+func splitResponse(response fm.Bundle, sizes []int) ([]fm.Bundle, error) {
+	var entryCount int
+	for _, size := range sizes {
+		entryCount += size
+	}
+	if len(response.Entry) != entryCount {
+		return nil, fmt.Errorf("expect %d response bundle entries but got %d", entryCount, len(response.Entry))
+	}
+
+	responses := make([]fm.Bundle, 0, len(sizes))
+	var offset int
+	for _, size := range sizes {
+		responses = append(responses, fm.Bundle{
+			Type:  response.Type,
+			Entry: response.Entry[offset : offset+size],
+		})
+		offset += size
+	}
+	return responses, nil
+}
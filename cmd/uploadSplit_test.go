@@ -0,0 +1,303 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/samply/blazectl/fhir"
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+var splitTestBundle = []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+	{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}},
+	{"fullUrl": "urn:uuid:2", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}},
+	{"fullUrl": "urn:uuid:3", "resource": {"resourceType": "Observation", "subject": {"reference": "urn:uuid:1"}},
+	 "request": {"method": "POST", "url": "Observation"}},
+	{"resource": {"resourceType": "Patient", "id": "4"}, "request": {"method": "PUT", "url": "Patient/4"}},
+	{"resource": {"resourceType": "Observation", "subject": {"reference": "Patient/4"}},
+	 "request": {"method": "POST", "url": "Observation"}}]}`)
+
+func TestEntryGroups(t *testing.T) {
+	groups, err := entryGroups(unmarshalBundle(t, splitTestBundle))
+
+	assert.Nil(t, err)
+	assert.Equal(t, [][]int{{0, 2}, {1}, {3, 4}}, groups)
+}
+
+func TestSplitBundle(t *testing.T) {
+	t.Run("KeepsDependentEntriesTogether", func(t *testing.T) {
+		pieces, err := splitBundle(unmarshalBundle(t, splitTestBundle), 2)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(pieces))
+		assert.Equal(t, []int{0, 2}, pieces[0].indexes)
+		assert.Equal(t, []int{1}, pieces[1].indexes)
+		assert.Equal(t, []int{3, 4}, pieces[2].indexes)
+		assert.Equal(t, fm.BundleTypeTransaction, pieces[0].bundle.Type)
+		assert.Equal(t, "urn:uuid:3", *pieces[0].bundle.Entry[1].FullUrl)
+	})
+
+	t.Run("PacksGroupsInOrder", func(t *testing.T) {
+		pieces, err := splitBundle(unmarshalBundle(t, splitTestBundle), 3)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(pieces))
+		assert.Equal(t, []int{0, 1, 2}, pieces[0].indexes)
+		assert.Equal(t, []int{3, 4}, pieces[1].indexes)
+	})
+
+	t.Run("GroupLargerThanMaxEntries", func(t *testing.T) {
+		pieces, err := splitBundle(unmarshalBundle(t, splitTestBundle), 1)
+
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(pieces))
+		assert.Equal(t, []int{0, 2}, pieces[0].indexes)
+	})
+}
+
+func TestJoinResponses(t *testing.T) {
+	status := func(s string) fm.BundleEntry {
+		return fm.BundleEntry{Response: &fm.BundleEntryResponse{Status: s}}
+	}
+	pieces := []bundlePiece{{indexes: []int{0, 2}}, {indexes: []int{1}}}
+
+	t.Run("Success", func(t *testing.T) {
+		joined, err := joinResponses(pieces, []fm.Bundle{
+			{Type: fm.BundleTypeTransactionResponse, Entry: []fm.BundleEntry{status("a"), status("c")}},
+			{Type: fm.BundleTypeTransactionResponse, Entry: []fm.BundleEntry{status("b")}},
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, fm.BundleTypeTransactionResponse, joined.Type)
+		assert.Equal(t, []fm.BundleEntry{status("a"), status("b"), status("c")}, joined.Entry)
+	})
+
+	t.Run("EntryCountMismatch", func(t *testing.T) {
+		_, err := joinResponses(pieces, []fm.Bundle{
+			{Entry: []fm.BundleEntry{status("a")}},
+			{Entry: []fm.BundleEntry{status("b")}},
+		})
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestMergeAndSplitResponse(t *testing.T) {
+	bundleA := fm.Bundle{Type: fm.BundleTypeTransaction, Entry: []fm.BundleEntry{{}, {}}}
+	bundleB := fm.Bundle{Type: fm.BundleTypeTransaction, Entry: []fm.BundleEntry{{}}}
+
+	merged := mergeBundles([]fm.Bundle{bundleA, bundleB})
+	assert.Equal(t, fm.BundleTypeBatch, merged.Type)
+	assert.Equal(t, 3, len(merged.Entry))
+
+	responses, err := splitResponse(fm.Bundle{Type: fm.BundleTypeBatchResponse, Entry: make([]fm.BundleEntry, 3)}, []int{2, 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(responses[0].Entry))
+	assert.Equal(t, 1, len(responses[1].Entry))
+	assert.Equal(t, fm.BundleTypeBatchResponse, responses[1].Type)
+
+	_, err = splitResponse(fm.Bundle{Entry: make([]fm.BundleEntry, 2)}, []int{2, 1})
+	assert.NotNil(t, err)
+}
+
+func TestIsIndependent(t *testing.T) {
+	independent, err := isIndependent(unmarshalBundle(t, splitTestBundle))
+	assert.Nil(t, err)
+	assert.False(t, independent)
+
+	independent, err = isIndependent(unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:1", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}}]}`)))
+	assert.Nil(t, err)
+	assert.True(t, independent)
+}
+
+// newEchoServer creates a test server responding to every transaction or batch bundle with a
+// response bundle containing one successful entry per request entry. The entry counts of all
+// received bundles are recorded.
+func newEchoServer(t *testing.T, entryCounts *[]int) *httptest.Server {
+	var mutex sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, err := fm.UnmarshalBundle(body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		mutex.Lock()
+		*entryCounts = append(*entryCounts, len(request.Entry))
+		mutex.Unlock()
+
+		response := fm.Bundle{Type: fm.BundleTypeTransactionResponse}
+		if request.Type == fm.BundleTypeBatch {
+			response.Type = fm.BundleTypeBatchResponse
+		}
+		for i, entry := range request.Entry {
+			location := fmt.Sprintf("%s/%d/_history/1", resourceTypeOfEntry(entry.Request, nil), i)
+			response.Entry = append(response.Entry, fm.BundleEntry{
+				Response: &fm.BundleEntryResponse{Status: "201", Location: &location},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func writeTestBundles(t *testing.T, bundles ...[]byte) []bundle {
+	dir := t.TempDir()
+	var result []bundle
+	for i, data := range bundles {
+		path := filepath.Join(dir, fmt.Sprintf("bundle-%d.json", i))
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal("can't create a temp json file")
+		}
+		result = append(result, bundle{id: bundleIdentifier{filename: path, bundleNumber: 1, endBytes: int64(len(data))}})
+	}
+	return result
+}
+
+func runConsumer(consumer *uploadBundleConsumer, bundles []bundle, results chan bundleUploadResult) []bundleUploadResult {
+	var wg sync.WaitGroup
+	go func() {
+		consumer.uploadBundles(bundles, 2, &wg)
+		wg.Wait()
+		close(results)
+	}()
+
+	var collected []bundleUploadResult
+	for result := range results {
+		collected = append(collected, result)
+	}
+	sort.Slice(collected, func(i, j int) bool { return collected[i].id.filename < collected[j].id.filename })
+	return collected
+}
+
+// patientBundle returns a transaction bundle creating a single patient with a fullUrl derived from
+// the given number.
+func patientBundle(n int) []byte {
+	return []byte(fmt.Sprintf(`{"resourceType": "Bundle", "type": "transaction", "entry": [
+		{"fullUrl": "urn:uuid:%d", "resource": {"resourceType": "Patient"}, "request": {"method": "POST", "url": "Patient"}}]}`, n))
+}
+
+func TestUploadBundleConsumerSplitAndMerge(t *testing.T) {
+
+	t.Run("Split", func(t *testing.T) {
+		var entryCounts []int
+		server := newEchoServer(t, &entryCounts)
+		defer server.Close()
+		baseURL, _ := url.ParseRequestURI(server.URL)
+
+		results := make(chan bundleUploadResult)
+		consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), results)
+		consumer.maxEntries = 2
+		consumer.collectIdMappings = true
+
+		collected := runConsumer(consumer, writeTestBundles(t, splitTestBundle), results)
+
+		assert.Equal(t, []int{2, 1, 2}, entryCounts)
+		assert.Equal(t, 1, len(collected))
+		assert.Nil(t, collected[0].err)
+		assert.Equal(t, http.StatusOK, collected[0].uploadInfo.statusCode)
+		assert.Equal(t, 5, len(collected[0].idMappings))
+		assert.Equal(t, "urn:uuid:2", collected[0].idMappings[1].fullUrl)
+		assert.Equal(t, "Patient/0/_history/1", collected[0].idMappings[1].location)
+		assert.Equal(t, resourceCounts{created: 3}, collected[0].resourceCounts["Patient"])
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		var entryCounts []int
+		server := newEchoServer(t, &entryCounts)
+		defer server.Close()
+		baseURL, _ := url.ParseRequestURI(server.URL)
+
+		results := make(chan bundleUploadResult)
+		consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), results)
+		consumer.minEntries = 2
+
+		collected := runConsumer(consumer, writeTestBundles(t, patientBundle(1), patientBundle(2), splitTestBundle, patientBundle(3)), results)
+
+		sort.Ints(entryCounts)
+		assert.Equal(t, []int{1, 2, 5}, entryCounts)
+		assert.Equal(t, 4, len(collected))
+		for _, result := range collected {
+			assert.Nil(t, result.err)
+			assert.Equal(t, http.StatusOK, result.uploadInfo.statusCode)
+			assert.Empty(t, result.failedEntries)
+		}
+		assert.Equal(t, resourceCounts{created: 1}, collected[0].resourceCounts["Patient"])
+	})
+
+	t.Run("MergeKeepsFullUrlsUnique", func(t *testing.T) {
+		var entryCounts []int
+		server := newEchoServer(t, &entryCounts)
+		defer server.Close()
+		baseURL, _ := url.ParseRequestURI(server.URL)
+
+		results := make(chan bundleUploadResult)
+		consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), results)
+		consumer.minEntries = 2
+
+		collected := runConsumer(consumer, writeTestBundles(t, patientBundle(1), patientBundle(1), patientBundle(2)), results)
+
+		sort.Ints(entryCounts)
+		assert.Equal(t, []int{1, 2}, entryCounts)
+		assert.Equal(t, 3, len(collected))
+	})
+
+	t.Run("SplitPartialCommit", func(t *testing.T) {
+		var entryCounts []int
+		echo := newEchoServer(t, &entryCounts)
+		defer echo.Close()
+		var requests int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requests++; requests > 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "invalid"}]}`))
+				return
+			}
+			echo.Config.Handler.ServeHTTP(w, r)
+		}))
+		defer server.Close()
+		baseURL, _ := url.ParseRequestURI(server.URL)
+
+		results := make(chan bundleUploadResult)
+		consumer := newUploadBundleConsumer(fhir.NewClient(*baseURL, fhir.ClientAuth{}), results)
+		consumer.maxEntries = 2
+		consumer.collectIdMappings = true
+
+		collected := runConsumer(consumer, writeTestBundles(t, splitTestBundle), results)
+
+		assert.Equal(t, 1, len(collected))
+		assert.Equal(t, http.StatusBadRequest, collected[0].uploadInfo.statusCode)
+		if assert.NotNil(t, collected[0].partialCommit) {
+			assert.Equal(t, "1 of 3 pieces with 2 of 5 entries were committed before a piece failed",
+				collected[0].partialCommit.String())
+		}
+		assert.Equal(t, resourceCounts{created: 1}, collected[0].resourceCounts["Patient"])
+		assert.Equal(t, resourceCounts{created: 1}, collected[0].resourceCounts["Observation"])
+		assert.Equal(t, 2, len(collected[0].idMappings))
+		assert.Contains(t, describeFailedUpload(collected[0]), "status 400, but 1 of 3 pieces")
+	})
+}
@@ -0,0 +1,216 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+)
+
+// resourceCounts counts the uploaded resources of a single resource type by the effect the upload
+// had on the server.
+type resourceCounts struct {
+	created, updated, unchanged, deleted int
+}
+
+func (c *resourceCounts) add(other resourceCounts) {
+	c.created += other.created
+	c.updated += other.updated
+	c.unchanged += other.unchanged
+	c.deleted += other.deleted
+}
+
+func (c *resourceCounts) total() int {
+	return c.created + c.updated + c.unchanged + c.deleted
+}
+
+// tallyResourceCounts counts the resources of the given request bundle by resource type and the
+// effect their upload had on the server. Entries of the response bundle are paired with the
+// entries of the request bundle by index.
+//
+// Failed entries and entries that only read data are not counted.
+func tallyResourceCounts(request fm.Bundle, response fm.Bundle) map[string]resourceCounts {
+	counts := make(map[string]resourceCounts)
+	for i, entry := range response.Entry {
+		var entryRequest *fm.BundleEntryRequest
+		if i < len(request.Entry) {
+			entryRequest = request.Entry[i].Request
+		}
+		if entry.Response == nil {
+			continue
+		}
+
+		statusCode, err := statusCodeOfResponse(entry.Response)
+		if err != nil || statusCode >= 400 {
+			continue
+		}
+
+		resourceType := resourceTypeOfEntry(entryRequest, entry.Response)
+		if resourceType == "" {
+			continue
+		}
+
+		c := counts[resourceType]
+		if !countEntry(&c, entryRequest, statusCode) {
+			continue
+		}
+		counts[resourceType] = c
+	}
+	return counts
+}
+
+// countEntry increments the count matching the effect of a single successful entry. The effect is
+// derived from the request method if known and from the response status code alone otherwise.
+//
+// Returns false if the entry did not change any data on the server.
+func countEntry(counts *resourceCounts, request *fm.BundleEntryRequest, statusCode int) bool {
+	if request != nil {
+		switch request.Method {
+		case fm.HTTPVerbGET, fm.HTTPVerbHEAD:
+			return false
+		case fm.HTTPVerbDELETE:
+			counts.deleted++
+			return true
+		}
+	}
+
+	switch {
+	case statusCode == 201:
+		counts.created++
+	case statusCode == 304:
+		counts.unchanged++
+	case request != nil && request.Method == fm.HTTPVerbPOST:
+		// a conditional create that found an existing resource
+		counts.unchanged++
+	default:
+		counts.updated++
+	}
+	return true
+}
+
+// resourceTypeOfEntry returns the resource type of a bundle entry. The type is taken from the
+// location of the response if present and from the URL of the request otherwise.
+//
+// Returns an empty string if the resource type can't be determined.
+func resourceTypeOfEntry(request *fm.BundleEntryRequest, response *fm.BundleEntryResponse) string {
+	if response != nil && response.Location != nil {
+		location, err := url.Parse(*response.Location)
+		if err == nil {
+			segments := strings.Split(strings.Trim(location.Path, "/"), "/")
+			for i, segment := range segments {
+				if segment == "_history" && i >= 2 {
+					return segments[i-2]
+				}
+			}
+			if len(segments) >= 2 {
+				return segments[len(segments)-2]
+			}
+		}
+	}
+
+	if request != nil {
+		path := request.Url
+		if idx := strings.IndexAny(path, "?/"); idx >= 0 {
+			path = path[:idx]
+		}
+		return path
+	}
+
+	return ""
+}
+
+// fmtResourceCounts formats the given resource counts as table with one row per resource type
+// followed by the totals.
+func fmtResourceCounts(counts map[string]resourceCounts) string {
+	resourceTypes := make([]string, 0, len(counts))
+	var total resourceCounts
+	maxResourceTypeLen := len("total")
+	for resourceType, c := range counts {
+		resourceTypes = append(resourceTypes, resourceType)
+		total.add(c)
+		if len(resourceType) > maxResourceTypeLen {
+			maxResourceTypeLen = len(resourceType)
+		}
+	}
+	sort.Strings(resourceTypes)
+
+	maxCount := len(fmt.Sprintf("%d", total.total()))
+	if maxCount < len("unchanged") {
+		maxCount = len("unchanged")
+	}
+	typeFormat := "%-" + fmt.Sprintf("%d", maxResourceTypeLen) + "s"
+	countFormat := "%" + fmt.Sprintf("%d", maxCount)
+
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf(typeFormat+"   "+countFormat+"s "+countFormat+"s "+countFormat+"s "+countFormat+"s\n",
+		"", "created", "updated", "unchanged", "deleted"))
+	row := typeFormat + " : " + countFormat + "d " + countFormat + "d " + countFormat + "d " + countFormat + "d\n"
+	for _, resourceType := range resourceTypes {
+		c := counts[resourceType]
+		builder.WriteString(fmt.Sprintf(row, resourceType, c.created, c.updated, c.unchanged, c.deleted))
+	}
+	builder.WriteString(strings.Repeat("-", maxResourceTypeLen+3+4*maxCount+3) + "\n")
+	builder.WriteString(fmt.Sprintf(row, "total", total.created, total.updated, total.unchanged, total.deleted))
+	return builder.String()
+}
+
+// fmtResourceCountDeltas formats the resource counts on the server before and after the upload.
+// Only resource types whose count changed or which were part of the upload are listed.
+func fmtResourceCountDeltas(before map[fm.ResourceType]int, after map[fm.ResourceType]int,
+	uploaded map[string]resourceCounts) string {
+
+	resourceTypes := make(map[string]fm.ResourceType)
+	for resourceType := range before {
+		resourceTypes[resourceType.Code()] = resourceType
+	}
+	for resourceType := range after {
+		resourceTypes[resourceType.Code()] = resourceType
+	}
+
+	var codes []string
+	maxResourceTypeLen := 0
+	maxCount := 1
+	for code, resourceType := range resourceTypes {
+		_, wasUploaded := uploaded[code]
+		if before[resourceType] == after[resourceType] && !wasUploaded {
+			continue
+		}
+		codes = append(codes, code)
+		if len(code) > maxResourceTypeLen {
+			maxResourceTypeLen = len(code)
+		}
+		if l := len(fmt.Sprintf("%d", after[resourceType])); l > maxCount {
+			maxCount = l
+		}
+		if l := len(fmt.Sprintf("%d", before[resourceType])); l > maxCount {
+			maxCount = l
+		}
+	}
+	sort.Strings(codes)
+
+	format := "%-" + fmt.Sprintf("%d", maxResourceTypeLen) + "s : %" + fmt.Sprintf("%d", maxCount) +
+		"d -> %" + fmt.Sprintf("%d", maxCount) + "d (%+d)\n"
+	builder := strings.Builder{}
+	for _, code := range codes {
+		resourceType := resourceTypes[code]
+		builder.WriteString(fmt.Sprintf(format, code, before[resourceType], after[resourceType],
+			after[resourceType]-before[resourceType]))
+	}
+	return builder.String()
+}
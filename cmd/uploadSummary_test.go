@@ -0,0 +1,84 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTallyResourceCounts(t *testing.T) {
+	request := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "batch", "entry": [
+		{"request": {"method": "POST", "url": "Patient"}},
+		{"request": {"method": "POST", "url": "Patient", "ifNoneExist": "identifier=1"}},
+		{"request": {"method": "PUT", "url": "Observation/1"}},
+		{"request": {"method": "PUT", "url": "Observation/2"}},
+		{"request": {"method": "DELETE", "url": "Condition/1"}},
+		{"request": {"method": "GET", "url": "Patient/1"}},
+		{"request": {"method": "POST", "url": "Observation"}}]}`))
+	response := unmarshalBundle(t, []byte(`{"resourceType": "Bundle", "type": "batch-response", "entry": [
+		{"response": {"status": "201", "location": "Patient/A/_history/1"}},
+		{"response": {"status": "200", "location": "Patient/B/_history/3"}},
+		{"response": {"status": "200 OK", "location": "http://localhost:8080/fhir/Observation/1/_history/2"}},
+		{"response": {"status": "201 Created"}},
+		{"response": {"status": "204"}},
+		{"response": {"status": "200"}},
+		{"response": {"status": "422"}}]}`))
+
+	counts := tallyResourceCounts(request, response)
+
+	assert.Equal(t, map[string]resourceCounts{
+		"Patient":     {created: 1, unchanged: 1},
+		"Observation": {created: 1, updated: 1},
+		"Condition":   {deleted: 1},
+	}, counts)
+}
+
+func TestResourceTypeOfEntry(t *testing.T) {
+	location := "Patient/A/_history/1"
+	absoluteLocation := "http://localhost:8080/fhir/Patient/A"
+
+	assert.Equal(t, "Patient", resourceTypeOfEntry(nil, &fm.BundleEntryResponse{Location: &location}))
+	assert.Equal(t, "Patient", resourceTypeOfEntry(nil, &fm.BundleEntryResponse{Location: &absoluteLocation}))
+	assert.Equal(t, "Observation", resourceTypeOfEntry(&fm.BundleEntryRequest{Url: "Observation?code=1"}, &fm.BundleEntryResponse{}))
+	assert.Equal(t, "Observation", resourceTypeOfEntry(&fm.BundleEntryRequest{Url: "Observation/1"}, nil))
+	assert.Equal(t, "", resourceTypeOfEntry(nil, &fm.BundleEntryResponse{}))
+}
+
+func TestFmtResourceCounts(t *testing.T) {
+	counts := map[string]resourceCounts{
+		"Patient":     {created: 1, unchanged: 1},
+		"Observation": {created: 10, updated: 2},
+	}
+
+	assert.Equal(t, `                created   updated unchanged   deleted
+Observation :        10         2         0         0
+Patient     :         1         0         1         0
+-----------------------------------------------------
+total       :        11         2         1         0
+`, fmtResourceCounts(counts))
+}
+
+func TestFmtResourceCountDeltas(t *testing.T) {
+	before := map[fm.ResourceType]int{fm.ResourceTypePatient: 10, fm.ResourceTypeObservation: 100, fm.ResourceTypeCondition: 5}
+	after := map[fm.ResourceType]int{fm.ResourceTypePatient: 10, fm.ResourceTypeObservation: 1100, fm.ResourceTypeCondition: 5}
+	uploaded := map[string]resourceCounts{"Patient": {unchanged: 10}, "Observation": {created: 1000}}
+
+	assert.Equal(t, `Observation :  100 -> 1100 (+1000)
+Patient     :   10 ->   10 (+0)
+`, fmtResourceCountDeltas(before, after, uploaded))
+}
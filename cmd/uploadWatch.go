@@ -0,0 +1,361 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/samply/blazectl/util"
+)
+
+const (
+	// doneMarkerSuffix is the suffix of marker files signaling that a file is completely written.
+	doneMarkerSuffix = ".done"
+	// processedDirName is the subdirectory successfully uploaded files are moved to.
+	processedDirName = "processed"
+	// failedDirName is the subdirectory files with failed uploads are moved to.
+	failedDirName = "failed"
+)
+
+type fileSnapshot struct {
+	size    int64
+	modTime time.Time
+}
+
+// spoolWatcher detects files in a spool directory which are completely written and therefore
+// ready to be uploaded.
+type spoolWatcher struct {
+	dir string
+	// snapshots of the files seen in the previous scan which were not ready yet
+	snapshots map[string]fileSnapshot
+	// files which are ready but couldn't be moved out of the spool directory
+	ignored map[string]bool
+}
+
+func newSpoolWatcher(dir string) *spoolWatcher {
+	return &spoolWatcher{
+		dir:       dir,
+		snapshots: make(map[string]fileSnapshot),
+		ignored:   make(map[string]bool),
+	}
+}
+
+// scan returns all files of the spool directory which are ready to be uploaded. A file is ready if
+// a marker file with the same name and the suffix .done exists or if its size and modification
+// time didn't change since the previous scan. The processed and failed subdirectories are skipped.
+func (w *spoolWatcher) scan() (processableFiles, error) {
+	var ready processableFiles
+	seen := make(map[string]bool)
+
+	err := filepath.WalkDir(w.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path == filepath.Join(w.dir, processedDirName) || path == filepath.Join(w.dir, failedDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := entry.Name()
+		if (!isSingleBundleFile(name) && !isMultiBundleFile(name)) || w.ignored[path] {
+			return nil
+		}
+		seen[path] = true
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		snapshot := fileSnapshot{size: info.Size(), modTime: info.ModTime()}
+
+		if _, err := os.Stat(path + doneMarkerSuffix); err != nil {
+			previous, ok := w.snapshots[path]
+			w.snapshots[path] = snapshot
+			if !ok || previous != snapshot {
+				return nil
+			}
+		}
+
+		delete(w.snapshots, path)
+		if isSingleBundleFile(name) {
+			ready.singleBundleFiles = append(ready.singleBundleFiles, path)
+		} else {
+			ready.multiBundleFiles = append(ready.multiBundleFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return processableFiles{}, fmt.Errorf("error while scanning the directory `%s`: %v", w.dir, err)
+	}
+
+	for path := range w.snapshots {
+		if !seen[path] {
+			delete(w.snapshots, path)
+		}
+	}
+	return ready, nil
+}
+
+// moveOut moves the given file together with its marker file into the given subdirectory of the
+// spool directory, keeping its path relative to the spool directory. Existing files are never
+// overwritten, instead the moved file gets a timestamp suffix.
+func (w *spoolWatcher) moveOut(path string, subDir string) (string, error) {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return "", err
+	}
+
+	target := filepath.Join(w.dir, subDir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); err == nil {
+		target = fmt.Sprintf("%s.%s", target, time.Now().Format("20060102T150405.000"))
+	}
+	if err := os.Rename(path, target); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path+doneMarkerSuffix, target+doneMarkerSuffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return target, err
+	}
+	return target, nil
+}
+
+// watchStats accumulates statistics about the files and bundles uploaded in watch mode. Request
+// durations are only kept as count, sum and maximum, so that the statistics of a watch running for
+// months don't grow with every request.
+type watchStats struct {
+	files, failedFiles     int
+	bundles, failedBundles int
+	bytesOut               int64
+	requests               int
+	requestDurationSum     time.Duration
+	maxRequestDuration     time.Duration
+}
+
+func (s *watchStats) addFile(results []bundleUploadResult, failed bool) {
+	s.files++
+	if failed {
+		s.failedFiles++
+	}
+	for _, result := range results {
+		s.bundles++
+		if isFailedUpload(result) {
+			s.failedBundles++
+		}
+		if result.err == nil {
+			s.bytesOut += result.uploadInfo.bytesOut
+			s.requests++
+			s.requestDurationSum += result.uploadInfo.requestDuration
+			if result.uploadInfo.requestDuration > s.maxRequestDuration {
+				s.maxRequestDuration = result.uploadInfo.requestDuration
+			}
+		}
+	}
+}
+
+func (s watchStats) String() string {
+	str := fmt.Sprintf("files %d (%d failed), bundles %d (%d failed), %s out", s.files, s.failedFiles,
+		s.bundles, s.failedBundles, util.FmtBytesHumanReadable(float32(s.bytesOut)))
+	if s.requests > 0 {
+		mean := s.requestDurationSum / time.Duration(s.requests)
+		str += fmt.Sprintf(", requ. latencies [mean, max] %s, %s", mean.Round(time.Millisecond),
+			s.maxRequestDuration.Round(time.Millisecond))
+	}
+	return str
+}
+
+// isFailedUpload returns true if the bundle couldn't be uploaded, the server didn't respond with
+// 200 or single entries of the bundle failed.
+func isFailedUpload(result bundleUploadResult) bool {
+	return result.err != nil || result.uploadInfo.statusCode != http.StatusOK || len(result.failedEntries) > 0
+}
+
+// describeFailedUpload returns a single line description of why the upload of a bundle failed.
+func describeFailedUpload(result bundleUploadResult) string {
+	var description string
+	switch {
+	case result.err != nil:
+		description = result.err.Error()
+	case result.uploadInfo.statusCode != http.StatusOK:
+		description = fmt.Sprintf("status %d", result.uploadInfo.statusCode)
+	default:
+		description = fmt.Sprintf("%d failed entries", len(result.failedEntries))
+	}
+	if result.partialCommit != nil {
+		description += ", but " + result.partialCommit.String()
+	}
+	return description
+}
+
+// spoolUploader uploads the files of a spool directory as soon as they are ready and moves them
+// out of the spool directory afterwards.
+type spoolUploader struct {
+	watcher *spoolWatcher
+	// creates a consumer sending its results to the given channel
+	newConsumer func(uploadResults chan<- bundleUploadResult) *uploadBundleConsumer
+	idMappings  *idMappingWriter
+	// statistics since the last time they were printed and since the start
+	recent, total watchStats
+}
+
+func newSpoolUploader(dir string, newConsumer func(uploadResults chan<- bundleUploadResult) *uploadBundleConsumer) *spoolUploader {
+	return &spoolUploader{
+		watcher:     newSpoolWatcher(dir),
+		newConsumer: newConsumer,
+	}
+}
+
+// uploadFiles uploads all bundles of the given files using the consumer pipeline and returns the
+// upload results by filename. Every file is contained in the result, even if it had no bundles.
+func (u *spoolUploader) uploadFiles(files processableFiles) map[string][]bundleUploadResult {
+	results := make(map[string][]bundleUploadResult)
+	for _, file := range append(append([]string{}, files.singleBundleFiles...), files.multiBundleFiles...) {
+		results[file] = nil
+	}
+
+	bundles := newUploadBundleProducer().createUploadBundles(files).bundles
+
+	uploadResultCh := make(chan bundleUploadResult)
+	done := make(chan bool)
+	go func() {
+		for result := range uploadResultCh {
+			results[result.id.filename] = append(results[result.id.filename], result)
+		}
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	u.newConsumer(uploadResultCh).uploadBundles(bundles, concurrency, &wg)
+	wg.Wait()
+	close(uploadResultCh)
+	<-done
+
+	return results
+}
+
+// processReadyFiles uploads all files which are ready and moves each file into the processed or
+// failed subdirectory depending on the outcome of its upload.
+func (u *spoolUploader) processReadyFiles() error {
+	files, err := u.watcher.scan()
+	if err != nil {
+		return err
+	}
+	if len(files.singleBundleFiles)+len(files.multiBundleFiles) == 0 {
+		return nil
+	}
+
+	results := u.uploadFiles(files)
+
+	filenames := make([]string, 0, len(results))
+	for filename := range results {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	for _, filename := range filenames {
+		fileResults := results[filename]
+		sort.Slice(fileResults, func(i, j int) bool {
+			return fileResults[i].id.bundleNumber < fileResults[j].id.bundleNumber
+		})
+
+		var failures []string
+		for _, result := range fileResults {
+			if u.idMappings != nil && result.err == nil && len(result.idMappings) > 0 {
+				if err := u.idMappings.write(result.id, result.idMappings); err != nil {
+					return fmt.Errorf("failed to write id mapping file: %v", err)
+				}
+			}
+			if isFailedUpload(result) {
+				failures = append(failures, fmt.Sprintf("bundle %d: %s", result.id.bundleNumber,
+					describeFailedUpload(result)))
+			}
+		}
+
+		u.recent.addFile(fileResults, len(failures) > 0)
+		u.total.addFile(fileResults, len(failures) > 0)
+
+		subDir := processedDirName
+		if len(failures) > 0 {
+			subDir = failedDirName
+		}
+		target, err := u.watcher.moveOut(filename, subDir)
+		if err != nil {
+			u.watcher.ignored[filename] = true
+			fmt.Printf("Failed to move %s out of the watched directory, ignoring it from now on: %v\n", filename, err)
+			continue
+		}
+
+		if len(failures) > 0 {
+			fmt.Printf("Failed   %s -> %s [%s]\n", filename, target, strings.Join(failures, "; "))
+		} else {
+			fmt.Printf("Uploaded %s -> %s [%d bundles]\n", filename, target, len(fileResults))
+		}
+	}
+
+	if u.idMappings != nil {
+		if err := u.idMappings.flush(); err != nil {
+			return fmt.Errorf("failed to write id mapping file: %v", err)
+		}
+	}
+	return nil
+}
+
+// watch scans the spool directory in the given poll interval and uploads all files which are
+// ready, until the process receives an interrupt or termination signal. Rolling statistics are
+// printed in the given statistics interval. Uploads in progress are finished before returning.
+func (u *spoolUploader) watch(pollInterval, statsInterval time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	pollTicker := time.NewTicker(pollInterval)
+	defer pollTicker.Stop()
+	statsTicker := time.NewTicker(statsInterval)
+	defer statsTicker.Stop()
+
+	if err := u.processReadyFiles(); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-signals:
+			fmt.Printf("Stopped watching. Total: %s\n", u.total)
+			return nil
+		case <-statsTicker.C:
+			fmt.Printf("%s  last %s: %s\n", time.Now().Format(time.RFC3339), statsInterval, u.recent)
+			u.recent = watchStats{}
+		case <-pollTicker.C:
+			if err := u.processReadyFiles(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 - 2022 The Samply Community
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samply/blazectl/fhir"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSpoolFile(t *testing.T, path string, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolWatcherScan(t *testing.T) {
+	t.Run("StableSize", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSpoolFile(t, filepath.Join(dir, "a.json"), "{}")
+		writeSpoolFile(t, filepath.Join(dir, "ignored.txt"), "{}")
+		watcher := newSpoolWatcher(dir)
+
+		ready, err := watcher.scan()
+		assert.Nil(t, err)
+		assert.Empty(t, ready.singleBundleFiles)
+
+		ready, err = watcher.scan()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "a.json")}, ready.singleBundleFiles)
+	})
+
+	t.Run("GrowingFile", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSpoolFile(t, filepath.Join(dir, "a.ndjson"), "{}\n")
+		watcher := newSpoolWatcher(dir)
+
+		_, _ = watcher.scan()
+		writeSpoolFile(t, filepath.Join(dir, "a.ndjson"), "{}\n{}\n")
+
+		ready, err := watcher.scan()
+		assert.Nil(t, err)
+		assert.Empty(t, ready.multiBundleFiles)
+
+		ready, err = watcher.scan()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "a.ndjson")}, ready.multiBundleFiles)
+	})
+
+	t.Run("DoneMarker", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSpoolFile(t, filepath.Join(dir, "sub", "a.json"), "{}")
+		writeSpoolFile(t, filepath.Join(dir, "sub", "a.json.done"), "")
+
+		ready, err := newSpoolWatcher(dir).scan()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "sub", "a.json")}, ready.singleBundleFiles)
+	})
+
+	t.Run("SkipsProcessedAndFailed", func(t *testing.T) {
+		dir := t.TempDir()
+		writeSpoolFile(t, filepath.Join(dir, processedDirName, "a.json"), "{}")
+		writeSpoolFile(t, filepath.Join(dir, processedDirName, "a.json.done"), "")
+		writeSpoolFile(t, filepath.Join(dir, failedDirName, "b.json"), "{}")
+		writeSpoolFile(t, filepath.Join(dir, failedDirName, "b.json.done"), "")
+
+		ready, err := newSpoolWatcher(dir).scan()
+		assert.Nil(t, err)
+		assert.Empty(t, ready.singleBundleFiles)
+	})
+}
+
+func TestSpoolWatcherMoveOut(t *testing.T) {
+	dir := t.TempDir()
+	watcher := newSpoolWatcher(dir)
+	writeSpoolFile(t, filepath.Join(dir, "sub", "a.json"), "1")
+	writeSpoolFile(t, filepath.Join(dir, "sub", "a.json.done"), "")
+
+	target, err := watcher.moveOut(filepath.Join(dir, "sub", "a.json"), processedDirName)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, processedDirName, "sub", "a.json"), target)
+	assert.FileExists(t, target)
+	assert.FileExists(t, target+doneMarkerSuffix)
+	assert.NoFileExists(t, filepath.Join(dir, "sub", "a.json"))
+
+	t.Run("ExistingTarget", func(t *testing.T) {
+		writeSpoolFile(t, filepath.Join(dir, "sub", "a.json"), "2")
+
+		secondTarget, err := watcher.moveOut(filepath.Join(dir, "sub", "a.json"), processedDirName)
+		assert.Nil(t, err)
+		assert.NotEqual(t, target, secondTarget)
+
+		first, _ := os.ReadFile(target)
+		assert.Equal(t, "1", string(first))
+	})
+}
+
+func TestSpoolUploaderProcessReadyFiles(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("Invalid")) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"resourceType": "OperationOutcome"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"resourceType": "Bundle", "type": "transaction-response"}`))
+	}))
+	defer server.Close()
+	baseURL, _ := url.ParseRequestURI(server.URL)
+	client := fhir.NewClient(*baseURL, fhir.ClientAuth{})
+
+	dir := t.TempDir()
+	writeSpoolFile(t, filepath.Join(dir, "good.json"), `{"resourceType": "Bundle", "type": "transaction"}`)
+	writeSpoolFile(t, filepath.Join(dir, "good.json.done"), "")
+	writeSpoolFile(t, filepath.Join(dir, "bad.ndjson"),
+		`{"resourceType": "Bundle", "type": "transaction"}`+"\n"+`{"resourceType": "Invalid"}`+"\n")
+	writeSpoolFile(t, filepath.Join(dir, "bad.ndjson.done"), "")
+	writeSpoolFile(t, filepath.Join(dir, "pending.json"), `{}`)
+
+	uploader := newSpoolUploader(dir, func(uploadResults chan<- bundleUploadResult) *uploadBundleConsumer {
+		return newUploadBundleConsumer(client, uploadResults)
+	})
+
+	assert.Nil(t, uploader.processReadyFiles())
+
+	assert.FileExists(t, filepath.Join(dir, processedDirName, "good.json"))
+	assert.FileExists(t, filepath.Join(dir, failedDirName, "bad.ndjson"))
+	assert.FileExists(t, filepath.Join(dir, "pending.json"))
+	assert.Equal(t, watchStats{files: 2, failedFiles: 1, bundles: 3, failedBundles: 1},
+		watchStats{files: uploader.total.files, failedFiles: uploader.total.failedFiles,
+			bundles: uploader.total.bundles, failedBundles: uploader.total.failedBundles})
+}
+
+func TestWatchStats(t *testing.T) {
+	var stats watchStats
+	stats.addFile([]bundleUploadResult{
+		{uploadInfo: uploadInfo{statusCode: http.StatusOK, bytesOut: 1024, requestDuration: 100 * time.Millisecond}},
+		{uploadInfo: uploadInfo{statusCode: http.StatusBadRequest, bytesOut: 1024, requestDuration: 300 * time.Millisecond}},
+		{err: errors.New("error-101553")},
+	}, true)
+
+	assert.Equal(t, watchStats{files: 1, failedFiles: 1, bundles: 3, failedBundles: 2, bytesOut: 2048, requests: 2,
+		requestDurationSum: 400 * time.Millisecond, maxRequestDuration: 300 * time.Millisecond}, stats)
+	assert.Equal(t, "files 1 (1 failed), bundles 3 (2 failed), 2.00 KiB out, requ. latencies [mean, max] 200ms, 300ms",
+		stats.String())
+}
@@ -0,0 +1,24 @@
+package data
+
+// Deidentification configures how resources are de-identified.
+type Deidentification struct {
+	// secret used to hash identifiers and ids and to derive date offsets
+	Salt string `yaml:"salt"`
+	// name of an environment variable containing the salt, used if salt is empty
+	SaltEnv string `yaml:"saltEnv"`
+	// paths of elements to drop like Patient.name or *.text
+	Drop []string `yaml:"drop"`
+	// whether identifier values are replaced by their hash
+	HashIdentifiers bool `yaml:"hashIdentifiers"`
+	// shifts dates by a per-patient offset if present
+	DateShift *DateShift `yaml:"dateShift"`
+	// generalizes birthDate to year or month if set
+	BirthDate string `yaml:"birthDate"`
+	// whether resource ids and references are replaced by their hash
+	RewriteIds bool `yaml:"rewriteIds"`
+}
+
+type DateShift struct {
+	// dates are shifted by at most this number of days into the past or the future
+	MaxDays int `yaml:"maxDays"`
+}
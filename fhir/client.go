@@ -73,6 +73,7 @@ func createClient(fhirServerBaseUrl url.URL, auth ClientAuth, insecure bool) *Cl
 }
 
 const fhirJson = "application/fhir+json"
+const fhirNdjson = "application/fhir+ndjson"
 
 // NewCapabilitiesRequest creates a new capabilities interaction request. Uses
 // the base URL from the FHIR client and sets JSON Accept header. Otherwise it's
@@ -149,6 +150,52 @@ func (c *Client) NewTypeOperationRequest(resourceType string, operationName stri
 	return req, nil
 }
 
+// NewBulkExportKickOffRequest creates a new request kicking off a bulk data export. The path is
+// relative to the base URL and is either empty for a system level export, Patient for a patient
+// level export or Group/<id> for a group level export. The request asks for asynchronous
+// processing by setting the Prefer header to respond-async.
+func (c *Client) NewBulkExportKickOffRequest(path string, parameters url.Values) (*http.Request, error) {
+	if path != "" {
+		path += "/"
+	}
+	rel := &url.URL{Path: path + "$export", RawQuery: parameters.Encode()}
+	req, err := http.NewRequest("GET", c.baseURL.ResolveReference(rel).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", fhirJson)
+	req.Header.Add("Prefer", "respond-async")
+	return req, nil
+}
+
+// NewBulkExportStatusRequest creates a new request polling the status endpoint of a bulk data
+// export with the given URL.
+func (c *Client) NewBulkExportStatusRequest(statusURL *url.URL) (*http.Request, error) {
+	req, err := http.NewRequest("GET", statusURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+	return req, nil
+}
+
+// NewBulkExportDeleteRequest creates a new request deleting the bulk data export with the given
+// status URL.
+func (c *Client) NewBulkExportDeleteRequest(statusURL *url.URL) (*http.Request, error) {
+	return http.NewRequest("DELETE", statusURL.String(), nil)
+}
+
+// NewBulkExportFileRequest creates a new request downloading an output file of a bulk data
+// export with the given URL.
+func (c *Client) NewBulkExportFileRequest(fileURL *url.URL) (*http.Request, error) {
+	req, err := http.NewRequest("GET", fileURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", fhirNdjson)
+	return req, nil
+}
+
 // Do calls Do on the HTTP client of the FHIR client.
 func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	if len(c.auth.BasicAuthUser) != 0 {
@@ -158,6 +205,18 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return c.httpClient.Do(req)
 }
 
+// DoWithoutAuth calls Do on the HTTP client of the FHIR client without adding the credentials of
+// the FHIR client. It is used for URLs not belonging to the FHIR server.
+func (c *Client) DoWithoutAuth(req *http.Request) (*http.Response, error) {
+	return c.httpClient.Do(req)
+}
+
+// IsServerURL returns true if the given URL has the same scheme and host as the base URL of the
+// FHIR client.
+func (c *Client) IsServerURL(u *url.URL) bool {
+	return strings.EqualFold(u.Scheme, c.baseURL.Scheme) && strings.EqualFold(u.Host, c.baseURL.Host)
+}
+
 // CloseIdleConnections calls CloseIdleConnections on the HTTP client of the
 // FHIR client.
 func (c *Client) CloseIdleConnections() {
@@ -180,3 +180,50 @@ func createSelfSignedCertificate() (*x509.Certificate, *ecdsa.PrivateKey, error)
 
 	return selfSignedCertificate, privateKey, nil
 }
+
+func TestNewBulkExportKickOffRequest(t *testing.T) {
+	baseURL, _ := url.ParseRequestURI("http://localhost:8080/fhir")
+	client := NewClient(*baseURL, ClientAuth{})
+
+	t.Run("SystemLevel", func(t *testing.T) {
+		req, err := client.NewBulkExportKickOffRequest("", url.Values{"_type": {"Patient"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/fhir/$export?_type=Patient", req.URL.String())
+		assert.Equal(t, "respond-async", req.Header.Get("Prefer"))
+		assert.Equal(t, "application/fhir+json", req.Header.Get("Accept"))
+	})
+
+	t.Run("GroupLevel", func(t *testing.T) {
+		req, err := client.NewBulkExportKickOffRequest("Group/0", url.Values{})
+		assert.NoError(t, err)
+		assert.Equal(t, "http://localhost:8080/fhir/Group/0/$export", req.URL.String())
+	})
+}
+
+func TestIsServerURL(t *testing.T) {
+	baseURL, _ := url.ParseRequestURI("http://localhost:8080/fhir")
+	client := NewClient(*baseURL, ClientAuth{})
+
+	for rawURL, expected := range map[string]bool{
+		"http://localhost:8080/files/1.ndjson":  true,
+		"HTTP://LOCALHOST:8080/files/1.ndjson":  true,
+		"https://localhost:8080/files/1.ndjson": false,
+		"http://localhost:9000/files/1.ndjson":  false,
+		"http://bucket.s3.example.com/1.ndjson": false,
+	} {
+		u, _ := url.Parse(rawURL)
+		assert.Equal(t, expected, client.IsServerURL(u), rawURL)
+	}
+}
+
+func TestNewBulkExportFileRequest(t *testing.T) {
+	baseURL, _ := url.ParseRequestURI("http://localhost:8080/fhir")
+	client := NewClient(*baseURL, ClientAuth{})
+	fileURL, _ := url.ParseRequestURI("http://localhost:8080/files/1.ndjson")
+
+	req, err := client.NewBulkExportFileRequest(fileURL)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "application/fhir+ndjson", req.Header.Get("Accept"))
+}
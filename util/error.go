@@ -17,6 +17,7 @@ package util
 import (
 	"fmt"
 	fm "github.com/samply/golang-fhir-models/fhir-models/fhir"
+	"regexp"
 	"strings"
 	"text/template"
 )
@@ -41,6 +42,50 @@ func (errRes *ErrorResponse) String() string {
 	return builder.String()
 }
 
+// Normalized returns the ErrorResponse formatted like String but with only the status code, the
+// issue codes and the diagnostics, in which ids and numbers are masked. Error responses which
+// differ only in ids or numbers have the same normalized form.
+func (errRes *ErrorResponse) Normalized() string {
+	builder := strings.Builder{}
+	builder.WriteString(fmt.Sprintf("StatusCode  : %d\n", errRes.StatusCode))
+	if errRes.OperationOutcome != nil {
+		for i, issue := range errRes.OperationOutcome.Issue {
+			if i > 0 {
+				builder.WriteString("---\n")
+			}
+			builder.WriteString(fmt.Sprintf("Code        : %s\n", issue.Code.Definition()))
+			if issue.Diagnostics != nil {
+				builder.WriteString(fmt.Sprintf("Diagnostics : %s\n", NormalizeDiagnostics(*issue.Diagnostics)))
+			}
+		}
+	}
+	if len(errRes.OtherError) > 0 {
+		builder.WriteString(fmt.Sprintf("Error       : %s\n",
+			IndentExceptFirstLine(14, NormalizeDiagnostics(errRes.OtherError))))
+	}
+	return builder.String()
+}
+
+var referencePattern = regexp.MustCompile(`\b([A-Z][A-Za-z]+)/[A-Za-z0-9\-.]{1,64}`)
+var tokenPattern = regexp.MustCompile(`[A-Za-z0-9_\-]+(\.[A-Za-z0-9_\-]+)*`)
+var numberPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// NormalizeDiagnostics masks ids and numbers in the given diagnostics. References like
+// Patient/123 become Patient/<id>, numbers become <n> and all other words containing digits
+// become <id>.
+func NormalizeDiagnostics(diagnostics string) string {
+	diagnostics = referencePattern.ReplaceAllString(diagnostics, "$1/<id>")
+	return tokenPattern.ReplaceAllStringFunc(diagnostics, func(token string) string {
+		if !strings.ContainsAny(token, "0123456789") {
+			return token
+		}
+		if numberPattern.MatchString(token) {
+			return "<n>"
+		}
+		return "<id>"
+	})
+}
+
 var outcomeTemplate, _ = template.New("outcomes").
 	Funcs(template.FuncMap{"join": strings.Join}).
 	Parse(`{{ define "issue" -}}
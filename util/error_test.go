@@ -145,3 +145,46 @@ Code        : Content invalid against the specification or a profile.
 `, errorResponse.String())
 	})
 }
+
+func TestNormalizeDiagnostics(t *testing.T) {
+	tests := []struct {
+		name, diagnostics, expected string
+	}{
+		{"Reference", "Referenced resource `Patient/0a1b2c` doesn't exist.", "Referenced resource `Patient/<id>` doesn't exist."},
+		{"Number", "Expected 3 entries but got 12.5.", "Expected <n> entries but got <n>."},
+		{"Uuid", "Duplicate fullUrl urn:uuid:6f1b6e2a-4c87-4e0b-9d5a-0b8c2a1f9e3d", "Duplicate fullUrl urn:uuid:<id>"},
+		{"NoIds", "Invalid JSON representation of a resource.", "Invalid JSON representation of a resource."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, NormalizeDiagnostics(test.diagnostics))
+		})
+	}
+}
+
+func TestNormalized(t *testing.T) {
+	diagnostics1 := "Resource `Patient/1` not found in 12ms."
+	diagnostics2 := "Resource `Patient/2` not found in 7ms."
+
+	errorResponse1 := &ErrorResponse{
+		StatusCode: 404,
+		OperationOutcome: &fm.OperationOutcome{Issue: []fm.OperationOutcomeIssue{
+			{Severity: fm.IssueSeverityError, Code: fm.IssueTypeNotFound, Diagnostics: &diagnostics1},
+		}},
+	}
+	errorResponse2 := &ErrorResponse{
+		StatusCode: 404,
+		OperationOutcome: &fm.OperationOutcome{Issue: []fm.OperationOutcomeIssue{
+			{Severity: fm.IssueSeverityError, Code: fm.IssueTypeNotFound, Diagnostics: &diagnostics2},
+		}},
+	}
+
+	assert.Equal(t, errorResponse1.Normalized(), errorResponse2.Normalized())
+	assert.Equal(t, "StatusCode  : 404\nCode        : "+fm.IssueTypeNotFound.Definition()+
+		"\nDiagnostics : Resource `Patient/<id>` not found in <id>.\n", errorResponse1.Normalized())
+
+	t.Run("Other Error", func(t *testing.T) {
+		errorResponse := &ErrorResponse{StatusCode: 502, OtherError: "upstream 10.0.0.1 failed"}
+		assert.Equal(t, "StatusCode  : 502\nError       : upstream <n> failed\n", errorResponse.Normalized())
+	})
+}